@@ -0,0 +1,293 @@
+package lblconv
+
+// Anchor box clustering functionality.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+)
+
+// AnchorOptions configures the anchor box clustering.
+type AnchorOptions struct {
+	NumAnchors    int   // The number of anchors (clusters). Defaults to 9.
+	MaxIterations int   // The max. number of k-means iterations. Defaults to 300.
+	Seed          int64 // The seed for the initial cluster selection.
+
+	// The network input resolution. If both are > 0, the bounding box sizes are scaled from the
+	// image size to the input size, as for an input that is resized without preserving the
+	// aspect ratio. The image dimensions are read from the images if they are not known.
+	InputWidth, InputHeight int
+}
+
+// AnchorBox is the size of an anchor box.
+type AnchorBox struct {
+	Width, Height float64
+}
+
+// iou returns the intersection over union of boxes a and b aligned at their top left corner.
+func (a AnchorBox) iou(b AnchorBox) float64 {
+	intersection := math.Min(a.Width, b.Width) * math.Min(a.Height, b.Height)
+	return intersection / (a.Width*a.Height + b.Width*b.Height - intersection)
+}
+
+// AnchorClusters is the result of ClusterAnchors.
+type AnchorClusters struct {
+	Anchors  []AnchorBox // Sorted by area.
+	NumBoxes int         // The number of bounding boxes clustered.
+	MeanIoU  float64     // The mean IoU of the boxes with their closest anchor.
+}
+
+// ClusterAnchors clusters the bounding box sizes with k-means, using 1 - IoU as the distance
+// measure, and returns the cluster centres as anchors. Boxes with a zero width or height are
+// ignored.
+func ClusterAnchors(boxes []AnchorBox, opts AnchorOptions) (AnchorClusters, error) {
+	k := opts.NumAnchors
+	if k <= 0 {
+		k = 9
+	}
+	maxIterations := opts.MaxIterations
+	if maxIterations <= 0 {
+		maxIterations = 300
+	}
+
+	valid := make([]AnchorBox, 0, len(boxes))
+	for _, b := range boxes {
+		if b.Width > 0 && b.Height > 0 {
+			valid = append(valid, b)
+		}
+	}
+	if len(valid) < k {
+		return AnchorClusters{}, fmt.Errorf("cannot cluster %d bounding boxes into %d anchors",
+			len(valid), k)
+	}
+
+	// Select the initial centres with k-means++.
+	rng := rand.New(rand.NewSource(opts.Seed))
+	centres := []AnchorBox{valid[rng.Intn(len(valid))]}
+	dists := make([]float64, len(valid))
+	for len(centres) < k {
+		var sum float64
+		for i, b := range valid {
+			dists[i] = 1 - b.iou(centres[nearestAnchor(b, centres)])
+			dists[i] *= dists[i]
+			sum += dists[i]
+		}
+		r := rng.Float64() * sum
+		next := len(valid) - 1
+		for i, d := range dists {
+			if r -= d; r < 0 {
+				next = i
+				break
+			}
+		}
+		centres = append(centres, valid[next])
+	}
+
+	// Assign the boxes to their nearest centre and move the centres to the cluster means, until
+	// the assignment does not change.
+	assignment := make([]int, len(valid))
+	for i := range assignment {
+		assignment[i] = -1
+	}
+	for iteration := 0; iteration < maxIterations; iteration++ {
+		changed := false
+		for i, b := range valid {
+			if c := nearestAnchor(b, centres); c != assignment[i] {
+				assignment[i] = c
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+
+		sums := make([]AnchorBox, k)
+		counts := make([]int, k)
+		for i, b := range valid {
+			sums[assignment[i]].Width += b.Width
+			sums[assignment[i]].Height += b.Height
+			counts[assignment[i]]++
+		}
+		for c := range centres {
+			// Empty clusters keep their centre.
+			if counts[c] > 0 {
+				centres[c] = AnchorBox{
+					Width:  sums[c].Width / float64(counts[c]),
+					Height: sums[c].Height / float64(counts[c]),
+				}
+			}
+		}
+	}
+
+	var iouSum float64
+	for _, b := range valid {
+		iouSum += b.iou(centres[nearestAnchor(b, centres)])
+	}
+	sort.Slice(centres, func(i, j int) bool {
+		return centres[i].Width*centres[i].Height < centres[j].Width*centres[j].Height
+	})
+
+	return AnchorClusters{
+		Anchors:  centres,
+		NumBoxes: len(valid),
+		MeanIoU:  iouSum / float64(len(valid)),
+	}, nil
+}
+
+// nearestAnchor returns the index of the anchor in anchors with the highest IoU with b.
+func nearestAnchor(b AnchorBox, anchors []AnchorBox) int {
+	nearest, maxIoU := 0, -1.0
+	for i, a := range anchors {
+		if iou := b.iou(a); iou > maxIoU {
+			nearest, maxIoU = i, iou
+		}
+	}
+	return nearest
+}
+
+// anchorBoxes returns the bounding box sizes of the annotations in f, scaled to the input
+// resolution in opts if set.
+func anchorBoxes(f AnnotatedFile, opts AnchorOptions) ([]AnchorBox, error) {
+	scaleX, scaleY := 1.0, 1.0
+	if opts.InputWidth > 0 && opts.InputHeight > 0 && len(f.Annotations) > 0 {
+		width, height := f.ImageWidth, f.ImageHeight
+		if width <= 0 || height <= 0 {
+			var err error
+			if width, height, err = imageDimensions(f.FilePath); err != nil {
+				return nil, err
+			}
+		}
+		scaleX = float64(opts.InputWidth) / float64(width)
+		scaleY = float64(opts.InputHeight) / float64(height)
+	}
+
+	boxes := make([]AnchorBox, len(f.Annotations))
+	for i, a := range f.Annotations {
+		boxes[i] = AnchorBox{
+			Width:  (a.Coords[2] - a.Coords[0]) * scaleX,
+			Height: (a.Coords[3] - a.Coords[1]) * scaleY,
+		}
+	}
+	return boxes, nil
+}
+
+// writeAnchors writes the anchors in the formats of YOLO (darknet) and SSD (TensorFlow Object
+// Detection API) configs to w.
+func writeAnchors(w io.Writer, clusters AnchorClusters, opts AnchorOptions) error {
+	normalised := opts.InputWidth > 0 && opts.InputHeight > 0
+	unit := "pixels of the original images"
+	if normalised {
+		unit = fmt.Sprintf("pixels of a %dx%d input", opts.InputWidth, opts.InputHeight)
+	}
+
+	sizes := make([]string, len(clusters.Anchors))
+	aspectRatios := make([]string, len(clusters.Anchors))
+	scales := make([]string, len(clusters.Anchors))
+	for i, a := range clusters.Anchors {
+		sizes[i] = fmt.Sprintf("%.0f,%.0f", a.Width, a.Height)
+		aspectRatios[i] = fmt.Sprintf("%.2f", a.Width/a.Height)
+		if normalised {
+			inputArea := float64(opts.InputWidth * opts.InputHeight)
+			scales[i] = fmt.Sprintf("%.4f", math.Sqrt(a.Width*a.Height/inputArea))
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "# %d anchors from %d bounding boxes, mean IoU %.4f\n"+
+			"# YOLO anchors (width,height) in %s, sorted by area:\n"+
+			"anchors = %s\n"+
+			"# SSD aspect ratios (width/height):\n"+
+			"aspect_ratios = %s\n",
+		len(clusters.Anchors), clusters.NumBoxes, clusters.MeanIoU, unit,
+		strings.Join(sizes, ", "), strings.Join(aspectRatios, ", "))
+	if err == nil && normalised {
+		_, err = fmt.Fprintf(w, "# SSD scales (square root of the area relative to the input):\n"+
+				"scales = %s\n", strings.Join(scales, ", "))
+	}
+	return err
+}
+
+// anchorSink is a Sink that collects the bounding box sizes and writes the anchors on Close.
+type anchorSink struct {
+	outFile string
+	opts    AnchorOptions
+	boxes   []AnchorBox
+}
+
+// NewAnchorSink returns a Sink that clusters the bounding box sizes of the files written to it
+// with ClusterAnchors and writes the anchors to outFile on Close. The anchors are written to
+// stdout if outFile is "-".
+func NewAnchorSink(outFile string, opts AnchorOptions) Sink {
+	return &anchorSink{outFile: outFile, opts: opts}
+}
+
+// Write implements Sink. Files whose image dimensions are required but cannot be read are logged
+// and skipped.
+func (s *anchorSink) Write(f AnnotatedFile) error {
+	boxes, err := anchorBoxes(f, s.opts)
+	if err != nil {
+		log.Print("Skipping file: ", err)
+		return ErrFileSkipped
+	}
+	s.boxes = append(s.boxes, boxes...)
+	return nil
+}
+
+// Close implements Sink.
+func (s *anchorSink) Close() (err error) {
+	clusters, err := ClusterAnchors(s.boxes, s.opts)
+	if err != nil {
+		return err
+	}
+
+	if s.outFile == "-" {
+		return writeAnchors(os.Stdout, clusters, s.opts)
+	}
+
+	file, err := createAtomicFile(s.outFile)
+	if err != nil {
+		return fmt.Errorf("cannot write file %q: %v", s.outFile, err)
+	}
+	defer file.commit(&err)
+
+	w := bufio.NewWriter(file)
+	if err := writeAnchors(w, clusters, s.opts); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// anchorsFormat implements the Writer interface for anchor box clusters.
+type anchorsFormat struct{}
+
+// Write implements Writer.
+func (f anchorsFormat) Write(outFile string, data AnnotatedFiles, opts FormatOptions) error {
+	sink, err := f.NewSink(outFile, opts)
+	if err != nil {
+		return err
+	}
+	if err := writeFiles(sink, data); err != nil {
+		return err
+	}
+	return sink.Close()
+}
+
+// NewSink implements StreamWriter.
+func (anchorsFormat) NewSink(outFile string, opts FormatOptions) (Sink, error) {
+	return NewAnchorSink(outFile, opts.Anchors), nil
+}
+
+func init() {
+	RegisterFormat(Format{
+		Name:        "anchors",
+		Description: "Anchor boxes clustered from the bounding box sizes (YOLO/SSD config values)",
+		Writer:      anchorsFormat{},
+		WriterArgs:  "-labels-out <file or -> [-anchors <k>] [-anchors-input-size <w>x<h>]",
+	})
+}
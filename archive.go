@@ -0,0 +1,307 @@
+package lblconv
+
+// Reading of label and image files from zip and tar archives without extracting them.
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Archive provides read access to the files in a zip, tar or gzip-compressed tar archive. While an
+// Archive is open, the files in it can be used like regular files, e.g. "data.zip/images/a.jpg"
+// for the entry "images/a.jpg", by the label Readers and for reading images.
+//
+// Gzip-compressed tar archives are decompressed to a temporary tar file, as they do not support
+// random access.
+type Archive struct {
+	path    string                  // The cleaned path of the archive file.
+	entries map[string]archiveEntry // The regular files in the archive, by entry path.
+	names   []string                // The sorted entry paths.
+	closers []io.Closer             // The open files of the archive.
+	tmpPath string                  // The decompressed tar file, if any.
+}
+
+// archiveEntry is a regular file in an Archive.
+type archiveEntry struct {
+	zipFile *zip.File   // The zip entry, for zip archives.
+	tarFile io.ReaderAt // The tar file and the data offset and size, for tar archives.
+	offset  int64
+	size    int64
+}
+
+var (
+	archivesMu sync.RWMutex
+	archives   []*Archive // The open archives, whose files are accessible by path.
+)
+
+// isArchivePath returns true if path has the file extension of a supported archive.
+func isArchivePath(path string) bool {
+	lower := strings.ToLower(path)
+	for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// ArchivePathOf returns the path of the archive file that contains path, e.g. "data.zip" for
+// "data.zip/images", or "" if path does not refer to an existing archive file or its contents.
+func ArchivePathOf(path string) string {
+	for p := filepath.Clean(path); ; p = filepath.Dir(p) {
+		if isArchivePath(p) {
+			if info, err := os.Stat(p); err == nil && info.Mode().IsRegular() {
+				return p
+			}
+		}
+		if parent := filepath.Dir(p); parent == p {
+			return ""
+		}
+	}
+}
+
+// OpenArchive opens the zip, tar or gzip-compressed tar archive at path (by file extension) and
+// makes its files accessible, see Archive. The caller must close the Archive once it is no longer
+// needed.
+func OpenArchive(path string) (*Archive, error) {
+	a := &Archive{path: filepath.Clean(path), entries: make(map[string]archiveEntry)}
+
+	var err error
+	lower := strings.ToLower(path)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		err = a.openZip()
+	case strings.HasSuffix(lower, ".tar"):
+		err = a.openTar(path)
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		err = a.openTarGz()
+	default:
+		return nil, fmt.Errorf("unsupported archive type: %q", path)
+	}
+	if err != nil {
+		_ = a.Close()
+		return nil, fmt.Errorf("failed to open archive %q: %v", path, err)
+	}
+
+	for name := range a.entries {
+		a.names = append(a.names, name)
+	}
+	sort.Strings(a.names)
+
+	archivesMu.Lock()
+	archives = append(archives, a)
+	archivesMu.Unlock()
+
+	return a, nil
+}
+
+// openZip indexes the zip archive.
+func (a *Archive) openZip() error {
+	r, err := zip.OpenReader(a.path)
+	if err != nil {
+		return err
+	}
+	a.closers = append(a.closers, r)
+
+	for _, f := range r.File {
+		if f.Mode().IsRegular() {
+			a.entries[archiveEntryPath(f.Name)] = archiveEntry{zipFile: f}
+		}
+	}
+	return nil
+}
+
+// openTar indexes the uncompressed tar archive at tarPath.
+func (a *Archive) openTar(tarPath string) error {
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return err
+	}
+	a.closers = append(a.closers, f)
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		// The tar reader has consumed the header blocks, i.e. the file data starts here.
+		offset, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		a.entries[archiveEntryPath(hdr.Name)] = archiveEntry{
+			tarFile: f,
+			offset:  offset,
+			size:    hdr.Size,
+		}
+	}
+}
+
+// openTarGz decompresses the gzip-compressed tar archive to a temporary file and indexes it.
+func (a *Archive) openTarGz() (err error) {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer closeWithErrCheck(f, &err)
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile("", "lblconv-*.tar")
+	if err != nil {
+		return err
+	}
+	a.tmpPath = tmp.Name()
+	_, err = io.Copy(tmp, gz)
+	closeWithErrCheck(tmp, &err)
+	if err != nil {
+		return err
+	}
+
+	if err := a.openTar(a.tmpPath); err != nil {
+		return err
+	}
+
+	// Remove the temporary file right away where open files remain accessible, so that it is not
+	// left behind if the process exits without Close.
+	if os.Remove(a.tmpPath) == nil {
+		a.tmpPath = ""
+	}
+	return nil
+}
+
+// archiveEntryPath returns the canonical form of the archive entry path p.
+func archiveEntryPath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(p)), "/")
+}
+
+// Path returns the path of the archive file, which is the path prefix of the files in it.
+func (a *Archive) Path() string {
+	return a.path
+}
+
+// Open implements ImageResolver for the entry name, which is a path relative to the archive or a
+// path with the prefix Path.
+func (a *Archive) Open(name string) (io.ReadCloser, error) {
+	if entry, ok := a.entryPath(name); ok {
+		name = entry
+	}
+	e, ok := a.entries[archiveEntryPath(name)]
+	switch {
+	case !ok:
+		return nil, ErrImageNotFound
+	case e.zipFile != nil:
+		return e.zipFile.Open()
+	default:
+		return ioutil.NopCloser(io.NewSectionReader(e.tarFile, e.offset, e.size)), nil
+	}
+}
+
+// entryPath returns the entry path for the file path p and true, if p is in the archive.
+func (a *Archive) entryPath(p string) (string, bool) {
+	p = filepath.Clean(p)
+	if p == a.path {
+		return "", true
+	}
+	if !strings.HasPrefix(p, a.path+string(os.PathSeparator)) {
+		return "", false
+	}
+	return archiveEntryPath(p[len(a.path)+1:]), true
+}
+
+// files returns the paths of the files in the archive directory dir (an entry path), optionally
+// including its subdirectories, with the file extension ext.
+func (a *Archive) files(dir, ext string, recursive bool) ([]string, error) {
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+
+	dirExists := dir == ""
+	var files []string
+	for _, name := range a.names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		dirExists = true
+		if !strings.HasSuffix(name, ext) ||
+				!recursive && strings.Contains(name[len(prefix):], "/") {
+			continue
+		}
+		files = append(files, filepath.Join(a.path, filepath.FromSlash(name)))
+	}
+	if !dirExists {
+		return nil, fmt.Errorf("cannot read directory %q: not found in archive %q", dir, a.path)
+	}
+	return files, nil
+}
+
+// Close closes the archive and makes its files inaccessible.
+func (a *Archive) Close() error {
+	archivesMu.Lock()
+	for i, other := range archives {
+		if other == a {
+			archives = append(archives[:i], archives[i+1:]...)
+			break
+		}
+	}
+	archivesMu.Unlock()
+
+	var err error
+	for _, c := range a.closers {
+		closeWithErrCheck(c, &err)
+	}
+	a.closers = nil
+	if a.tmpPath != "" {
+		if rmErr := os.Remove(a.tmpPath); rmErr != nil && err == nil {
+			err = rmErr
+		}
+		a.tmpPath = ""
+	}
+	return err
+}
+
+// archiveOf returns the open archive that contains the file path p and the entry path of p in it.
+func archiveOf(p string) (*Archive, string, bool) {
+	archivesMu.RLock()
+	defer archivesMu.RUnlock()
+
+	for _, a := range archives {
+		if entry, ok := a.entryPath(p); ok {
+			return a, entry, true
+		}
+	}
+	return nil, "", false
+}
+
+// openFile opens the file at path, which may be in an open Archive.
+func openFile(path string) (io.ReadCloser, error) {
+	if a, entry, ok := archiveOf(path); ok {
+		rc, err := a.Open(entry)
+		if err == ErrImageNotFound {
+			err = &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+		}
+		return rc, err
+	}
+	return os.Open(path)
+}
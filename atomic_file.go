@@ -0,0 +1,119 @@
+package lblconv
+
+// Atomic creation of output files, so that a crash or a failed conversion never leaves a truncated
+// file at the output path that could be mistaken for a complete one.
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// atomicFile is an output file that is written to a temporary file in the same directory and
+// renamed to its path when it is committed, which replaces any existing file at once.
+type atomicFile struct {
+	file *os.File
+	path string
+
+	closed    bool
+	committed bool // Whether the file was renamed to its path.
+}
+
+// createAtomicFile creates an atomicFile for path. The file keeps the permissions of an existing
+// file at path, or is created with mode 0644.
+func createAtomicFile(path string) (*atomicFile, error) {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	file, err := ioutil.TempFile(dir, "."+base+".*.tmp")
+	if err != nil {
+		// Report the error for path, like os.Create.
+		if pathErr, ok := err.(*os.PathError); ok {
+			err = pathErr.Err
+		}
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := file.Chmod(mode); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return nil, err
+	}
+	return &atomicFile{file: file, path: path}, nil
+}
+
+// Write implements io.Writer.
+func (f *atomicFile) Write(p []byte) (int, error) {
+	return f.file.Write(p)
+}
+
+// Name returns the path of the file, not of the temporary file.
+func (f *atomicFile) Name() string {
+	return f.path
+}
+
+// Close closes the file and renames it to its path. The temporary file is removed if that fails.
+// Subsequent calls do nothing. The file is not synced to disk, as that would slow down writing many
+// small files, e.g. KITTI labels or images, and the rename suffices to never expose partial output
+// of a failed or killed run.
+func (f *atomicFile) Close() error {
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+
+	err := f.file.Close()
+	if err == nil {
+		err = os.Rename(f.file.Name(), f.path)
+	}
+	if err != nil {
+		_ = os.Remove(f.file.Name())
+		return err
+	}
+	f.committed = true
+	return nil
+}
+
+// Abort removes the temporary file, leaving any existing file at the path unchanged. If the file
+// was already committed by Close, e.g. one of several files of an output that failed as a whole,
+// it is removed from its path instead. The file that it replaced, if any, is then lost.
+func (f *atomicFile) Abort() error {
+	if f.committed {
+		f.committed = false
+		return os.Remove(f.path)
+	}
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+
+	_ = f.file.Close()
+	return os.Remove(f.file.Name())
+}
+
+// commit closes f if (*e == nil), or aborts it otherwise, so that a file whose writing failed is
+// never renamed to its path. If closing fails, and (*e == nil), e is set to that error.
+func (f *atomicFile) commit(e *error) {
+	if *e != nil {
+		_ = f.Abort()
+		return
+	}
+	*e = f.Close()
+}
+
+// writeFileAtomic writes data to the file at path, like ioutil.WriteFile, but atomically, see
+// atomicFile.
+func writeFileAtomic(path string, data []byte) (err error) {
+	file, err := createAtomicFile(path)
+	if err != nil {
+		return err
+	}
+	defer file.commit(&err)
+
+	_, err = file.Write(data)
+	return err
+}
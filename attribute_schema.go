@@ -0,0 +1,226 @@
+package lblconv
+
+// Declared attribute types, and the coercion of attribute values to them.
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AttributeType is the declared type of an attribute, see AttributeSchema.
+type AttributeType string
+
+// The supported attribute types.
+const (
+	FloatAttribute      AttributeType = "float"       // Go type float64.
+	IntAttribute        AttributeType = "int"         // Go type int.
+	StringAttribute     AttributeType = "string"      // Go type string.
+	StringListAttribute AttributeType = "string-list" // Go type []string.
+	BoolAttribute       AttributeType = "bool"        // Go type bool.
+)
+
+// AttributeSchema declares the types of annotation and file attributes by attribute name, e.g. so
+// that formats that store all values as strings, like VIA, can restore the types, and writers can
+// describe the attributes.
+type AttributeSchema map[string]AttributeType
+
+// DefaultAttributeSchema declares the types of the attributes defined by this package, except for
+// those whose values are maps, e.g. ImageLabels.
+var DefaultAttributeSchema = AttributeSchema{
+	AncestorLabels:  StringListAttribute,
+	Area:            FloatAttribute,
+	Confidence:      FloatAttribute,
+	CropCoords:      StringAttribute,
+	DetectedText:    StringAttribute,
+	Difficult:       BoolAttribute,
+	Ignore:          BoolAttribute,
+	ImageLabel:      BoolAttribute,
+	InputSource:     StringAttribute,
+	IsCrowd:         BoolAttribute,
+	Truncated:       BoolAttribute,
+	TrackID:         IntAttribute,
+	Interpolated:    BoolAttribute,
+	Visibility:      FloatAttribute,
+	Synthetic:       BoolAttribute,
+	LabelConfidence: FloatAttribute,
+	TextID:          IntAttribute,
+	TextParentID:    IntAttribute,
+	Sequence:        StringAttribute,
+	Frame:           IntAttribute,
+}
+
+// LoadAttributeSchema reads an attribute schema from the JSON file at path, which maps attribute
+// names to types, e.g. {"Occluded": "bool", "Tags": "string-list"}. The declarations are added to
+// DefaultAttributeSchema, whose types they override.
+func LoadAttributeSchema(path string) (AttributeSchema, error) {
+	enc, err := readFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var schema AttributeSchema
+	if err := json.Unmarshal(enc, &schema); err != nil {
+		return nil, newJSONParseError(path, enc, err)
+	}
+	for name, t := range schema {
+		switch t {
+		case FloatAttribute, IntAttribute, StringAttribute, StringListAttribute, BoolAttribute:
+		default:
+			return nil, fmt.Errorf("unsupported type %q of attribute %q in %q", t, name, path)
+		}
+	}
+
+	return schema.withDefaults(), nil
+}
+
+// withDefaults returns s with the declarations of DefaultAttributeSchema that it does not
+// override. A nil schema yields DefaultAttributeSchema.
+func (s AttributeSchema) withDefaults() AttributeSchema {
+	if len(s) == 0 {
+		return DefaultAttributeSchema
+	}
+	merged := make(AttributeSchema, len(DefaultAttributeSchema)+len(s))
+	for name, t := range DefaultAttributeSchema {
+		merged[name] = t
+	}
+	for name, t := range s {
+		merged[name] = t
+	}
+	return merged
+}
+
+// Coerce converts the values of the declared attributes in attrs to their types, e.g. the string
+// "0.9" to the float64 0.9 or the float64 3 to the int 3. Empty strings are removed for the types
+// other than string, as they denote unset values in some formats. Values that cannot be converted
+// are kept, and an error describing them is returned.
+func (s AttributeSchema) Coerce(attrs map[string]interface{}) error {
+	var failed []string
+	for name, v := range attrs {
+		t, ok := s[name]
+		if !ok {
+			continue
+		}
+		if str, ok := v.(string); ok && str == "" && t != StringAttribute {
+			delete(attrs, name)
+			continue
+		}
+		if w, err := coerceAttribute(v, t); err == nil {
+			attrs[name] = w
+		} else {
+			failed = append(failed, fmt.Sprintf("%s (%v)", name, err))
+		}
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("cannot coerce the attributes %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// coerceAttribute converts the attribute value v to the type t.
+func coerceAttribute(v interface{}, t AttributeType) (interface{}, error) {
+	switch t {
+	case FloatAttribute:
+		if s, ok := v.(string); ok {
+			return strconv.ParseFloat(strings.TrimSpace(s), 64)
+		}
+		if f, ok := numberValue(v); ok {
+			return f, nil
+		}
+	case IntAttribute:
+		if s, ok := v.(string); ok {
+			return strconv.Atoi(strings.TrimSpace(s))
+		}
+		if f, ok := numberValue(v); ok && f == float64(int(f)) {
+			return int(f), nil
+		}
+	case StringAttribute:
+		switch v := v.(type) {
+		case string:
+			return v, nil
+		case bool:
+			return strconv.FormatBool(v), nil
+		case encoding.TextMarshaler:
+			s, err := v.MarshalText()
+			return string(s), err
+		}
+		if f, ok := numberValue(v); ok {
+			return strconv.FormatFloat(f, 'f', -1, 64), nil
+		}
+	case StringListAttribute:
+		switch v := v.(type) {
+		case []string:
+			return v, nil
+		case string:
+			return splitAttributeList(v), nil
+		case []interface{}:
+			strs := make([]string, len(v))
+			for i, e := range v {
+				s, ok := e.(string)
+				if !ok {
+					return nil, fmt.Errorf("list element of type %T", e)
+				}
+				strs[i] = s
+			}
+			return strs, nil
+		}
+	case BoolAttribute:
+		if s, ok := v.(string); ok {
+			return strconv.ParseBool(strings.TrimSpace(s))
+		}
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+		if f, ok := numberValue(v); ok && (f == 0 || f == 1) {
+			return f == 1, nil
+		}
+	}
+	return nil, fmt.Errorf("value of type %T is not a %s", v, t)
+}
+
+// splitAttributeList splits the comma-separated list s into its trimmed, non-empty elements. This
+// is how string-list attributes are stored in formats with string values.
+func splitAttributeList(s string) []string {
+	strs := make([]string, 0, strings.Count(s, ",")+1)
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			strs = append(strs, e)
+		}
+	}
+	return strs
+}
+
+// CoerceAttributes coerces the file and annotation attributes of f to the types declared by s, see
+// AttributeSchema.Coerce.
+func (s AttributeSchema) CoerceAttributes(f *AnnotatedFile) error {
+	var errs []string
+	if err := s.Coerce(f.Attributes); err != nil {
+		errs = append(errs, "file: "+err.Error())
+	}
+	for i, a := range f.Annotations {
+		if err := s.Coerce(a.Attributes); err != nil {
+			errs = append(errs, fmt.Sprintf("annotation %d: %v", i, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s: %s", f.FilePath, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// CoerceAttributesStage returns a Stage that coerces the attributes of each file to the types
+// declared by s, see AttributeSchema.Coerce. Values that cannot be converted are logged and kept.
+func CoerceAttributesStage(s AttributeSchema) Stage {
+	return func(f AnnotatedFile) ([]AnnotatedFile, error) {
+		f = f.Clone()
+		if err := s.CoerceAttributes(&f); err != nil {
+			log.Print(err)
+		}
+		return []AnnotatedFile{f}, nil
+	}
+}
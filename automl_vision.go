@@ -0,0 +1,144 @@
+package lblconv
+
+// Google AutoML Vision object detection CSV files.
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+)
+
+// autoMLSets maps the ML uses to the values of the set column.
+var autoMLSets = map[string]string{
+	"":           "UNASSIGNED",
+	"training":   "TRAIN",
+	"validation": "VALIDATION",
+	"test":       "TEST",
+}
+
+// toAutoMLVision returns the CSV records for f, one per bounding box, with the columns
+// set,path,label,x_min,y_min,,,x_max,y_max,, and the coordinates relative to the image size. Files
+// without bounding boxes have a single record with the set and path only. The image URI is formed
+// with gcsImageURI. The image dimensions are only read from the image if the coordinates are
+// absolute and the dimensions are not known. Image-level labels are omitted.
+func toAutoMLVision(f AnnotatedFile, gcsPrefix, set string) ([][]string, error) {
+	uri := gcsImageURI(f.FilePath, gcsPrefix)
+	var records [][]string
+	sx, sy := 0.0, 0.0
+	for _, a := range f.Annotations {
+		if a.boolAttribute(ImageLabel) {
+			continue
+		}
+		if sx == 0 {
+			var err error
+			if sx, sy, err = f.normalizationScale(); err != nil {
+				return nil, err
+			}
+		}
+
+		// The coordinates must be in the range [0, 1].
+		norm := func(v, scale float64) string {
+			return strconv.FormatFloat(math.Min(math.Max(v*scale, 0), 1), 'f', -1, 64)
+		}
+		records = append(records, []string{set, uri, a.Label,
+			norm(a.Coords[0], sx), norm(a.Coords[1], sy), "", "",
+			norm(a.Coords[2], sx), norm(a.Coords[3], sy), "", ""})
+	}
+	if len(records) == 0 {
+		records = append(records, []string{set, uri})
+	}
+	return records, nil
+}
+
+// autoMLVisionSink is a Sink that writes an AutoML Vision CSV file.
+type autoMLVisionSink struct {
+	file      *atomicFile
+	w         *bufio.Writer
+	csv       *csv.Writer
+	gcsPrefix string
+	set       string
+}
+
+// NewAutoMLVisionSink returns a Sink that writes an AutoML Vision object detection CSV file to
+// outFile. gcsPrefix is the Cloud Storage location of the images, see NewVertexAISink. All images
+// are assigned to the set of the split with the name split (train, val or test), or UNASSIGNED if
+// split is empty.
+func NewAutoMLVisionSink(outFile, gcsPrefix, split string) (Sink, error) {
+	mlUse, err := mlUseOfSplit(split)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := createAtomicFile(outFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot write file %q: %v", outFile, err)
+	}
+	s := &autoMLVisionSink{file: file, w: bufio.NewWriter(file), gcsPrefix: gcsPrefix,
+		set: autoMLSets[mlUse]}
+	s.csv = csv.NewWriter(s.w)
+	return s, nil
+}
+
+// Write implements Sink. Files whose image dimensions cannot be determined are logged and skipped.
+func (s *autoMLVisionSink) Write(f AnnotatedFile) error {
+	records, err := toAutoMLVision(f, s.gcsPrefix, s.set)
+	if err != nil {
+		log.Print("Skipping file: ", err)
+		return ErrFileSkipped
+	}
+	return s.csv.WriteAll(records)
+}
+
+// Close implements Sink.
+func (s *autoMLVisionSink) Close() (err error) {
+	defer s.file.commit(&err)
+
+	s.csv.Flush()
+	if err := s.csv.Error(); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+// Abort implements Aborter. It removes the partially written file.
+func (s *autoMLVisionSink) Abort() error {
+	return s.file.Abort()
+}
+
+// autoMLVisionFormat implements the Writer interface for AutoML Vision CSV files.
+type autoMLVisionFormat struct{}
+
+// Write implements Writer.
+func (autoMLVisionFormat) Write(outFile string, data AnnotatedFiles, opts FormatOptions) (
+		err error) {
+
+	s, err := NewAutoMLVisionSink(outFile, opts.GCSPrefix, opts.Split)
+	if err != nil {
+		return err
+	}
+	defer closeWithErrCheck(s, &err)
+
+	return writeFiles(s, data)
+}
+
+// NewSink implements StreamWriter.
+func (autoMLVisionFormat) NewSink(outFile string, opts FormatOptions) (Sink, error) {
+	return NewAutoMLVisionSink(outFile, opts.GCSPrefix, opts.Split)
+}
+
+// AcceptsNormalizedCoords implements NormalizedWriter.
+func (autoMLVisionFormat) AcceptsNormalizedCoords() bool {
+	return true
+}
+
+func init() {
+	RegisterFormat(Format{
+		Name:        "automl-csv",
+		Description: "Google AutoML Vision object detection CSV",
+		Writer:      autoMLVisionFormat{},
+		WriterArgs:  "-labels-out <file> [-gcs-prefix <gs://bucket/dir/>]",
+	})
+}
@@ -3,8 +3,9 @@ package lblconv
 // AWS Rekognition detect-labels specific functionality.
 
 import (
+	"context"
 	"encoding/json"
-	"io/ioutil"
+	"fmt"
 )
 
 // AWSInstance is an object instance in an AWS label.
@@ -30,17 +31,88 @@ type AWSDLAnnotatedFile struct {
 	ModelVersion string     `json:"LabelModelVersion"`
 }
 
+// AWSDetectLabelsOptions configures the parsing of AWS detect-labels files.
+type AWSDetectLabelsOptions struct {
+	// How to keep the labels without instances, e.g. scene labels like "Outdoors", which are
+	// discarded if empty: "attributes" adds them to the ImageLabels file attribute, and
+	// "annotations" adds an annotation with a zero bounding box and the ImageLabel attribute.
+	ImageLabels string
+}
+
+// validate returns an error if opts are invalid.
+func (opts AWSDetectLabelsOptions) validate() error {
+	switch opts.ImageLabels {
+	case "", "attributes", "annotations":
+		return nil
+	}
+	return fmt.Errorf("unsupported image label mode %q", opts.ImageLabels)
+}
+
 // FromAWSDetectLabels reads and parses AWS detect-labels annotations from labelDir and matches them
 // to the images in imageDir.
 func FromAWSDetectLabels(labelDir, imageDir string) ([]AnnotatedFile, error) {
-	return parseLabelsWithOneToOneImages(labelDir, ".json", imageDir, parseAWSDetectLabelsFile)
+	return FromAWSDetectLabelsContext(context.Background(), labelDir, imageDir)
 }
 
-// parseAWSDetectLabelsFile parses the label file at labelPath and reads metadata from the
-// corresponding image at imagePath to construct an AnnotatedFile struct and return it.
-func parseAWSDetectLabelsFile(labelPath, imagePath string) (AnnotatedFile, error) {
+// FromAWSDetectLabelsContext works like FromAWSDetectLabels, but stops parsing when ctx is done, in
+// which case it returns ctx.Err().
+func FromAWSDetectLabelsContext(ctx context.Context, labelDir, imageDir string) (
+		[]AnnotatedFile, error) {
+
+	return FromAWSDetectLabelsWithOptions(ctx, labelDir, imageDir, AWSDetectLabelsOptions{})
+}
+
+// FromAWSDetectLabelsWithOptions works like FromAWSDetectLabelsContext, with the labels without
+// instances kept as configured by opts.
+func FromAWSDetectLabelsWithOptions(ctx context.Context, labelDir, imageDir string,
+		opts AWSDetectLabelsOptions) ([]AnnotatedFile, error) {
+
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	return parseLabelsWithOneToOneImages(ctx, labelDir, ".json", imageDir, ImageMatchOptions{},
+		absoluteCoordsParser(awsDetectLabelsFileParser(opts), false))
+}
+
+// NewAWSDetectLabelsSource returns a Source that streams the AWS detect-labels annotations from
+// labelDir, matched to the images in imageDir.
+func NewAWSDetectLabelsSource(labelDir, imageDir string) (Source, error) {
+	return NewAWSDetectLabelsSourceWithOptions(labelDir, imageDir, AWSDetectLabelsOptions{})
+}
+
+// NewAWSDetectLabelsSourceWithOptions works like NewAWSDetectLabelsSource, with the labels without
+// instances kept as configured by opts.
+func NewAWSDetectLabelsSourceWithOptions(labelDir, imageDir string, opts AWSDetectLabelsOptions) (
+		Source, error) {
+
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	return newOneToOneSource(labelDir, ".json", imageDir, ImageMatchOptions{},
+		absoluteCoordsParser(awsDetectLabelsFileParser(opts), false))
+}
+
+// awsDetectLabelsFileParser returns a function that parses AWS detect-labels files with
+// parseAWSDetectLabelsFile and opts.
+func awsDetectLabelsFileParser(opts AWSDetectLabelsOptions) labelParserFn {
+	return func(labelPath, imagePath string) (AnnotatedFile, error) {
+		return parseAWSDetectLabelsFile(labelPath, imagePath, opts)
+	}
+}
+
+// awsDetectLabelsFormatParser returns the labelParserFn of the aws-dl format for opts.
+func awsDetectLabelsFormatParser(opts FormatOptions) labelParserFn {
+	return absoluteCoordsParser(awsDetectLabelsFileParser(opts.AWSDetectLabels),
+		opts.NormalizedCoords)
+}
+
+// parseAWSDetectLabelsFile parses the label file at labelPath into an AnnotatedFile for the image
+// at imagePath, with the NormalizedCoords of the file, so that the image is not read.
+func parseAWSDetectLabelsFile(labelPath, imagePath string, opts AWSDetectLabelsOptions) (
+		AnnotatedFile, error) {
+
 	// Unmarshal JSON.
-	enc, err := ioutil.ReadFile(labelPath)
+	enc, err := readFile(labelPath)
 	if err != nil {
 		return AnnotatedFile{}, err
 	}
@@ -48,13 +120,7 @@ func parseAWSDetectLabelsFile(labelPath, imagePath string) (AnnotatedFile, error
 	var awsFileData AWSDLAnnotatedFile
 	err = json.Unmarshal(enc, &awsFileData)
 	if err != nil {
-		return AnnotatedFile{}, err
-	}
-
-	// Get the image width and height.
-	img, _, err := decodeImageConfig(imagePath)
-	if err != nil {
-		return AnnotatedFile{}, err
+		return AnnotatedFile{}, newJSONParseError(labelPath, enc, err)
 	}
 
 	// Convert to the intermediate representation.
@@ -62,28 +128,62 @@ func parseAWSDetectLabelsFile(labelPath, imagePath string) (AnnotatedFile, error
 	fileData := AnnotatedFile{
 		Annotations: make([]Annotation, 0, 2*len(awsFileData.Annotations)),
 		FilePath:    imagePath,
+		CoordSpace:  NormalizedCoords,
+	}
+
+	// The parents have no confidence, but are usually also labels of the image.
+	labelConfidences := make(map[string]float64, len(awsFileData.Annotations))
+	for _, a := range awsFileData.Annotations {
+		labelConfidences[a.Name] = a.Confidence / 100
 	}
+
 	for _, a := range awsFileData.Annotations {
-		// Convert the parents attribute to a []string.
+		// Convert the parents attribute to a []string, and collect their confidences.
 		ancestors := make([]string, len(a.Parents))
+		ancestorConfidences := make(map[string]float64, len(a.Parents))
 		for i, p := range a.Parents {
 			ancestors[i] = p.Name
+			if c, ok := labelConfidences[p.Name]; ok {
+				ancestorConfidences[p.Name] = c
+			}
+		}
+
+		// Keep labels without instances as configured.
+		if len(a.Instances) == 0 {
+			switch opts.ImageLabels {
+			case "attributes":
+				if fileData.Attributes == nil {
+					fileData.Attributes = map[string]interface{}{
+						ImageLabels: make(map[string]float64),
+					}
+				}
+				fileData.imageLabels()[a.Name] = a.Confidence / 100
+			case "annotations":
+				fileData.Annotations = append(fileData.Annotations, Annotation{
+					Attributes: map[string]interface{}{
+						AncestorLabels:      ancestors,
+						AncestorConfidences: ancestorConfidences,
+						Confidence:          a.Confidence / 100,
+						LabelConfidence:     a.Confidence / 100,
+						ImageLabel:          true,
+					},
+					Label: a.Name,
+				})
+			}
+			continue
 		}
 
-		// Only keep annotations for objects, i.e. annotations with instances. These are unrolled.
+		// Annotations for objects, i.e. annotations with instances, are unrolled.
 		for _, i := range a.Instances {
 			annotation := Annotation{
 				Attributes: map[string]interface{}{
-					AncestorLabels: ancestors,
-					Confidence:     i.Confidence / 100,
-				},
-				// Scale normalised coordinates to image coordinates.
-				Coords: [4]float64{
-					i.BoundingBox.Left * float64(img.Width),
-					i.BoundingBox.Top * float64(img.Height),
-					(i.BoundingBox.Left + i.BoundingBox.Width) * float64(img.Width),
-					(i.BoundingBox.Top + i.BoundingBox.Height) * float64(img.Height),
+					AncestorLabels:      ancestors,
+					AncestorConfidences: ancestorConfidences,
+					Confidence:          i.Confidence / 100,
+					LabelConfidence:     a.Confidence / 100,
 				},
+				Coords: CoordsFromXYWH(i.BoundingBox.Left, i.BoundingBox.Top,
+					i.BoundingBox.Width, i.BoundingBox.Height),
 				Label: a.Name,
 			}
 
@@ -93,3 +193,40 @@ func parseAWSDetectLabelsFile(labelPath, imagePath string) (AnnotatedFile, error
 
 	return fileData, nil
 }
+
+// awsDetectLabelsFormat implements the Reader interface for the AWS Rekognition detect-labels
+// format.
+type awsDetectLabelsFormat struct{}
+
+// Parse implements Reader.
+func (awsDetectLabelsFormat) Parse(labelDir string, opts FormatOptions) ([]AnnotatedFile, error) {
+	if err := requireImageDir(opts); err != nil {
+		return nil, err
+	}
+	if err := opts.AWSDetectLabels.validate(); err != nil {
+		return nil, err
+	}
+	return parseLabelsWithOneToOneImages(context.Background(), labelDir, ".json", opts.ImageDir,
+		opts.ImageMatch, awsDetectLabelsFormatParser(opts))
+}
+
+// NewSource implements StreamReader.
+func (awsDetectLabelsFormat) NewSource(labelDir string, opts FormatOptions) (Source, error) {
+	if err := requireImageDir(opts); err != nil {
+		return nil, err
+	}
+	if err := opts.AWSDetectLabels.validate(); err != nil {
+		return nil, err
+	}
+	return newOneToOneSource(labelDir, ".json", opts.ImageDir, opts.ImageMatch,
+		awsDetectLabelsFormatParser(opts))
+}
+
+func init() {
+	RegisterFormat(Format{
+		Name:        "aws-dl",
+		Description: "AWS Rekognition detect-labels",
+		Reader:      awsDetectLabelsFormat{},
+		ReaderArgs:  "-labels <dir> -images <dir>",
+	})
+}
@@ -3,8 +3,8 @@ package lblconv
 // AWS Rekognition detect-text specific functionality.
 
 import (
+	"context"
 	"encoding/json"
-	"io/ioutil"
 )
 
 // AWSGeometry is the geometry of a text object annotation.
@@ -32,17 +32,34 @@ type AWSDTAnnotatedFile struct {
 // FromAWSDetectText reads and parses AWS detect-text annotations from labelDir and matches them
 // to the images in imageDir.
 func FromAWSDetectText(labelDir, imageDir string) ([]AnnotatedFile, error) {
-	return parseLabelsWithOneToOneImages(labelDir, ".json", imageDir, parseAWSDetectTextFile)
+	return FromAWSDetectTextContext(context.Background(), labelDir, imageDir)
 }
 
-// parseAWSDetectTextFile parses the label file at labelPath and reads metadata from the
-// corresponding image at imagePath to construct an AnnotatedFile struct and return it.
+// FromAWSDetectTextContext works like FromAWSDetectText, but stops parsing when ctx is done, in
+// which case it returns ctx.Err().
+func FromAWSDetectTextContext(ctx context.Context, labelDir, imageDir string) (
+		[]AnnotatedFile, error) {
+
+	return parseLabelsWithOneToOneImages(ctx, labelDir, ".json", imageDir, ImageMatchOptions{},
+		absoluteCoordsParser(parseAWSDetectTextFile, false))
+}
+
+// NewAWSDetectTextSource returns a Source that streams the AWS detect-text annotations from
+// labelDir, matched to the images in imageDir.
+func NewAWSDetectTextSource(labelDir, imageDir string) (Source, error) {
+	return newOneToOneSource(labelDir, ".json", imageDir, ImageMatchOptions{},
+		absoluteCoordsParser(parseAWSDetectTextFile, false))
+}
+
+// parseAWSDetectTextFile parses the label file at labelPath into an AnnotatedFile for the image at
+// imagePath, with the NormalizedCoords of the file, so that the image is not read.
 //
 // The extracted annotations have label "Text_Line" or "Text_Word" (and fallback "Text"), according
-// to the AWSTextDetection.Type.
+// to the AWSTextDetection.Type. They have the TextID and, for words, TextParentID attributes, and
+// the polygon of the text, if any.
 func parseAWSDetectTextFile(labelPath, imagePath string) (AnnotatedFile, error) {
 	// Unmarshal JSON.
-	enc, err := ioutil.ReadFile(labelPath)
+	enc, err := readFile(labelPath)
 	if err != nil {
 		return AnnotatedFile{}, err
 	}
@@ -50,19 +67,14 @@ func parseAWSDetectTextFile(labelPath, imagePath string) (AnnotatedFile, error)
 	var awsFileData AWSDTAnnotatedFile
 	err = json.Unmarshal(enc, &awsFileData)
 	if err != nil {
-		return AnnotatedFile{}, err
-	}
-
-	// Get the image width and height.
-	img, _, err := decodeImageConfig(imagePath)
-	if err != nil {
-		return AnnotatedFile{}, err
+		return AnnotatedFile{}, newJSONParseError(labelPath, enc, err)
 	}
 
 	// Convert to the intermediate representation.
 	fileData := AnnotatedFile{
 		Annotations: make([]Annotation, 0, len(awsFileData.Annotations)),
 		FilePath:    imagePath,
+		CoordSpace:  NormalizedCoords,
 	}
 	for _, a := range awsFileData.Annotations {
 		annotation := Annotation{
@@ -70,15 +82,20 @@ func parseAWSDetectTextFile(labelPath, imagePath string) (AnnotatedFile, error)
 				Confidence:   a.Confidence / 100,
 				DetectedText: a.DetectedText,
 			},
-			// Scale normalised coordinates to image coordinates.
-			Coords: [4]float64{
-				a.Geometry.BoundingBox.Left * float64(img.Width),
-				a.Geometry.BoundingBox.Top * float64(img.Height),
-				(a.Geometry.BoundingBox.Left + a.Geometry.BoundingBox.Width) * float64(img.Width),
-				(a.Geometry.BoundingBox.Top + a.Geometry.BoundingBox.Height) * float64(img.Height),
-			},
+			Coords: CoordsFromXYWH(a.Geometry.BoundingBox.Left, a.Geometry.BoundingBox.Top,
+				a.Geometry.BoundingBox.Width, a.Geometry.BoundingBox.Height),
 			Label: "Text",
 		}
+		annotation.Attributes[TextID] = a.ID
+		if a.ParentID != nil {
+			annotation.Attributes[TextParentID] = *a.ParentID
+		}
+		if len(a.Geometry.Polygon) > 0 {
+			annotation.Polygon = make([][2]float64, len(a.Geometry.Polygon))
+			for i, p := range a.Geometry.Polygon {
+				annotation.Polygon[i] = [2]float64{p.X, p.Y}
+			}
+		}
 		if a.Type == "LINE" {
 			annotation.Label = "Text_Line"
 		} else if a.Type == "WORD" {
@@ -90,3 +107,33 @@ func parseAWSDetectTextFile(labelPath, imagePath string) (AnnotatedFile, error)
 
 	return fileData, nil
 }
+
+// awsDetectTextFormat implements the Reader interface for the AWS Rekognition detect-text format.
+type awsDetectTextFormat struct{}
+
+// Parse implements Reader.
+func (awsDetectTextFormat) Parse(labelDir string, opts FormatOptions) ([]AnnotatedFile, error) {
+	if err := requireImageDir(opts); err != nil {
+		return nil, err
+	}
+	return parseLabelsWithOneToOneImages(context.Background(), labelDir, ".json", opts.ImageDir,
+		opts.ImageMatch, absoluteCoordsParser(parseAWSDetectTextFile, opts.NormalizedCoords))
+}
+
+// NewSource implements StreamReader.
+func (awsDetectTextFormat) NewSource(labelDir string, opts FormatOptions) (Source, error) {
+	if err := requireImageDir(opts); err != nil {
+		return nil, err
+	}
+	return newOneToOneSource(labelDir, ".json", opts.ImageDir, opts.ImageMatch,
+		absoluteCoordsParser(parseAWSDetectTextFile, opts.NormalizedCoords))
+}
+
+func init() {
+	RegisterFormat(Format{
+		Name:        "aws-dt",
+		Description: "AWS Rekognition detect-text",
+		Reader:      awsDetectTextFormat{},
+		ReaderArgs:  "-labels <dir> -images <dir>",
+	})
+}
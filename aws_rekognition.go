@@ -0,0 +1,231 @@
+package lblconv
+
+// AWS Rekognition client functionality, to produce detect-labels and detect-text label files.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RekognitionAPI selects the AWS Rekognition operation to annotate images with.
+type RekognitionAPI int
+
+// The supported Rekognition operations. Their responses are the label files of the aws-dl and
+// aws-dt formats, respectively.
+const (
+	RekognitionDetectLabels RekognitionAPI = iota
+	RekognitionDetectText
+)
+
+// RekognitionOptions configures AnnotateWithRekognition.
+type RekognitionOptions struct {
+	Region      string         // The AWS region, e.g. "us-east-1". Required.
+	Credentials AWSCredentials // The credentials to sign the requests with.
+	Endpoint    string         // Overrides the regional endpoint URL, if not empty.
+
+	MaxLabels     int     // The max. number of labels per image (detect-labels only; 0: no limit).
+	MinConfidence float64 // The min. confidence of the labels in [0, 100] (detect-labels only).
+
+	Concurrency int // The number of concurrent requests. Defaults to 4.
+	MaxRetries  int // The number of retries for throttled or failed requests.
+}
+
+// AnnotateWithRekognition calls the Rekognition api for each JPEG and PNG image in imageDir and
+// writes the raw JSON responses to labelDir (created if it does not exist), using the image file
+// names with a .json extension. Images that already have a label file are skipped, so that an
+// interrupted run can be resumed. The label files can then be read with the aws-dl and aws-dt
+// formats.
+//
+// Requests that fail after the retries are logged and their images skipped. Stops when ctx is
+// done, in which case it returns ctx.Err(). Returns the number of label files written and of images
+// skipped because their requests failed.
+func AnnotateWithRekognition(ctx context.Context, imageDir, labelDir string, api RekognitionAPI,
+		opts RekognitionOptions) (n, failed int, err error) {
+
+	if opts.Region == "" {
+		return 0, 0, fmt.Errorf("missing AWS region")
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 4
+	}
+	if err := os.MkdirAll(labelDir, 0755); err != nil {
+		return 0, 0, fmt.Errorf("failed to create the label directory: %v", err)
+	}
+
+	images, err := filesByExtInDir(imageDir, "")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	client := &rekognitionClient{
+		http:     &http.Client{Timeout: time.Minute},
+		endpoint: opts.Endpoint,
+		opts:     opts,
+	}
+	if client.endpoint == "" {
+		client.endpoint = "https://rekognition." + opts.Region + ".amazonaws.com/"
+	}
+
+	// Annotate the images concurrently from a work queue.
+	workQueue := make(chan string)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	wg.Add(opts.Concurrency)
+	for i := 0; i < opts.Concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for imagePath := range workQueue {
+				written, err := client.annotate(ctx, imagePath, labelDir, api)
+				if err != nil {
+					log.Printf("Failed to annotate %q: %v", imagePath, err)
+					mu.Lock()
+					failed++
+					mu.Unlock()
+					continue
+				} else if !written {
+					continue
+				}
+				mu.Lock()
+				n++
+				mu.Unlock()
+			}
+		}()
+	}
+
+feedLoop:
+	for _, imagePath := range images {
+		if !isImage(imagePath) {
+			continue
+		}
+		select {
+		case workQueue <- imagePath:
+		case <-ctx.Done():
+			break feedLoop
+		}
+	}
+	close(workQueue)
+	wg.Wait()
+
+	return n, failed, ctx.Err()
+}
+
+// rekognitionClient sends signed requests to the Rekognition API.
+type rekognitionClient struct {
+	http     *http.Client
+	endpoint string
+	opts     RekognitionOptions
+}
+
+// annotate calls api for the image at imagePath and writes the response to labelDir, unless the
+// label file exists. Returns whether the label file was written.
+func (c *rekognitionClient) annotate(ctx context.Context, imagePath, labelDir string,
+		api RekognitionAPI) (bool, error) {
+
+	_, baseNoExt, _, err := splitPath(imagePath)
+	if err != nil {
+		return false, err
+	}
+	labelPath := filepath.Join(labelDir, baseNoExt+".json")
+	if _, err := os.Stat(labelPath); err == nil {
+		return false, nil
+	}
+
+	imgData, err := readImage(imagePath)
+	if err != nil {
+		return false, err
+	}
+
+	// Build the request. Byte slices are base64 encoded, as required for Image.Bytes.
+	target := "RekognitionService.DetectLabels"
+	request := map[string]interface{}{"Image": map[string]interface{}{"Bytes": imgData}}
+	if api == RekognitionDetectText {
+		target = "RekognitionService.DetectText"
+	} else {
+		if c.opts.MaxLabels > 0 {
+			request["MaxLabels"] = c.opts.MaxLabels
+		}
+		if c.opts.MinConfidence > 0 {
+			request["MinConfidence"] = c.opts.MinConfidence
+		}
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := c.call(ctx, target, body)
+	if err != nil {
+		return false, err
+	}
+
+	if err := writeFileAtomic(labelPath, resp); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// call sends the request body for the target operation, retrying throttled requests and server
+// errors with exponential backoff. Returns the response body.
+func (c *rekognitionClient) call(ctx context.Context, target string, body []byte) ([]byte, error) {
+	backoff := 500 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		resp, retry, err := c.send(ctx, target, body)
+		if err == nil || !retry || attempt >= c.opts.MaxRetries {
+			return resp, err
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// send sends a single request. It returns whether the request can be retried if it fails.
+func (c *rekognitionClient) send(ctx context.Context, target string, body []byte) (
+		respBody []byte, retry bool, err error) {
+
+	req, err := http.NewRequest(http.MethodPost, c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", target)
+	signAWSRequest(req, body, c.opts.Credentials, "rekognition", c.opts.Region, time.Now())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, ctx.Err() == nil, err
+	}
+	defer closeWithErrCheck(resp.Body, &err)
+
+	respBody, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Type    string `json:"__type"`
+			Message string
+		}
+		_ = json.Unmarshal(respBody, &apiErr)
+		retry = resp.StatusCode >= 500 || strings.Contains(apiErr.Type, "Throttling") ||
+				strings.Contains(apiErr.Type, "ProvisionedThroughputExceeded")
+		return nil, retry, fmt.Errorf("%s: %s %s", resp.Status, apiErr.Type, apiErr.Message)
+	}
+
+	return respBody, false, nil
+}
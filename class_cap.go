@@ -0,0 +1,136 @@
+package lblconv
+
+// Subsampling of over-represented classes.
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ClassCapOptions holds the settings of AnnotatedFiles.CapClasses.
+type ClassCapOptions struct {
+	Caps map[string]int // The max. number of annotations by label.
+	Seed int64          // The seed for the random selection of the annotations or files to keep.
+
+	// Whether to drop whole files instead of individual annotations. A file is dropped if keeping
+	// it would exceed the cap of any of its labels, so that no objects are left unlabelled in the
+	// kept images. Files with other, uncapped labels may be dropped as a result.
+	DropFiles bool
+}
+
+// ParseClassCaps parses caps in the format label=n[,label=n...], e.g. "Person=5000,Car=2000".
+func ParseClassCaps(spec string) (map[string]int, error) {
+	caps := make(map[string]int)
+	for _, v := range strings.Split(spec, ",") {
+		sep := strings.LastIndex(v, "=")
+		if sep <= 0 {
+			return nil, fmt.Errorf("invalid class cap %q", v)
+		}
+		n, err := strconv.Atoi(v[sep+1:])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid number in class cap %q", v)
+		}
+		caps[v[:sep]] = n
+	}
+	return caps, nil
+}
+
+// CapClasses randomly subsamples the annotations of the labels in opts.Caps to at most the given
+// number each, e.g. to limit over-represented classes in a training set. Image-level labels are
+// not counted. The selection only depends on opts.Seed and the order of data. Returns the number of
+// annotations removed, including those of the dropped files if opts.DropFiles is true.
+func (data *AnnotatedFiles) CapClasses(opts ClassCapOptions) int {
+	rng := rand.New(rand.NewSource(opts.Seed))
+	if opts.DropFiles {
+		return data.capClassFiles(opts.Caps, rng)
+	}
+
+	// Collect the capped annotations by label, and randomly select those to remove.
+	type ref struct{ file, annotation int }
+	byLabel := make(map[string][]ref)
+	for i, f := range *data {
+		for j, a := range f.Annotations {
+			if _, ok := opts.Caps[a.Label]; ok && !a.boolAttribute(ImageLabel) {
+				byLabel[a.Label] = append(byLabel[a.Label], ref{i, j})
+			}
+		}
+	}
+	// Shuffle in the order of the labels rather than the random order of the map, so that the
+	// selection is reproducible.
+	labels := make([]string, 0, len(byLabel))
+	for label := range byLabel {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	removed := make(map[ref]bool)
+	for _, label := range labels {
+		refs := byLabel[label]
+		max := opts.Caps[label]
+		if len(refs) <= max {
+			continue
+		}
+		rng.Shuffle(len(refs), func(i, j int) { refs[i], refs[j] = refs[j], refs[i] })
+		for _, r := range refs[max:] {
+			removed[r] = true
+		}
+	}
+	if len(removed) == 0 {
+		return 0
+	}
+
+	for i := range *data {
+		f := &(*data)[i]
+		var annotations []Annotation
+		for j, a := range f.Annotations {
+			if !removed[ref{i, j}] {
+				annotations = append(annotations, a)
+			}
+		}
+		f.Annotations = annotations
+	}
+	return len(removed)
+}
+
+// capClassFiles implements CapClasses for opts.DropFiles. The files are visited in random order,
+// and dropped if they would exceed a cap.
+func (data *AnnotatedFiles) capClassFiles(caps map[string]int, rng *rand.Rand) int {
+	order := rng.Perm(len(*data))
+	counts := make(map[string]int)
+	dropped := make([]bool, len(*data))
+	numRemoved := 0
+	for _, i := range order {
+		fileCounts := make(map[string]int)
+		numAnnotations := 0
+		for _, a := range (*data)[i].Annotations {
+			if !a.boolAttribute(ImageLabel) {
+				fileCounts[a.Label]++
+				numAnnotations++
+			}
+		}
+		for label, n := range fileCounts {
+			if max, ok := caps[label]; ok && counts[label]+n > max {
+				dropped[i] = true
+				break
+			}
+		}
+		if dropped[i] {
+			numRemoved += numAnnotations
+			continue
+		}
+		for label, n := range fileCounts {
+			counts[label] += n
+		}
+	}
+
+	kept := (*data)[:0]
+	for i, f := range *data {
+		if !dropped[i] {
+			kept = append(kept, f)
+		}
+	}
+	*data = kept
+	return numRemoved
+}
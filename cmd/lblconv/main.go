@@ -1,46 +1,207 @@
-// Converts between KITTI, Sloth, AWS detect-labels, AWS detect-text, TFRecord and
-// VGG Image Annotator label formats.
+// Converts between the label formats registered with package lblconv, i.e. KITTI, Sloth,
+// AWS detect-labels, AWS detect-text, TFRecord, label maps, VGG Image Annotator and the detections
+// of inference endpoints.
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sensorable/lblconv"
 )
 
-var (
-	convertFrom format // The source format.
-	convertTo   format // The target format.
+// version is the lblconv version, which can be set at build time with
+// -ldflags "-X main.version=<version>". The module version is used otherwise.
+var version string
+
+// The exit statuses of lblconv, so that scripts can tell a partial from a complete conversion.
+const (
+	exitSuccess     = 0 // All input files were converted.
+	exitFailure     = 1 // The conversion failed, e.g. on an I/O error (the status of log.Fatal).
+	exitInvalidArgs = 2 // The arguments are invalid, so nothing was converted.
+	exitPartial     = 3 // The conversion completed, but some input files were skipped.
+)
+
+// nonProcessingFlags are the flags defined with the filters and transformations that do not change
+// the output dataset, and are therefore not listed on the dataset card.
+var nonProcessingFlags = map[string]bool{
+	"attribute-schema": true,
+	"strict-images":    true,
+	"max-megapixels":   true,
+	"image-timeout":    true,
+	"audit-images":     true,
+	"strict-audit":     true,
+	"quarantine":       true,
+	"quarantine-mode":  true,
+	"package":          true,
+	"package-version":  true,
+}
+
+// Config is the configuration of a run, as parsed from the command line by ParseConfig.
+type Config struct {
+	args []string // The command line arguments, recorded as provenance.
+
+	convertFrom lblconv.Format // The source format.
+	convertTo   lblconv.Format // The target format.
+
+	strictDuplicates bool // Reject duplicate image entries in the input instead of merging them.
+	validateInput    bool // Validate the JSON input files against their schemas.
+	annotationIDs    bool // Assign deterministic IDs to annotations without an ID.
+	interpolateGap   int  // The max. number of frames to interpolate object tracks over.
+	imageChecksums   bool // Compute the SHA-256 of the (processed) images.
+	provenance       bool // Record the lblconv version and arguments in the output.
+	appendOutput     bool // Update existing label output files instead of overwriting them.
+	force            bool // Overwrite existing outputs and remove stale KITTI label files.
+	sortOutput       bool // Sort the output files by path and the annotations by coordinates.
+
+	coordRounding lblconv.CoordRounding // The rounding of the output coordinates.
 
 	imageDirPath             string   // The input directory with the labeled images.
 	imageOutDirPath          string   // The output directory for images after processing.
-	labelFileOrDirPath       string   // The input label directory or file, depending on the format.
+	labelFileOrDirPaths      []string // The input label dirs or files, depending on the format.
+	labelInputNames          []string // The names of the input datasets, if they are tagged.
 	labelOutFileOrDirPaths   []string // The output label dir or file path(s), depending on the format.
 	labelOutSplits           []int    // The cumulative split percentages for the output datasets.
+	labelOutSplitNames       []string // The names of the output datasets, if the splits are named.
+	splitCoverage            string   // The splits that must contain every class {all, train, none}.
+	strictSplitCoverage      bool     // Fail if a class is missing from a split.
+	imageOutDirPaths         []string // The image output dir per dataset for templated paths.
+	splitOutDirPaths         []string // The directories to create for the {split} output paths.
 	tfRecordLabelMapFilePath string   // The TFRecord label map file.
+	categoriesFilePath       string   // The file with the category IDs to pin in the label map.
 	numShardFiles            int      // The number of shard files to create.
+	imageDimCacheFilePath    string   // The file for caching image dimensions across runs.
+	imageDimManifestPath     string   // The manifest of image dimensions, if not empty.
+	attributeSchemaPath      string   // The attribute schema file, if not empty.
+	numWorkers               int      // The number of concurrent workers (0 for the default).
+	maxImageMemoryMB         int      // The max. memory of the decoded images in flight (0: none).
+	imageFetchDirPath        string   // The directory for downloaded images.
+	imageFetchConcurrency    int      // The max. number of concurrent image downloads.
+
+	imageMatch lblconv.ImageMatchOptions // How label files are matched to the input images.
+
+	rekognition            bool   // Annotate the images with AWS Rekognition first.
+	rekognitionRegion      string // The AWS region for Rekognition requests.
+	rekognitionMaxLabels   int    // The max. number of labels per image.
+	rekognitionConcurrency int    // The number of concurrent Rekognition requests.
+	rekognitionRetries     int    // The number of retries for failed Rekognition requests.
+
+	awsImageLabels string // How to keep AWS detect-labels labels without instances.
+
+	inferenceProtocol    lblconv.InferenceProtocol // The protocol of the inference endpoint.
+	inferenceMinScore    float64                   // The min. score of detections to keep.
+	inferenceConcurrency int                       // The number of concurrent inference requests.
+
+	tfRecordShardAssignment lblconv.TFRecordShardAssignment // How to assign examples to shards.
+	tfRecordCompression     lblconv.TFRecordCompression     // The compression of the shards.
+	tfRecordShuffle         bool                            // Shuffle the TFRecord examples.
+	tfRecordSeed            int64                           // The seed for shuffling.
+	tfRecordTranscodeJPEG   bool                            // Transcode images to JPEG.
+	tfRecordDisplayNames    bool                            // Write label map display names.
+	tfRecordMaxErrorRate    float64                         // The max. fraction of failed files.
+	tfRecordVerify          bool                            // Verify the written shards.
+	tfRecordOmitImages      bool                            // Do not embed the images.
+
+	pipelineConfigPath string                          // The TF OD API pipeline config output file.
+	pipelineConfig     lblconv.TFPipelineConfigOptions // The base model and training settings.
+
+	labelMapFirstID    int    // The first label map ID, 0 or 1.
+	labelMapBackground string // The label of an explicit background entry.
+	displayNamesPath   string // The CSV file with the display names of the labels.
+
+	// The attributes to write as additional TFRecord features.
+	tfRecordAttributeFeatures []lblconv.TFRecordAttributeFeature
+
+	viaProjectName string // The VIA project name.
+	viaRegionShape string // The VIA region shape for bounding boxes.
+	viaSchemaPath  string // The VIA region attribute schema file.
+
+	slothFileClass      string // The Sloth file class.
+	slothAnnotationType string // The Sloth annotation type.
+	slothAttributes     bool   // Write the annotation attributes to Sloth files.
+
+	sqlEmbedImages bool // Store the image files in the SQL output.
+
+	captionSeparator string // The separator of the lines of text in COCO captions.
+
+	oneHotLabels string // The labels that images are tagged with in one-hot CSV files.
+
+	parquetAttributes string // A comma-separated string of attributes to write to Parquet files.
+
+	gcsPrefix string // The Cloud Storage location of the images for the Google Cloud formats.
+
+	kittiScoreScale float64 // The KITTI score that corresponds to a confidence of 1.0.
+
+	heatmapDirPath  string // The output directory for bounding box heatmaps.
+	heatmapSize     int    // The heatmap resolution.
+	heatmapCoverage bool   // Accumulate the box coverage instead of the box centres.
+
+	pixelStats bool // Compute the per-channel pixel mean and standard deviation.
+
+	cooccurrenceFilePath string // The CSV output file for the label co-occurrence matrix.
+	labelUsageFilePath   string // The CSV output file for the image and annotation counts by label.
+
+	thresholdsFilePath  string                        // The CSV output file for the threshold sweep.
+	thresholdsTruthPath string                        // The ground truth for the threshold sweep.
+	thresholdsTruthFrom lblconv.Format                // The format of the ground truth.
+	thresholdSweepOpts  lblconv.ThresholdSweepOptions // The threshold sweep options.
+
+	samplingWeightsFilePath string                       // The CSV output file for the weights.
+	samplingWeightMethod    lblconv.SamplingWeightMethod // How to compute the sampling weights.
+	repeatFactorThreshold   float64                      // The threshold for repeat factors.
+
+	sourceStats bool // Log the number of annotations by input source and label.
+
+	datasetCardPath     string   // The Markdown output file for the dataset card.
+	datasetCardExamples int      // The number of example images on the dataset card.
+	processingArgs      []string // The filter and transformation arguments, for the dataset card.
 
+	numAnchors                 int // The number of anchor boxes to cluster.
+	anchorInputW, anchorInputH int // The network input resolution for the anchor boxes.
+
+	midsToNamesPath string  // The class descriptions to translate the input labels with.
+	namesToMIDsPath string  // The class descriptions to translate the output labels back with.
 	labelMappings   string  // A comma-separated string of label mappings.
 	bboxScaleWidth  float64 // A scale factor for the bounding box width.
 	bboxScaleHeight float64 // A scale factor for the bounding box height.
 	bboxAspectRatio float64 // The desired output aspect ratio for bounding boxes.
+	sanitizeBboxes  bool    // Repair inverted, out-of-bounds and degenerate bounding boxes.
+
+	flagRules []lblconv.FlagRule // Rules that flag annotations as difficult or ignored.
+
+	classCaps lblconv.ClassCapOptions // The max. number of annotations per label.
 
 	filterLabels         string  // A comma-separated string of labels to keep (empty keeps all).
+	filterSources        string  // A comma-separated string of input sources to keep.
 	filterAttributes     string  // A comma-separated string of attributes to keep (empty keeps all).
 	filterRequiredAttrs  string  // A comma-sep. str of required attrs (present and not zero value).
 	filterConfidence     float64 // The min. confidence value.
+	filterLabelConf      float64 // The min. label confidence value, e.g. of AWS labels.
 	filterRequireLabel   bool    // Filter out files with no labels (after other filters).
+	filterImageLabels    string  // A comma-separated string of required image-level labels.
 	filterMinBboxWidth   float64 // The minimum bounding box width.
 	filterMinBboxHeight  float64 // The minimum bounding box height.
 	filterMinAspectRatio float64 // The minimum aspect ratio of bboxes (w/h).
 	filterMaxAspectRatio float64 // The maximum aspect ratio of bboxes (w/h).
 
+	filterMinTextLength int            // The min. length of detected text.
+	filterTextRegexp    string         // A regular expression that detected text must match.
+	filterTextPattern   *regexp.Regexp // The compiled filterTextRegexp.
+	filterTextCharset   string         // The characters that detected text may consist of.
+	filterNumericText   bool           // Keep detected text that consists of digits only.
+
 	imageOutEncoding        string // The file type for image outputs.
 	imageResizeLonger       int    // The target length for the longer side of the image.
 	imageResizeShorter      int    // The target length for the shorter side of the image.
@@ -49,349 +210,2352 @@ var (
 	imageJPEGQuality        int    // The JPEG quality for JPEG outputs.
 
 	imageCropObjects bool // Crop individual objects from images and output these instead.
-)
+	imageToSRGB      bool // Convert images with an embedded ICC profile to sRGB.
+	strictImages     bool // Fail on images that cannot be decoded instead of skipping them.
 
-type format int
+	imageMaxMegapixels float64       // The max. size of the input images (0 for no limit).
+	imageTimeout       time.Duration // The max. time to process an image (0 for no limit).
 
-// The known label formats.
-const (
-	Unknown format = iota // If an unknown format is specified.
-	AWSDetectLabels
-	AWSDetectText
-	Kitti
-	Sloth
-	TFRecord
-	VIA  // VGG Image Annotator
-)
+	auditImages float64 // The fraction of the processed images to audit (0 for none).
+	strictAudit bool    // Fail on the first inconsistent image instead of reporting them all.
+
+	imageColor     lblconv.ImageColorMode   // The colour model of the output images.
+	imageCopyPaste lblconv.CopyPasteOptions // The copy-paste augmentation of the output images.
+	imageCutout    lblconv.CutoutOptions    // The cutout augmentation of the output images.
+	imageExifTags  lblconv.ExifTags         // The EXIF metadata to copy to the output images.
 
-func formatFrom(s string) format {
-	switch s {
-	case "aws-dl":
-		return AWSDetectLabels
-	case "aws-dt":
-		return AWSDetectText
-	case "kitti":
-		return Kitti
-	case "sloth":
-		return Sloth
-	case "tfrecord":
-		return TFRecord
-	case "via":
-		return VIA
-	}
-	return Unknown
-}
-
-func init() {
-	flag.Usage = func() {
+	imageExtMode lblconv.ImageExtensionMode // How to handle images with a mismatched extension.
+
+	quarantineDirPath string                 // The directory for images that cannot be decoded.
+	quarantineMode    lblconv.QuarantineMode // Whether to move or only list these images.
+
+	packagePath    string // The output archive or directory for packaging the dataset.
+	packageVersion string // The version of the packaged dataset.
+}
+
+// ParseConfig parses and validates the command line arguments args, which exclude the program
+// name. All invalid arguments are reported together by a *ConfigError. The usage is printed to
+// stderr for -help and for invalid flags, for which the flag package's error is returned.
+func ParseConfig(args []string) (*Config, error) {
+	cfg := &Config{args: args}
+
+	fs := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	fs.Usage = func() {
 		_, _ = fmt.Fprintf(os.Stderr, "Usage: %s -from <format> -to <format> [<arg> ...]\n",
-			filepath.Base(os.Args[0]))
+			fs.Name())
 		_, _ = fmt.Fprintln(os.Stderr)
 		_, _ = fmt.Fprintln(os.Stderr, "The supported input (-from) and output (-to) formats and their"+
 				" required arguments:")
-		_, _ = fmt.Fprintln(os.Stderr, "  AWS Rekognition detect-labels:")
-		_, _ = fmt.Fprintln(os.Stderr, "    -from aws-dl -labels <dir> -images <dir>")
-		_, _ = fmt.Fprintln(os.Stderr, "  AWS Rekognition detect-text:")
-		_, _ = fmt.Fprintln(os.Stderr, "    -from aws-dt -labels <dir> -images <dir>")
-		_, _ = fmt.Fprintln(os.Stderr, "  KITTI 2D object detection:")
-		_, _ = fmt.Fprintln(os.Stderr, "    -from kitti -labels <dir> -images <dir>")
-		_, _ = fmt.Fprintln(os.Stderr, "    -to kitti -labels-out <dir>")
-		_, _ = fmt.Fprintln(os.Stderr, "  Sloth:")
-		_, _ = fmt.Fprintln(os.Stderr, "    -from sloth -labels <file>")
-		_, _ = fmt.Fprintln(os.Stderr, "    -to sloth -labels-out <file>")
-		_, _ = fmt.Fprintln(os.Stderr, "  TensorFlow TFRecord:")
-		_, _ = fmt.Fprintln(os.Stderr, "    -to tfrecord -labels-out <file>"+
-				" -tfrecord-label-map-file <file> [-num-shards <int>]")
-		_, _ = fmt.Fprintln(os.Stderr, "  VGG Image Annotator (VIA):")
-		_, _ = fmt.Fprintln(os.Stderr, "    -from via -labels <file>")
-		_, _ = fmt.Fprintln(os.Stderr, "    -to via -labels-out <file>")
+		for _, f := range lblconv.Formats() {
+			_, _ = fmt.Fprintf(os.Stderr, "  %s:\n", f.Description)
+			if f.Reader != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "    -from %s %s\n", f.Name, f.ReaderArgs)
+			}
+			if f.Writer != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "    -to %s %s\n", f.Name, f.WriterArgs)
+			}
+		}
 		_, _ = fmt.Fprintln(os.Stderr)
 		_, _ = fmt.Fprintln(os.Stderr, "Arguments:")
-		flag.PrintDefaults()
+		fs.PrintDefaults()
+		_, _ = fmt.Fprintln(os.Stderr)
+		_, _ = fmt.Fprintln(os.Stderr, "Exit status:")
+		_, _ = fmt.Fprintf(os.Stderr, "  %d  Success\n", exitSuccess)
+		_, _ = fmt.Fprintf(os.Stderr, "  %d  Failure, e.g. on an I/O error\n", exitFailure)
+		_, _ = fmt.Fprintf(os.Stderr, "  %d  Invalid arguments\n", exitInvalidArgs)
+		_, _ = fmt.Fprintf(os.Stderr, "  %d  Partial success, some input files were skipped because of"+
+				" errors\n", exitPartial)
 	}
 
-	printUsageAndExit := func(msg ...interface{}) {
-		log.Print(msg...)
-		flag.Usage()
-		os.Exit(1)
+	// The problems with the arguments, which are all reported together.
+	var problems []string
+	problem := func(msg ...interface{}) {
+		p := fmt.Sprint(msg...)
+		for _, q := range problems {
+			if p == q {
+				return
+			}
+		}
+		problems = append(problems, p)
 	}
 
 	// Format arguments.
-	from := flag.String("from", "", "The source `format`")
-	to := flag.String("to", "", "The target `format`")
+	from := fs.String("from", "", "The source `format`")
+	to := fs.String("to", "", "The target `format`")
+	fs.BoolVar(&cfg.strictDuplicates, "strict-duplicates", cfg.strictDuplicates,
+		"Fail on duplicate entries for the same image in sloth and via input files, or in multiple"+
+				" -labels inputs, instead of merging their annotations")
+	fs.BoolVar(&cfg.validateInput, "validate-input", cfg.validateInput,
+		"Validate sloth and via input files against their JSON Schemas before converting them, and"+
+				" report the paths of all malformed entries (files that fail to parse are always"+
+				" validated)")
+	fs.BoolVar(&cfg.annotationIDs, "annotation-ids", cfg.annotationIDs,
+		"Assign IDs derived from the image path, label and coordinates of the input to annotations"+
+				" without an ID, so that they can be tracked across conversions (written by -to"+
+				" sloth)")
+	fs.IntVar(&cfg.interpolateGap, "interpolate-tracks", cfg.interpolateGap,
+		"Interpolate the boxes of object tracks (TrackID attribute, e.g. from -from mot) in the"+
+				" frames between two keyframes that are at most this many `frames` apart (zero"+
+				" disables interpolation)")
+	fs.BoolVar(&cfg.imageChecksums, "image-sha256", cfg.imageChecksums,
+		"Compute the SHA-256 of each (processed) image and write it to the output (tfrecord"+
+				" image/key/sha256 without embedded images, via file attribute sha256)")
+	fs.BoolVar(&cfg.provenance, "provenance", cfg.provenance,
+		"Record the lblconv version and the command line arguments in the output (via projects,"+
+				" prototxt tfrecord label maps and the info of coco-captions)")
+
+	rounding := fs.String("round-coords", "none",
+		"How to round the output coordinates {none, nearest, floor, ceil}, consistently for all"+
+				" output formats (none keeps the rounding of each format)")
+	fs.IntVar(&cfg.coordRounding.Decimals, "coord-decimals", 0,
+		"The number of decimal places to keep with -round-coords (via always uses whole pixels)")
 
 	// Path arguments.
-	flag.StringVar(&imageDirPath, "images", imageDirPath,
-		"The `path` to the image input directory")
-	flag.StringVar(&imageOutDirPath, "images-out", imageOutDirPath,
+	fs.StringVar(&cfg.imageDirPath, "images", cfg.imageDirPath,
+		"The `path` to the image input directory, which may be or be in a .zip, .tar or .tar.gz"+
+				" archive")
+	fs.BoolVar(&cfg.imageMatch.StripImageExtensions, "match-image-ext", false,
+		"Strip image file extensions from the label file names when matching them to the images"+
+				" of -from kitti, aws-dl and aws-dt, e.g. match \"a.jpg.json\" to \"a.jpg\"")
+	fs.BoolVar(&cfg.imageMatch.CaseInsensitive, "match-ignore-case", false,
+		"Match the label files to the images of -from kitti, aws-dl and aws-dt case-insensitively")
+	fs.BoolVar(&cfg.imageMatch.Recursive, "match-recursive", false,
+		"Search the subdirectories of -images for the images of -from kitti, aws-dl and aws-dt;"+
+				" image names must be unique")
+	fs.StringVar(&cfg.imageMatch.ManifestPath, "image-manifest", "",
+		"The `path` to a CSV file with the columns label and image that maps the label file names"+
+				" of -from kitti, aws-dl and aws-dt to the image paths (relative to -images)")
+	fs.StringVar(&cfg.imageMatch.MissingImageExt, "missing-image-ext", "",
+		"Convert the label files of -from kitti, aws-dl and aws-dt without an image, with the image"+
+				" path formed from the label file name and this file `extension`, e.g. .png; stages"+
+				" that need the pixels fail for them (default: skip the label files)")
+	fs.StringVar(&cfg.imageOutDirPath, "images-out", cfg.imageOutDirPath,
 		"The `path` to the image output directory (only required when image processing"+
-				" functionality is used")
-	flag.StringVar(&labelFileOrDirPath, "labels", labelFileOrDirPath,
-		"The `path` to the label input file (sloth, via) or directory (kitti, aws-dl, aws-dt)")
-	outPaths := flag.String("labels-out", "",
-		"The comma-separated paths (`path[,...]`) to the label output files (sloth, tfrecord, via)"+
-				" or directories (kitti); must be one path per value in flag -split")
-	outSplits := flag.String("split", "100",
-		"The comma-separated output split percentages (`percent[,...]`) to divide labels into"+
-				" (only sloth, tfrecord, and via output formats); must add up to 100%")
-	flag.StringVar(&tfRecordLabelMapFilePath, "tfrecord-label-map-file", tfRecordLabelMapFilePath,
-		"The TFRecord label map file `path`")
-
-	flag.IntVar(&numShardFiles, "num-shards", 1,
+				" functionality is used); {split} is replaced by the split name, see -split")
+	inPaths := fs.String("labels", "",
+		"The comma-separated, optionally named paths (`[name=]path[,...]`) to the label input"+
+				" files or directories, depending on the format, which may be in a .zip, .tar or"+
+				" .tar.gz archive (or be the archive, for directories); multiple inputs are merged"+
+				" and their annotations tagged with the attribute Source (the name, or the base"+
+				" name of the path)")
+	outPaths := fs.String("labels-out", "",
+		"The comma-separated paths (`path[,...]`) to the label output files or directories,"+
+				" depending on the format; must be one path per value in flag -split, or a single"+
+				" path in which {split} is replaced by the split name (directories are created)")
+	fs.BoolVar(&cfg.appendOutput, "append", cfg.appendOutput,
+		"Update existing -labels-out files instead of overwriting them, replacing the entries for"+
+				" the same image paths and adding the others (sloth and via only)")
+	fs.BoolVar(&cfg.force, "force", cfg.force,
+		"Overwrite existing non-empty output files and directories, and remove the label files"+
+				" of a previous export from -to kitti output directories, instead of refusing to"+
+				" run (the existing outputs are not restored if the conversion fails)")
+	fs.BoolVar(&cfg.sortOutput, "sort", cfg.sortOutput,
+		"Sort the output files by image path and their annotations by coordinates, so that the"+
+				" output does not depend on the input order (this reads the whole dataset into"+
+				" memory; appended files are written after the existing ones)")
+	outSplits := fs.String("split", "100",
+		"The comma-separated, optionally named output split percentages (`[name=]percent[,...]`)"+
+				" to divide labels into, e.g. train=80,val=20; must add up to 100%")
+	fs.StringVar(&cfg.splitCoverage, "split-coverage", "all",
+		"The output splits that every class must appear in {all, train, none}, where train is the"+
+				" split named train or training, or the first one; missing classes are logged with"+
+				" their total number of annotations")
+	fs.BoolVar(&cfg.strictSplitCoverage, "strict-split-coverage", cfg.strictSplitCoverage,
+		"Fail if a class is missing from a split checked by -split-coverage, instead of logging"+
+				" it")
+	fs.StringVar(&cfg.tfRecordLabelMapFilePath, "tfrecord-label-map-file",
+		cfg.tfRecordLabelMapFilePath,
+		"The TFRecord label map file `path`; the format depends on the extension"+
+				" {.pbtxt, .json, .csv, .names}")
+	fs.StringVar(&cfg.categoriesFilePath, "pin-category-ids", cfg.categoriesFilePath,
+		"The `path` to a label map or COCO dataset/categories JSON file whose label IDs are"+
+				" assigned in -tfrecord-label-map-file, e.g. to concatenate the output with an"+
+				" existing dataset; fails if the label map maps them differently")
+
+	fs.IntVar(&cfg.numShardFiles, "num-shards", 1,
 		"The number of shard files to create (tfrecord only)")
+	shardAssignment := fs.String("tfrecord-shard-assignment", "round-robin",
+		"How to assign the examples to the shards {round-robin, class-balanced}")
+	compression := fs.String("tfrecord-compression", "none",
+		"The compression type for TFRecord files {none, gzip, zlib}")
+	fs.BoolVar(&cfg.tfRecordShuffle, "tfrecord-shuffle", cfg.tfRecordShuffle,
+		"Shuffle the order of the TFRecord examples")
+	fs.Int64Var(&cfg.tfRecordSeed, "tfrecord-seed", cfg.tfRecordSeed,
+		"The seed for -tfrecord-shuffle")
+	fs.BoolVar(&cfg.tfRecordDisplayNames, "tfrecord-display-names", cfg.tfRecordDisplayNames,
+		"Write a display_name for each label map item (the label, unless already set; tfrecord and"+
+				" labelmap only)")
+	fs.IntVar(&cfg.labelMapFirstID, "label-map-first-id", 1,
+		"The first class `ID` of new label maps {0, 1}; existing label maps must not have lower"+
+				" IDs (tfrecord and labelmap only)")
+	fs.StringVar(&cfg.labelMapBackground, "label-map-background", cfg.labelMapBackground,
+		"The `label` of an explicit background entry with the first ID, so that the classes"+
+				" start at the next ID, e.g. background with -label-map-first-id 0 (tfrecord and"+
+				" labelmap only)")
+	fs.StringVar(&cfg.displayNamesPath, "display-names", cfg.displayNamesPath,
+		"The `path` to a CSV file with labels and their display names (label,display_name), e.g."+
+				" Open Images class descriptions, to write to label maps and show as the label"+
+				" options of -to via")
+	fs.Float64Var(&cfg.tfRecordMaxErrorRate, "tfrecord-max-error-rate", cfg.tfRecordMaxErrorRate,
+		"The max. fraction of files that may fail to convert to TFRecord examples before the output"+
+				" is discarded; range [0.0, 1.0] (zero disables the check)")
+	fs.BoolVar(&cfg.tfRecordVerify, "tfrecord-verify", cfg.tfRecordVerify,
+		"Read back and verify the written TFRecord shards (checksums, bounding boxes and class"+
+				" IDs)")
+	fs.BoolVar(&cfg.tfRecordOmitImages, "tfrecord-omit-images", cfg.tfRecordOmitImages,
+		"Write path-only TFRecord examples without the encoded image data")
+	fs.BoolVar(&cfg.tfRecordTranscodeJPEG, "tfrecord-jpeg", cfg.tfRecordTranscodeJPEG,
+		"Transcode all embedded non-JPEG images to JPEG (with -jpeg-quality)")
+	tfRecordFeatures := fs.String("tfrecord-attribute-features", "",
+		"Comma-separated list of attribute=feature mappings to write attributes as additional"+
+				" TFRecord features, e.g. Text=image/object/text (features under image/object/ hold"+
+				" one value per annotation, others a file attribute; typed as per -attribute-schema)")
+	fs.StringVar(&cfg.pipelineConfigPath, "pipeline-config", cfg.pipelineConfigPath,
+		"The `path` to write a TensorFlow Object Detection API pipeline config to, for the base"+
+				" model -pipeline-model and with the paths, number of classes and input resolution"+
+				" filled in (-to tfrecord only; trains on the split named train or training, or the"+
+				" first one, and evaluates on the split named val or validation, or else on the"+
+				" others)")
+	fs.StringVar(&cfg.pipelineConfig.Model, "pipeline-model", "ssd-mobilenet-v2-fpnlite",
+		"The base `model` of -pipeline-config {"+strings.Join(pipelineModelNames(), ", ")+"}")
+	pipelineInputSize := fs.String("pipeline-input-size", "",
+		"The input resolution (`width`x`height`) of the model of -pipeline-config (empty for the"+
+				" default of the model)")
+	fs.IntVar(&cfg.pipelineConfig.BatchSize, "pipeline-batch-size", 0,
+		"The training batch `size` of -pipeline-config (zero for the default of the model, which"+
+				" is for TPUs)")
+	fs.StringVar(&cfg.pipelineConfig.FineTuneCheckpoint, "pipeline-checkpoint", "",
+		"The `path` to the checkpoint of the base model to fine-tune for -pipeline-config, e.g."+
+				" checkpoint/ckpt-0 of the model zoo archive (empty for a placeholder)")
+	fs.StringVar(&cfg.imageFetchDirPath, "fetch-images", cfg.imageFetchDirPath,
+		"Download images referenced by http(s) URL to the directory at `path` (created if it does"+
+				" not exist), reusing previous downloads")
+	fs.IntVar(&cfg.imageFetchConcurrency, "fetch-concurrency", 4,
+		"The max. number of concurrent image downloads (with -fetch-images)")
+	fs.BoolVar(&cfg.rekognition, "rekognition", cfg.rekognition,
+		"Annotate the images in -images with AWS Rekognition, writing the responses to -labels,"+
+				" before the conversion (aws-dl and aws-dt only; credentials from the environment)")
+	fs.StringVar(&cfg.rekognitionRegion, "rekognition-region", os.Getenv("AWS_REGION"),
+		"The AWS `region` for -rekognition")
+	fs.IntVar(&cfg.rekognitionMaxLabels, "rekognition-max-labels", 0,
+		"The max. number of labels per image for -rekognition (aws-dl only; zero for no limit)")
+	fs.IntVar(&cfg.rekognitionConcurrency, "rekognition-concurrency", 4,
+		"The number of concurrent requests for -rekognition")
+	fs.IntVar(&cfg.rekognitionRetries, "rekognition-retries", 3,
+		"The number of retries for throttled or failed requests for -rekognition")
+	fs.StringVar(&cfg.awsImageLabels, "aws-image-labels", cfg.awsImageLabels,
+		"Keep the image-level labels without instances of -from aws-dl, e.g. \"Outdoors\", as file"+
+				" `{attributes, annotations}` (with a zero bounding box); discarded if empty")
+	protocol := fs.String("inference-protocol", "json",
+		"The protocol of the inference endpoint {json, tfserving, triton} (class IDs are mapped to"+
+				" labels with -tfrecord-label-map-file)")
+	fs.Float64Var(&cfg.inferenceMinScore, "inference-min-score", cfg.inferenceMinScore,
+		"The min. score of the detections to keep for -from inference; range [0.0, 1.0]")
+	fs.IntVar(&cfg.inferenceConcurrency, "inference-concurrency", 0,
+		"The number of concurrent requests for -from inference (zero for -workers)")
+	fs.StringVar(&cfg.viaProjectName, "via-project-name", cfg.viaProjectName,
+		"The project `name` for -to via")
+	fs.StringVar(&cfg.viaRegionShape, "via-region-shape", "rect",
+		"The region shape of bounding boxes for -to via {rect, polygon}")
+	fs.StringVar(&cfg.viaSchemaPath, "via-schema", cfg.viaSchemaPath,
+		"The `path` to a JSON file with the region attribute types and options for -to via (label"+
+				" options are pre-populated from -tfrecord-label-map-file)")
+	fs.StringVar(&cfg.slothFileClass, "sloth-file-class", "image",
+		"The class of the files for -to sloth")
+	fs.StringVar(&cfg.slothAnnotationType, "sloth-annotation-type", "rect",
+		"The type of the annotations for -to sloth")
+	fs.BoolVar(&cfg.slothAttributes, "sloth-attributes", cfg.slothAttributes,
+		"Write the annotation attributes, e.g. confidence and detected text, for -to sloth")
+	fs.BoolVar(&cfg.sqlEmbedImages, "sql-embed-images", cfg.sqlEmbedImages,
+		"Store the image files in the images table for -to sql")
+	fs.StringVar(&cfg.captionSeparator, "caption-separator", " ",
+		"The `separator` of the lines of text in the captions of -to coco-captions")
+	fs.StringVar(&cfg.oneHotLabels, "onehot-labels", "all",
+		"The labels that the images are tagged with for -to onehot-csv `{all, boxes, image}`:"+
+				" the labels of the bounding boxes, the image-level labels, or both (the columns"+
+				" are the labels of -tfrecord-label-map-file, if given)")
+	fs.StringVar(&cfg.parquetAttributes, "parquet-attributes", cfg.parquetAttributes,
+		"The comma-separated annotation attributes (`name[,...]`) to write as additional columns"+
+				" for -to parquet, e.g. DetectedText")
+	fs.StringVar(&cfg.gcsPrefix, "gcs-prefix", cfg.gcsPrefix,
+		"The Cloud Storage location (`gs://bucket/dir/`) of the images for -to vertex-ai and"+
+				" automl-csv; the image file names are appended to it")
+	fs.Float64Var(&cfg.kittiScoreScale, "kitti-score-scale", 1,
+		"The KITTI score that corresponds to a confidence of 1.0, e.g. 100 for percentages; scores"+
+				" are divided by it for -from kitti and confidences multiplied by it for -to kitti")
+	fs.StringVar(&cfg.heatmapDirPath, "heatmap-dir", cfg.heatmapDirPath,
+		"The `path` to a directory to write PNG heatmaps of the bounding box positions to, per"+
+				" label and for all labels (created if it does not exist)")
+	fs.IntVar(&cfg.heatmapSize, "heatmap-size", 64,
+		"The width and height of the heatmaps in pixels")
+	fs.BoolVar(&cfg.heatmapCoverage, "heatmap-coverage", cfg.heatmapCoverage,
+		"Accumulate the area covered by the bounding boxes instead of their centres")
+	fs.BoolVar(&cfg.pixelStats, "pixel-stats", cfg.pixelStats,
+		"Compute the per-channel pixel mean and standard deviation of the (processed) images")
+	fs.StringVar(&cfg.cooccurrenceFilePath, "cooccurrence-csv", cfg.cooccurrenceFilePath,
+		"The `path` to a CSV file to write the label co-occurrence matrix to, i.e. the number of"+
+				" files that contain each pair of labels")
+	fs.StringVar(&cfg.labelUsageFilePath, "label-usage-csv", cfg.labelUsageFilePath,
+		"The `path` to a CSV file to write the number of output images and annotations of each"+
+				" label to, e.g. label_map_usage.csv, including the labels of"+
+				" -tfrecord-label-map-file without annotations, which are also logged")
+	fs.StringVar(&cfg.thresholdsFilePath, "thresholds-csv", cfg.thresholdsFilePath,
+		"The `path` to a CSV file to write the precision and recall of the input labels, as"+
+				" predictions, against -thresholds-truth by confidence threshold and label, with"+
+				" a suggested operating point per label (evaluated before image processing)")
+	fs.StringVar(&cfg.thresholdsTruthPath, "thresholds-truth", cfg.thresholdsTruthPath,
+		"The `path` to the ground truth labels for -thresholds-csv, in the format of"+
+				" -thresholds-truth-from")
+	thresholdsTruthFromName := fs.String("thresholds-truth-from", "",
+		"The `format` of -thresholds-truth (defaults to -from)")
+	fs.Float64Var(&cfg.thresholdSweepOpts.IoU, "thresholds-iou", 0.5,
+		"The min. IoU of a prediction with a ground truth box to match it for -thresholds-csv")
+	fs.IntVar(&cfg.thresholdSweepOpts.Steps, "thresholds-steps", 20,
+		"The `number` of evenly spaced confidence thresholds in [0, 1) for -thresholds-csv")
+	fs.Float64Var(&cfg.thresholdSweepOpts.MinPrecision, "thresholds-min-precision",
+		cfg.thresholdSweepOpts.MinPrecision,
+		"The min. `precision` of the suggested operating points, which maximise the recall at"+
+				" it (zero, or if it is not reached, to maximise the F1 score instead)")
+	fs.StringVar(&cfg.samplingWeightsFilePath, "sampling-weights-csv", cfg.samplingWeightsFilePath,
+		"The `path` to a CSV file to write per-image sampling weights to, computed from the"+
+				" frequencies of the labels of the (processed) images as per -sampling-weights")
+	samplingWeights := fs.String("sampling-weights", "inverse",
+		"The sampling weight of an image {inverse, repeat-factor}: the max. inverse frequency of"+
+				" its labels normalised to a mean of 1, or the LVIS repeat factor"+
+				" max(1, sqrt(t/frequency)) with t = -repeat-factor-threshold")
+	fs.Float64Var(&cfg.repeatFactorThreshold, "repeat-factor-threshold", 0.001,
+		"The label frequency `threshold` t below which images are repeated for -sampling-weights"+
+				" repeat-factor")
+	fs.BoolVar(&cfg.sourceStats, "source-stats", cfg.sourceStats,
+		"Log the number of files and annotations per input source and label (after filters), see"+
+				" -labels")
+	fs.IntVar(&cfg.numAnchors, "anchors", 9,
+		"The number of anchor boxes to cluster the bounding boxes into for -to anchors")
+	anchorInputSize := fs.String("anchors-input-size", "",
+		"The network input resolution (`width`x`height`) to scale the bounding boxes to for"+
+				" -to anchors (empty for the original image resolution)")
+	fs.IntVar(&cfg.numWorkers, "workers", 0,
+		"The number of files to parse, process and encode concurrently (zero for twice the number"+
+				" of CPUs)")
+	fs.IntVar(&cfg.maxImageMemoryMB, "max-mem-mb", 0,
+		"The approximate max. memory in MiB of the images decoded concurrently, e.g. for image"+
+				" processing (zero for no limit)")
+	fs.StringVar(&cfg.imageDimCacheFilePath, "image-dim-cache", cfg.imageDimCacheFilePath,
+		"The `path` to a file for caching image dimensions across runs (created if it does not exist)")
+	fs.StringVar(&cfg.imageDimManifestPath, "image-dims", cfg.imageDimManifestPath,
+		"The `path` to a CSV (path,width,height) or JSON manifest of image dimensions, which are"+
+				" then not read from the images, e.g. to convert coordinates without the images (relative"+
+				" paths are relative to -images)")
+	fs.StringVar(&cfg.datasetCardPath, "dataset-card", cfg.datasetCardPath,
+		"The `path` to a Markdown file to write a dataset card to, which summarises the output"+
+				" datasets (files, classes, image sizes), the filters and transformations applied,"+
+				" and renders example images with their bounding boxes to <name>_examples next to it")
+	fs.IntVar(&cfg.datasetCardExamples, "dataset-card-examples", 4,
+		"The `number` of example images to render for -dataset-card")
+
+	// The flags defined up to here configure the formats, inputs, outputs and statistics, the ones
+	// defined from here on mostly the filters and transformations.
+	ioFlags := make(map[string]bool)
+	fs.VisitAll(func(f *flag.Flag) {
+		ioFlags[f.Name] = true
+	})
 
 	// Conversion and transformation arguments.
-	flag.StringVar(&labelMappings, "map-labels", labelMappings,
+	fs.StringVar(&cfg.attributeSchemaPath, "attribute-schema", cfg.attributeSchemaPath,
+		"The `path` to a JSON file that maps attribute names to types {float, int, string,"+
+				" string-list, bool}, to which the input attribute values are coerced, and which -to via"+
+				" describes (in addition to the types of the attributes defined by lblconv)")
+	fs.StringVar(&cfg.midsToNamesPath, "mids-to-names", cfg.midsToNamesPath,
+		"The `path` to an Open Images class descriptions CSV file (mid,display_name) to translate"+
+				" the MIDs of the input labels, e.g. /m/01yrx, to display names, e.g. Cat, before"+
+				" the other transformations")
+	fs.StringVar(&cfg.namesToMIDsPath, "names-to-mids", cfg.namesToMIDsPath,
+		"The `path` to an Open Images class descriptions CSV file (mid,display_name) to translate"+
+				" the display names of the output labels back to MIDs")
+	fs.StringVar(&cfg.labelMappings, "map-labels", cfg.labelMappings,
 		"Comma-separated list of old=new label (sub-)string replacements")
-	flag.Float64Var(&bboxScaleWidth, "bbox-scale-x", 1,
+	fs.Float64Var(&cfg.bboxScaleWidth, "bbox-scale-x", 1,
 		"A scale factor for the width of all bounding boxes")
-	flag.Float64Var(&bboxScaleHeight, "bbox-scale-y", 1,
+	fs.Float64Var(&cfg.bboxScaleHeight, "bbox-scale-y", 1,
 		"A scale factor for the height of all bounding boxes")
-	flag.Float64Var(&bboxAspectRatio, "bbox-aspect-ratio", 0,
+	fs.Float64Var(&cfg.bboxAspectRatio, "bbox-aspect-ratio", 0,
 		"The output aspect `ratio` for object bounding boxes; bounding boxes are grown (not shrunk)"+
 				" to match this ratio when it is > 0")
+	fs.BoolVar(&cfg.sanitizeBboxes, "sanitize-bboxes", cfg.sanitizeBboxes,
+		"Swap inverted bounding box coordinates, clamp bounding boxes to the image bounds and drop"+
+				" those with a zero area, logging the number of repairs per label")
+	flagRulesSpec := fs.String("flag-rules", "",
+		"Semicolon-separated rules (`flag:condition[,...][;...]`) that set the flag {difficult,"+
+				" ignore} of the annotations matching all conditions {label=l1|l2|..., width<n,"+
+				" height<n, area<n, confidence<n, truncated}, e.g. difficult:height<16;ignore:"+
+				"label=crowd; ignored objects are written as tfrecord is_crowd and kitti DontCare")
+	classCapsSpec := fs.String("max-per-class", "",
+		"Comma-separated caps (`label=n[,...]`) on the number of annotations per label, e.g."+
+				" Person=5000; the annotations of over-represented labels are randomly subsampled"+
+				" after filtering (this reads the whole dataset into memory)")
+	fs.Int64Var(&cfg.classCaps.Seed, "max-per-class-seed", cfg.classCaps.Seed,
+		"The seed for the random subsampling of -max-per-class")
+	fs.BoolVar(&cfg.classCaps.DropFiles, "max-per-class-drop-images", cfg.classCaps.DropFiles,
+		"Subsample -max-per-class by dropping whole images instead of annotations, so that no"+
+				" objects are left unlabelled (images with other labels may be dropped as well)")
 
 	// Filter arguments.
-	flag.StringVar(&filterLabels, "filter-labels", filterLabels,
+	fs.StringVar(&cfg.filterLabels, "filter-labels", cfg.filterLabels,
 		"Comma-separated list of labels to keep (after map-labels; empty string keeps all)")
-	flag.StringVar(&filterAttributes, "filter-attributes", filterAttributes,
+	fs.StringVar(&cfg.filterSources, "filter-sources", cfg.filterSources,
+		"Comma-separated list of input sources to keep annotations from, i.e. the Source attribute"+
+				" set for multiple or named -labels inputs (empty string keeps all)")
+	fs.StringVar(&cfg.filterAttributes, "filter-attributes", cfg.filterAttributes,
 		"Comma-separated list of attributes to keep (if the target format supports attributes;"+
 				" empty string keeps all)")
-	flag.StringVar(&filterRequiredAttrs, "filter-required-attrs", filterRequiredAttrs,
+	fs.StringVar(&cfg.filterRequiredAttrs, "filter-required-attrs", cfg.filterRequiredAttrs,
 		"Comma-separated list of required attributes whose values must not be the Go zero value for"+
 				" their type to keep the annotation")
-	flag.Float64Var(&filterConfidence, "min-confidence", filterConfidence,
+	fs.Float64Var(&cfg.filterConfidence, "min-confidence", cfg.filterConfidence,
 		"The minimum confidence value to keep a label; range [0.0, 1.0)")
-	flag.BoolVar(&filterRequireLabel, "require-label", filterRequireLabel,
+	fs.Float64Var(&cfg.filterLabelConf, "min-label-confidence", cfg.filterLabelConf,
+		"The minimum label confidence (-from aws-dl) to keep a label, as opposed to the object"+
+				" instance confidence of -min-confidence; range [0.0, 1.0)")
+	fs.BoolVar(&cfg.filterRequireLabel, "require-label", cfg.filterRequireLabel,
 		"Require at least one label (after filters) to keep the file")
-	flag.Float64Var(&filterMinBboxWidth, "min-bbox-width", filterMinBboxWidth,
+	fs.IntVar(&cfg.filterMinTextLength, "min-text-length", cfg.filterMinTextLength,
+		"The min. number of characters of the detected text to keep a label (e.g. -from aws-dt)")
+	fs.StringVar(&cfg.filterTextRegexp, "text-regexp", cfg.filterTextRegexp,
+		"A regular `expression` that the detected text must match to keep a label, e.g."+
+				" ^[A-Z0-9]{5,8}$ (unanchored unless ^ and $ are used)")
+	fs.StringVar(&cfg.filterTextCharset, "text-charset", cfg.filterTextCharset,
+		"The `characters` that the detected text may consist of to keep a label (empty allows"+
+				" all)")
+	fs.BoolVar(&cfg.filterNumericText, "numeric-text", cfg.filterNumericText,
+		"Only keep labels with detected text that consists of digits")
+	fs.StringVar(&cfg.filterImageLabels, "filter-image-labels", cfg.filterImageLabels,
+		"Comma-separated list of image-level labels that files must have to be kept, see"+
+				" -aws-image-labels attributes")
+	fs.Float64Var(&cfg.filterMinBboxWidth, "min-bbox-width", cfg.filterMinBboxWidth,
 		"The min. required width in `pixels` for object bounding boxes (before resizing)")
-	flag.Float64Var(&filterMinBboxHeight, "min-bbox-height", filterMinBboxHeight,
+	fs.Float64Var(&cfg.filterMinBboxHeight, "min-bbox-height", cfg.filterMinBboxHeight,
 		"The min. required height in `pixels` for object bounding boxes (before resizing)")
-	flag.Float64Var(&filterMinAspectRatio, "min-bbox-aspect-ratio", filterMinAspectRatio,
+	fs.Float64Var(&cfg.filterMinAspectRatio, "min-bbox-aspect-ratio", cfg.filterMinAspectRatio,
 		"The min. required aspect `ratio` (width/height) for object bounding boxes (before resizing;"+
 				" zero disables the filter)")
-	flag.Float64Var(&filterMaxAspectRatio, "max-bbox-aspect-ratio", filterMaxAspectRatio,
+	fs.Float64Var(&cfg.filterMaxAspectRatio, "max-bbox-aspect-ratio", cfg.filterMaxAspectRatio,
 		"The max. required aspect `ratio` (width/height) for object bounding boxes (before resizing;"+
 				" zero disables the filter)")
 
 	// Image processing arguments.
-	flag.StringVar(&imageOutEncoding, "image-enc", "jpg",
+	fs.StringVar(&cfg.imageOutEncoding, "image-enc", "jpg",
 		"The `encoding` for output images {jpg, png}")
-	flag.IntVar(&imageResizeLonger, "resize-longer", imageResizeLonger,
+	fs.IntVar(&cfg.imageResizeLonger, "resize-longer", cfg.imageResizeLonger,
 		"The target `length` for the longer side of the image (zero to keep aspect ratio)")
-	flag.IntVar(&imageResizeShorter, "resize-shorter", imageResizeShorter,
+	fs.IntVar(&cfg.imageResizeShorter, "resize-shorter", cfg.imageResizeShorter,
 		"The target `length` for the shorter side of the image (zero to keep aspect ratio)")
-	flag.StringVar(&imageDownsamplingFilter, "downsample-filter", "box",
+	fs.StringVar(&cfg.imageDownsamplingFilter, "downsample-filter", "box",
 		"The filter to use when downsampling an image {nearest, box, linear, gaussian, lanczos}")
-	flag.StringVar(&imageUpsamplingFilter, "upsample-filter", "linear",
+	fs.StringVar(&cfg.imageUpsamplingFilter, "upsample-filter", "linear",
 		"The filter to use when upsampling an image {nearest, box, linear, gaussian, lanczos}")
-	flag.IntVar(&imageJPEGQuality, "jpeg-quality", 90,
+	fs.IntVar(&cfg.imageJPEGQuality, "jpeg-quality", 90,
 		"The quality to use when encoding JPEGs [1, 100]")
-	flag.BoolVar(&imageCropObjects, "crop-objects", imageCropObjects,
+	imageColorMode := fs.String("image-color", "keep",
+		"The colour model of the output images {keep, gray, rgb}, e.g. to convert infrared or"+
+				" document images to a single channel or grayscale images to 3-channel RGB")
+	fs.BoolVar(&cfg.imageToSRGB, "srgb", cfg.imageToSRGB,
+		"Convert images with an embedded ICC profile, e.g. Adobe RGB or Display P3, to sRGB instead"+
+				" of re-encoding their pixel values unchanged")
+	keepExif := fs.String("keep-exif", "",
+		"The comma-separated EXIF `tags` to copy to re-encoded output images {timestamp, gps};"+
+				" all EXIF, XMP and other metadata is stripped otherwise")
+	fs.BoolVar(&cfg.imageCropObjects, "crop-objects", cfg.imageCropObjects,
 		"Crop and output objects from images (image processing flags apply to the individual crops)")
+	fs.IntVar(&cfg.imageCopyPaste.Count, "copy-paste", cfg.imageCopyPaste.Count,
+		"The `number` of objects cropped from other images to paste onto each output image"+
+				" (copy-paste augmentation, after resizing; this reads the whole dataset into"+
+				" memory)")
+	copyPasteLabels := fs.String("copy-paste-labels", "",
+		"The comma-separated `labels` of the objects to paste for -copy-paste, e.g. rare classes"+
+				" (empty for all)")
+	fs.Float64Var(&cfg.imageCopyPaste.MaxOverlap, "copy-paste-max-overlap", 0.1,
+		"The max. `fraction` of a pasted object that may overlap an existing bounding box, and"+
+				" vice versa")
+	fs.IntVar(&cfg.imageCopyPaste.MaxObjects, "copy-paste-max-objects", 1000,
+		"The max. `number` of object crops to keep in memory for -copy-paste")
+	fs.Int64Var(&cfg.imageCopyPaste.Seed, "copy-paste-seed", cfg.imageCopyPaste.Seed,
+		"The seed for the objects and positions of -copy-paste, which is combined with the image"+
+				" path")
+	fs.IntVar(&cfg.imageCutout.Count, "cutout", cfg.imageCutout.Count,
+		"The `number` of random grey rectangles to occlude each output image with (cutout"+
+				" augmentation, after resizing; the labels are unchanged)")
+	fs.Float64Var(&cfg.imageCutout.MinSize, "cutout-min-size", 0.1,
+		"The min. side length of the -cutout rectangles, as a `fraction` of the shorter side of"+
+				" the image (or of the bounding box for -cutout-mode target)")
+	fs.Float64Var(&cfg.imageCutout.MaxSize, "cutout-max-size", 0.3,
+		"The max. side length of the -cutout rectangles, as a `fraction` of the shorter side of"+
+				" the image (or of the bounding box for -cutout-mode target)")
+	cutoutMode := fs.String("cutout-mode", "anywhere",
+		"Where to place the -cutout rectangles {anywhere, avoid, target}: anywhere in the image,"+
+				" outside of the bounding boxes, or centred in random bounding boxes")
+	fs.Int64Var(&cfg.imageCutout.Seed, "cutout-seed", cfg.imageCutout.Seed,
+		"The seed for the -cutout rectangles, which is combined with the image path")
+	fs.BoolVar(&cfg.strictImages, "strict-images", cfg.strictImages,
+		"Fail on images that cannot be read or decoded during image processing, e.g. unsupported"+
+				" JPEG variants, instead of logging and skipping them (incomplete JPEGs are"+
+				" recovered)")
+	fs.Float64Var(&cfg.imageMaxMegapixels, "max-megapixels", 0,
+		"The max. size of the input images for image processing in `megapixels`, e.g. to guard"+
+				" against decompression bombs; larger images are skipped like images that cannot"+
+				" be decoded, without decoding them (zero for no limit)")
+	fs.DurationVar(&cfg.imageTimeout, "image-timeout", 0,
+		"The max. `duration` to decode and process a single image, e.g. 30s; images that take"+
+				" longer are skipped like images that cannot be decoded, so that a pathological"+
+				" image cannot stall a worker (zero for no limit)")
+	fs.Float64Var(&cfg.auditImages, "audit-images", cfg.auditImages,
+		"The `fraction` of the (processed) images to re-open and check against their annotations,"+
+				" i.e. that their dimensions match the image size and the annotation extents and"+
+				" that they have no EXIF orientation, e.g. 0.01 (zero for none)")
+	fs.BoolVar(&cfg.strictAudit, "strict-audit", cfg.strictAudit,
+		"Fail on the first inconsistent image of -audit-images instead of reporting them all")
+	fs.StringVar(&cfg.quarantineDirPath, "quarantine", cfg.quarantineDirPath,
+		"Verify that the images can be decoded and quarantine the files that cannot be to this"+
+				" `directory` with a "+lblconv.QuarantineReasonsFile+" file listing the reasons,"+
+				" instead of logging and skipping them")
+	quarantine := fs.String("quarantine-mode", "list",
+		"What to do with quarantined images {list, move}; move moves them out of the input dataset"+
+				" into -quarantine")
+	fs.StringVar(&cfg.packagePath, "package", cfg.packagePath,
+		"After the conversion, bundle the labels, -images-out, the label map, statistics and a"+
+				" summary of the run into a `path` with a manifest of checksums (a tar.gz archive"+
+				" if path ends in .tar.gz or .tgz, a new directory otherwise)")
+	fs.StringVar(&cfg.packageVersion, "package-version", "1",
+		"The `version` of the packaged dataset")
+	imageExt := fs.String("image-ext", "keep",
+		"How to handle images whose file extension does not match the format detected from their"+
+				" data {keep, warn, fix}; fix copies them to -images-out with the correct extension"+
+				" (processed images always have the extension of -image-enc)")
 
 	// Parse and validate flags.
-	flag.Parse()
-
-	convertFrom = formatFrom(*from)
-	convertTo = formatFrom(*to)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if !ioFlags[f.Name] && !nonProcessingFlags[f.Name] {
+			cfg.processingArgs = append(cfg.processingArgs, "-"+f.Name+"="+f.Value.String())
+		}
+	})
 
 	// Validate the conversion direction.
-	validInFormat := false
-	for _, f := range []format{AWSDetectLabels, AWSDetectText, Kitti, Sloth, VIA} {
-		if f == convertFrom {
-			validInFormat = true
-			break
-		}
+	var ok bool
+	if cfg.convertFrom, ok = lblconv.LookupFormat(*from); !ok || cfg.convertFrom.Reader == nil {
+		cfg.convertFrom = lblconv.Format{}
+		problem(fmt.Sprintf("Unsupported input format %q, -from must be one of: ", *from),
+			strings.Join(formatNames(true), ", "))
 	}
-	validOutFormat := false
-	for _, f := range []format{Kitti, Sloth, TFRecord, VIA} {
-		if f == convertTo {
-			validOutFormat = true
-			break
+	if cfg.convertTo, ok = lblconv.LookupFormat(*to); !ok || cfg.convertTo.Writer == nil {
+		cfg.convertTo = lblconv.Format{}
+		problem(fmt.Sprintf("Unsupported output format %q, -to must be one of: ", *to),
+			strings.Join(formatNames(false), ", "))
+	}
+	cfg.thresholdsTruthFrom = cfg.convertFrom
+	if *thresholdsTruthFromName != "" {
+		if cfg.thresholdsTruthFrom, ok = lblconv.LookupFormat(*thresholdsTruthFromName);
+				!ok || cfg.thresholdsTruthFrom.Reader == nil {
+			problem(fmt.Sprintf("Unsupported -thresholds-truth-from format %q, must be one of: ",
+				*thresholdsTruthFromName), strings.Join(formatNames(true), ", "))
 		}
 	}
-	if !validInFormat {
-		printUsageAndExit("Unsupported input format")
-	} else if !validOutFormat {
-		printUsageAndExit("Unsupported output format")
+	if (cfg.thresholdsFilePath == "") != (cfg.thresholdsTruthPath == "") {
+		problem("-thresholds-csv and -thresholds-truth must be set together")
+	}
+	if cfg.appendOutput && cfg.convertTo.Name != "sloth" && cfg.convertTo.Name != "via" {
+		problem("-append requires -to sloth or via")
 	}
 
 	// Validate input arguments.
-	if labelFileOrDirPath == "" ||
-			(convertFrom == Kitti && imageDirPath == "") ||
-			(convertFrom == AWSDetectLabels && imageDirPath == "") ||
-			(convertFrom == AWSDetectText && imageDirPath == "") {
-		printUsageAndExit("Missing label or image input path argument")
+	var inputs []string
+	if *inPaths != "" {
+		inputs = strings.Split(*inPaths, ",")
+	} else {
+		problem("Missing label input path argument -labels")
 	}
-
-	// Validate output split arguments.
-	labelOutFileOrDirPaths = strings.Split(*outPaths, ",")
-	splits := strings.Split(*outSplits, ",")
-	if len(splits) != len(labelOutFileOrDirPaths) {
-		printUsageAndExit("The number of output datasets defined by -split and the number of" +
-				" paths in -labels-out must match")
+	inputNames := make(map[string]bool)
+	namedInputs := false
+	for _, v := range inputs {
+		// A name must not contain path separators, which distinguishes it from a path with "=".
+		path, name := v, ""
+		if sep := strings.Index(v, "="); sep > 0 && !strings.ContainsAny(v[:sep], `/\`) {
+			path, name = v[sep+1:], v[:sep]
+			namedInputs = true
+		}
+		if path == "" {
+			problem("Invalid value in -labels: ", v)
+		}
+		if name == "" {
+			name = filepath.Base(path)
+		}
+		if inputNames[name] {
+			problem("Duplicate input name in -labels: ", name)
+		}
+		inputNames[name] = true
+		cfg.labelFileOrDirPaths = append(cfg.labelFileOrDirPaths, path)
+		cfg.labelInputNames = append(cfg.labelInputNames, name)
+	}
+	if len(cfg.labelFileOrDirPaths) == 1 && !namedInputs {
+		// A single input is only tagged if it is named.
+		cfg.labelInputNames = nil
+	}
+	if len(cfg.labelFileOrDirPaths) > 1 && cfg.rekognition {
+		problem("-rekognition requires a single -labels path")
+	}
+	if cfg.rekognition && (cfg.convertFrom.Name != "aws-dl" && cfg.convertFrom.Name != "aws-dt" ||
+			cfg.imageDirPath == "") {
+		problem("-rekognition requires -from aws-dl or aws-dt and -images")
+	}
+	if cfg.awsImageLabels != "" && cfg.convertFrom.Name != "aws-dl" {
+		problem("-aws-image-labels requires -from aws-dl")
+	}
+	switch cfg.oneHotLabels {
+	case "all", "boxes", "image":
+	default:
+		problem("Invalid value for -onehot-labels: ", cfg.oneHotLabels)
+	}
+	if (cfg.imageMatch != lblconv.ImageMatchOptions{}) && cfg.convertFrom.Name != "kitti" &&
+			cfg.convertFrom.Name != "aws-dl" && cfg.convertFrom.Name != "aws-dt" {
+		problem("-match-*, -image-manifest and -missing-image-ext require -from kitti," +
+				" aws-dl or aws-dt")
 	}
-	if convertTo == Kitti && len(splits) > 1 {
-		printUsageAndExit("Argument -split is not supported with output format \"kitti\"")
+	if ext := cfg.imageMatch.MissingImageExt; ext != "" && !strings.HasPrefix(ext, ".") {
+		cfg.imageMatch.MissingImageExt = "." + ext
+	}
+	if cfg.categoriesFilePath != "" && cfg.tfRecordLabelMapFilePath == "" {
+		problem("-pin-category-ids requires -tfrecord-label-map-file")
 	}
 
-	// Parse splits as cumulative int percentages.
+	// Parse splits as cumulative int percentages, with optional names.
+	splits := strings.Split(*outSplits, ",")
 	var splitSum int
+	named := strings.Contains(splits[0], "=")
+	splitNames := make(map[string]bool)
 	for _, v := range splits {
+		if strings.Contains(v, "=") != named {
+			problem("Either all or none of the values in -split must be named")
+			continue
+		}
+		if named {
+			sep := strings.Index(v, "=")
+			name := v[:sep]
+			v = v[sep+1:]
+			if name == "" || strings.ContainsAny(name, `/\`) || splitNames[name] {
+				problem("Invalid or duplicate split name in -split: ", name)
+			}
+			splitNames[name] = true
+			cfg.labelOutSplitNames = append(cfg.labelOutSplitNames, name)
+		}
 		if i, err := strconv.Atoi(v); err != nil || i < 0 || i > 100 {
-			printUsageAndExit("Invalid value in -split: ", v)
+			problem("Invalid value in -split: ", v)
 		} else {
 			splitSum += i
-			labelOutSplits = append(labelOutSplits, splitSum)
+			cfg.labelOutSplits = append(cfg.labelOutSplits, splitSum)
 		}
 	}
 	if splitSum != 100 {
-		printUsageAndExit("The values in -split must add up to 100%")
+		problem("The values in -split must add up to 100%")
 	}
 
-	// Validate other output arguments.
-	if convertTo == TFRecord && tfRecordLabelMapFilePath == "" {
-		printUsageAndExit("Missing label output path argument")
+	// Validate the output paths, expanding a {split} template.
+	cfg.labelOutFileOrDirPaths = strings.Split(*outPaths, ",")
+	if len(cfg.labelOutFileOrDirPaths) == 1 && strings.Contains(*outPaths, splitPlaceholder) {
+		if !named {
+			problem("The {split} placeholder in -labels-out requires named splits")
+		}
+		cfg.labelOutFileOrDirPaths = expandSplitTemplate(*outPaths, cfg.labelOutSplitNames)
+		for _, path := range cfg.labelOutFileOrDirPaths {
+			// A trailing separator denotes a directory output path.
+			if strings.HasSuffix(path, "/") || strings.HasSuffix(path, string(filepath.Separator)) {
+				cfg.splitOutDirPaths = append(cfg.splitOutDirPaths, path)
+			} else {
+				cfg.splitOutDirPaths = append(cfg.splitOutDirPaths, filepath.Dir(path))
+			}
+		}
+	}
+	if len(splits) != len(cfg.labelOutFileOrDirPaths) {
+		problem("The number of output datasets defined by -split and the number of" +
+				" paths in -labels-out must match")
+	}
+	if strings.Contains(cfg.imageOutDirPath, splitPlaceholder) {
+		if !named {
+			problem("The {split} placeholder in -images-out requires named splits")
+		}
+		cfg.imageOutDirPaths = expandSplitTemplate(cfg.imageOutDirPath, cfg.labelOutSplitNames)
+		cfg.splitOutDirPaths = append(cfg.splitOutDirPaths, cfg.imageOutDirPaths...)
+	}
+
+	// TFRecord arguments.
+	switch cfg.splitCoverage {
+	case "all", "train", "none":
+	default:
+		problem("Invalid value for -split-coverage: ", cfg.splitCoverage)
+	}
+	switch *shardAssignment {
+	case "round-robin":
+		cfg.tfRecordShardAssignment = lblconv.TFRecordRoundRobin
+	case "class-balanced":
+		cfg.tfRecordShardAssignment = lblconv.TFRecordClassBalanced
+	default:
+		problem("Invalid value for -tfrecord-shard-assignment: ", *shardAssignment)
+	}
+	switch *compression {
+	case "none":
+		cfg.tfRecordCompression = lblconv.TFRecordNoCompression
+	case "gzip":
+		cfg.tfRecordCompression = lblconv.TFRecordGZIP
+	case "zlib":
+		cfg.tfRecordCompression = lblconv.TFRecordZLIB
+	default:
+		problem("Invalid value for -tfrecord-compression: ", *compression)
+	}
+	switch *rounding {
+	case "none":
+		cfg.coordRounding.Mode = lblconv.RoundNone
+	case "nearest":
+		cfg.coordRounding.Mode = lblconv.RoundNearest
+	case "floor":
+		cfg.coordRounding.Mode = lblconv.RoundFloor
+	case "ceil":
+		cfg.coordRounding.Mode = lblconv.RoundCeil
+	default:
+		problem("Invalid value for -round-coords: ", *rounding)
+	}
+	if cfg.coordRounding.Decimals < 0 {
+		problem("Invalid -coord-decimals, must be >= 0: ", cfg.coordRounding.Decimals)
+	}
+	switch *protocol {
+	case "json":
+		cfg.inferenceProtocol = lblconv.InferenceJSON
+	case "tfserving":
+		cfg.inferenceProtocol = lblconv.InferenceTFServing
+	case "triton":
+		cfg.inferenceProtocol = lblconv.InferenceTriton
+	default:
+		problem("Invalid value for -inference-protocol: ", *protocol)
+	}
+	if cfg.kittiScoreScale <= 0 {
+		problem("Invalid -kitti-score-scale, must be > 0: ", cfg.kittiScoreScale)
+	}
+	if cfg.numWorkers < 0 {
+		problem("Invalid -workers, must be >= 0: ", cfg.numWorkers)
+	}
+	if cfg.maxImageMemoryMB < 0 {
+		problem("Invalid -max-mem-mb, must be >= 0: ", cfg.maxImageMemoryMB)
+	}
+	if cfg.heatmapSize < 1 {
+		problem("Invalid -heatmap-size, must be > 0: ", cfg.heatmapSize)
+	}
+	if cfg.numAnchors < 1 {
+		problem("Invalid -anchors, must be > 0: ", cfg.numAnchors)
+	}
+	if *anchorInputSize != "" {
+		_, err := fmt.Sscanf(*anchorInputSize, "%dx%d", &cfg.anchorInputW, &cfg.anchorInputH)
+		if err != nil || cfg.anchorInputW <= 0 || cfg.anchorInputH <= 0 {
+			problem("Invalid value for -anchors-input-size: ", *anchorInputSize)
+		}
+	}
+	if cfg.pipelineConfigPath != "" {
+		if cfg.convertTo.Name != "tfrecord" {
+			problem("-pipeline-config requires -to tfrecord")
+		}
+		switch strings.ToLower(filepath.Ext(cfg.tfRecordLabelMapFilePath)) {
+		case ".json", ".csv", ".names":
+			problem("-pipeline-config requires a prototxt -tfrecord-label-map-file")
+		}
+		if cfg.labelMapFirstID != 1 || cfg.labelMapBackground != "" {
+			problem("-pipeline-config requires label map IDs starting at 1 without a background" +
+					" entry")
+		}
+		known := false
+		for _, name := range pipelineModelNames() {
+			known = known || name == cfg.pipelineConfig.Model
+		}
+		if !known {
+			problem("Invalid value for -pipeline-model: ", cfg.pipelineConfig.Model)
+		}
+		if *pipelineInputSize != "" {
+			_, err := fmt.Sscanf(*pipelineInputSize, "%dx%d", &cfg.pipelineConfig.InputWidth,
+				&cfg.pipelineConfig.InputHeight)
+			if err != nil || cfg.pipelineConfig.InputWidth <= 0 ||
+					cfg.pipelineConfig.InputHeight <= 0 {
+				problem("Invalid value for -pipeline-input-size: ", *pipelineInputSize)
+			}
+		}
+		if cfg.pipelineConfig.BatchSize < 0 {
+			problem("Invalid value for -pipeline-batch-size: ", cfg.pipelineConfig.BatchSize)
+		}
+	}
+	if cfg.viaRegionShape != "rect" && cfg.viaRegionShape != "polygon" {
+		problem("Invalid value for -via-region-shape: ", cfg.viaRegionShape)
+	}
+
+	if cfg.labelMapFirstID != 0 && cfg.labelMapFirstID != 1 {
+		problem("Invalid -label-map-first-id, must be 0 or 1: ", cfg.labelMapFirstID)
+	}
+
+	if cfg.tfRecordMaxErrorRate < 0 || cfg.tfRecordMaxErrorRate > 1 {
+		problem("Invalid -tfrecord-max-error-rate, must be in [0.0, 1.0]: ",
+			cfg.tfRecordMaxErrorRate)
 	}
 
 	// Transformation arguments.
-	if bboxScaleWidth <= 0 || bboxScaleHeight <= 0 {
-		printUsageAndExit("Invalid bounding box scale factor")
-	} else if bboxAspectRatio < 0 {
-		printUsageAndExit("Invalid value for -bbox-aspect-ratio")
+	if *flagRulesSpec != "" {
+		var err error
+		if cfg.flagRules, err = lblconv.ParseFlagRules(*flagRulesSpec); err != nil {
+			problem("Invalid -flag-rules: ", err)
+		}
+	}
+	switch *samplingWeights {
+	case "inverse":
+		cfg.samplingWeightMethod = lblconv.InverseFrequency
+	case "repeat-factor":
+		cfg.samplingWeightMethod = lblconv.RepeatFactor
+	default:
+		problem("Invalid value for -sampling-weights: ", *samplingWeights)
+	}
+	if *classCapsSpec != "" {
+		var err error
+		if cfg.classCaps.Caps, err = lblconv.ParseClassCaps(*classCapsSpec); err != nil {
+			problem("Invalid -max-per-class: ", err)
+		}
+	}
+	if cfg.bboxScaleWidth <= 0 || cfg.bboxScaleHeight <= 0 {
+		problem("Invalid bounding box scale factor")
+	} else if cfg.bboxAspectRatio < 0 {
+		problem("Invalid value for -bbox-aspect-ratio")
 	}
 
 	// Image processing arguments.
-	if (imageResizeLonger > 0 || imageResizeShorter > 0 || imageCropObjects) &&
-			imageOutDirPath == "" {
-		printUsageAndExit("Missing image output directory path")
+	switch *imageColorMode {
+	case "keep":
+		cfg.imageColor = lblconv.ImageColorKeep
+	case "gray":
+		cfg.imageColor = lblconv.ImageColorGray
+	case "rgb":
+		cfg.imageColor = lblconv.ImageColorRGB
+	default:
+		problem("Invalid value for -image-color: ", *imageColorMode)
+	}
+	if *keepExif != "" {
+		var err error
+		if cfg.imageExifTags, err = lblconv.ParseExifTags(*keepExif); err != nil {
+			problem("Invalid -keep-exif: ", err)
+		}
+	}
+	if *tfRecordFeatures != "" {
+		var err error
+		cfg.tfRecordAttributeFeatures, err = lblconv.ParseTFRecordAttributeFeatures(
+			*tfRecordFeatures)
+		if err != nil {
+			problem("Invalid -tfrecord-attribute-features: ", err)
+		}
+	}
+	if (cfg.imageResizeLonger > 0 || cfg.imageResizeShorter > 0 || cfg.imageCropObjects ||
+			cfg.imageCopyPaste.Count > 0 || cfg.imageCutout.Count > 0 ||
+			cfg.imageColor != lblconv.ImageColorKeep || cfg.imageToSRGB) &&
+			cfg.imageOutDirPath == "" {
+		problem("Missing image output directory path")
+	}
+	if cfg.imageCopyPaste.Count < 0 {
+		problem("Invalid value for -copy-paste: ", cfg.imageCopyPaste.Count)
+	} else if cfg.imageCopyPaste.Count > 0 && cfg.imageCropObjects {
+		problem("-copy-paste and -crop-objects are mutually exclusive")
+	}
+	if *copyPasteLabels != "" {
+		cfg.imageCopyPaste.Labels = strings.Split(*copyPasteLabels, ",")
+	}
+	switch *cutoutMode {
+	case "anywhere":
+		cfg.imageCutout.Mode = lblconv.CutoutAnywhere
+	case "avoid":
+		cfg.imageCutout.Mode = lblconv.CutoutAvoidObjects
+	case "target":
+		cfg.imageCutout.Mode = lblconv.CutoutTargetObjects
+	default:
+		problem("Invalid value for -cutout-mode: ", *cutoutMode)
+	}
+	switch *imageExt {
+	case "keep":
+		cfg.imageExtMode = lblconv.ImageExtensionKeep
+	case "warn":
+		cfg.imageExtMode = lblconv.ImageExtensionWarn
+	case "fix":
+		cfg.imageExtMode = lblconv.ImageExtensionFix
+		if cfg.imageOutDirPath == "" {
+			problem("-image-ext fix requires -images-out")
+		}
+	default:
+		problem("Invalid value for -image-ext: ", *imageExt)
+	}
+	switch *quarantine {
+	case "list":
+		cfg.quarantineMode = lblconv.QuarantineList
+	case "move":
+		cfg.quarantineMode = lblconv.QuarantineMove
+	default:
+		problem("Invalid value for -quarantine-mode: ", *quarantine)
+	}
+	if cfg.datasetCardExamples < 0 {
+		problem("Invalid -dataset-card-examples, must be >= 0: ", cfg.datasetCardExamples)
+	}
+	if cfg.interpolateGap < 0 {
+		problem("Invalid value for -interpolate-tracks: ", cfg.interpolateGap)
+	}
+	if cfg.imageMaxMegapixels < 0 {
+		problem("Invalid value for -max-megapixels: ", cfg.imageMaxMegapixels)
+	}
+	if cfg.imageTimeout < 0 {
+		problem("Invalid value for -image-timeout: ", cfg.imageTimeout)
+	}
+	if cfg.auditImages < 0 || cfg.auditImages > 1 {
+		problem("Invalid value for -audit-images: ", cfg.auditImages)
 	}
-	if imageJPEGQuality < 1 || imageJPEGQuality > 100 {
-		imageJPEGQuality = 92
-		log.Print("Invalid JPEG quality, setting it to ", imageJPEGQuality)
+	if cfg.packagePath != "" && cfg.packageVersion == "" {
+		problem("Missing package version")
+	}
+	if cfg.quarantineDirPath != "" && cfg.strictImages {
+		problem("-quarantine and -strict-images are mutually exclusive")
+	}
+	if cfg.imageJPEGQuality < 1 || cfg.imageJPEGQuality > 100 {
+		problem("Invalid -jpeg-quality, must be in [1, 100]: ", cfg.imageJPEGQuality)
 	}
 
 	// Validate filter arguments.
-	if filterConfidence < 0 || filterConfidence >= 1 {
-		printUsageAndExit("Invalid -min-confidence, must be in [0.0, 1.0): ", filterConfidence)
+	if cfg.filterConfidence < 0 || cfg.filterConfidence >= 1 {
+		problem("Invalid -min-confidence, must be in [0.0, 1.0): ", cfg.filterConfidence)
+	}
+	if cfg.filterTextRegexp != "" {
+		var err error
+		if cfg.filterTextPattern, err = regexp.Compile(cfg.filterTextRegexp); err != nil {
+			problem("Invalid -text-regexp: ", err)
+		}
+	}
+	if cfg.filterLabelConf < 0 || cfg.filterLabelConf >= 1 {
+		problem("Invalid -min-label-confidence, must be in [0.0, 1.0): ",
+			cfg.filterLabelConf)
 	}
 
 	// Clean path arguments.
-	if imageDirPath != "" {
-		imageDirPath = filepath.Clean(imageDirPath)
+	if cfg.imageDirPath != "" {
+		cfg.imageDirPath = filepath.Clean(cfg.imageDirPath)
+	}
+	if cfg.imageOutDirPath != "" {
+		cfg.imageOutDirPath = filepath.Clean(cfg.imageOutDirPath)
+	}
+	for i, v := range cfg.imageOutDirPaths {
+		cfg.imageOutDirPaths[i] = filepath.Clean(v)
+		if cfg.imageDirPath != "" && cfg.imageDirPath == cfg.imageOutDirPaths[i] {
+			problem("The image input and output paths cannot be identical")
+		}
+	}
+	if cfg.imageDirPath != "" && cfg.imageDirPath == cfg.imageOutDirPath {
+		problem("The image input and output paths cannot be identical")
+	}
+
+	// The label input path is an endpoint URL for some formats.
+	for i, v := range cfg.labelFileOrDirPaths {
+		if !strings.Contains(v, "://") {
+			cfg.labelFileOrDirPaths[i] = filepath.Clean(v)
+		}
+	}
+	for i, v := range cfg.labelOutFileOrDirPaths {
+		cfg.labelOutFileOrDirPaths[i] = filepath.Clean(v)
+		for _, inPath := range cfg.labelFileOrDirPaths {
+			if inPath == cfg.labelOutFileOrDirPaths[i] {
+				problem("The label input and output paths cannot be identical")
+			}
+		}
+	}
+
+	if cfg.tfRecordLabelMapFilePath != "" {
+		cfg.tfRecordLabelMapFilePath = filepath.Clean(cfg.tfRecordLabelMapFilePath)
 	}
-	if imageOutDirPath != "" {
-		imageOutDirPath = filepath.Clean(imageOutDirPath)
+	if cfg.imageDimCacheFilePath != "" {
+		cfg.imageDimCacheFilePath = filepath.Clean(cfg.imageDimCacheFilePath)
 	}
-	if imageDirPath != "" && imageDirPath == imageOutDirPath {
-		printUsageAndExit("The image input and output paths cannot be identical")
+	if cfg.imageDimManifestPath != "" {
+		cfg.imageDimManifestPath = filepath.Clean(cfg.imageDimManifestPath)
 	}
+	if cfg.imageFetchDirPath != "" {
+		cfg.imageFetchDirPath = filepath.Clean(cfg.imageFetchDirPath)
+	}
+	if cfg.datasetCardPath != "" {
+		cfg.datasetCardPath = filepath.Clean(cfg.datasetCardPath)
+	}
+	if cfg.pipelineConfigPath != "" {
+		cfg.pipelineConfigPath = filepath.Clean(cfg.pipelineConfigPath)
+	}
+
+	if len(problems) > 0 {
+		return nil, &ConfigError{Problems: problems, From: cfg.convertFrom, To: cfg.convertTo}
+	}
+	return cfg, nil
+}
+
+// ConfigError reports all the problems with the command line arguments found by ParseConfig.
+type ConfigError struct {
+	Problems []string       // The descriptions of the problems, in the order of validation.
+	From, To lblconv.Format // The selected formats, which are zero if unsupported.
+}
 
-	labelFileOrDirPath = filepath.Clean(labelFileOrDirPath)
-	for i, v := range labelOutFileOrDirPaths {
-		labelOutFileOrDirPaths[i] = filepath.Clean(v)
-		if labelFileOrDirPath == labelOutFileOrDirPaths[i] {
-			printUsageAndExit("The label input and output paths cannot be identical")
+// Error lists the problems, followed by the arguments of the selected formats.
+func (e *ConfigError) Error() string {
+	var b strings.Builder
+	b.WriteString("Invalid arguments:")
+	for _, p := range e.Problems {
+		b.WriteString("\n  - " + p)
+	}
+	if e.From.Reader != nil {
+		_, _ = fmt.Fprintf(&b, "\nThe input format requires: -from %s %s", e.From.Name,
+			e.From.ReaderArgs)
+	}
+	if e.To.Writer != nil {
+		_, _ = fmt.Fprintf(&b, "\nThe output format requires: -to %s %s", e.To.Name,
+			e.To.WriterArgs)
+	}
+	b.WriteString("\nRun with -help for the arguments of all formats.")
+	return b.String()
+}
+
+// formatNames returns the names of the formats that can be read, if input is true, or written.
+func formatNames(input bool) []string {
+	var names []string
+	for _, f := range lblconv.Formats() {
+		if input && f.Reader != nil || !input && f.Writer != nil {
+			names = append(names, f.Name)
 		}
 	}
+	return names
+}
+
+// lblconvVersion returns the version of this program.
+func lblconvVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "unknown"
+}
+
+// splitPlaceholder is replaced by the split names in output path templates.
+const splitPlaceholder = "{split}"
+
+// expandSplitTemplate returns the paths for template with splitPlaceholder replaced by each name.
+func expandSplitTemplate(template string, names []string) []string {
+	paths := make([]string, len(names))
+	for i, name := range names {
+		paths[i] = strings.Replace(template, splitPlaceholder, name, -1)
+	}
+	return paths
+}
+
+// countingSink counts the files accepted by the wrapped Sink, i.e. neither skipped nor failed.
+type countingSink struct {
+	lblconv.Sink
+	n int
+}
+
+// Write implements lblconv.Sink.
+func (s *countingSink) Write(f lblconv.AnnotatedFile) error {
+	if err := s.Sink.Write(f); err != nil {
+		return err
+	}
+	s.n++
+	return nil
+}
+
+// written returns the number of files written. The TFRecord writer converts the files after
+// accepting them, so the files that it skips then are only excluded from its own count.
+func (s *countingSink) written() int {
+	if w, ok := unwrapSink(s.Sink).(*lblconv.TFRecordWriter); ok {
+		return w.Stats().Written
+	}
+	return s.n
+}
+
+// Abort implements lblconv.Aborter.
+func (s *countingSink) Abort() error {
+	return lblconv.AbortSink(s.Sink)
+}
 
-	tfRecordLabelMapFilePath = filepath.Clean(tfRecordLabelMapFilePath)
+// acceptedSink passes the files accepted by the wrapped Sink, i.e. neither skipped nor failed, to
+// its stages, so that they describe the files as written. The TFRecord writer may still skip the
+// files that it accepts, so it passes the files that it writes with its OnWrite option instead.
+type acceptedSink struct {
+	lblconv.Sink
+	stages []lblconv.Stage
+}
+
+// Write implements lblconv.Sink.
+func (s *acceptedSink) Write(f lblconv.AnnotatedFile) error {
+	if err := s.Sink.Write(f); err != nil {
+		return err
+	}
+	if _, ok := unwrapSink(s.Sink).(*lblconv.TFRecordWriter); !ok {
+		s.accept(f)
+	}
+	return nil
+}
+
+// accept passes f to the stages, which collect statistics and pass it on unchanged.
+func (s *acceptedSink) accept(f lblconv.AnnotatedFile) {
+	for _, stage := range s.stages {
+		if _, err := stage(f); err != nil {
+			log.Printf("Failed to describe %q: %v", f.FilePath, err)
+		}
+	}
+}
+
+// Unwrap returns the wrapped Sink.
+func (s *acceptedSink) Unwrap() lblconv.Sink {
+	return s.Sink
+}
+
+// Abort implements lblconv.Aborter.
+func (s *acceptedSink) Abort() error {
+	return lblconv.AbortSink(s.Sink)
+}
+
+// sliceSink appends the files written to it to data.
+type sliceSink struct {
+	data *lblconv.AnnotatedFiles
+}
+
+// Write implements lblconv.Sink.
+func (s *sliceSink) Write(f lblconv.AnnotatedFile) error {
+	*s.data = append(*s.data, f)
+	return nil
+}
+
+// Close implements lblconv.Sink.
+func (s *sliceSink) Close() error {
+	return nil
+}
+
+// readAll reads all files from src like lblconv.ReadAllContext, and adds the number of files that
+// failed to parse to *skipped.
+func readAll(ctx context.Context, src lblconv.Source, skipped *int) (lblconv.AnnotatedFiles,
+		error) {
+
+	var files lblconv.AnnotatedFiles
+	stats, err := lblconv.StreamContext(ctx, src, &sliceSink{data: &files})
+	*skipped += stats.Skipped
+	return files, err
+}
+
+// unwrapSink returns the innermost Sink wrapped by sink, e.g. by lblconv.NewStageSink.
+func unwrapSink(sink lblconv.Sink) lblconv.Sink {
+	for {
+		w, ok := sink.(interface{ Unwrap() lblconv.Sink })
+		if !ok {
+			return sink
+		}
+		sink = w.Unwrap()
+	}
+}
+
+// existingOutputs returns the quoted paths of the outputs of cfg that exist and are not empty: the
+// -labels-out files and directories (or the TFRecord shards, or the KITTI directories with label
+// files), unless they are updated by -append, the image output directories and the report files.
+// The label map is not included, as it is updated rather than replaced.
+func existingOutputs(cfg *Config) ([]string, error) {
+	var paths []string
+	if !cfg.appendOutput {
+		for _, path := range cfg.labelOutFileOrDirPaths {
+			switch {
+			case path == "" || path == "-":
+			case cfg.convertTo.Name == "kitti":
+				files, err := lblconv.ExistingKittiLabelFiles(path)
+				if err != nil {
+					return nil, err
+				}
+				if len(files) > 0 {
+					paths = append(paths, path)
+				}
+			case cfg.convertTo.Name == "tfrecord":
+				shards, err := filepath.Glob(path + "-*-of-*")
+				if err != nil {
+					return nil, err
+				}
+				paths = append(paths, path)
+				paths = append(paths, shards...)
+			default:
+				paths = append(paths, path)
+			}
+		}
+	}
+	imageOutDirPaths := cfg.imageOutDirPaths
+	if imageOutDirPaths == nil {
+		imageOutDirPaths = []string{cfg.imageOutDirPath}
+	}
+	paths = append(paths, imageOutDirPaths...)
+	paths = append(paths, cfg.heatmapDirPath, cfg.cooccurrenceFilePath, cfg.labelUsageFilePath,
+		cfg.thresholdsFilePath, cfg.samplingWeightsFilePath, cfg.datasetCardPath,
+		cfg.pipelineConfigPath, cfg.packagePath)
+
+	var existing []string
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		ok, err := nonEmpty(path)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			existing = append(existing, strconv.Quote(path))
+		}
+	}
+	return existing, nil
+}
+
+// nonEmpty returns whether the file or directory at path exists and is not empty.
+func nonEmpty(path string) (bool, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if !info.IsDir() {
+		return info.Size() > 0, nil
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = dir.Close() }()
+	names, err := dir.Readdirnames(1)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return len(names) > 0, nil
+}
+
+// removeStaleKittiLabelFiles removes the label files of a previous export from the KITTI output
+// directories dirPaths, see lblconv.ExistingKittiLabelFiles.
+func removeStaleKittiLabelFiles(dirPaths []string) error {
+	for _, dirPath := range dirPaths {
+		files, err := lblconv.ExistingKittiLabelFiles(dirPath)
+		if err != nil {
+			return err
+		}
+		for _, path := range files {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+		if len(files) > 0 {
+			log.Printf("Removed %d stale label files from %q", len(files), dirPath)
+		}
+	}
+	return nil
 }
 
 func main() {
-	// Parse input.
-	var data []lblconv.AnnotatedFile
-	var err error
-	switch convertFrom {
-	case AWSDetectLabels:
-		data, err = lblconv.FromAWSDetectLabels(labelFileOrDirPath, imageDirPath)
-	case AWSDetectText:
-		data, err = lblconv.FromAWSDetectText(labelFileOrDirPath, imageDirPath)
-	case Kitti:
-		data, err = lblconv.FromKitti(labelFileOrDirPath, imageDirPath)
-	case Sloth:
-		data, err = lblconv.FromSloth(labelFileOrDirPath)
-	case VIA:
-		data, err = lblconv.FromVIA(labelFileOrDirPath)
-	default:
-		err = fmt.Errorf("unsupported input format")
+	cfg, err := ParseConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(exitSuccess)
+	} else if err != nil {
+		// The flag package has printed its errors with the usage.
+		if _, ok := err.(*ConfigError); ok {
+			log.Print(err)
+		}
+		os.Exit(exitInvalidArgs)
 	}
+
+	// Refuse to overwrite existing outputs, or to mix the label files of a previous KITTI export
+	// with the new ones.
+	existing, err := existingOutputs(cfg)
 	if err != nil {
-		log.Fatal("Failed to parse the input: ", err)
+		log.Fatal("Failed to check the existing outputs: ", err)
+	}
+	if len(existing) > 0 && !cfg.force {
+		log.Fatalf("Refusing to overwrite the existing outputs %s; use -force to overwrite them",
+			strings.Join(existing, ", "))
+	}
+	if len(existing) > 0 {
+		// Outputs of several files are replaced file by file, and a failed conversion removes the
+		// files written so far rather than restoring the replaced ones.
+		log.Printf("Overwriting the existing outputs %s; they are not restored if the conversion"+
+				" fails", strings.Join(existing, ", "))
+	}
+	if cfg.force && cfg.convertTo.Name == "kitti" {
+		if err := removeStaleKittiLabelFiles(cfg.labelOutFileOrDirPaths); err != nil {
+			log.Fatal("Failed to remove the stale label files: ", err)
+		}
+	}
+
+	// Load the image dimension cache.
+	lblconv.SetWorkers(cfg.numWorkers)
+	lblconv.SetMaxImageMemory(int64(cfg.maxImageMemoryMB) << 20)
+
+	var imageDimCache *lblconv.ImageDimensionCache
+	if cfg.imageDimCacheFilePath != "" {
+		var err error
+		imageDimCache, err = lblconv.LoadImageDimensionCache(cfg.imageDimCacheFilePath)
+		if err != nil {
+			log.Fatal("Failed to load the image dimension cache: ", err)
+		}
+		lblconv.SetImageDimensionCache(imageDimCache)
+	}
+	if cfg.imageDimManifestPath != "" {
+		manifest, err := lblconv.LoadImageDimensionManifest(cfg.imageDimManifestPath,
+			cfg.imageDirPath)
+		if err != nil {
+			log.Fatal("Failed to load the image dimension manifest: ", err)
+		}
+		lblconv.SetImageDimensionManifest(manifest)
+	}
+
+	// Open the input archives, which makes the files in them accessible by path.
+	archives := make(map[string]*lblconv.Archive)
+	for _, path := range append([]string{cfg.imageDirPath}, cfg.labelFileOrDirPaths...) {
+		archivePath := lblconv.ArchivePathOf(path)
+		if archivePath == "" || archives[archivePath] != nil {
+			continue
+		}
+		archive, err := lblconv.OpenArchive(archivePath)
+		if err != nil {
+			log.Fatal("Failed to open the input archive: ", err)
+		}
+		archives[archivePath] = archive
+		defer func() {
+			if err := archive.Close(); err != nil {
+				log.Print("Failed to close the input archive: ", err)
+			}
+		}()
+	}
+
+	formatOpts := lblconv.FormatOptions{
+		ImageDir:             cfg.imageDirPath,
+		ImageMatch:           cfg.imageMatch,
+		StrictDuplicates:     cfg.strictDuplicates,
+		ValidateInput:        cfg.validateInput,
+		Rounding:             cfg.coordRounding,
+		GCSPrefix:            cfg.gcsPrefix,
+		TFRecordLabelMapPath: cfg.tfRecordLabelMapFilePath,
+		LabelMapDisplayNames: cfg.tfRecordDisplayNames,
+		LabelMap: lblconv.LabelMapOptions{
+			ZeroBased:  cfg.labelMapFirstID == 0,
+			Background: cfg.labelMapBackground,
+		},
+		TFRecord: lblconv.TFRecordOptions{
+			NumShards:       cfg.numShardFiles,
+			ShardAssignment: cfg.tfRecordShardAssignment,
+			Compression:     cfg.tfRecordCompression,
+			Shuffle:         cfg.tfRecordShuffle,
+			Seed:            cfg.tfRecordSeed,
+			TranscodeToJPEG: cfg.tfRecordTranscodeJPEG,
+			JPEGQuality:     cfg.imageJPEGQuality,
+			MaxErrorRate:    cfg.tfRecordMaxErrorRate,
+			OmitImageData:   cfg.tfRecordOmitImages,
+
+			AttributeFeatures: cfg.tfRecordAttributeFeatures,
+		},
+		Inference: lblconv.InferenceOptions{
+			Protocol:    cfg.inferenceProtocol,
+			MinScore:    cfg.inferenceMinScore,
+			Concurrency: cfg.inferenceConcurrency,
+		},
+		VIA: lblconv.VIAOptions{
+			ProjectName: cfg.viaProjectName,
+			RegionShape: cfg.viaRegionShape,
+		},
+		KITTI:           lblconv.KITTIOptions{ScoreScale: cfg.kittiScoreScale},
+		AWSDetectLabels: lblconv.AWSDetectLabelsOptions{ImageLabels: cfg.awsImageLabels},
+		Anchors: lblconv.AnchorOptions{
+			NumAnchors:  cfg.numAnchors,
+			InputWidth:  cfg.anchorInputW,
+			InputHeight: cfg.anchorInputH,
+		},
+		Sloth: lblconv.SlothOptions{
+			FileClass:      cfg.slothFileClass,
+			AnnotationType: cfg.slothAnnotationType,
+			Attributes:     cfg.slothAttributes,
+		},
+		SQL:          lblconv.SQLOptions{EmbedImages: cfg.sqlEmbedImages},
+		COCOCaptions: lblconv.COCOCaptionsOptions{Separator: cfg.captionSeparator},
+		OneHot:       lblconv.OneHotOptions{Labels: cfg.oneHotLabels},
+	}
+	if cfg.parquetAttributes != "" {
+		formatOpts.Parquet.Attributes = strings.Split(cfg.parquetAttributes, ",")
+	}
+	if cfg.viaSchemaPath != "" {
+		var err error
+		formatOpts.VIA.Schema, err = lblconv.LoadVIAAttributeSchema(cfg.viaSchemaPath)
+		if err != nil {
+			log.Fatal("Failed to load the VIA schema: ", err)
+		}
+	}
+	if cfg.attributeSchemaPath != "" {
+		var err error
+		formatOpts.Attributes, err = lblconv.LoadAttributeSchema(cfg.attributeSchemaPath)
+		if err != nil {
+			log.Fatal("Failed to load the attribute schema: ", err)
+		}
+	}
+	if cfg.displayNamesPath != "" {
+		var err error
+		formatOpts.DisplayNames, err = lblconv.LoadDisplayNames(cfg.displayNamesPath)
+		if err != nil {
+			log.Fatal("Failed to load the display names: ", err)
+		}
+	}
+
+	// Share the TFRecord label map between the output datasets, so that they use the same IDs.
+	if cfg.tfRecordLabelMapFilePath != "" {
+		var err error
+		formatOpts.TFRecord.LabelMap, err = lblconv.LoadTFRecordLabelMapWithOptions(
+			cfg.tfRecordLabelMapFilePath, formatOpts.LabelMap)
+		if err != nil {
+			log.Fatal("Failed to load the label map: ", err)
+		}
+		formatOpts.TFRecord.LabelMap.DisplayNames = cfg.tfRecordDisplayNames
+		formatOpts.TFRecord.LabelMap.SetDisplayNames(formatOpts.DisplayNames)
+		if cfg.categoriesFilePath != "" {
+			categories, err := lblconv.LoadTFRecordLabelMapCategories(cfg.categoriesFilePath)
+			if err != nil {
+				log.Fatal("Failed to load the categories: ", err)
+			}
+			if err := formatOpts.TFRecord.LabelMap.PinIDs(categories); err != nil {
+				log.Fatal("Failed to pin the category IDs: ", err)
+			}
+		}
+		formatOpts.Inference.LabelMap = formatOpts.TFRecord.LabelMap
+		formatOpts.VIA.LabelOptions = formatOpts.TFRecord.LabelMap.Labels()
+		for _, label := range formatOpts.TFRecord.LabelMap.Labels() {
+			if label != cfg.labelMapBackground {
+				formatOpts.OneHot.Classes = append(formatOpts.OneHot.Classes, label)
+			}
+		}
+		formatOpts.Detectron2.Classes = formatOpts.OneHot.Classes
+	}
+	if cfg.provenance {
+		formatOpts.Provenance = &lblconv.Provenance{Version: lblconvVersion(), Args: cfg.args}
+	}
+
+	// Cancel the conversion on interrupt. The partial output is discarded in this case.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		log.Print("Interrupted, cancelling the conversion")
+		cancel()
+		signal.Stop(interrupt)
+	}()
+
+	// The number of files that were logged and left out of the output because of errors.
+	skipped := 0
+
+	// Annotate the images with AWS Rekognition.
+	if cfg.rekognition {
+		creds, err := lblconv.AWSCredentialsFromEnv()
+		if err != nil {
+			log.Fatal("Failed to get the AWS credentials: ", err)
+		}
+		api := lblconv.RekognitionDetectLabels
+		if cfg.convertFrom.Name == "aws-dt" {
+			api = lblconv.RekognitionDetectText
+		}
+		n, failed, err := lblconv.AnnotateWithRekognition(ctx, cfg.imageDirPath,
+			cfg.labelFileOrDirPaths[0], api,
+			lblconv.RekognitionOptions{
+				Region:      cfg.rekognitionRegion,
+				Credentials: creds,
+				MaxLabels:   cfg.rekognitionMaxLabels,
+				Concurrency: cfg.rekognitionConcurrency,
+				MaxRetries:  cfg.rekognitionRetries,
+			})
+		if err == context.Canceled {
+			log.Fatal("Annotation cancelled")
+		} else if err != nil {
+			log.Fatal("Annotation failed: ", err)
+		}
+		log.Printf("Annotated %d images with AWS Rekognition", n)
+		skipped += failed
+	}
+
+	// Create the input source. Formats that support streaming are parsed incrementally, the others
+	// are parsed in full. Normalized coordinates are converted by the first stage below.
+	inputOpts := formatOpts
+	inputOpts.NormalizedCoords = true
+	inputs := make([]lblconv.Source, len(cfg.labelFileOrDirPaths))
+	for i, path := range cfg.labelFileOrDirPaths {
+		src, err := lblconv.OpenSource(cfg.convertFrom.Reader, path, inputOpts)
+		if err != nil {
+			log.Fatal("Failed to parse the input: ", err)
+		}
+		if cfg.labelInputNames != nil {
+			src = lblconv.TagSource(src, cfg.labelInputNames[i])
+		}
+		inputs[i] = src
+	}
+	src := inputs[0]
+	if len(inputs) > 1 {
+		// Merge the inputs in memory, as the same image may be annotated in several of them.
+		files, err := readAll(ctx, lblconv.ConcatSources(inputs...), &skipped)
+		if err == context.Canceled {
+			log.Fatal("Conversion cancelled")
+		} else if err != nil {
+			log.Fatal("Failed to parse the input: ", err)
+		}
+		n, err := files.MergeDuplicates(cfg.strictDuplicates)
+		if err != nil {
+			log.Fatal("Failed to merge the inputs: ", err)
+		}
+		log.Printf("Merged %d inputs with %d files (%d duplicate image entries)", len(inputs),
+			len(files), n)
+		src = lblconv.NewSliceSource(files)
+	}
+
+	// Interpolate object tracks, which requires all frames of a sequence.
+	if cfg.interpolateGap > 0 {
+		files, err := readAll(ctx, src, &skipped)
+		if err == context.Canceled {
+			log.Fatal("Conversion cancelled")
+		} else if err != nil {
+			log.Fatal("Failed to parse the input: ", err)
+		}
+		log.Printf("Interpolated %d annotations of object tracks", files.InterpolateTracks(
+			cfg.interpolateGap))
+		src = lblconv.NewSliceSource(files)
 	}
 
-	af := lblconv.AnnotatedFiles(data)
+	// The stages expect absolute coordinates, which some readers leave normalized.
+	stages := []lblconv.Stage{lblconv.AbsoluteCoordsStage()}
+
+	// Coerce the attribute values to their declared types, before any stage uses them.
+	if formatOpts.Attributes != nil {
+		stages = append(stages, lblconv.CoerceAttributesStage(formatOpts.Attributes))
+	}
+
+	// Assign annotation IDs, before any stage changes the paths or coordinates.
+	if cfg.annotationIDs {
+		stages = append(stages, lblconv.AnnotationIDStage())
+	}
+
+	// Download remote images.
+	if cfg.imageFetchDirPath != "" {
+		stage, err := lblconv.FetchImagesStage(lblconv.ImageFetchOptions{
+			CacheDir:      cfg.imageFetchDirPath,
+			MaxConcurrent: cfg.imageFetchConcurrency,
+		})
+		if err != nil {
+			log.Fatal("Failed to set up image downloads: ", err)
+		}
+		stages = append(stages, stage)
+	}
+
+	// Translate the Open Images MIDs to display names, before any stage uses the labels.
+	if cfg.midsToNamesPath != "" {
+		names, err := lblconv.LoadDisplayNames(cfg.midsToNamesPath)
+		if err != nil {
+			log.Fatal("Failed to load the class descriptions: ", err)
+		}
+		stages = append(stages, lblconv.TranslateLabelsStage(names))
+	}
 
 	// Map labels.
-	if len(labelMappings) > 0 {
-		if err := af.MapLabels(strings.Split(labelMappings, ",")); err != nil {
+	var labelMappingStats *lblconv.LabelMappingStats
+	if len(cfg.labelMappings) > 0 {
+		labelMappingStats = lblconv.NewLabelMappingStats()
+		stage, err := lblconv.MapLabelsStage(strings.Split(cfg.labelMappings, ","),
+			labelMappingStats)
+		if err != nil {
 			log.Fatal("Failed to map labels: ", err)
 		}
+		stages = append(stages, stage)
 	}
 
 	// Perform transformations.
-	if bboxScaleWidth != 1 || bboxScaleHeight != 1 || bboxAspectRatio > 0 {
-		af.TransformBboxes(bboxScaleWidth, bboxScaleHeight, bboxAspectRatio)
+	if cfg.bboxScaleWidth != 1 || cfg.bboxScaleHeight != 1 || cfg.bboxAspectRatio > 0 {
+		stages = append(stages,
+			lblconv.TransformBboxesStage(cfg.bboxScaleWidth, cfg.bboxScaleHeight,
+				cfg.bboxAspectRatio))
+	}
+
+	// Repair invalid bounding boxes, including those produced by the transformations.
+	var bboxRepairs *lblconv.BboxRepairStats
+	if cfg.sanitizeBboxes {
+		bboxRepairs = lblconv.NewBboxRepairStats()
+		stages = append(stages, lblconv.SanitizeBboxesStage(bboxRepairs))
+	}
+
+	// Flag difficult and ignored objects, before the filters and image processing.
+	var flagCounts *lblconv.FlagCounts
+	if cfg.flagRules != nil {
+		flagCounts = lblconv.NewFlagCounts()
+		stages = append(stages, lblconv.FlagRulesStage(cfg.flagRules, flagCounts))
 	}
 
 	// Apply filters.
-	var labelNames, attrNames, requiredAttrNames []string
-	if filterLabels != "" {
-		labelNames = strings.Split(filterLabels, ",")
+	filterOpts := lblconv.FilterOptions{
+		MinConfidence:      cfg.filterConfidence,
+		MinLabelConfidence: cfg.filterLabelConf,
+		RequireLabel:       cfg.filterRequireLabel,
+		MinBboxWidth:       cfg.filterMinBboxWidth,
+		MinBboxHeight:      cfg.filterMinBboxHeight,
+		MinAspectRatio:     cfg.filterMinAspectRatio,
+		MaxAspectRatio:     cfg.filterMaxAspectRatio,
+		MinTextLength:      cfg.filterMinTextLength,
+		TextPattern:        cfg.filterTextPattern,
+		TextCharset:        cfg.filterTextCharset,
+		NumericText:        cfg.filterNumericText,
+	}
+	if cfg.filterLabels != "" {
+		filterOpts.Labels = strings.Split(cfg.filterLabels, ",")
+	}
+	if cfg.filterSources != "" {
+		filterOpts.Sources = strings.Split(cfg.filterSources, ",")
+	}
+	if cfg.filterAttributes != "" {
+		filterOpts.Attributes = strings.Split(cfg.filterAttributes, ",")
 	}
-	if filterAttributes != "" {
-		attrNames = strings.Split(filterAttributes, ",")
+	if cfg.filterImageLabels != "" {
+		filterOpts.RequiredImageLabels = strings.Split(cfg.filterImageLabels, ",")
 	}
-	if filterRequiredAttrs != "" {
-		requiredAttrNames = strings.Split(filterRequiredAttrs, ",")
+	if cfg.filterRequiredAttrs != "" {
+		filterOpts.RequiredAttributes = strings.Split(cfg.filterRequiredAttrs, ",")
 	}
-	af.Filter(labelNames, attrNames, requiredAttrNames, filterConfidence, filterRequireLabel,
-		filterMinBboxWidth, filterMinBboxHeight, filterMinAspectRatio, filterMaxAspectRatio)
+	filterStats := lblconv.NewFilterStats()
+	stages = append(stages, lblconv.FilterStage(filterOpts, filterStats))
 
-	// Process images.
-	err = af.ProcessImages(imageOutDirPath, imageResizeLonger, imageResizeShorter,
-		imageDownsamplingFilter, imageUpsamplingFilter, imageOutEncoding, imageJPEGQuality,
-		imageCropObjects)
-	if err != nil {
-		log.Fatal("Image processing failed: ", err)
+	// Sort the files, subsample over-represented labels and collect the objects to paste, which
+	// requires the whole dataset. The stages so far are applied first, as the latter two apply to
+	// the filtered annotations.
+	var copyPastePool *lblconv.CopyPastePool
+	if cfg.sortOutput || cfg.classCaps.Caps != nil || cfg.imageCopyPaste.Count > 0 {
+		var files lblconv.AnnotatedFiles
+		stats, err := lblconv.StreamContext(ctx, src, &sliceSink{data: &files}, stages...)
+		if err == context.Canceled {
+			log.Fatal("Conversion cancelled")
+		} else if err != nil {
+			log.Fatal("Conversion failed: ", err)
+		}
+		skipped += stats.Skipped
+		if cfg.sortOutput {
+			files.Sort()
+		}
+		if cfg.classCaps.Caps != nil {
+			n := files.CapClasses(cfg.classCaps)
+			log.Printf("Removed %d annotations of over-represented labels", n)
+		}
+		if cfg.imageCopyPaste.Count > 0 {
+			var err error
+			copyPastePool, err = lblconv.NewCopyPastePool(files, cfg.imageCopyPaste)
+			if err != nil {
+				log.Fatal("Failed to collect the objects to paste: ", err)
+			}
+			log.Printf("Collected %d objects to paste", copyPastePool.Len())
+		}
+		src, stages = lblconv.NewSliceSource(files), nil
+	}
+
+	// Accumulate the heatmaps of the bounding boxes, before image processing changes the
+	// coordinates.
+	var heatmap *lblconv.BboxHeatmap
+	if cfg.heatmapDirPath != "" {
+		heatmap = lblconv.NewBboxHeatmap(lblconv.HeatmapOptions{
+			Size:     cfg.heatmapSize,
+			Coverage: cfg.heatmapCoverage,
+		})
+		stages = append(stages, lblconv.HeatmapStage(heatmap))
+	}
+
+	// Match the predictions to the ground truth, before image processing changes the coordinates.
+	var thresholdSweep *lblconv.ThresholdSweep
+	if cfg.thresholdsFilePath != "" {
+		truthSrc, err := lblconv.OpenSource(cfg.thresholdsTruthFrom.Reader, cfg.thresholdsTruthPath,
+			formatOpts)
+		if err != nil {
+			log.Fatal("Failed to read the ground truth: ", err)
+		}
+		truth, err := readAll(ctx, truthSrc, &skipped)
+		if err != nil {
+			log.Fatal("Failed to read the ground truth: ", err)
+		}
+		thresholdSweep, err = lblconv.NewThresholdSweep(truth, cfg.thresholdSweepOpts)
+		if err != nil {
+			log.Fatal("Failed to set up the threshold sweep: ", err)
+		}
+		stages = append(stages, lblconv.ThresholdSweepStage(thresholdSweep))
+	}
+
+	// Count the label co-occurrences.
+	var cooccurrence *lblconv.LabelCooccurrence
+	if cfg.cooccurrenceFilePath != "" {
+		cooccurrence = lblconv.NewLabelCooccurrence()
+		stages = append(stages, lblconv.LabelCooccurrenceStage(cooccurrence))
+	}
+
+	// Count the images and annotations by label, as written.
+	var labelUsage *lblconv.LabelUsage
+	if cfg.labelUsageFilePath != "" {
+		labelUsage = lblconv.NewLabelUsage()
+	}
+
+	// Count the annotations by input source.
+	var sourceStatsAcc *lblconv.SourceStats
+	if cfg.sourceStats {
+		sourceStatsAcc = lblconv.NewSourceStats()
+		stages = append(stages, lblconv.SourceStatsStage(sourceStatsAcc))
+	}
+
+	// Quarantine the images that cannot be decoded. These are detected during image processing,
+	// or by decoding each image otherwise.
+	var imageQuarantine *lblconv.Quarantine
+	if cfg.quarantineDirPath != "" {
+		var err error
+		if imageQuarantine, err = lblconv.NewQuarantine(cfg.quarantineDirPath, cfg.quarantineMode);
+				err != nil {
+			log.Fatal("Failed to create the quarantine directory: ", err)
+		}
+		if cfg.imageResizeLonger <= 0 && cfg.imageResizeShorter <= 0 && !cfg.imageCropObjects &&
+				cfg.imageCopyPaste.Count == 0 && cfg.imageCutout.Count == 0 &&
+				cfg.imageColor == lblconv.ImageColorKeep && !cfg.imageToSRGB {
+			stages = append(stages, lblconv.VerifyImagesStage(imageQuarantine))
+		}
+	}
+
+	// Process images. The images are written to a directory per output dataset if -images-out is
+	// a template, in which case they are processed after splitting the dataset.
+	imageOpts := lblconv.ImageProcessingOptions{
+		OutDir:             cfg.imageOutDirPath,
+		ResizeLonger:       cfg.imageResizeLonger,
+		ResizeShorter:      cfg.imageResizeShorter,
+		DownsamplingFilter: cfg.imageDownsamplingFilter,
+		UpsamplingFilter:   cfg.imageUpsamplingFilter,
+		Encoding:           cfg.imageOutEncoding,
+		JPEGQuality:        cfg.imageJPEGQuality,
+		CropObjects:        cfg.imageCropObjects,
+		CopyPaste:          copyPastePool,
+		Cutout:             cfg.imageCutout,
+		Color:              cfg.imageColor,
+		ConvertToSRGB:      cfg.imageToSRGB,
+		ExifTags:           cfg.imageExifTags,
+		SkipInvalidImages:  !cfg.strictImages,
+		Quarantine:         imageQuarantine,
+		MaxMegapixels:      cfg.imageMaxMegapixels,
+		Timeout:            cfg.imageTimeout,
+	}
+	if cfg.imageOutDirPaths == nil {
+		stage, err := lblconv.ProcessImagesStage(imageOpts)
+		if err != nil {
+			log.Fatal("Image processing failed: ", err)
+		}
+		if stage == nil {
+			// The images are not re-encoded, so check their extensions instead.
+			stage, err = lblconv.ImageExtensionStage(cfg.imageExtMode, cfg.imageOutDirPath)
+			if err != nil {
+				log.Fatal("Failed to set up the image extension check: ", err)
+			}
+		}
+		if stage != nil {
+			stages = append(stages, stage)
+		}
+	}
+
+	// Audit a sample of the processed images.
+	var imageAudit *lblconv.ImageAudit
+	if cfg.auditImages > 0 {
+		var err error
+		imageAudit, err = lblconv.NewImageAudit(lblconv.ImageAuditOptions{
+			SampleRate: cfg.auditImages,
+			Strict:     cfg.strictAudit,
+		})
+		if err != nil {
+			log.Fatal("Failed to set up the image audit: ", err)
+		}
+		if cfg.imageOutDirPaths == nil {
+			stages = append(stages, lblconv.ImageAuditStage(imageAudit))
+		}
+	}
+
+	// Compute the checksums of the processed images.
+	if cfg.imageChecksums && cfg.imageOutDirPaths == nil {
+		stages = append(stages, lblconv.ImageChecksumStage())
+	}
+
+	// Compute the pixel statistics of the processed images.
+	var pixelStatsAcc *lblconv.PixelStats
+	if cfg.pixelStats {
+		pixelStatsAcc = lblconv.NewPixelStats()
+		if cfg.imageOutDirPaths == nil {
+			stages = append(stages, lblconv.PixelStatsStage(pixelStatsAcc))
+		}
+	}
+
+	// Compute the sampling weights of the processed images.
+	var samplingWeightsAcc *lblconv.SamplingWeights
+	if cfg.samplingWeightsFilePath != "" {
+		var err error
+		samplingWeightsAcc, err = lblconv.NewSamplingWeights(cfg.samplingWeightMethod,
+			cfg.repeatFactorThreshold)
+		if err != nil {
+			log.Fatal("Failed to set up the sampling weights: ", err)
+		}
+		if cfg.imageOutDirPaths == nil {
+			stages = append(stages, lblconv.SamplingWeightsStage(samplingWeightsAcc))
+		}
+	}
+
+	// Create the directories of the {split} output paths.
+	for _, dirPath := range cfg.splitOutDirPaths {
+		if err := os.MkdirAll(dirPath, 0755); err != nil {
+			log.Fatal("Failed to create the output directory: ", err)
+		}
+	}
+
+	// Summarise the output datasets on a dataset card.
+	var datasetCard *lblconv.DatasetCard
+	if cfg.datasetCardPath != "" {
+		datasetCard = lblconv.NewDatasetCard(lblconv.DatasetCardOptions{
+			Provenance: &lblconv.Provenance{Version: lblconvVersion(), Args: cfg.args},
+			Processing: cfg.processingArgs,
+			Examples:   cfg.datasetCardExamples,
+		})
+	}
+
+	// Translate the display names of the output labels back to Open Images MIDs.
+	var namesToMIDs lblconv.Stage
+	if cfg.namesToMIDsPath != "" {
+		names, err := lblconv.LoadDisplayNames(cfg.namesToMIDsPath)
+		if err != nil {
+			log.Fatal("Failed to load the class descriptions: ", err)
+		}
+		mids, err := lblconv.InvertDisplayNames(names)
+		if err != nil {
+			log.Fatal("Failed to load the class descriptions: ", err)
+		}
+		namesToMIDs = lblconv.TranslateLabelsStage(mids)
+	}
+
+	// Name the output datasets for the dataset card and the split coverage.
+	splitNames := make([]string, len(cfg.labelOutFileOrDirPaths))
+	for i, outPath := range cfg.labelOutFileOrDirPaths {
+		if cfg.labelOutSplitNames != nil {
+			splitNames[i] = cfg.labelOutSplitNames[i]
+		} else if len(cfg.labelOutFileOrDirPaths) > 1 {
+			splitNames[i] = filepath.Base(outPath)
+		}
+	}
+
+	// Verify that every class appears in the output splits.
+	var splitCoverage *lblconv.SplitCoverage
+	if cfg.splitCoverage != "none" && len(splitNames) > 1 {
+		splitCoverage = lblconv.NewSplitCoverage(splitNames)
+	}
+
+	// Create the sinks for the output datasets.
+	sinks := make([]*countingSink, len(cfg.labelOutFileOrDirPaths))
+	splitSinks := make([]lblconv.Sink, len(cfg.labelOutFileOrDirPaths))
+	for i, outPath := range cfg.labelOutFileOrDirPaths {
+		splitOpts := formatOpts
+		if cfg.labelOutSplitNames != nil {
+			splitOpts.Split = cfg.labelOutSplitNames[i]
+		}
+
+		// Describe and verify the files as written, i.e. after the image processing and the label
+		// translation, and only if they are not skipped.
+		accepted := &acceptedSink{}
+		if datasetCard != nil {
+			accepted.stages = append(accepted.stages,
+				lblconv.DatasetCardStage(datasetCard, splitNames[i]))
+		}
+		if splitCoverage != nil {
+			accepted.stages = append(accepted.stages,
+				lblconv.SplitCoverageStage(splitCoverage, splitNames[i]))
+		}
+		if labelUsage != nil {
+			accepted.stages = append(accepted.stages, lblconv.LabelUsageStage(labelUsage))
+		}
+		splitOpts.TFRecord.OnWrite = accepted.accept
+
+		var sink lblconv.Sink
+		var err error
+		if cfg.appendOutput {
+			sink, err = lblconv.OpenAppendSink(cfg.convertTo.Reader, cfg.convertTo.Writer, outPath,
+					splitOpts)
+		} else {
+			sink, err = lblconv.OpenSink(cfg.convertTo.Writer, outPath, splitOpts)
+		}
+		if err != nil {
+			log.Fatal("Conversion failed: ", err)
+		}
+		if len(accepted.stages) > 0 {
+			accepted.Sink = sink
+			sink = accepted
+		}
+		if namesToMIDs != nil {
+			sink = lblconv.NewStageSink(sink, namesToMIDs)
+		}
+		if cfg.sortOutput {
+			// Sort the annotations last, as the image processing may add annotations.
+			sink = lblconv.NewStageSink(sink, lblconv.SortAnnotationsStage())
+		}
+		sinks[i] = &countingSink{Sink: sink}
+		splitSinks[i] = sinks[i]
+
+		if cfg.imageOutDirPaths != nil {
+			imageOpts.OutDir = cfg.imageOutDirPaths[i]
+			stage, err := lblconv.ProcessImagesStage(imageOpts)
+			if err != nil {
+				log.Fatal("Image processing failed: ", err)
+			}
+			if stage == nil {
+				stage, err = lblconv.ImageExtensionStage(cfg.imageExtMode, imageOpts.OutDir)
+				if err != nil {
+					log.Fatal("Failed to set up the image extension check: ", err)
+				}
+			}
+			var splitStages []lblconv.Stage
+			if stage != nil {
+				splitStages = append(splitStages, stage)
+			}
+			if imageAudit != nil {
+				splitStages = append(splitStages, lblconv.ImageAuditStage(imageAudit))
+			}
+			if cfg.imageChecksums {
+				splitStages = append(splitStages, lblconv.ImageChecksumStage())
+			}
+			if pixelStatsAcc != nil {
+				splitStages = append(splitStages, lblconv.PixelStatsStage(pixelStatsAcc))
+			}
+			if samplingWeightsAcc != nil {
+				splitStages = append(splitStages, lblconv.SamplingWeightsStage(samplingWeightsAcc))
+			}
+			if len(splitStages) > 0 {
+				splitSinks[i] = lblconv.NewStageSink(splitSinks[i], splitStages...)
+			}
+		}
 	}
 
 	// Split data into output datasets.
-	var datasets []lblconv.AnnotatedFiles
-	if len(labelOutSplits) == 1 {
-		datasets = []lblconv.AnnotatedFiles{af}
-	} else {
-		if datasets, err = af.Split(labelOutSplits); err != nil {
+	sink := splitSinks[0]
+	if len(cfg.labelOutSplits) > 1 {
+		var err error
+		if sink, err = lblconv.NewSplitSink(cfg.labelOutSplits, splitSinks); err != nil {
 			log.Fatal("Failed to split the dataset: ", err)
 		}
 	}
 
-	// Write output datasets.
-	for i, data := range datasets {
-		outPath := labelOutFileOrDirPaths[i]
-		switch convertTo {
-		case Kitti:
-			kittiData := lblconv.ToKitti(data)
-			err = lblconv.WriteKitti(outPath, kittiData)
-		case Sloth:
-			slothData := lblconv.ToSloth(data)
-			err = lblconv.WriteSloth(outPath, slothData)
-		case TFRecord:
-			err = lblconv.WriteTFRecord(outPath, tfRecordLabelMapFilePath, data, numShardFiles)
-		case VIA:
-			viaData := lblconv.ToVIA(data)
-			err = lblconv.WriteVIA(outPath, viaData)
-		default:
-			err = fmt.Errorf("unsupported output format")
+	// Run the conversion.
+	stats, err := lblconv.StreamContext(ctx, src, sink, stages...)
+	if err == context.Canceled {
+		log.Fatal("Conversion cancelled")
+	} else if err != nil {
+		log.Fatal("Conversion failed: ", err)
+	}
+	n := stats.Written
+	skipped += stats.Skipped
+
+	for i, sink := range sinks {
+		if cfg.labelOutSplitNames != nil {
+			log.Printf("Successfully wrote labels for %d files to %s (%s)", sink.written(),
+				cfg.labelOutFileOrDirPaths[i], cfg.labelOutSplitNames[i])
+		} else {
+			log.Printf("Successfully wrote labels for %d files to %s", sink.written(),
+				cfg.labelOutFileOrDirPaths[i])
+		}
+		if w, ok := unwrapSink(sink.Sink).(*lblconv.TFRecordWriter); ok {
+			stats := w.Stats()
+			log.Printf("TFRecord examples written: %d, skipped (missing image): %d, failed: %d",
+				stats.Written, stats.Skipped, stats.Failed)
+			n -= stats.Skipped + stats.Failed
+			skipped += stats.Skipped + stats.Failed
+		}
+	}
+
+	if heatmap != nil {
+		if err := heatmap.WritePNGs(cfg.heatmapDirPath); err != nil {
+			log.Fatal("Failed to write the heatmaps: ", err)
+		}
+		log.Print("Wrote the bounding box heatmaps to ", cfg.heatmapDirPath)
+	}
+
+	if labelMappingStats != nil {
+		log.Printf("The label mappings changed %d labels", labelMappingStats.Changed())
+	}
+	filteredLabels, filteredFiles := filterStats.Removed()
+	log.Printf("Filtered out %d labels and %d files", filteredLabels, filteredFiles)
+
+	if bboxRepairs != nil {
+		byLabel := bboxRepairs.ByLabel()
+		labels := make([]string, 0, len(byLabel))
+		for label := range byLabel {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		var total lblconv.BboxRepairs
+		for _, label := range labels {
+			r := byLabel[label]
+			log.Printf("Repaired bounding boxes of %q: %d swapped, %d clamped, %d dropped", label,
+				r.Swapped, r.Clamped, r.Dropped)
+			total.Swapped += r.Swapped
+			total.Clamped += r.Clamped
+			total.Dropped += r.Dropped
+		}
+		log.Printf("Repaired bounding boxes: %d swapped, %d clamped, %d dropped", total.Swapped,
+			total.Clamped, total.Dropped)
+	}
+
+	if flagCounts != nil {
+		byFlag := flagCounts.ByFlag()
+		log.Printf("Flagged annotations: %d difficult, %d ignored", byFlag[lblconv.Difficult],
+			byFlag[lblconv.Ignore])
+	}
+
+	if cooccurrence != nil {
+		if err := cooccurrence.WriteCSV(cfg.cooccurrenceFilePath); err != nil {
+			log.Fatal("Failed to write the label co-occurrence matrix: ", err)
+		}
+		log.Print("Wrote the label co-occurrence matrix to ", cfg.cooccurrenceFilePath)
+	}
+
+	if labelUsage != nil {
+		// The label map is complete once the outputs are written.
+		labelMap := formatOpts.TFRecord.LabelMap
+		if err := labelUsage.WriteCSV(cfg.labelUsageFilePath, labelMap); err != nil {
+			log.Fatal("Failed to write the label usage: ", err)
+		}
+		log.Print("Wrote the label usage to ", cfg.labelUsageFilePath)
+		if labelMap != nil {
+			for _, label := range labelUsage.Unused(labelMap) {
+				if label != cfg.labelMapBackground {
+					log.Printf("Label %q of the label map has no annotations", label)
+				}
+			}
+		}
+	}
+
+	if thresholdSweep != nil {
+		if err := thresholdSweep.WriteCSV(cfg.thresholdsFilePath); err != nil {
+			log.Fatal("Failed to write the threshold sweep: ", err)
+		}
+		for _, r := range thresholdSweep.Results() {
+			p := r.Points[r.Suggested]
+			log.Printf("Suggested confidence threshold for %q: %g (precision %.3f, recall %.3f)",
+				r.Label, p.Threshold, p.Precision, p.Recall)
+		}
+		log.Print("Wrote the threshold sweep to ", cfg.thresholdsFilePath)
+	}
+
+	if samplingWeightsAcc != nil {
+		if err := samplingWeightsAcc.WriteCSV(cfg.samplingWeightsFilePath); err != nil {
+			log.Fatal("Failed to write the sampling weights: ", err)
+		}
+		log.Print("Wrote the sampling weights to ", cfg.samplingWeightsFilePath)
+	}
+
+	if sourceStatsAcc != nil {
+		for _, source := range sourceStatsAcc.Sources() {
+			byLabel := sourceStatsAcc.ByLabel(source)
+			labels := make([]string, 0, len(byLabel))
+			total := 0
+			for label, n := range byLabel {
+				labels = append(labels, label)
+				total += n
+			}
+			sort.Strings(labels)
+			name := source
+			if name == "" {
+				name = "(untagged)"
+			}
+			log.Printf("Source %s: %d annotations in %d files", name, total,
+				sourceStatsAcc.Files(source))
+			for _, label := range labels {
+				log.Printf("  %s: %d", label, byLabel[label])
+			}
+		}
+	}
+
+	if pixelStatsAcc != nil {
+		mean, std := pixelStatsAcc.Mean(), pixelStatsAcc.Std()
+		log.Printf("Pixel statistics of %d pixels (RGB):", pixelStatsAcc.Pixels())
+		log.Printf("  mean [0, 1]:   %.4f, %.4f, %.4f", mean[0], mean[1], mean[2])
+		log.Printf("  std [0, 1]:    %.4f, %.4f, %.4f", std[0], std[1], std[2])
+		log.Printf("  mean [0, 255]: %.2f, %.2f, %.2f", mean[0]*255, mean[1]*255, mean[2]*255)
+		log.Printf("  std [0, 255]:  %.2f, %.2f, %.2f", std[0]*255, std[1]*255, std[2]*255)
+	}
+
+	if imageQuarantine != nil {
+		if err := imageQuarantine.Close(); err != nil {
+			log.Fatal("Failed to write the quarantine reasons: ", err)
+		}
+		log.Printf("Quarantined %d images in %s", len(imageQuarantine.Entries()),
+			cfg.quarantineDirPath)
+	}
+
+	if datasetCard != nil {
+		if err := datasetCard.WriteMarkdown(cfg.datasetCardPath); err != nil {
+			log.Fatal("Failed to write the dataset card: ", err)
 		}
+		log.Print("Wrote the dataset card to ", cfg.datasetCardPath)
+	}
+
+	if imageDimCache != nil {
+		if err := imageDimCache.Save(); err != nil {
+			log.Print("Failed to save the image dimension cache: ", err)
+		}
+	}
+
+	// Verify the TFRecord output.
+	if cfg.tfRecordVerify && cfg.convertTo.Name == "tfrecord" {
+		verified := true
+		for _, outPath := range cfg.labelOutFileOrDirPaths {
+			reports, err := lblconv.VerifyTFRecord(outPath, formatOpts.TFRecord.LabelMap,
+				cfg.tfRecordCompression)
+			if err != nil {
+				log.Fatal("TFRecord verification failed: ", err)
+			}
+			for _, r := range reports {
+				log.Printf("Verified %s: %d records, %d objects, %d invalid records", r.Path,
+					r.Records, r.Objects, r.Invalid)
+				if r.Err != nil {
+					log.Printf("Failed to read %s: %v", r.Path, r.Err)
+				}
+				verified = verified && r.OK()
+			}
+		}
+		if !verified {
+			log.Fatal("TFRecord verification failed")
+		}
+	}
+
+	// Write the TF Object Detection API pipeline config.
+	if cfg.pipelineConfigPath != "" {
+		opts := cfg.pipelineConfig
+		opts.NumClasses = len(formatOpts.TFRecord.LabelMap.Labels())
+		var err error
+		if opts.LabelMapPath, err = filepath.Abs(cfg.tfRecordLabelMapFilePath); err != nil {
+			log.Fatal("Failed to write the pipeline config: ", err)
+		}
+		train, eval := cfg.pipelineInputs()
+		for _, i := range train {
+			opts.TrainInputPaths = append(opts.TrainInputPaths, cfg.pipelineInputPattern(i))
+		}
+		for _, i := range eval {
+			opts.EvalInputPaths = append(opts.EvalInputPaths, cfg.pipelineInputPattern(i))
+		}
+		if err := lblconv.WriteTFPipelineConfig(cfg.pipelineConfigPath, opts); err != nil {
+			log.Fatal("Failed to write the pipeline config: ", err)
+		}
+		log.Printf("Wrote the %s pipeline config for %d classes to %s", opts.Model,
+			opts.NumClasses, cfg.pipelineConfigPath)
+	}
+
+	// Report the image audit.
+	if imageAudit != nil {
+		issues := imageAudit.Issues()
+		log.Printf("Audited %d images, %d issues", imageAudit.Audited(), len(issues))
+	}
+
+	// Verify the split coverage.
+	if splitCoverage != nil {
+		var missing []lblconv.MissingClass
+		if cfg.splitCoverage == "train" {
+			missing = splitCoverage.Missing(splitCoverage.TrainingSplit())
+		} else {
+			missing = splitCoverage.Missing()
+		}
+		for _, m := range missing {
+			log.Printf("Class %q (%d annotations) is missing from split %s", m.Label, m.Total,
+				m.Split)
+		}
+		if len(missing) > 0 && cfg.strictSplitCoverage {
+			log.Fatal("Split coverage verification failed")
+		}
+	}
+
+	// Package the dataset.
+	if cfg.packagePath != "" {
+		summary := packageSummary{From: cfg.convertFrom.Name, To: cfg.convertTo.Name, Files: n}
+		for i, sink := range sinks {
+			output := packageOutput{Path: cfg.labelOutFileOrDirPaths[i], Files: sink.written()}
+			if cfg.labelOutSplitNames != nil {
+				output.Split = cfg.labelOutSplitNames[i]
+			}
+			summary.Outputs = append(summary.Outputs, output)
+		}
+		if imageQuarantine != nil {
+			summary.Quarantined = len(imageQuarantine.Entries())
+		}
+		if pixelStatsAcc != nil {
+			mean, std := pixelStatsAcc.Mean(), pixelStatsAcc.Std()
+			summary.PixelMean, summary.PixelStd = mean[:], std[:]
+		}
+
+		manifest, err := lblconv.WritePackage(cfg.packagePath, cfg.packageEntries(),
+			lblconv.PackageOptions{
+				Version:    cfg.packageVersion,
+				Provenance: &lblconv.Provenance{Version: lblconvVersion(), Args: cfg.args},
+				Summary:    summary,
+			})
 		if err != nil {
-			log.Fatal("Conversion failed: ", err)
+			log.Fatal("Failed to package the dataset: ", err)
 		}
+		log.Printf("Packaged %d files to %s", len(manifest.Files), cfg.packagePath)
+	}
 
-		log.Printf("Successfully wrote labels for %d files to %s", len(data), outPath)
+	log.Print("Total number of labelled files: ", n)
+	if skipped > 0 {
+		log.Printf("Skipped %d input files because of errors", skipped)
+		os.Exit(exitPartial)
 	}
+}
+
+// packageSummary is the summary of the run recorded in the manifest of a package.
+type packageSummary struct {
+	From        string          `json:"from"`
+	To          string          `json:"to"`
+	Files       int             `json:"files"` // The number of files converted.
+	Outputs     []packageOutput `json:"outputs"`
+	Quarantined int             `json:"quarantined,omitempty"`
+	PixelMean   []float64       `json:"pixel_mean,omitempty"`
+	PixelStd    []float64       `json:"pixel_std,omitempty"`
+}
 
-	log.Print("Total number of labelled files: ", len(af))
+// packageOutput is an output dataset in a packageSummary.
+type packageOutput struct {
+	Path  string `json:"path"`
+	Split string `json:"split,omitempty"`
+	Files int    `json:"files"` // The number of files written.
+}
+
+// pipelineModelNames returns the names of the base models of -pipeline-model.
+func pipelineModelNames() []string {
+	var names []string
+	for _, m := range lblconv.TFPipelineModels() {
+		names = append(names, m.Name)
+	}
+	return names
+}
+
+// pipelineInputs returns the indices of the outputs to train and evaluate on with the
+// -pipeline-config: the split named train or training, or the first output, and the splits named
+// val or validation, or else all other outputs. A single output is used for both.
+func (cfg *Config) pipelineInputs() (train, eval []int) {
+	train = []int{0}
+	for i, name := range cfg.labelOutSplitNames {
+		if n := strings.ToLower(name); n == "train" || n == "training" {
+			train = []int{i}
+			break
+		}
+	}
+	for i, name := range cfg.labelOutSplitNames {
+		if n := strings.ToLower(name); n == "val" || n == "validation" {
+			eval = append(eval, i)
+		}
+	}
+	if eval == nil {
+		for i := range cfg.labelOutFileOrDirPaths {
+			if i != train[0] {
+				eval = append(eval, i)
+			}
+		}
+	}
+	if eval == nil {
+		log.Print("There is no split to evaluate on; the pipeline config evaluates on the training" +
+				" data")
+		eval = train
+	}
+	return train, eval
+}
+
+// pipelineInputPattern returns the absolute glob pattern of the TFRecord shards of output i.
+func (cfg *Config) pipelineInputPattern(i int) string {
+	path := cfg.labelOutFileOrDirPaths[i]
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return lblconv.TFRecordInputPattern(path, cfg.numShardFiles)
+}
+
+// packageEntries returns the outputs of the run to package: the labels in "labels", the images
+// in "images", the label map and the dataset card at the top level, and the statistics in "stats".
+func (cfg *Config) packageEntries() []lblconv.PackageEntry {
+	var entries []lblconv.PackageEntry
+	for _, outPath := range cfg.labelOutFileOrDirPaths {
+		entries = append(entries, lblconv.PackageEntry{
+			Path: outPath,
+			Name: "labels/" + filepath.Base(outPath),
+		})
+	}
+	if cfg.imageOutDirPaths != nil {
+		for _, dirPath := range cfg.imageOutDirPaths {
+			entries = append(entries, lblconv.PackageEntry{
+				Path: dirPath,
+				Name: "images/" + filepath.Base(dirPath),
+			})
+		}
+	} else if cfg.imageOutDirPath != "" {
+		entries = append(entries, lblconv.PackageEntry{Path: cfg.imageOutDirPath, Name: "images"})
+	} else {
+		log.Print("The images are not packaged without -images-out")
+	}
+	if cfg.tfRecordLabelMapFilePath != "" {
+		entries = append(entries, lblconv.PackageEntry{
+			Path: cfg.tfRecordLabelMapFilePath,
+			Name: filepath.Base(cfg.tfRecordLabelMapFilePath),
+		})
+	}
+	if cfg.cooccurrenceFilePath != "" {
+		entries = append(entries, lblconv.PackageEntry{
+			Path: cfg.cooccurrenceFilePath,
+			Name: "stats/" + filepath.Base(cfg.cooccurrenceFilePath),
+		})
+	}
+	if cfg.labelUsageFilePath != "" {
+		entries = append(entries, lblconv.PackageEntry{
+			Path: cfg.labelUsageFilePath,
+			Name: "stats/" + filepath.Base(cfg.labelUsageFilePath),
+		})
+	}
+	if cfg.thresholdsFilePath != "" {
+		entries = append(entries, lblconv.PackageEntry{
+			Path: cfg.thresholdsFilePath,
+			Name: "stats/" + filepath.Base(cfg.thresholdsFilePath),
+		})
+	}
+	if cfg.samplingWeightsFilePath != "" {
+		entries = append(entries, lblconv.PackageEntry{
+			Path: cfg.samplingWeightsFilePath,
+			Name: "stats/" + filepath.Base(cfg.samplingWeightsFilePath),
+		})
+	}
+	if cfg.heatmapDirPath != "" {
+		entries = append(entries, lblconv.PackageEntry{
+			Path: cfg.heatmapDirPath,
+			Name: "stats/heatmaps",
+		})
+	}
+	if cfg.datasetCardPath != "" {
+		entries = append(entries, lblconv.PackageEntry{
+			Path: cfg.datasetCardPath,
+			Name: filepath.Base(cfg.datasetCardPath),
+		})
+		examples := lblconv.DatasetCardExampleDir(cfg.datasetCardPath)
+		if _, err := os.Stat(examples); err == nil {
+			entries = append(entries, lblconv.PackageEntry{
+				Path: examples,
+				Name: filepath.Base(examples),
+			})
+		}
+	}
+	if cfg.quarantineDirPath != "" {
+		entries = append(entries, lblconv.PackageEntry{
+			Path: filepath.Join(cfg.quarantineDirPath, lblconv.QuarantineReasonsFile),
+			Name: "stats/quarantine_" + lblconv.QuarantineReasonsFile,
+		})
+	}
+	return entries
 }
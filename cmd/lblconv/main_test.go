@@ -0,0 +1,93 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	valid := []string{"-from", "sloth", "-to", "kitti", "-labels", "in.json", "-labels-out", "out"}
+
+	tests := []struct {
+		name     string
+		args     []string
+		problems []string // The problems of the ConfigError, or none if the arguments are valid.
+	}{
+		{
+			name: "valid",
+			args: valid,
+		},
+		{
+			name: "valid JPEG quality",
+			args: append(valid, "-jpeg-quality", "100"),
+		},
+		{
+			name: "unsupported input format and missing labels",
+			args: []string{"-from", "nope", "-to", "sloth", "-labels-out", "out.json"},
+			problems: []string{
+				`Unsupported input format "nope", -from must be one of: ` +
+						"aws-dl, aws-dt, inference, ir, kitti, mot, sloth, via",
+				"Missing label input path argument -labels",
+			},
+		},
+		{
+			name:     "append to an unsupported format",
+			args:     append(valid, "-append"),
+			problems: []string{"-append requires -to sloth or via"},
+		},
+		{
+			name: "split percentages",
+			args: []string{"-from", "sloth", "-to", "sloth", "-labels", "in.json", "-labels-out",
+				"a.json", "-split", "50,40"},
+			problems: []string{
+				"The values in -split must add up to 100%",
+				"The number of output datasets defined by -split and the number of paths in" +
+						" -labels-out must match",
+			},
+		},
+		{
+			name:     "JPEG quality too low",
+			args:     append(valid, "-jpeg-quality", "0"),
+			problems: []string{"Invalid -jpeg-quality, must be in [1, 100]: 0"},
+		},
+		{
+			name:     "JPEG quality too high",
+			args:     append(valid, "-jpeg-quality", "101"),
+			problems: []string{"Invalid -jpeg-quality, must be in [1, 100]: 101"},
+		},
+		{
+			name: "all problems",
+			args: append(valid, "-jpeg-quality", "0", "-min-confidence", "2"),
+			problems: []string{
+				"Invalid -jpeg-quality, must be in [1, 100]: 0",
+				"Invalid -min-confidence, must be in [0.0, 1.0): 2",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args := test.args
+			cfg, err := ParseConfig(args)
+			if test.problems == nil {
+				if err != nil {
+					t.Fatalf("ParseConfig(%q) failed: %v", args, err)
+				}
+				if cfg.convertFrom.Name != args[1] || cfg.convertTo.Name != args[3] {
+					t.Errorf("ParseConfig(%q) selected the formats %q and %q", args,
+						cfg.convertFrom.Name, cfg.convertTo.Name)
+				}
+				return
+			}
+
+			configErr, ok := err.(*ConfigError)
+			if !ok {
+				t.Fatalf("ParseConfig(%q) returned %v, want a *ConfigError", args, err)
+			}
+			if !reflect.DeepEqual(configErr.Problems, test.problems) {
+				t.Errorf("ParseConfig(%q) problems:\n got: %q\nwant: %q", args, configErr.Problems,
+					test.problems)
+			}
+		})
+	}
+}
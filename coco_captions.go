@@ -0,0 +1,202 @@
+package lblconv
+
+// COCO captions files, e.g. to train OCR or captioning models on the text of detect-text datasets.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// COCOCaptions is a COCO captions file, like captions_train2017.json of the COCO dataset.
+type COCOCaptions struct {
+	Info        COCOInfo      `json:"info"`
+	Images      []COCOImage   `json:"images"`
+	Annotations []COCOCaption `json:"annotations"`
+}
+
+// COCOInfo describes a COCO dataset.
+type COCOInfo struct {
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version,omitempty"`
+}
+
+// COCOImage is an image of a COCO dataset.
+type COCOImage struct {
+	ID       int    `json:"id"`
+	FileName string `json:"file_name"` // The file name, relative to the image directory.
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+}
+
+// COCOCaption is a caption of a COCO image.
+type COCOCaption struct {
+	ID      int    `json:"id"`
+	ImageID int    `json:"image_id"`
+	Caption string `json:"caption"`
+}
+
+// COCOCaptionsOptions holds the settings of the COCO captions writer.
+type COCOCaptionsOptions struct {
+	Separator string // The separator of the lines of text in a caption. Defaults to " ".
+}
+
+// ImageCaption returns the text of f as a single caption: the DetectedText of the annotations
+// that are lines of text, i.e. that have no TextParentID, joined with sep. If f has no lines, e.g.
+// because they were filtered out, the text of all annotations is joined instead. The text is in
+// the order of the TextID attributes, if the annotations have them, or in the order of the
+// annotations otherwise. Returns "" if f has no text.
+func ImageCaption(f AnnotatedFile, sep string) string {
+	type text struct {
+		id    float64
+		value string
+	}
+	var lines, all []text
+	for _, a := range f.Annotations {
+		value, _ := a.Attributes[DetectedText].(string)
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+		t := text{value: value}
+		if id, ok := numberValue(a.Attributes[TextID]); ok {
+			t.id = id
+		}
+		all = append(all, t)
+		if _, ok := a.Attributes[TextParentID]; !ok {
+			lines = append(lines, t)
+		}
+	}
+	if len(lines) == 0 {
+		lines = all
+	}
+
+	sort.SliceStable(lines, func(i, j int) bool {
+		return lines[i].id < lines[j].id
+	})
+	values := make([]string, len(lines))
+	for i, t := range lines {
+		values[i] = t.value
+	}
+	return strings.Join(values, sep)
+}
+
+// cocoCaptionsSink is a Sink that writes a COCO captions file. The captions are written when the
+// Sink is closed.
+type cocoCaptionsSink struct {
+	file     *atomicFile
+	opts     COCOCaptionsOptions
+	captions COCOCaptions
+	noText   int // The number of files without text, which are omitted.
+}
+
+// NewCOCOCaptionsSink returns a Sink that writes the text of the files, see ImageCaption, as a
+// COCO captions file to outFile, with one caption per image. Files without text are omitted.
+// info describes the dataset in the file.
+func NewCOCOCaptionsSink(outFile string, info COCOInfo, opts COCOCaptionsOptions) (Sink, error) {
+	if opts.Separator == "" {
+		opts.Separator = " "
+	}
+	file, err := createAtomicFile(outFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot write file %q: %v", outFile, err)
+	}
+	return &cocoCaptionsSink{
+		file: file,
+		opts: opts,
+		captions: COCOCaptions{
+			Info:        info,
+			Images:      []COCOImage{},
+			Annotations: []COCOCaption{},
+		},
+	}, nil
+}
+
+// Write implements Sink. Files whose image dimensions cannot be determined are logged and skipped.
+func (s *cocoCaptionsSink) Write(f AnnotatedFile) error {
+	caption := ImageCaption(f, s.opts.Separator)
+	if caption == "" {
+		s.noText++
+		return nil
+	}
+	width, height, err := f.Dimensions()
+	if err != nil {
+		log.Print("Skipping file: ", err)
+		return ErrFileSkipped
+	}
+
+	id := len(s.captions.Images) + 1
+	s.captions.Images = append(s.captions.Images, COCOImage{
+		ID:       id,
+		FileName: filepath.Base(f.FilePath),
+		Width:    width,
+		Height:   height,
+	})
+	s.captions.Annotations = append(s.captions.Annotations, COCOCaption{
+		ID:      id,
+		ImageID: id,
+		Caption: caption,
+	})
+	return nil
+}
+
+// Close implements Sink.
+func (s *cocoCaptionsSink) Close() (err error) {
+	defer s.file.commit(&err)
+
+	if s.noText > 0 {
+		log.Printf("Omitted %d files without text from the COCO captions", s.noText)
+	}
+	w := bufio.NewWriter(s.file)
+	if err := json.NewEncoder(w).Encode(s.captions); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// Abort implements Aborter. It removes the output file.
+func (s *cocoCaptionsSink) Abort() error {
+	return s.file.Abort()
+}
+
+// cocoCaptionsFormat implements the Writer interface for COCO captions files.
+type cocoCaptionsFormat struct{}
+
+// Write implements Writer.
+func (c cocoCaptionsFormat) Write(outFile string, data AnnotatedFiles, opts FormatOptions) (
+		err error) {
+
+	s, err := c.NewSink(outFile, opts)
+	if err != nil {
+		return err
+	}
+	defer closeWithErrCheck(s, &err)
+
+	return writeFiles(s, data)
+}
+
+// NewSink implements StreamWriter.
+func (cocoCaptionsFormat) NewSink(outFile string, opts FormatOptions) (Sink, error) {
+	var info COCOInfo
+	if opts.Provenance != nil {
+		info = COCOInfo{Description: opts.Provenance.String(), Version: opts.Provenance.Version}
+	}
+	return NewCOCOCaptionsSink(outFile, info, opts.COCOCaptions)
+}
+
+// AcceptsNormalizedCoords implements NormalizedWriter, as the coordinates are not written.
+func (cocoCaptionsFormat) AcceptsNormalizedCoords() bool {
+	return true
+}
+
+func init() {
+	RegisterFormat(Format{
+		Name:        "coco-captions",
+		Description: "COCO captions JSON of the detected text, one caption per image",
+		Writer:      cocoCaptionsFormat{},
+		WriterArgs:  "-labels-out <file> [-caption-separator <separator>]",
+	})
+}
@@ -0,0 +1,113 @@
+package lblconv
+
+// Label co-occurrence statistics.
+
+import (
+	"encoding/csv"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// LabelCooccurrence counts how often pairs of labels appear in the same file. It is safe for
+// concurrent use.
+type LabelCooccurrence struct {
+	mu     sync.Mutex
+	counts map[[2]string]int // The number of files by label pair, with pair[0] <= pair[1].
+	labels map[string]bool
+}
+
+// NewLabelCooccurrence returns an empty LabelCooccurrence.
+func NewLabelCooccurrence() *LabelCooccurrence {
+	return &LabelCooccurrence{
+		counts: make(map[[2]string]int),
+		labels: make(map[string]bool),
+	}
+}
+
+// Add counts the label pairs of f. Each label is counted once per file, regardless of the number
+// of its annotations.
+func (c *LabelCooccurrence) Add(f AnnotatedFile) {
+	labels := make([]string, 0, len(f.Annotations))
+	seen := make(map[string]bool, len(f.Annotations))
+	for _, a := range f.Annotations {
+		if !seen[a.Label] {
+			seen[a.Label] = true
+			labels = append(labels, a.Label)
+		}
+	}
+	sort.Strings(labels)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, l1 := range labels {
+		c.labels[l1] = true
+		for _, l2 := range labels[i:] {
+			c.counts[[2]string{l1, l2}]++
+		}
+	}
+}
+
+// Labels returns the labels counted, sorted.
+func (c *LabelCooccurrence) Labels() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	labels := make([]string, 0, len(c.labels))
+	for label := range c.labels {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// Count returns the number of files that contain both labels. For identical labels, it is the
+// number of files that contain the label.
+func (c *LabelCooccurrence) Count(label1, label2 string) int {
+	if label1 > label2 {
+		label1, label2 = label2, label1
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.counts[[2]string{label1, label2}]
+}
+
+// WriteCSV writes the symmetric co-occurrence matrix to path as CSV, with a header row and a
+// header column of the sorted labels.
+func (c *LabelCooccurrence) WriteCSV(path string) (err error) {
+	file, err := createAtomicFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot write file %q: %v", path, err)
+	}
+	defer file.commit(&err)
+
+	labels := c.Labels()
+	w := csv.NewWriter(file)
+	if err := w.Write(append([]string{"label"}, labels...)); err != nil {
+		return err
+	}
+	for _, l1 := range labels {
+		row := make([]string, 0, len(labels)+1)
+		row = append(row, l1)
+		for _, l2 := range labels {
+			row = append(row, strconv.Itoa(c.Count(l1, l2)))
+		}
+		if err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// LabelCooccurrenceStage returns a Stage that adds each file to c and passes it on unchanged.
+func LabelCooccurrenceStage(c *LabelCooccurrence) Stage {
+	return func(f AnnotatedFile) ([]AnnotatedFile, error) {
+		c.Add(f)
+		return []AnnotatedFile{f}, nil
+	}
+}
@@ -0,0 +1,165 @@
+package lblconv
+
+// Coordinate spaces of annotations, and the conversion between them.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CoordinateSpace is the space of the coordinates of the annotations of an AnnotatedFile.
+type CoordinateSpace int
+
+const (
+	// AbsoluteCoords are pixel offsets from the top-left corner of the image. This is the default,
+	// and expected by most functions of this package.
+	AbsoluteCoords CoordinateSpace = iota
+
+	// NormalizedCoords are offsets from the top-left corner of the image as fractions of the
+	// image width and height, e.g. as read from formats that store them without the image size.
+	NormalizedCoords
+)
+
+// coordinateSpaceNames are the names of the coordinate spaces, by space.
+var coordinateSpaceNames = []string{"absolute", "normalized"}
+
+// String returns the name of s, i.e. absolute or normalized.
+func (s CoordinateSpace) String() string {
+	if s < 0 || int(s) >= len(coordinateSpaceNames) {
+		return fmt.Sprintf("CoordinateSpace(%d)", int(s))
+	}
+	return coordinateSpaceNames[s]
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s CoordinateSpace) MarshalText() ([]byte, error) {
+	if s < 0 || int(s) >= len(coordinateSpaceNames) {
+		return nil, fmt.Errorf("invalid coordinate space %d", int(s))
+	}
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (s *CoordinateSpace) UnmarshalText(text []byte) error {
+	for i, name := range coordinateSpaceNames {
+		if strings.EqualFold(string(text), name) {
+			*s = CoordinateSpace(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid coordinate space %q (must be absolute or normalized)", text)
+}
+
+// Dimensions returns the width and height of the image of f. They are read from the image, or the
+// image dimension cache, only if they are not known, and then stored in f.
+func (f *AnnotatedFile) Dimensions() (width, height int, err error) {
+	if f.ImageWidth <= 0 || f.ImageHeight <= 0 {
+		if f.ImageWidth, f.ImageHeight, err = imageDimensions(f.FilePath); err != nil {
+			return 0, 0, err
+		}
+	}
+	return f.ImageWidth, f.ImageHeight, nil
+}
+
+// ToAbsolute converts the coordinates and polygons of the annotations of f to AbsoluteCoords. The
+// image dimensions are only read from the image if the coordinates are normalized and the
+// dimensions are not known.
+func (f *AnnotatedFile) ToAbsolute() error {
+	if f.CoordSpace == AbsoluteCoords {
+		return nil
+	}
+	width, height, err := f.Dimensions()
+	if err != nil {
+		return err
+	}
+	f.Annotations = append([]Annotation(nil), f.Annotations...) // May be shared.
+	f.scaleCoords(float64(width), float64(height))
+	f.CoordSpace = AbsoluteCoords
+	return nil
+}
+
+// ToNormalized converts the coordinates and polygons of the annotations of f to NormalizedCoords.
+// The image dimensions are only read from the image if the coordinates are absolute and the
+// dimensions are not known.
+func (f *AnnotatedFile) ToNormalized() error {
+	if f.CoordSpace == NormalizedCoords {
+		return nil
+	}
+	width, height, err := f.Dimensions()
+	if err != nil {
+		return err
+	}
+	f.Annotations = append([]Annotation(nil), f.Annotations...) // May be shared.
+	f.scaleCoords(1/float64(width), 1/float64(height))
+	f.CoordSpace = NormalizedCoords
+	return nil
+}
+
+// normalizationScale returns the factors by which to multiply the x and y coordinates of f to
+// normalize them, reading the image dimensions only if needed.
+func (f *AnnotatedFile) normalizationScale() (sx, sy float64, err error) {
+	if f.CoordSpace == NormalizedCoords {
+		return 1, 1, nil
+	}
+	width, height, err := f.Dimensions()
+	if err != nil {
+		return 0, 0, err
+	}
+	return 1 / float64(width), 1 / float64(height), nil
+}
+
+// ToAbsolute converts the coordinates of all files to AbsoluteCoords, see AnnotatedFile.ToAbsolute.
+func (data *AnnotatedFiles) ToAbsolute() error {
+	for i := range *data {
+		if err := (*data)[i].ToAbsolute(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AbsoluteCoordsStage returns a Stage that converts the coordinates of each file to
+// AbsoluteCoords, see AnnotatedFile.ToAbsolute.
+func AbsoluteCoordsStage() Stage {
+	return func(f AnnotatedFile) ([]AnnotatedFile, error) {
+		if err := f.ToAbsolute(); err != nil {
+			return nil, err
+		}
+		return []AnnotatedFile{f}, nil
+	}
+}
+
+// absoluteCoordsParser returns a labelParserFn that converts the files parsed by parse to
+// AbsoluteCoords, unless normalized is true, see FormatOptions.NormalizedCoords.
+func absoluteCoordsParser(parse labelParserFn, normalized bool) labelParserFn {
+	if normalized {
+		return parse
+	}
+	return func(labelPath, imagePath string) (AnnotatedFile, error) {
+		f, err := parse(labelPath, imagePath)
+		if err != nil {
+			return AnnotatedFile{}, err
+		}
+		if err := f.ToAbsolute(); err != nil {
+			return AnnotatedFile{}, err
+		}
+		return f, nil
+	}
+}
+
+// NormalizedWriter is implemented by the Writers that accept files with NormalizedCoords, e.g.
+// because their format stores normalized coordinates. The Sinks returned by OpenSink convert the
+// files for other Writers to AbsoluteCoords.
+type NormalizedWriter interface {
+	Writer
+
+	// AcceptsNormalizedCoords returns whether the Writer accepts files with NormalizedCoords.
+	AcceptsNormalizedCoords() bool
+}
+
+// acceptsNormalizedCoords returns whether w implements NormalizedWriter and accepts files with
+// NormalizedCoords.
+func acceptsNormalizedCoords(w Writer) bool {
+	nw, ok := w.(NormalizedWriter)
+	return ok && nw.AcceptsNormalizedCoords()
+}
@@ -0,0 +1,194 @@
+package lblconv
+
+// Copy-paste augmentation, i.e. compositing object crops onto other images.
+
+import (
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/draw"
+	"log"
+	"math"
+	"math/rand"
+
+	"github.com/disintegration/imaging"
+)
+
+// copyPasteAttempts is the number of random positions tried for an object before it is skipped.
+const copyPasteAttempts = 20
+
+// CopyPasteOptions configures a CopyPastePool.
+type CopyPasteOptions struct {
+	Labels []string // The labels of the objects to paste, e.g. rare classes; empty for all.
+
+	Count int // The number of objects to paste onto each image.
+
+	// The max. fraction of a pasted object that may overlap an existing bounding box, and vice
+	// versa.
+	MaxOverlap float64
+
+	MaxObjects int // The max. number of object crops kept in memory. Defaults to 1000.
+
+	// The seed for the selection of the objects and their positions. The positions are seeded
+	// with Seed and the input path of each image, so that they do not depend on the processing
+	// order.
+	Seed int64
+}
+
+// copyPasteObject is an object crop in a CopyPastePool.
+type copyPasteObject struct {
+	img     image.Image
+	label   string
+	path    string  // The path of the image that the object was cropped from.
+	shorter float64 // The length of the shorter side of that image.
+}
+
+// CopyPastePool holds object crops to paste onto the images during image processing, see
+// ImageProcessingOptions.CopyPaste.
+type CopyPastePool struct {
+	opts    CopyPasteOptions
+	objects []copyPasteObject
+}
+
+// NewCopyPastePool crops the objects with the labels in opts.Labels from the images of data, up to
+// opts.MaxObjects randomly selected ones, to paste them onto other images. Images that cannot be
+// read are logged and skipped.
+func NewCopyPastePool(data AnnotatedFiles, opts CopyPasteOptions) (*CopyPastePool, error) {
+	if opts.Count <= 0 {
+		return nil, fmt.Errorf("invalid number of objects to paste %d", opts.Count)
+	}
+	if opts.MaxOverlap < 0 || opts.MaxOverlap > 1 {
+		return nil, fmt.Errorf("invalid max. overlap %g", opts.MaxOverlap)
+	}
+	if opts.MaxObjects == 0 {
+		opts.MaxObjects = 1000
+	}
+	labels := make(map[string]bool, len(opts.Labels))
+	for _, label := range opts.Labels {
+		labels[label] = true
+	}
+
+	pool := &CopyPastePool{opts: opts}
+	rng := rand.New(rand.NewSource(opts.Seed))
+	for _, i := range rng.Perm(len(data)) {
+		f := data[i]
+		var annotations []Annotation
+		for _, a := range f.Annotations {
+			if (len(labels) == 0 || labels[a.Label]) && !a.boolAttribute(ImageLabel) {
+				annotations = append(annotations, a)
+			}
+		}
+		if len(annotations) == 0 {
+			continue
+		}
+		f.Annotations = annotations
+
+		img, _, err := loadImage(f.FilePath)
+		if err != nil {
+			log.Print("Skipping the objects of file: ", err)
+			continue
+		}
+		crops, cropData, err := f.cropObjectsFromImage(img)
+		if err != nil {
+			return nil, err
+		}
+		shorter := math.Min(float64(img.Bounds().Dx()), float64(img.Bounds().Dy()))
+		for j, crop := range crops {
+			// Copy the crops, which share the memory of the image otherwise.
+			pool.objects = append(pool.objects, copyPasteObject{
+				img:     imaging.Clone(crop),
+				label:   cropData[j].Annotations[0].Label,
+				path:    f.FilePath,
+				shorter: shorter,
+			})
+			if len(pool.objects) == opts.MaxObjects {
+				return pool, nil
+			}
+		}
+	}
+	return pool, nil
+}
+
+// Len returns the number of objects in the pool.
+func (pool *CopyPastePool) Len() int {
+	return len(pool.objects)
+}
+
+// paste returns a copy of img with pool.opts.Count random objects pasted onto it, and adds their
+// annotations, with the Synthetic attribute, to f, whose coordinates must be those of img. The
+// objects are scaled by the ratio of the shorter sides of the images, and skipped if they cannot
+// be placed without exceeding the max. overlap. inPath is the path of the input image, which seeds
+// the objects and their positions. Objects from the same image are not pasted onto it.
+func (pool *CopyPastePool) paste(img image.Image, f *AnnotatedFile, inPath string) image.Image {
+	if pool == nil || len(pool.objects) == 0 {
+		return img
+	}
+
+	hash := fnv.New64a()
+	hash.Write([]byte(inPath))
+	rng := rand.New(rand.NewSource(pool.opts.Seed ^ int64(hash.Sum64())))
+
+	out := imaging.Clone(img)
+	bounds := out.Bounds()
+	shorter := math.Min(float64(bounds.Dx()), float64(bounds.Dy()))
+	annotations := f.Annotations[:len(f.Annotations):len(f.Annotations)]
+	for i := 0; i < pool.opts.Count; i++ {
+		obj := pool.objects[rng.Intn(len(pool.objects))]
+		if imagePathKey(obj.path) == imagePathKey(inPath) {
+			continue
+		}
+
+		// Scale the object to the size of the image, and to fit into it.
+		scale := shorter / obj.shorter
+		w, h := float64(obj.img.Bounds().Dx())*scale, float64(obj.img.Bounds().Dy())*scale
+		if fit := math.Min(float64(bounds.Dx())/w, float64(bounds.Dy())/h); fit < 1 {
+			w, h = w*fit, h*fit
+		}
+		width, height := int(math.Round(w)), int(math.Round(h))
+		if width < 1 || height < 1 {
+			continue
+		}
+
+		for attempt := 0; attempt < copyPasteAttempts; attempt++ {
+			x := rng.Intn(bounds.Dx() - width + 1)
+			y := rng.Intn(bounds.Dy() - height + 1)
+			r := image.Rect(x, y, x+width, y+height)
+			if pool.overlaps(r, annotations) {
+				continue
+			}
+
+			draw.Draw(out, r, imaging.Resize(obj.img, width, height, imaging.Linear), image.Point{},
+				draw.Src)
+			annotations = append(annotations, Annotation{
+				Attributes: map[string]interface{}{Synthetic: true},
+				Coords: [4]float64{float64(r.Min.X), float64(r.Min.Y), float64(r.Max.X),
+					float64(r.Max.Y)},
+				Label: obj.label,
+			})
+			break
+		}
+	}
+	f.Annotations = annotations
+	return out
+}
+
+// overlaps returns whether r overlaps the bounding box of any annotation by more than the max.
+// overlap, relative to the area of either.
+func (pool *CopyPastePool) overlaps(r image.Rectangle, annotations []Annotation) bool {
+	rc := [4]float64{float64(r.Min.X), float64(r.Min.Y), float64(r.Max.X), float64(r.Max.Y)}
+	area := CoordsArea(rc)
+	for _, a := range annotations {
+		if a.boolAttribute(ImageLabel) {
+			continue
+		}
+		intersection, ok := IntersectCoords(rc, a.Coords)
+		if !ok {
+			continue
+		}
+		inter := CoordsArea(intersection)
+		if inter > pool.opts.MaxOverlap*area || inter > pool.opts.MaxOverlap*a.Area() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package lblconv
+
+// Cutout augmentation, i.e. occluding random rectangles of the output images.
+
+import (
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/draw"
+	"math/rand"
+
+	"github.com/disintegration/imaging"
+)
+
+// CutoutMode selects where CutoutOptions places the rectangles relative to the annotations.
+type CutoutMode int
+
+// The supported cutout modes.
+const (
+	CutoutAnywhere      CutoutMode = iota // Place the rectangles anywhere in the image.
+	CutoutAvoidObjects                    // Place the rectangles outside of all bounding boxes.
+	CutoutTargetObjects                   // Centre the rectangles in random bounding boxes.
+)
+
+// cutoutAttempts is the number of random positions tried for a rectangle in CutoutAvoidObjects
+// mode before it is skipped.
+const cutoutAttempts = 20
+
+// cutoutFill is the colour of the rectangles.
+var cutoutFill = color.NRGBA{R: 128, G: 128, B: 128, A: 255}
+
+// CutoutOptions configures the cutout augmentation of ProcessImagesWithOptions, which fills random
+// rectangles of the output images with grey to simulate occlusions. The annotations are not
+// changed. The zero value disables it.
+type CutoutOptions struct {
+	Count int // The number of rectangles per image.
+
+	// The min. and max. side lengths of the rectangles, as fractions of the shorter side of the
+	// image, or of the bounding box in CutoutTargetObjects mode. Default to 0.1 and 0.3.
+	MinSize, MaxSize float64
+
+	Mode CutoutMode
+
+	// The seed for the random rectangles. Each image uses a generator seeded with Seed and its
+	// input path, so that the rectangles do not depend on the processing order.
+	Seed int64
+}
+
+// sizes returns the min. and max. sizes, with the defaults applied.
+func (opts CutoutOptions) sizes() (float64, float64) {
+	minSize, maxSize := opts.MinSize, opts.MaxSize
+	if minSize == 0 {
+		minSize = 0.1
+	}
+	if maxSize == 0 {
+		maxSize = 0.3
+	}
+	return minSize, maxSize
+}
+
+// validate returns an error if the options are invalid.
+func (opts CutoutOptions) validate() error {
+	minSize, maxSize := opts.sizes()
+	if opts.Count < 0 {
+		return fmt.Errorf("invalid number of cutout rectangles %d", opts.Count)
+	}
+	if minSize <= 0 || maxSize > 1 || minSize > maxSize {
+		return fmt.Errorf("invalid cutout sizes %g to %g", minSize, maxSize)
+	}
+	return nil
+}
+
+// apply returns a copy of img with the rectangles filled in, for the annotations of f, whose
+// coordinates must be those of img. inPath is the path of the input image, which seeds the
+// rectangles.
+func (opts CutoutOptions) apply(img image.Image, f *AnnotatedFile, inPath string) image.Image {
+	if opts.Count <= 0 {
+		return img
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(inPath))
+	rng := rand.New(rand.NewSource(opts.Seed ^ int64(h.Sum64())))
+
+	var boxes []image.Rectangle
+	for _, a := range f.Annotations {
+		if !a.boolAttribute(ImageLabel) && a.Width() > 0 && a.Height() > 0 {
+			boxes = append(boxes, image.Rect(int(a.Coords[0]), int(a.Coords[1]),
+				int(a.Coords[2]+0.5), int(a.Coords[3]+0.5)))
+		}
+	}
+	if opts.Mode == CutoutTargetObjects && len(boxes) == 0 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	minSize, maxSize := opts.sizes()
+	size := func(length int) int {
+		return int(float64(length)*(minSize+rng.Float64()*(maxSize-minSize)) + 0.5)
+	}
+	shorter := bounds.Dx()
+	if bounds.Dy() < shorter {
+		shorter = bounds.Dy()
+	}
+
+	out := imaging.Clone(img)
+	fill := image.NewUniform(cutoutFill)
+	for i := 0; i < opts.Count; i++ {
+		var r image.Rectangle
+		switch opts.Mode {
+		case CutoutTargetObjects:
+			box := boxes[rng.Intn(len(boxes))]
+			boxShorter := box.Dx()
+			if box.Dy() < boxShorter {
+				boxShorter = box.Dy()
+			}
+			w, h := size(boxShorter), size(boxShorter)
+			x := box.Min.X + rng.Intn(box.Dx()+1) - w/2
+			y := box.Min.Y + rng.Intn(box.Dy()+1) - h/2
+			r = image.Rect(x, y, x+w, y+h)
+		default:
+			for attempt := 0; attempt < cutoutAttempts; attempt++ {
+				w, h := size(shorter), size(shorter)
+				x := rng.Intn(bounds.Dx() - w + 1)
+				y := rng.Intn(bounds.Dy() - h + 1)
+				r = image.Rect(x, y, x+w, y+h)
+				if opts.Mode == CutoutAnywhere || !overlapsAny(r, boxes) {
+					break
+				}
+				r = image.Rectangle{}
+			}
+		}
+		draw.Draw(out, r.Intersect(out.Bounds()), fill, image.Point{}, draw.Src)
+	}
+	return out
+}
+
+// overlapsAny returns whether r overlaps any of the boxes.
+func overlapsAny(r image.Rectangle, boxes []image.Rectangle) bool {
+	for _, box := range boxes {
+		if r.Overlaps(box) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,403 @@
+package lblconv
+
+// Dataset cards, human-readable Markdown summaries of converted datasets.
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/disintegration/imaging"
+)
+
+// datasetCardExampleSize is the max. length of the longer side of the example images.
+const datasetCardExampleSize = 640
+
+// DatasetCardOptions configures a DatasetCard.
+type DatasetCardOptions struct {
+	Title      string      // The title of the card. Defaults to "Dataset card".
+	Provenance *Provenance // How the dataset was created, if not nil.
+
+	// The filters and transformations applied to the dataset, e.g. the command line arguments that
+	// configure them, listed in the order given.
+	Processing []string
+
+	// The number of example images to render with their bounding boxes. The first files with
+	// annotations are used.
+	Examples int
+}
+
+// DatasetCard accumulates the statistics of the output datasets of a conversion, and writes them
+// as a Markdown document, e.g. to share the dataset. It is safe for concurrent use.
+type DatasetCard struct {
+	opts DatasetCardOptions
+
+	mu       sync.Mutex
+	splits   []*datasetCardSplit // In the order of DatasetCardStage calls.
+	examples []AnnotatedFile
+}
+
+// datasetCardSplit holds the statistics of an output dataset.
+type datasetCardSplit struct {
+	name        string
+	files       int
+	annotations int
+	unlabeled   int            // The number of files without annotations.
+	labels      map[string]int // The number of annotations by label.
+	labelFiles  map[string]int // The number of files by label.
+
+	sized               int // The number of files with known image dimensions.
+	minWidth, minHeight int
+	maxWidth, maxHeight int
+	sumWidth, sumHeight int
+}
+
+// NewDatasetCard returns an empty DatasetCard.
+func NewDatasetCard(opts DatasetCardOptions) *DatasetCard {
+	if opts.Title == "" {
+		opts.Title = "Dataset card"
+	}
+	return &DatasetCard{opts: opts}
+}
+
+// split returns the statistics of the named split, creating them if needed. c.mu must be held.
+func (c *DatasetCard) split(name string) *datasetCardSplit {
+	for _, s := range c.splits {
+		if s.name == name {
+			return s
+		}
+	}
+	s := &datasetCardSplit{
+		name:       name,
+		labels:     make(map[string]int),
+		labelFiles: make(map[string]int),
+	}
+	c.splits = append(c.splits, s)
+	return s
+}
+
+// Add adds f to the statistics of the named output dataset (split), which is empty if the dataset
+// is not split. The image dimensions are read from the image if they are not known.
+func (c *DatasetCard) Add(split string, f AnnotatedFile) {
+	width, height, err := f.Dimensions()
+	if err != nil {
+		log.Printf("Failed to add the image dimensions of %q to the dataset card: %v", f.FilePath,
+			err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := c.split(split)
+	s.files++
+	s.annotations += len(f.Annotations)
+	if len(f.Annotations) == 0 {
+		s.unlabeled++
+	}
+	seen := make(map[string]bool, len(f.Annotations))
+	for _, a := range f.Annotations {
+		s.labels[a.Label]++
+		if !seen[a.Label] {
+			seen[a.Label] = true
+			s.labelFiles[a.Label]++
+		}
+	}
+
+	if err == nil {
+		if s.sized == 0 || width < s.minWidth {
+			s.minWidth = width
+		}
+		if s.sized == 0 || height < s.minHeight {
+			s.minHeight = height
+		}
+		if width > s.maxWidth {
+			s.maxWidth = width
+		}
+		if height > s.maxHeight {
+			s.maxHeight = height
+		}
+		s.sumWidth += width
+		s.sumHeight += height
+		s.sized++
+	}
+
+	if len(c.examples) < c.opts.Examples && len(f.Annotations) > 0 {
+		c.examples = append(c.examples, f.Clone())
+	}
+}
+
+// DatasetCardExampleDir returns the directory to which DatasetCard.WriteMarkdown writes the
+// example images of the dataset card at path: "<name>_examples" next to it, where name is the base
+// name of path without its extension.
+func DatasetCardExampleDir(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + "_examples"
+}
+
+// WriteMarkdown writes the dataset card to the Markdown file at path, and the example images to
+// DatasetCardExampleDir(path). Examples whose image cannot be read are logged and omitted.
+func (c *DatasetCard) WriteMarkdown(path string) (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Render the examples first, so that the card only links the ones written.
+	exampleDir := DatasetCardExampleDir(path)
+	var examples []string
+	for i, f := range c.examples {
+		if i == 0 {
+			if err := os.MkdirAll(exampleDir, 0755); err != nil {
+				return fmt.Errorf("failed to create the dataset card example directory: %v", err)
+			}
+		}
+		name := fmt.Sprintf("example_%d.jpg", i+1)
+		if err := writeDatasetCardExample(filepath.Join(exampleDir, name), f); err != nil {
+			log.Printf("Failed to render the dataset card example %q: %v", f.FilePath, err)
+			continue
+		}
+		examples = append(examples, filepath.Base(exampleDir)+"/"+name)
+	}
+
+	file, err := createAtomicFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to create the dataset card: %v", err)
+	}
+	defer file.commit(&err)
+	w := bufio.NewWriter(file)
+
+	_, _ = fmt.Fprintf(w, "# %s\n\n", c.opts.Title)
+	if c.opts.Provenance != nil {
+		_, _ = fmt.Fprintf(w, "Created with:\n\n```\n%s\n```\n\n", c.opts.Provenance)
+	}
+
+	c.writeSplits(w)
+	c.writeLabels(w)
+	c.writeImages(w)
+
+	if len(c.opts.Processing) > 0 {
+		_, _ = fmt.Fprint(w, "## Filters and transformations\n\n")
+		for _, p := range c.opts.Processing {
+			_, _ = fmt.Fprintf(w, "- `%s`\n", p)
+		}
+		_, _ = fmt.Fprintln(w)
+	}
+
+	if len(examples) > 0 {
+		_, _ = fmt.Fprint(w, "## Examples\n\n")
+		for i, example := range examples {
+			_, _ = fmt.Fprintf(w, "![Example %d](%s)\n\n", i+1, example)
+		}
+	}
+
+	return w.Flush()
+}
+
+// writeSplits writes the table of the output datasets to w.
+func (c *DatasetCard) writeSplits(w *bufio.Writer) {
+	_, _ = fmt.Fprint(w, "## Splits\n\n")
+	_, _ = fmt.Fprint(w, "| Split | Files | Annotations | Files without annotations |\n")
+	_, _ = fmt.Fprint(w, "|---|--:|--:|--:|\n")
+	var files, annotations, unlabeled int
+	for _, s := range c.splits {
+		name := s.name
+		if name == "" {
+			name = "(all)"
+		}
+		_, _ = fmt.Fprintf(w, "| %s | %d | %d | %d |\n", markdownEscape(name), s.files,
+			s.annotations, s.unlabeled)
+		files += s.files
+		annotations += s.annotations
+		unlabeled += s.unlabeled
+	}
+	if len(c.splits) > 1 {
+		_, _ = fmt.Fprintf(w, "| **Total** | %d | %d | %d |\n", files, annotations, unlabeled)
+	}
+	_, _ = fmt.Fprintln(w)
+}
+
+// writeLabels writes the table of the annotation counts by label and split to w.
+func (c *DatasetCard) writeLabels(w *bufio.Writer) {
+	totals := make(map[string]int)
+	files := make(map[string]int)
+	for _, s := range c.splits {
+		for label, n := range s.labels {
+			totals[label] += n
+			files[label] += s.labelFiles[label]
+		}
+	}
+	labels := make([]string, 0, len(totals))
+	for label := range totals {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	_, _ = fmt.Fprintf(w, "## Classes\n\nNumber of classes: %d\n\n", len(labels))
+	if len(labels) == 0 {
+		return
+	}
+	_, _ = fmt.Fprint(w, "| Class |")
+	if len(c.splits) > 1 {
+		for _, s := range c.splits {
+			_, _ = fmt.Fprintf(w, " %s |", markdownEscape(s.name))
+		}
+	}
+	_, _ = fmt.Fprint(w, " Annotations | Files |\n|---|")
+	if len(c.splits) > 1 {
+		_, _ = fmt.Fprint(w, strings.Repeat("--:|", len(c.splits)))
+	}
+	_, _ = fmt.Fprint(w, "--:|--:|\n")
+	for _, label := range labels {
+		_, _ = fmt.Fprintf(w, "| %s |", markdownEscape(label))
+		if len(c.splits) > 1 {
+			for _, s := range c.splits {
+				_, _ = fmt.Fprintf(w, " %d |", s.labels[label])
+			}
+		}
+		_, _ = fmt.Fprintf(w, " %d | %d |\n", totals[label], files[label])
+	}
+	_, _ = fmt.Fprintln(w)
+}
+
+// writeImages writes the image dimension statistics to w.
+func (c *DatasetCard) writeImages(w *bufio.Writer) {
+	var all datasetCardSplit
+	for _, s := range c.splits {
+		all.files += s.files
+		all.annotations += s.annotations
+		if s.sized == 0 {
+			continue
+		}
+		if all.sized == 0 || s.minWidth < all.minWidth {
+			all.minWidth = s.minWidth
+		}
+		if all.sized == 0 || s.minHeight < all.minHeight {
+			all.minHeight = s.minHeight
+		}
+		all.maxWidth = maxInt(all.maxWidth, s.maxWidth)
+		all.maxHeight = maxInt(all.maxHeight, s.maxHeight)
+		all.sumWidth += s.sumWidth
+		all.sumHeight += s.sumHeight
+		all.sized += s.sized
+	}
+
+	_, _ = fmt.Fprint(w, "## Images\n\n")
+	if all.files > 0 {
+		_, _ = fmt.Fprintf(w, "%.2f annotations per image on average.\n\n",
+			float64(all.annotations)/float64(all.files))
+	}
+	if all.sized == 0 {
+		_, _ = fmt.Fprint(w, "The image dimensions are unknown.\n\n")
+		return
+	}
+	_, _ = fmt.Fprint(w, "| | Min. | Mean | Max. |\n|---|--:|--:|--:|\n")
+	_, _ = fmt.Fprintf(w, "| Width | %d | %.0f | %d |\n", all.minWidth,
+		float64(all.sumWidth)/float64(all.sized), all.maxWidth)
+	_, _ = fmt.Fprintf(w, "| Height | %d | %.0f | %d |\n", all.minHeight,
+		float64(all.sumHeight)/float64(all.sized), all.maxHeight)
+	_, _ = fmt.Fprintln(w)
+	if all.sized < all.files {
+		_, _ = fmt.Fprintf(w, "The dimensions of %d images are unknown.\n\n", all.files-all.sized)
+	}
+}
+
+// markdownEscape escapes the characters of s that would break a Markdown table cell.
+func markdownEscape(s string) string {
+	return strings.NewReplacer("|", `\|`, "\n", " ").Replace(s)
+}
+
+// maxInt returns the larger of a and b.
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// writeDatasetCardExample renders the image of f, scaled down to datasetCardExampleSize, with the
+// bounding boxes of its annotations, and saves it to path.
+func writeDatasetCardExample(path string, f AnnotatedFile) error {
+	if err := f.ToAbsolute(); err != nil {
+		return err
+	}
+	img, _, err := loadImage(f.FilePath)
+	if err != nil {
+		return err
+	}
+
+	scale := 1.0
+	bounds := img.Bounds()
+	if longer := maxInt(bounds.Dx(), bounds.Dy()); longer > datasetCardExampleSize {
+		img = imaging.Fit(img, datasetCardExampleSize, datasetCardExampleSize, imaging.Box)
+		scale = float64(img.Bounds().Dx()) / float64(bounds.Dx())
+	}
+	canvas := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(canvas, canvas.Bounds(), img, img.Bounds().Min, draw.Src)
+
+	for _, a := range f.Annotations {
+		r := image.Rect(int(math.Round(a.Coords[0]*scale)), int(math.Round(a.Coords[1]*scale)),
+			int(math.Round(a.Coords[2]*scale)), int(math.Round(a.Coords[3]*scale)))
+		drawRectOutline(canvas, r, labelColor(a.Label), 2)
+	}
+
+	return saveImage(path, canvas, 90, nil)
+}
+
+// drawRectOutline draws the outline of r with the given line width onto img, inside r.
+func drawRectOutline(img draw.Image, r image.Rectangle, c color.Color, width int) {
+	src := image.NewUniform(c)
+	r = r.Intersect(img.Bounds())
+	for _, edge := range []image.Rectangle{
+		image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+width), // Top.
+		image.Rect(r.Min.X, r.Max.Y-width, r.Max.X, r.Max.Y), // Bottom.
+		image.Rect(r.Min.X, r.Min.Y, r.Min.X+width, r.Max.Y), // Left.
+		image.Rect(r.Max.X-width, r.Min.Y, r.Max.X, r.Max.Y), // Right.
+	} {
+		draw.Draw(img, edge.Intersect(r), src, image.Point{}, draw.Src)
+	}
+}
+
+// labelColor returns a saturated colour that is derived from the label, so that the same label has
+// the same colour in all images.
+func labelColor(label string) color.RGBA {
+	var hash uint32 = 2166136261 // FNV-1a.
+	for i := 0; i < len(label); i++ {
+		hash = (hash ^ uint32(label[i])) * 16777619
+	}
+	hue := float64(hash%360) / 60
+	x := uint8(255 * (1 - math.Abs(math.Mod(hue, 2)-1)))
+	switch int(hue) {
+	case 0:
+		return color.RGBA{R: 255, G: x, A: 255}
+	case 1:
+		return color.RGBA{R: x, G: 255, A: 255}
+	case 2:
+		return color.RGBA{G: 255, B: x, A: 255}
+	case 3:
+		return color.RGBA{G: x, B: 255, A: 255}
+	case 4:
+		return color.RGBA{R: x, B: 255, A: 255}
+	}
+	return color.RGBA{R: 255, B: x, A: 255}
+}
+
+// DatasetCardStage returns a Stage that adds each file to the statistics of the named output
+// dataset in c, see DatasetCard.Add, and passes it on unchanged. Apply it to the files that the
+// sink of each output dataset accepts, e.g. with TFRecordOptions.OnWrite, rather than to the files
+// passed to the sink, some of which may be skipped, so that the card describes the written files.
+func DatasetCardStage(c *DatasetCard, split string) Stage {
+	c.mu.Lock()
+	c.split(split) // Registers the split, so that the splits are listed in order.
+	c.mu.Unlock()
+
+	return func(f AnnotatedFile) ([]AnnotatedFile, error) {
+		c.Add(split, f)
+		return []AnnotatedFile{f}, nil
+	}
+}
@@ -0,0 +1,204 @@
+package lblconv
+
+// Detectron2 dataset dicts, the standard dataset format of Detectron2, as JSON files that a
+// DatasetCatalog function can load without the COCO API.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+)
+
+// Detectron2Record is a Detectron2 dataset dict of an image.
+type Detectron2Record struct {
+	FileName    string                 `json:"file_name"` // The path of the image.
+	Height      int                    `json:"height"`
+	Width       int                    `json:"width"`
+	ImageID     int                    `json:"image_id"`
+	Annotations []Detectron2Annotation `json:"annotations"`
+}
+
+// Detectron2Annotation is an instance annotation of a Detectron2Record.
+type Detectron2Annotation struct {
+	BBox       [4]float64 `json:"bbox"`      // The absolute x1, y1, x2, y2 coordinates.
+	BBoxMode   int        `json:"bbox_mode"` // Always detectron2BoxModeXYXYAbs.
+	CategoryID int        `json:"category_id"`
+
+	// The outline of the object as a single polygon of absolute x, y coordinates, if it has one.
+	Segmentation [][]float64 `json:"segmentation,omitempty"`
+
+	label string // The label, which is mapped to the CategoryID when the records are written.
+}
+
+// detectron2BoxModeXYXYAbs is the value of detectron2.structures.BoxMode.XYXY_ABS.
+const detectron2BoxModeXYXYAbs = 0
+
+// Detectron2Options holds the settings of the Detectron2 writer.
+type Detectron2Options struct {
+	// The classes, i.e. the thing_classes of the dataset metadata, in order of their category IDs
+	// from 0. Annotations with other labels are omitted. If empty, the classes are the labels of
+	// the dataset, sorted by label.
+	Classes []string
+}
+
+// ToDetectron2 converts f, which must have AbsoluteCoords, to a Detectron2Record with the given
+// image ID. The category IDs of the annotations are not set. Image-level labels are omitted.
+func ToDetectron2(f AnnotatedFile, imageID int) (Detectron2Record, error) {
+	width, height, err := f.Dimensions()
+	if err != nil {
+		return Detectron2Record{}, err
+	}
+	record := Detectron2Record{
+		FileName:    f.FilePath,
+		Height:      height,
+		Width:       width,
+		ImageID:     imageID,
+		Annotations: []Detectron2Annotation{},
+	}
+	for _, a := range f.Annotations {
+		if a.boolAttribute(ImageLabel) {
+			continue
+		}
+		ann := Detectron2Annotation{
+			BBox:     a.Coords,
+			BBoxMode: detectron2BoxModeXYXYAbs,
+			label:    a.Label,
+		}
+		if len(a.Polygon) >= 3 {
+			points := make([]float64, 0, 2*len(a.Polygon))
+			for _, p := range a.Polygon {
+				points = append(points, p[0], p[1])
+			}
+			ann.Segmentation = [][]float64{points}
+		}
+		record.Annotations = append(record.Annotations, ann)
+	}
+	return record, nil
+}
+
+// detectron2Sink is a Sink that writes a Detectron2 dataset dicts JSON file. The records are
+// written when the Sink is closed, as the category IDs are only known then.
+type detectron2Sink struct {
+	file    *atomicFile
+	opts    Detectron2Options
+	records []Detectron2Record
+}
+
+// NewDetectron2Sink returns a Sink that writes the files as a JSON array of Detectron2 dataset
+// dicts to outFile, with XYXY_ABS bounding boxes and category IDs by the classes of opts. The
+// classes are logged as the thing_classes to register with the dataset.
+func NewDetectron2Sink(outFile string, opts Detectron2Options) (Sink, error) {
+	file, err := createAtomicFile(outFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot write file %q: %v", outFile, err)
+	}
+	return &detectron2Sink{file: file, opts: opts, records: []Detectron2Record{}}, nil
+}
+
+// Write implements Sink. Files whose image dimensions cannot be determined are logged and skipped.
+func (s *detectron2Sink) Write(f AnnotatedFile) error {
+	record, err := ToDetectron2(f, len(s.records)+1)
+	if err != nil {
+		log.Print("Skipping file: ", err)
+		return ErrFileSkipped
+	}
+	s.records = append(s.records, record)
+	return nil
+}
+
+// Close implements Sink.
+func (s *detectron2Sink) Close() (err error) {
+	defer s.file.commit(&err)
+
+	classes := s.opts.Classes
+	if len(classes) == 0 {
+		seen := make(map[string]bool)
+		for _, r := range s.records {
+			for _, a := range r.Annotations {
+				if !seen[a.label] {
+					seen[a.label] = true
+					classes = append(classes, a.label)
+				}
+			}
+		}
+		sort.Strings(classes)
+	}
+	ids := make(map[string]int, len(classes))
+	for i, label := range classes {
+		ids[label] = i
+	}
+
+	omitted := make(map[string]int)
+	for i := range s.records {
+		r := &s.records[i]
+		annotations := r.Annotations[:0]
+		for _, a := range r.Annotations {
+			id, ok := ids[a.label]
+			if !ok {
+				omitted[a.label]++
+				continue
+			}
+			a.CategoryID = id
+			annotations = append(annotations, a)
+		}
+		r.Annotations = annotations
+	}
+	labels := make([]string, 0, len(omitted))
+	for label := range omitted {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		log.Printf("Omitted %d annotations with the label %q, which is not a Detectron2 class",
+			omitted[label], label)
+	}
+
+	thingClasses, err := json.Marshal(classes)
+	if err != nil {
+		return err
+	}
+	log.Printf("Detectron2 thing_classes: %s", thingClasses)
+
+	w := bufio.NewWriter(s.file)
+	if err := json.NewEncoder(w).Encode(s.records); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// Abort implements Aborter. It removes the output file.
+func (s *detectron2Sink) Abort() error {
+	return s.file.Abort()
+}
+
+// detectron2Format implements the Writer interface for Detectron2 dataset dicts JSON files.
+type detectron2Format struct{}
+
+// Write implements Writer.
+func (d detectron2Format) Write(outFile string, data AnnotatedFiles, opts FormatOptions) (
+		err error) {
+
+	s, err := d.NewSink(outFile, opts)
+	if err != nil {
+		return err
+	}
+	defer closeWithErrCheck(s, &err)
+
+	return writeFiles(s, data)
+}
+
+// NewSink implements StreamWriter.
+func (detectron2Format) NewSink(outFile string, opts FormatOptions) (Sink, error) {
+	return NewDetectron2Sink(outFile, opts.Detectron2)
+}
+
+func init() {
+	RegisterFormat(Format{
+		Name:        "detectron2",
+		Description: "Detectron2 dataset dicts JSON with XYXY_ABS bounding boxes",
+		Writer:      detectron2Format{},
+		WriterArgs:  "-labels-out <file> [-tfrecord-label-map-file <file>]",
+	})
+}
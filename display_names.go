@@ -0,0 +1,114 @@
+package lblconv
+
+// Human-readable display names of labels, e.g. for taxonomy codes, and the translation between
+// them.
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// LoadDisplayNames loads the display names of labels from the CSV file at path, with the label in
+// the first and its display name in the second column, like the class descriptions of Open Images
+// (/m/01yrx,Cat). The first row is skipped if it is a header, i.e. if its second column is
+// "display_name". Further columns are ignored.
+func LoadDisplayNames(path string) (names map[string]string, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer closeWithErrCheck(file, &err)
+
+	r := csv.NewReader(file)
+	r.FieldsPerRecord = -1
+	names = make(map[string]string)
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read the display names from %q: %v", path, err)
+		}
+		if line == 1 && len(record) > 1 && strings.TrimSpace(record[1]) == "display_name" {
+			continue
+		}
+		if len(record) < 2 {
+			return nil, fmt.Errorf("insufficient columns in line %d of %q", line, path)
+		}
+
+		label, name := strings.TrimSpace(record[0]), strings.TrimSpace(record[1])
+		if label == "" || name == "" {
+			return nil, fmt.Errorf("empty label or display name in line %d of %q", line, path)
+		}
+		if existing, ok := names[label]; ok && existing != name {
+			return nil, fmt.Errorf("conflicting display names %q and %q of %q in %q", existing,
+				name, label, path)
+		}
+		names[label] = name
+	}
+	return names, nil
+}
+
+// InvertDisplayNames returns the labels by display name in names, e.g. to translate display names
+// back to Open Images MIDs with TranslateLabelsStage. It returns an error if labels share a
+// display name, as the translation would be ambiguous.
+func InvertDisplayNames(names map[string]string) (map[string]string, error) {
+	labels := make(map[string]string, len(names))
+	var ambiguous []string
+	for label, name := range names {
+		if other, ok := labels[name]; ok {
+			if other > label {
+				other, label = label, other
+			}
+			ambiguous = append(ambiguous, fmt.Sprintf("%q (%s, %s)", name, other, label))
+			continue
+		}
+		labels[name] = label
+	}
+	if len(ambiguous) > 0 {
+		sort.Strings(ambiguous)
+		return nil, fmt.Errorf("display names of multiple labels: %s",
+			strings.Join(ambiguous, ", "))
+	}
+	return labels, nil
+}
+
+// TranslateLabelsStage returns a Stage that replaces the labels that are keys of names with their
+// values, e.g. the Open Images MIDs with their display names from LoadDisplayNames. The labels in
+// the AncestorLabels and AncestorConfidences attributes are translated likewise. Other labels are
+// kept. See InvertDisplayNames for the reverse translation.
+func TranslateLabelsStage(names map[string]string) Stage {
+	translate := func(label string) string {
+		if name, ok := names[label]; ok {
+			return name
+		}
+		return label
+	}
+
+	return func(f AnnotatedFile) ([]AnnotatedFile, error) {
+		for i := range f.Annotations {
+			a := &f.Annotations[i]
+			a.Label = translate(a.Label)
+
+			if ancestors, ok := a.Attributes[AncestorLabels].([]string); ok {
+				translated := make([]string, len(ancestors))
+				for j, ancestor := range ancestors {
+					translated[j] = translate(ancestor)
+				}
+				a.Attributes[AncestorLabels] = translated
+			}
+			if confidences, ok := a.Attributes[AncestorConfidences].(map[string]float64); ok {
+				translated := make(map[string]float64, len(confidences))
+				for ancestor, confidence := range confidences {
+					translated[translate(ancestor)] = confidence
+				}
+				a.Attributes[AncestorConfidences] = translated
+			}
+		}
+		return []AnnotatedFile{f}, nil
+	}
+}
@@ -0,0 +1,150 @@
+package lblconv
+
+// Error types returned by the readers and writers.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrImageNotFound is the underlying error when an image file referenced by the annotations does
+// not exist. Use errors.Is to test for it.
+var ErrImageNotFound = errors.New("image not found")
+
+// ErrImageTooLarge is the underlying error when an image has more pixels than allowed by
+// ImageProcessingOptions.MaxMegapixels, e.g. a decompression bomb. Use errors.Is to test for it.
+var ErrImageTooLarge = errors.New("image exceeds the max. number of pixels")
+
+// ErrImageTimeout is the underlying error when decoding and transforming an image takes longer
+// than ImageProcessingOptions.Timeout. Use errors.Is to test for it.
+var ErrImageTimeout = errors.New("image processing timed out")
+
+// ImageError records a failure to access the image at Path.
+type ImageError struct {
+	Path string
+	Err  error // E.g. ErrImageNotFound if the image does not exist.
+}
+
+func (e *ImageError) Error() string {
+	return fmt.Sprintf("cannot read image %q: %v", e.Path, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ImageError) Unwrap() error {
+	return e.Err
+}
+
+// newImageError wraps the error err that occurred while accessing the image at path in an
+// ImageError. A non-existing file is reported as ErrImageNotFound.
+func newImageError(path string, err error) error {
+	if os.IsNotExist(err) {
+		err = ErrImageNotFound
+	}
+	return &ImageError{Path: path, Err: err}
+}
+
+// ImageProcessingErrors lists the failures of AnnotatedFiles.ProcessImagesWithOptions, one per
+// file whose image could not be processed, e.g. ImageErrors.
+type ImageProcessingErrors struct {
+	Errors []error // In the order of the files.
+}
+
+// maxReportedImageErrors is the max. number of errors in the message of ImageProcessingErrors.
+const maxReportedImageErrors = 10
+
+func (e *ImageProcessingErrors) Error() string {
+	errs := e.Errors
+	if len(errs) > maxReportedImageErrors {
+		errs = errs[:maxReportedImageErrors]
+	}
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	msg := fmt.Sprintf("failed to process %d images: %s", len(e.Errors), strings.Join(msgs, "; "))
+	if n := len(e.Errors) - len(errs); n > 0 {
+		msg += fmt.Sprintf(" (and %d more)", n)
+	}
+	return msg
+}
+
+// Is reports whether any of the underlying errors matches target, see errors.Is.
+func (e *ImageProcessingErrors) Is(target error) bool {
+	for _, err := range e.Errors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first underlying error that matches target and sets target to it, see errors.As.
+func (e *ImageProcessingErrors) As(target interface{}) bool {
+	for _, err := range e.Errors {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseError records a failure to parse the label file or annotation at Path.
+//
+// Sources return a ParseError for a single label file that cannot be parsed, including when its
+// image is missing. Such errors are not fatal, i.e. Next can be called again to continue with the
+// following file.
+type ParseError struct {
+	Path string
+	Line int // The 1-based line number of the error, or 0 if unknown.
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("failed to parse %q, line %d: %v", e.Path, e.Line, e.Err)
+	}
+	return fmt.Sprintf("failed to parse %q: %v", e.Path, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// newParseError wraps err in a ParseError for the file at path, unless it already is one.
+func newParseError(path string, err error) error {
+	if _, ok := err.(*ParseError); ok {
+		return err
+	}
+	return &ParseError{Path: path, Err: err}
+}
+
+// newJSONParseError returns a ParseError for the error err returned by json.Unmarshal when decoding
+// data from the file at path. The line number is derived from the error offset, if available.
+func newJSONParseError(path string, data []byte, err error) error {
+	offset := int64(-1)
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		offset = e.Offset
+	case *json.UnmarshalTypeError:
+		offset = e.Offset
+	}
+
+	line := 0
+	if offset >= 0 && offset <= int64(len(data)) {
+		line = 1 + bytes.Count(data[:offset], []byte("\n"))
+	}
+
+	return &ParseError{Path: path, Line: line, Err: err}
+}
+
+// isSkippable returns whether err only affects a single file of a Source, which can then be
+// skipped.
+func isSkippable(err error) bool {
+	var parseErr *ParseError
+	return errors.As(err, &parseErr)
+}
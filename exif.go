@@ -0,0 +1,342 @@
+package lblconv
+
+// Copying selected EXIF metadata from the input to the output images.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strings"
+)
+
+// ExifTags selects the EXIF metadata that ProcessImagesWithOptions copies to the output images. The
+// images are re-encoded without any metadata otherwise, i.e. EXIF, XMP and other metadata is
+// stripped. The orientation is never copied, as the pixels are decoded without applying it.
+type ExifTags int
+
+// The supported EXIF tag groups, which can be combined with |.
+const (
+	// The date and time of the image, its capture and digitisation, with their time zone offsets
+	// and sub-second parts.
+	ExifTimestamp ExifTags = 1 << iota
+
+	// The GPS IFD, i.e. all GPS tags such as the position, altitude and GPS time.
+	ExifGPS
+)
+
+// ParseExifTags parses comma-separated EXIF tag groups {timestamp, gps}. The empty string strips
+// all metadata.
+func ParseExifTags(spec string) (ExifTags, error) {
+	var tags ExifTags
+	if spec == "" {
+		return tags, nil
+	}
+	for _, v := range strings.Split(spec, ",") {
+		switch v {
+		case "timestamp":
+			tags |= ExifTimestamp
+		case "gps":
+			tags |= ExifGPS
+		default:
+			return 0, fmt.Errorf("unknown EXIF tags %q", v)
+		}
+	}
+	return tags, nil
+}
+
+// The EXIF tags of IFD0 that are referenced explicitly.
+const (
+	exifTagOrientation = 0x0112
+	exifTagDateTime    = 0x0132
+	exifTagExifIFD     = 0x8769
+	exifTagGPSIFD      = 0x8825
+)
+
+// The layout of EXIF data.
+const (
+	exifHeader       = "Exif\x00\x00" // The prefix of the TIFF data in a JPEG APP1 segment.
+	exifEntrySize    = 12
+	exifIFDFixedSize = 2 + 4 // The entry count and the offset of the next IFD.
+)
+
+// exifTimestampTags are the ExifTimestamp tags of the Exif IFD.
+var exifTimestampTags = map[uint16]bool{
+	0x9003: true, // DateTimeOriginal
+	0x9004: true, // DateTimeDigitized
+	0x9010: true, // OffsetTime
+	0x9011: true, // OffsetTimeOriginal
+	0x9012: true, // OffsetTimeDigitized
+	0x9290: true, // SubSecTime
+	0x9291: true, // SubSecTimeOriginal
+	0x9292: true, // SubSecTimeDigitized
+}
+
+// exifTypeSizes are the sizes of the TIFF field types in bytes.
+var exifTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8,
+	11: 4, 12: 8}
+
+// exifEntry is a TIFF IFD entry. The value is in the byte order of the TIFF data it was read from.
+type exifEntry struct {
+	tag, kind uint16
+	count     uint32
+	value     []byte
+}
+
+// embeddedExif returns the TIFF data of the EXIF metadata of the JPEG (APP1 segment) or PNG (eXIf
+// chunk) image data, or nil if it has none.
+func embeddedExif(data []byte, format string) []byte {
+	switch format {
+	case "jpeg":
+		for i := 2; i+4 <= len(data) && data[i] == 0xff && data[i+1] != 0xda; {
+			length := int(binary.BigEndian.Uint16(data[i+2:]))
+			if length < 2 || i+2+length > len(data) {
+				break
+			}
+			segment := data[i+4 : i+2+length]
+			if data[i+1] == 0xe1 && strings.HasPrefix(string(segment), exifHeader) {
+				return segment[len(exifHeader):]
+			}
+			i += 2 + length
+		}
+	case "png":
+		for i := 8; i+12 <= len(data); {
+			length := int(binary.BigEndian.Uint32(data[i:]))
+			kind := string(data[i+4 : i+8])
+			if length < 0 || i+12+length > len(data) || kind == "IEND" {
+				break
+			}
+			if kind == "eXIf" {
+				return data[i+8 : i+8+length]
+			}
+			i += 12 + length
+		}
+	}
+	return nil
+}
+
+// selectExif returns new TIFF data with the tags of the TIFF data tiff that are selected by tags,
+// or nil if there are none or the data is invalid.
+func selectExif(tiff []byte, tags ExifTags) []byte {
+	if tags == 0 || len(tiff) < 8 {
+		return nil
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil
+	}
+
+	ifd0, ok := readExifIFD(tiff, order, order.Uint32(tiff[4:]))
+	if !ok {
+		return nil
+	}
+	var selected, exifIFD, gpsIFD []exifEntry
+	for _, e := range ifd0 {
+		switch {
+		case e.tag == exifTagDateTime && tags&ExifTimestamp != 0:
+			selected = append(selected, e)
+		case e.tag == exifTagExifIFD && tags&ExifTimestamp != 0 && len(e.value) == 4:
+			entries, _ := readExifIFD(tiff, order, order.Uint32(e.value))
+			for _, e := range entries {
+				if exifTimestampTags[e.tag] {
+					exifIFD = append(exifIFD, e)
+				}
+			}
+		case e.tag == exifTagGPSIFD && tags&ExifGPS != 0 && len(e.value) == 4:
+			gpsIFD, _ = readExifIFD(tiff, order, order.Uint32(e.value))
+		}
+	}
+	if len(selected) == 0 && len(exifIFD) == 0 && len(gpsIFD) == 0 {
+		return nil
+	}
+
+	// Lay out IFD0 and the sub-IFDs one after another, and point to the sub-IFDs from IFD0.
+	pointer := func(tag uint16) exifEntry {
+		return exifEntry{tag: tag, kind: 4, count: 1, value: make([]byte, 4)}
+	}
+	if len(exifIFD) > 0 {
+		selected = append(selected, pointer(exifTagExifIFD))
+	}
+	if len(gpsIFD) > 0 {
+		selected = append(selected, pointer(exifTagGPSIFD))
+	}
+	sort.Slice(selected, func(i, j int) bool { return selected[i].tag < selected[j].tag })
+	offset := 8 + exifIFDSize(selected)
+	for _, e := range selected {
+		switch e.tag {
+		case exifTagExifIFD:
+			order.PutUint32(e.value, uint32(offset))
+			offset += exifIFDSize(exifIFD)
+		case exifTagGPSIFD:
+			order.PutUint32(e.value, uint32(offset))
+			offset += exifIFDSize(gpsIFD)
+		}
+	}
+
+	out := append([]byte(nil), tiff[:4]...)
+	out = appendUint32(out, order, 8)
+	out = appendExifIFD(out, order, selected)
+	for _, e := range selected {
+		switch e.tag {
+		case exifTagExifIFD:
+			out = appendExifIFD(out, order, exifIFD)
+		case exifTagGPSIFD:
+			out = appendExifIFD(out, order, gpsIFD)
+		}
+	}
+	return out
+}
+
+// exifOrientation returns the orientation tag of the TIFF data tiff, from 1 (upright) to 8, or 1 if
+// it has none or the data is invalid. Orientations 5 to 8 swap the width and height.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd0, _ := readExifIFD(tiff, order, order.Uint32(tiff[4:]))
+	for _, e := range ifd0 {
+		if e.tag == exifTagOrientation && e.kind == 3 && len(e.value) >= 2 {
+			if v := int(order.Uint16(e.value)); v >= 1 && v <= 8 {
+				return v
+			}
+		}
+	}
+	return 1
+}
+
+// readExifIFD reads the entries of the IFD at offset in tiff. Entries with an invalid type or value
+// offset are skipped. Returns false if the IFD itself is invalid.
+func readExifIFD(tiff []byte, order binary.ByteOrder, offset uint32) ([]exifEntry, bool) {
+	if uint64(offset)+2 > uint64(len(tiff)) {
+		return nil, false
+	}
+	n := int(order.Uint16(tiff[offset:]))
+	start := int(offset) + 2
+	if start+n*exifEntrySize > len(tiff) {
+		return nil, false
+	}
+
+	entries := make([]exifEntry, 0, n)
+	for i := 0; i < n; i++ {
+		raw := tiff[start+i*exifEntrySize:]
+		e := exifEntry{tag: order.Uint16(raw), kind: order.Uint16(raw[2:]),
+			count: order.Uint32(raw[4:])}
+		typeSize, ok := exifTypeSizes[e.kind]
+		if !ok {
+			continue
+		}
+		size := uint64(typeSize) * uint64(e.count)
+		if size <= 4 {
+			e.value = append([]byte(nil), raw[8:8+size]...)
+		} else {
+			valueOffset := uint64(order.Uint32(raw[8:]))
+			if valueOffset+size > uint64(len(tiff)) {
+				continue
+			}
+			e.value = append([]byte(nil), tiff[valueOffset:valueOffset+size]...)
+		}
+		entries = append(entries, e)
+	}
+	return entries, true
+}
+
+// exifIFDSize returns the size of the IFD with entries, including the values that do not fit into
+// the entries.
+func exifIFDSize(entries []exifEntry) int {
+	size := exifIFDFixedSize + len(entries)*exifEntrySize
+	for _, e := range entries {
+		if len(e.value) > 4 {
+			size += len(e.value) + len(e.value)%2
+		}
+	}
+	return size
+}
+
+// appendExifIFD appends the IFD with entries, which must be sorted by tag, to out, followed by the
+// values that do not fit into the entries. The IFD is not linked to a next IFD.
+func appendExifIFD(out []byte, order binary.ByteOrder, entries []exifEntry) []byte {
+	valueOffset := len(out) + exifIFDFixedSize + len(entries)*exifEntrySize
+	var values []byte
+	out = appendUint16(out, order, uint16(len(entries)))
+	for _, e := range entries {
+		out = appendUint16(out, order, e.tag)
+		out = appendUint16(out, order, e.kind)
+		out = appendUint32(out, order, e.count)
+		if len(e.value) <= 4 {
+			var value [4]byte
+			copy(value[:], e.value)
+			out = append(out, value[:]...)
+			continue
+		}
+		out = appendUint32(out, order, uint32(valueOffset+len(values)))
+		values = append(values, e.value...)
+		if len(e.value)%2 != 0 {
+			values = append(values, 0) // Values start on a word boundary.
+		}
+	}
+	out = appendUint32(out, order, 0)
+	return append(out, values...)
+}
+
+// insertExif returns the encoded JPEG or PNG image data with the TIFF data tiff inserted as its
+// EXIF metadata, i.e. as an APP1 segment after the start-of-image marker or as an eXIf chunk
+// after the IHDR chunk.
+func insertExif(data []byte, format string, tiff []byte) ([]byte, error) {
+	var out bytes.Buffer
+	switch format {
+	case "jpeg":
+		length := 2 + len(exifHeader) + len(tiff)
+		if length > 0xffff || len(data) < 2 {
+			return nil, fmt.Errorf("cannot insert EXIF data of %d bytes", len(tiff))
+		}
+		out.Write(data[:2])
+		out.Write([]byte{0xff, 0xe1, byte(length >> 8), byte(length)})
+		out.WriteString(exifHeader)
+		out.Write(tiff)
+		out.Write(data[2:])
+	case "png":
+		const ihdrEnd = 8 + 12 + 13 // The signature and the IHDR chunk.
+		if len(data) < ihdrEnd {
+			return nil, fmt.Errorf("invalid PNG data")
+		}
+		out.Write(data[:ihdrEnd])
+		chunk := append([]byte("eXIf"), tiff...)
+		binary.Write(&out, binary.BigEndian, uint32(len(tiff)))
+		out.Write(chunk)
+		binary.Write(&out, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+		out.Write(data[ihdrEnd:])
+	default:
+		return nil, fmt.Errorf("unsupported image format %q", format)
+	}
+	return out.Bytes(), nil
+}
+
+// appendUint16 appends v to out in order.
+func appendUint16(out []byte, order binary.ByteOrder, v uint16) []byte {
+	var b [2]byte
+	order.PutUint16(b[:], v)
+	return append(out, b[:]...)
+}
+
+// appendUint32 appends v to out in order.
+func appendUint32(out []byte, order binary.ByteOrder, v uint32) []byte {
+	var b [4]byte
+	order.PutUint32(b[:], v)
+	return append(out, b[:]...)
+}
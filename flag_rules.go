@@ -0,0 +1,204 @@
+package lblconv
+
+// Rules that flag annotations as difficult or ignored.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FlagRule sets the bool attribute Flag, e.g. Difficult or Ignore, of the annotations that match
+// all of its conditions. A zero-valued condition is disabled, so a rule without conditions matches
+// all annotations. Image-level labels never match.
+type FlagRule struct {
+	Flag string // The attribute to set, e.g. Difficult or Ignore.
+
+	Labels []string // The labels to match; empty matches all.
+
+	// Match bounding boxes with a width, height or area (in pixels) less than these values.
+	MaxBboxWidth, MaxBboxHeight, MaxBboxArea float64
+
+	// Match annotations with a Confidence less than this value. Annotations without a confidence
+	// value do not match.
+	MaxConfidence float64
+
+	Truncated bool // Match annotations with the Truncated attribute only.
+}
+
+// match returns whether the rule applies to a.
+func (r *FlagRule) match(a Annotation) bool {
+	if a.boolAttribute(ImageLabel) {
+		return false
+	}
+	if len(r.Labels) > 0 {
+		found := false
+		for _, label := range r.Labels {
+			found = found || label == a.Label
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.MaxBboxWidth > 0 && a.Width() >= r.MaxBboxWidth ||
+			r.MaxBboxHeight > 0 && a.Height() >= r.MaxBboxHeight ||
+			r.MaxBboxArea > 0 && a.Width()*a.Height() >= r.MaxBboxArea {
+		return false
+	}
+	if r.MaxConfidence > 0 {
+		if c, ok := a.Attributes[Confidence].(float64); !ok || c >= r.MaxConfidence {
+			return false
+		}
+	}
+	return !r.Truncated || a.boolAttribute(Truncated)
+}
+
+// ParseFlagRules parses rules in the format flag:condition[,condition...], separated by ";", e.g.
+// "difficult:height<16;ignore:label=crowd|group". The flag is difficult or ignore, and the
+// conditions are label=l1|l2|..., width<n, height<n, area<n, confidence<n and truncated.
+func ParseFlagRules(spec string) ([]FlagRule, error) {
+	var rules []FlagRule
+	for _, v := range strings.Split(spec, ";") {
+		sep := strings.Index(v, ":")
+		if sep < 0 {
+			sep = len(v)
+		}
+
+		var rule FlagRule
+		switch flag := strings.TrimSpace(v[:sep]); flag {
+		case "difficult":
+			rule.Flag = Difficult
+		case "ignore":
+			rule.Flag = Ignore
+		default:
+			return nil, fmt.Errorf("invalid flag %q in rule %q", flag, v)
+		}
+		if sep == len(v) {
+			rules = append(rules, rule)
+			continue
+		}
+
+		for _, cond := range strings.Split(v[sep+1:], ",") {
+			cond = strings.TrimSpace(cond)
+			if cond == "truncated" {
+				rule.Truncated = true
+				continue
+			}
+			if strings.HasPrefix(cond, "label=") {
+				rule.Labels = strings.Split(cond[len("label="):], "|")
+				continue
+			}
+
+			lt := strings.Index(cond, "<")
+			if lt < 0 {
+				return nil, fmt.Errorf("invalid condition %q in rule %q", cond, v)
+			}
+			n, err := strconv.ParseFloat(cond[lt+1:], 64)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid value in condition %q in rule %q", cond, v)
+			}
+			switch cond[:lt] {
+			case "width":
+				rule.MaxBboxWidth = n
+			case "height":
+				rule.MaxBboxHeight = n
+			case "area":
+				rule.MaxBboxArea = n
+			case "confidence":
+				rule.MaxConfidence = n
+			default:
+				return nil, fmt.Errorf("invalid condition %q in rule %q", cond, v)
+			}
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// applyFlagRules sets the flags of the annotations of f that match the rules. Returns the number
+// of annotations flagged by flag, excluding those that were already flagged.
+func (f *AnnotatedFile) applyFlagRules(rules []FlagRule) map[string]int {
+	var counts map[string]int
+	for i := range f.Annotations {
+		a := &f.Annotations[i]
+		copied := false
+		for j := range rules {
+			r := &rules[j]
+			if a.boolAttribute(r.Flag) || !r.match(*a) {
+				continue
+			}
+
+			// Copy the attributes on the first change, as they may be shared with other files.
+			if !copied {
+				attrs := make(map[string]interface{}, 1+len(a.Attributes))
+				for k, v := range a.Attributes {
+					attrs[k] = v
+				}
+				a.Attributes = attrs
+				copied = true
+			}
+			a.Attributes[r.Flag] = true
+
+			if counts == nil {
+				counts = make(map[string]int)
+			}
+			counts[r.Flag]++
+		}
+	}
+	return counts
+}
+
+// ApplyFlagRules sets the flags of the annotations that match the rules, e.g. to mark small
+// objects as Difficult instead of removing them. Returns the number of annotations flagged by
+// flag.
+func (data *AnnotatedFiles) ApplyFlagRules(rules []FlagRule) map[string]int {
+	counts := make(map[string]int)
+	for i := range *data {
+		for flag, n := range (*data)[i].applyFlagRules(rules) {
+			counts[flag] += n
+		}
+	}
+	return counts
+}
+
+// FlagCounts accumulates the number of annotations flagged by FlagRulesStage by flag. It is safe
+// for concurrent use.
+type FlagCounts struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// NewFlagCounts returns an empty FlagCounts.
+func NewFlagCounts() *FlagCounts {
+	return &FlagCounts{counts: make(map[string]int)}
+}
+
+// ByFlag returns a copy of the counts by flag.
+func (c *FlagCounts) ByFlag() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	counts := make(map[string]int, len(c.counts))
+	for flag, n := range c.counts {
+		counts[flag] = n
+	}
+	return counts
+}
+
+// FlagRulesStage returns a Stage that applies AnnotatedFiles.ApplyFlagRules to each file. The
+// number of flagged annotations are added to counts, unless it is nil.
+func FlagRulesStage(rules []FlagRule, counts *FlagCounts) Stage {
+	return func(f AnnotatedFile) ([]AnnotatedFile, error) {
+		n := f.applyFlagRules(rules)
+		if counts != nil && len(n) > 0 {
+			counts.mu.Lock()
+			for flag, v := range n {
+				counts.counts[flag] += v
+			}
+			counts.mu.Unlock()
+		}
+		return []AnnotatedFile{f}, nil
+	}
+}
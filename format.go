@@ -0,0 +1,337 @@
+package lblconv
+
+// Label format registry.
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Provenance describes how a dataset was created.
+type Provenance struct {
+	Version string   `json:"version"` // The lblconv version.
+	Args    []string `json:"args"`    // The command line arguments or pipeline parameters.
+}
+
+// String returns the provenance as a single line. Arguments with whitespace or quotes are quoted.
+func (p Provenance) String() string {
+	args := make([]string, len(p.Args))
+	for i, arg := range p.Args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n\"'") {
+			arg = strconv.Quote(arg)
+		}
+		args[i] = arg
+	}
+	return fmt.Sprintf("lblconv %s: %s", p.Version, strings.Join(args, " "))
+}
+
+// FormatOptions holds the settings of Readers and Writers. Each format uses the options that apply
+// to it and ignores the others.
+type FormatOptions struct {
+	ImageDir string // The image input directory, for formats that match label files to images.
+
+	// How label files are matched to the images in ImageDir.
+	ImageMatch ImageMatchOptions
+
+	// The provenance of the output, which is recorded by the formats that can carry it (VIA,
+	// prototxt TFRecord label maps and COCO captions), if not nil.
+	Provenance *Provenance
+
+	// The rounding of the coordinates written by the Writers, see CoordRounding.
+	Rounding CoordRounding
+
+	// Whether the Readers of formats with normalized coordinates, e.g. AWS Rekognition, return
+	// files with NormalizedCoords, rather than read the size of every image to convert them. The
+	// files must then be converted where absolute coordinates are expected, see
+	// AbsoluteCoordsStage. OpenSink converts them for the Writers that are not NormalizedWriters.
+	NormalizedCoords bool
+
+	// Whether duplicate entries for the same image in Sloth and VIA files are an error. Their
+	// annotations are merged otherwise.
+	StrictDuplicates bool
+
+	// Whether to validate Sloth and VIA files against their JSON Schemas, SlothJSONSchema and
+	// VIAJSONSchema, before reading them. Files that fail to decode are validated regardless, to
+	// report the location of the malformed entries.
+	ValidateInput bool
+
+	// The declared attribute types, which VIA attribute values are coerced to when reading and
+	// described as when writing. DefaultAttributeSchema applies if nil.
+	Attributes AttributeSchema
+
+	// The name of the output dataset, if the dataset is split into named datasets. The Google
+	// Cloud formats map it to the training, validation or test set.
+	Split string
+
+	// The Cloud Storage location of the images for the Google Cloud formats, e.g.
+	// "gs://bucket/images/". The image file names are appended to it.
+	GCSPrefix string
+
+	TFRecordLabelMapPath string          // The path to the TFRecord label map file.
+	TFRecord             TFRecordOptions // The TFRecord writer options.
+
+	// Whether to write display names to label maps, see TFRecordLabelMap.DisplayNames, and the IDs
+	// of label maps. These do not apply to a label map passed in TFRecord.LabelMap.
+	LabelMapDisplayNames bool
+	LabelMap             LabelMapOptions
+
+	// The display names of the labels, see LoadDisplayNames, for label maps and the label options
+	// of VIA projects. They do not apply to a label map passed in TFRecord.LabelMap either.
+	DisplayNames map[string]string
+
+	AWSDetectLabels AWSDetectLabelsOptions // The AWS detect-labels parsing options.
+
+	Inference InferenceOptions // The inference endpoint options.
+	VIA       VIAOptions       // The VIA project options.
+	Sloth     SlothOptions     // The Sloth output options.
+	SQL       SQLOptions       // The SQL output options.
+	Parquet   ParquetOptions   // The Parquet output options.
+	KITTI     KITTIOptions     // The KITTI score options.
+	Anchors   AnchorOptions    // The anchor box clustering options.
+
+	COCOCaptions COCOCaptionsOptions // The COCO captions output options.
+	OneHot       OneHotOptions       // The one-hot CSV output options.
+	Detectron2   Detectron2Options   // The Detectron2 output options.
+}
+
+// Reader parses the label dataset at path, which is a file or directory, depending on the format.
+type Reader interface {
+	Parse(path string, opts FormatOptions) ([]AnnotatedFile, error)
+}
+
+// Writer serialises data to the label dataset at path, which is a file or directory, depending on
+// the format.
+type Writer interface {
+	Write(path string, data AnnotatedFiles, opts FormatOptions) error
+}
+
+// StreamReader is implemented by Readers that can parse a dataset incrementally.
+type StreamReader interface {
+	NewSource(path string, opts FormatOptions) (Source, error)
+}
+
+// StreamWriter is implemented by Writers that can serialise a dataset incrementally.
+type StreamWriter interface {
+	NewSink(path string, opts FormatOptions) (Sink, error)
+}
+
+// Format describes a label format.
+type Format struct {
+	Name        string // The unique name of the format, e.g. as used on the command line.
+	Description string // A human readable description.
+
+	Reader Reader // Nil if the format cannot be read.
+	Writer Writer // Nil if the format cannot be written.
+
+	// Descriptions of the arguments required by the Reader and Writer, e.g. for usage messages.
+	ReaderArgs, WriterArgs string
+}
+
+var (
+	formatsMu sync.RWMutex
+	formats   = make(map[string]Format)
+)
+
+// RegisterFormat makes the format f available by name, e.g. to the lblconv command. It panics if
+// f has no name or a format with the same name is already registered.
+func RegisterFormat(f Format) {
+	formatsMu.Lock()
+	defer formatsMu.Unlock()
+
+	if f.Name == "" {
+		panic("lblconv: RegisterFormat called with an empty format name")
+	}
+	if _, dup := formats[f.Name]; dup {
+		panic("lblconv: RegisterFormat called twice for format " + f.Name)
+	}
+	formats[f.Name] = f
+}
+
+// LookupFormat returns the registered format with the given name.
+func LookupFormat(name string) (Format, bool) {
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+
+	f, ok := formats[name]
+	return f, ok
+}
+
+// Formats returns all registered formats, sorted by name.
+func Formats() []Format {
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+
+	list := make([]Format, 0, len(formats))
+	for _, f := range formats {
+		list = append(list, f)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list
+}
+
+// OpenSource returns a Source for the dataset at path. It streams the dataset if r implements
+// StreamReader, and parses it in full otherwise.
+func OpenSource(r Reader, path string, opts FormatOptions) (Source, error) {
+	if sr, ok := r.(StreamReader); ok {
+		return sr.NewSource(path, opts)
+	}
+
+	data, err := r.Parse(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	return NewSliceSource(data), nil
+}
+
+// OpenSink returns a Sink for the dataset at path. It streams the dataset if w implements
+// StreamWriter. Otherwise, the files are collected in memory and written when the Sink is closed.
+// The coordinates are converted to AbsoluteCoords unless w is a NormalizedWriter, and rounded as
+// per opts.Rounding, before they are passed to w.
+func OpenSink(w Writer, path string, opts FormatOptions) (Sink, error) {
+	var sink Sink = &writerSink{w: w, path: path, opts: opts}
+	if sw, ok := w.(StreamWriter); ok {
+		var err error
+		if sink, err = sw.NewSink(path, opts); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Rounding.Mode != RoundNone {
+		sink = NewStageSink(sink, RoundCoordsStage(opts.Rounding))
+	}
+	// Pixel rounding requires absolute coordinates, too.
+	if opts.Rounding.Mode != RoundNone || !acceptsNormalizedCoords(w) {
+		sink = NewStageSink(sink, AbsoluteCoordsStage())
+	}
+	return sink, nil
+}
+
+// OpenAppendSink returns a Sink that updates the existing dataset at path, which is parsed with r
+// and must be a single file. Files written to the Sink replace the existing files with the same
+// image path in place, and the others are added after the existing files. All files are collected
+// in memory and written to a temporary file when the Sink is closed, which then replaces the
+// existing file, so that it is kept if the Sink is aborted. If path does not exist, the Sink is
+// equivalent to OpenSink.
+func OpenAppendSink(r Reader, w Writer, path string, opts FormatOptions) (Sink, error) {
+	existing, err := r.Parse(path, opts)
+	if os.IsNotExist(err) {
+		return OpenSink(w, path, opts)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to parse the existing output %q: %v", path, err)
+	}
+
+	s := &appendSink{
+		w:           w,
+		path:        path,
+		opts:        opts,
+		files:       existing,
+		index:       make(map[string]int, len(existing)),
+		numExisting: len(existing),
+	}
+	for i, f := range existing {
+		s.index[imagePathKey(f.FilePath)] = i
+	}
+	return s, nil
+}
+
+// appendSink is a Sink that merges the files written to it into an existing dataset.
+type appendSink struct {
+	w           Writer
+	path        string
+	opts        FormatOptions
+	files       AnnotatedFiles // The existing files, updated with the files written.
+	index       map[string]int // The index in files by image path key.
+	numExisting int            // The number of existing files, which precede the added files.
+	replaced    int            // The number of writes that replaced an existing file.
+	added       int            // The number of files added.
+}
+
+// Write implements Sink.
+func (s *appendSink) Write(f AnnotatedFile) error {
+	key := imagePathKey(f.FilePath)
+	if i, ok := s.index[key]; ok {
+		if i < s.numExisting {
+			s.replaced++
+		}
+		s.files[i] = f
+		return nil
+	}
+	s.index[key] = len(s.files)
+	s.files = append(s.files, f)
+	s.added++
+	return nil
+}
+
+// Close implements Sink.
+func (s *appendSink) Close() (err error) {
+	// Keep the file extension, which may select the output format.
+	dir, name := filepath.Split(s.path)
+	tmpPath := filepath.Join(dir, ".lblconv-tmp-"+name)
+
+	sink, err := OpenSink(s.w, tmpPath, s.opts)
+	if err != nil {
+		return err
+	}
+	for _, f := range s.files {
+		if err := sink.Write(f); err != nil {
+			_ = AbortSink(sink)
+			return err
+		}
+	}
+	if err := sink.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("failed to replace %q: %v", s.path, err)
+	}
+
+	log.Printf("Replaced %d and added %d files in %q", s.replaced, s.added, s.path)
+	return nil
+}
+
+// Abort implements Aborter. Nothing has been written yet, so the collected files are discarded.
+func (s *appendSink) Abort() error {
+	s.files = nil
+	return nil
+}
+
+// writerSink is a Sink that collects the files for a Writer without streaming support.
+type writerSink struct {
+	w    Writer
+	path string
+	opts FormatOptions
+	data AnnotatedFiles
+}
+
+// Write implements Sink.
+func (s *writerSink) Write(f AnnotatedFile) error {
+	s.data = append(s.data, f)
+	return nil
+}
+
+// Close implements Sink.
+func (s *writerSink) Close() error {
+	return s.w.Write(s.path, s.data, s.opts)
+}
+
+// Abort implements Aborter. Nothing has been written yet, so the collected files are discarded.
+func (s *writerSink) Abort() error {
+	s.data = nil
+	return nil
+}
+
+// requireImageDir returns an error if opts does not specify the image directory.
+func requireImageDir(opts FormatOptions) error {
+	if opts.ImageDir == "" {
+		return fmt.Errorf("missing image input directory")
+	}
+	return nil
+}
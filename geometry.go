@@ -0,0 +1,100 @@
+package lblconv
+
+// Conversions between the bounding box and polygon representations of the label formats.
+//
+// The coordinates of an Annotation are x1, y1, x2, y2, i.e. the top-left and bottom-right corners
+// of the bounding box (xyxy). The functions below convert them from and to the representations of
+// other formats, e.g. for custom Readers and Writers. They apply to absolute and normalized
+// coordinates alike.
+
+import "math"
+
+// CoordsFromXYWH returns the coordinates of the bounding box with the top-left corner x, y and the
+// size width x height (xywh), e.g. of Sloth, VIA, COCO or AWS Rekognition.
+func CoordsFromXYWH(x, y, width, height float64) [4]float64 {
+	return [4]float64{x, y, x + width, y + height}
+}
+
+// CoordsToXYWH returns the top-left corner and size of the bounding box with coordinates c.
+func CoordsToXYWH(c [4]float64) (x, y, width, height float64) {
+	return c[0], c[1], c[2] - c[0], c[3] - c[1]
+}
+
+// CoordsFromCXCYWH returns the coordinates of the bounding box with the centre cx, cy and the size
+// width x height (cxcywh), e.g. of YOLO.
+func CoordsFromCXCYWH(cx, cy, width, height float64) [4]float64 {
+	return [4]float64{cx - width/2, cy - height/2, cx + width/2, cy + height/2}
+}
+
+// CoordsToCXCYWH returns the centre and size of the bounding box with coordinates c.
+func CoordsToCXCYWH(c [4]float64) (cx, cy, width, height float64) {
+	return (c[0] + c[2]) / 2, (c[1] + c[3]) / 2, c[2] - c[0], c[3] - c[1]
+}
+
+// NormalizeCoords returns the coordinates c of a bounding box in an image of the given size as
+// fractions of the size, i.e. in NormalizedCoords.
+func NormalizeCoords(c [4]float64, width, height int) [4]float64 {
+	w, h := float64(width), float64(height)
+	return [4]float64{c[0] / w, c[1] / h, c[2] / w, c[3] / h}
+}
+
+// DenormalizeCoords returns the NormalizedCoords c of a bounding box in an image of the given size
+// as absolute pixel offsets.
+func DenormalizeCoords(c [4]float64, width, height int) [4]float64 {
+	w, h := float64(width), float64(height)
+	return [4]float64{c[0] * w, c[1] * h, c[2] * w, c[3] * h}
+}
+
+// PolygonBounds returns the coordinates of the bounding box of the polygon with the given
+// vertices, i.e. of its axis-aligned hull. Returns zero coordinates if polygon is empty.
+func PolygonBounds(polygon [][2]float64) [4]float64 {
+	if len(polygon) == 0 {
+		return [4]float64{}
+	}
+	c := [4]float64{polygon[0][0], polygon[0][1], polygon[0][0], polygon[0][1]}
+	for _, p := range polygon[1:] {
+		c[0], c[1] = math.Min(c[0], p[0]), math.Min(c[1], p[1])
+		c[2], c[3] = math.Max(c[2], p[0]), math.Max(c[3], p[1])
+	}
+	return c
+}
+
+// CoordsPolygon returns the corners of the bounding box with coordinates c as a polygon, clockwise
+// from the top-left corner, e.g. for formats that only store polygons.
+func CoordsPolygon(c [4]float64) [][2]float64 {
+	return [][2]float64{{c[0], c[1]}, {c[2], c[1]}, {c[2], c[3]}, {c[0], c[3]}}
+}
+
+// CoordsArea returns the area of the bounding box with coordinates c, or zero if it is empty or
+// inverted.
+func CoordsArea(c [4]float64) float64 {
+	return math.Max(0, c[2]-c[0]) * math.Max(0, c[3]-c[1])
+}
+
+// IntersectCoords returns the coordinates of the intersection of the bounding boxes with
+// coordinates a and b, and whether they overlap, i.e. whether the intersection has a positive area.
+func IntersectCoords(a, b [4]float64) ([4]float64, bool) {
+	c := [4]float64{
+		math.Max(a[0], b[0]), math.Max(a[1], b[1]), math.Min(a[2], b[2]), math.Min(a[3], b[3]),
+	}
+	return c, c[2] > c[0] && c[3] > c[1]
+}
+
+// UnionCoords returns the coordinates of the smallest bounding box that encloses the bounding
+// boxes with coordinates a and b.
+func UnionCoords(a, b [4]float64) [4]float64 {
+	return [4]float64{
+		math.Min(a[0], b[0]), math.Min(a[1], b[1]), math.Max(a[2], b[2]), math.Max(a[3], b[3]),
+	}
+}
+
+// CoordsIoU returns the intersection over union of the bounding boxes with coordinates a and b,
+// i.e. the area of their intersection divided by the area covered by either, in [0, 1].
+func CoordsIoU(a, b [4]float64) float64 {
+	inter, ok := IntersectCoords(a, b)
+	if !ok {
+		return 0
+	}
+	interArea := CoordsArea(inter)
+	return interArea / (CoordsArea(a) + CoordsArea(b) - interArea)
+}
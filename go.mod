@@ -1,6 +1,6 @@
 module github.com/sensorable/lblconv
 
-go 1.12
+go 1.13
 
 require (
 	github.com/disintegration/imaging v1.6.0
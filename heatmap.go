@@ -0,0 +1,195 @@
+package lblconv
+
+// Bounding box heatmap functionality, to visualise the spatial distribution of the annotations.
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// HeatmapOptions configures a BboxHeatmap.
+type HeatmapOptions struct {
+	Size int // The width and height of the heatmaps in cells (pixels). Defaults to 64.
+
+	// Whether to accumulate the area covered by the bounding boxes instead of their centres.
+	Coverage bool
+}
+
+// BboxHeatmap accumulates the spatial density of bounding boxes per label, in coordinates
+// normalised to the image size. It is safe for concurrent use.
+type BboxHeatmap struct {
+	size     int
+	coverage bool
+
+	mu   sync.Mutex
+	maps map[string][]float64 // The density maps by label, row-major.
+	all  []float64            // The density map of all labels.
+}
+
+// NewBboxHeatmap returns an empty BboxHeatmap.
+func NewBboxHeatmap(opts HeatmapOptions) *BboxHeatmap {
+	size := opts.Size
+	if size <= 0 {
+		size = 64
+	}
+	return &BboxHeatmap{
+		size:     size,
+		coverage: opts.Coverage,
+		maps:     make(map[string][]float64),
+		all:      make([]float64, size*size),
+	}
+}
+
+// Add adds the bounding boxes of f to the heatmaps. The image dimensions are read from the image
+// if they are not known.
+func (h *BboxHeatmap) Add(f AnnotatedFile) error {
+	if len(f.Annotations) == 0 {
+		return nil
+	}
+	width, height := f.ImageWidth, f.ImageHeight
+	if width <= 0 || height <= 0 {
+		var err error
+		if width, height, err = imageDimensions(f.FilePath); err != nil {
+			return err
+		}
+	}
+
+	// Convert the bounding boxes to cell coordinates.
+	scaleX := float64(h.size) / float64(width)
+	scaleY := float64(h.size) / float64(height)
+	cell := func(v, scale float64) int {
+		c := int(v * scale)
+		if c < 0 {
+			return 0
+		} else if c >= h.size {
+			return h.size - 1
+		}
+		return c
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, a := range f.Annotations {
+		if a.boolAttribute(ImageLabel) {
+			continue
+		}
+
+		m, ok := h.maps[a.Label]
+		if !ok {
+			m = make([]float64, h.size*h.size)
+			h.maps[a.Label] = m
+		}
+
+		if h.coverage {
+			x1, y1 := cell(a.Coords[0], scaleX), cell(a.Coords[1], scaleY)
+			x2, y2 := cell(a.Coords[2], scaleX), cell(a.Coords[3], scaleY)
+			for y := y1; y <= y2; y++ {
+				for x := x1; x <= x2; x++ {
+					m[y*h.size+x]++
+					h.all[y*h.size+x]++
+				}
+			}
+		} else {
+			x := cell((a.Coords[0]+a.Coords[2])/2, scaleX)
+			y := cell((a.Coords[1]+a.Coords[3])/2, scaleY)
+			m[y*h.size+x]++
+			h.all[y*h.size+x]++
+		}
+	}
+
+	return nil
+}
+
+// Labels returns the labels with a heatmap, sorted.
+func (h *BboxHeatmap) Labels() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	labels := make([]string, 0, len(h.maps))
+	for label := range h.maps {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// Image returns the heatmap for label, or for all labels if label is empty, normalised to its
+// maximum density and colour-coded from black (no boxes) to white (max. density).
+func (h *BboxHeatmap) Image(label string) *image.RGBA {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	m := h.all
+	if label != "" {
+		m = h.maps[label]
+	}
+
+	var max float64
+	for _, v := range m {
+		max = math.Max(max, v)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, h.size, h.size))
+	for i, v := range m {
+		if max > 0 {
+			v /= max
+		}
+		img.Set(i%h.size, i/h.size, heatColor(v))
+	}
+	return img
+}
+
+// WritePNGs writes the heatmaps to dirPath as PNG files, named heatmap_all.png for all labels and
+// heatmap_<label>.png per label, with characters other than letters, digits, '-' and '_' in the
+// label replaced by '_'.
+func (h *BboxHeatmap) WritePNGs(dirPath string) error {
+	if err := os.MkdirAll(dirPath, 0755); err != nil {
+		return fmt.Errorf("failed to create the heatmap directory: %v", err)
+	}
+
+	if err := saveImage(filepath.Join(dirPath, "heatmap_all.png"), h.Image(""), 0, nil); err != nil {
+		return err
+	}
+	for _, label := range h.Labels() {
+		name := strings.Map(func(r rune) rune {
+			if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' ||
+					r == '_' {
+				return r
+			}
+			return '_'
+		}, label)
+		err := saveImage(filepath.Join(dirPath, "heatmap_"+name+".png"), h.Image(label), 0, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// heatColor maps v in [0, 1] to a colour on a black-red-yellow-white scale.
+func heatColor(v float64) color.RGBA {
+	channel := func(x float64) uint8 {
+		return uint8(math.Max(0, math.Min(1, x)) * 255)
+	}
+	return color.RGBA{R: channel(3 * v), G: channel(3*v - 1), B: channel(3*v - 2), A: 255}
+}
+
+// HeatmapStage returns a Stage that adds each file to h and passes it on unchanged. Files whose
+// image dimensions cannot be read are logged and not added.
+func HeatmapStage(h *BboxHeatmap) Stage {
+	return func(f AnnotatedFile) ([]AnnotatedFile, error) {
+		if err := h.Add(f); err != nil {
+			log.Printf("Failed to add %q to the heatmap: %v", f.FilePath, err)
+		}
+		return []AnnotatedFile{f}, nil
+	}
+}
@@ -0,0 +1,288 @@
+package lblconv
+
+// Conversion of images with embedded ICC profiles to sRGB.
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// errUnsupportedICCProfile is returned for ICC profiles other than RGB matrix/TRC profiles, e.g.
+// LUT-based, grayscale or CMYK profiles.
+var errUnsupportedICCProfile = errors.New("unsupported ICC profile")
+
+// xyzD50ToSRGB converts D50-adapted CIE XYZ values, the profile connection space of ICC profiles,
+// to linear sRGB values.
+var xyzD50ToSRGB = [3][3]float64{
+	{3.1338561, -1.6168667, -0.4906146},
+	{-0.9787684, 1.9161415, 0.0334540},
+	{0.0719453, -0.2289914, 1.4052427},
+}
+
+// embeddedICCProfile returns the ICC profile embedded in the encoded JPEG or PNG image data, or
+// nil if it has none.
+func embeddedICCProfile(data []byte, format string) []byte {
+	switch format {
+	case "jpeg":
+		return jpegICCProfile(data)
+	case "png":
+		return pngICCProfile(data)
+	}
+	return nil
+}
+
+// jpegICCProfile returns the ICC profile in the APP2 segments of the JPEG data, which may be split
+// across multiple segments, or nil if it has none.
+func jpegICCProfile(data []byte) []byte {
+	const marker = "ICC_PROFILE\x00"
+	var chunks [][]byte
+	for i := 2; i+4 <= len(data) && data[i] == 0xff; {
+		kind := data[i+1]
+		if kind == 0xda { // Start of scan, i.e. the end of the headers.
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			break
+		}
+		segment := data[i+4 : i+2+length]
+		if kind == 0xe2 && len(segment) > len(marker)+2 && string(segment[:len(marker)]) == marker {
+			seq := int(segment[len(marker)])
+			for len(chunks) < seq {
+				chunks = append(chunks, nil)
+			}
+			if seq > 0 {
+				chunks[seq-1] = segment[len(marker)+2:]
+			}
+		}
+		i += 2 + length
+	}
+
+	var profile []byte
+	for _, chunk := range chunks {
+		if chunk == nil {
+			return nil
+		}
+		profile = append(profile, chunk...)
+	}
+	return profile
+}
+
+// pngICCProfile returns the ICC profile in the iCCP chunk of the PNG data, or nil if it has none.
+func pngICCProfile(data []byte) []byte {
+	for i := 8; i+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		kind := string(data[i+4 : i+8])
+		if length < 0 || i+12+length > len(data) || kind == "IDAT" {
+			break
+		}
+		if kind == "iCCP" {
+			chunk := data[i+8 : i+8+length]
+			sep := bytes.IndexByte(chunk, 0)
+			if sep < 0 || sep+2 > len(chunk) || chunk[sep+1] != 0 {
+				return nil
+			}
+			r, err := zlib.NewReader(bytes.NewReader(chunk[sep+2:]))
+			if err != nil {
+				return nil
+			}
+			profile, err := ioutil.ReadAll(r)
+			if err != nil {
+				return nil
+			}
+			return profile
+		}
+		i += 12 + length
+	}
+	return nil
+}
+
+// iccTransform converts the colours of an RGB matrix/TRC profile to sRGB.
+type iccTransform struct {
+	curves [3][256]float64 // The linear values of the 8-bit encoded values, by channel.
+	matrix [3][3]float64   // The matrix from the linear profile values to linear sRGB.
+}
+
+// parseICCProfile parses an RGB matrix/TRC ICC profile, e.g. Adobe RGB or Display P3, and
+// returns the transform to sRGB.
+func parseICCProfile(profile []byte) (*iccTransform, error) {
+	if len(profile) < 132 {
+		return nil, fmt.Errorf("invalid ICC profile of %d bytes", len(profile))
+	}
+	if string(profile[16:20]) != "RGB " || string(profile[20:24]) != "XYZ " {
+		return nil, errUnsupportedICCProfile
+	}
+
+	tags := make(map[string][]byte)
+	numTags := int(binary.BigEndian.Uint32(profile[128:]))
+	for i := 0; i < numTags && 132+12*(i+1) <= len(profile); i++ {
+		entry := profile[132+12*i:]
+		offset, size := binary.BigEndian.Uint32(entry[4:]), binary.BigEndian.Uint32(entry[8:])
+		if uint64(offset)+uint64(size) > uint64(len(profile)) {
+			return nil, fmt.Errorf("invalid ICC profile tag offset")
+		}
+		tags[string(entry[:4])] = profile[offset : offset+size]
+	}
+
+	var t iccTransform
+	var toXYZ [3][3]float64
+	for c, names := range [3][2]string{{"rXYZ", "rTRC"}, {"gXYZ", "gTRC"}, {"bXYZ", "bTRC"}} {
+		xyz, trc := tags[names[0]], tags[names[1]]
+		if len(xyz) < 20 || string(xyz[:4]) != "XYZ " || trc == nil {
+			return nil, errUnsupportedICCProfile
+		}
+		for i := 0; i < 3; i++ {
+			toXYZ[i][c] = s15Fixed16(xyz[8+4*i:])
+		}
+		curve, err := parseICCCurve(trc)
+		if err != nil {
+			return nil, err
+		}
+		for v := range t.curves[c] {
+			t.curves[c][v] = curve(float64(v) / 255)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				t.matrix[i][j] += xyzD50ToSRGB[i][k] * toXYZ[k][j]
+			}
+		}
+	}
+	return &t, nil
+}
+
+// s15Fixed16 decodes the ICC s15Fixed16Number at the start of b.
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// parseICCCurve parses a curv or para tag and returns the curve, which maps encoded values in
+// [0, 1] to linear ones.
+func parseICCCurve(tag []byte) (func(float64) float64, error) {
+	if len(tag) < 12 {
+		return nil, errUnsupportedICCProfile
+	}
+
+	switch string(tag[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if len(tag) < 12+2*n {
+			return nil, errUnsupportedICCProfile
+		}
+		switch n {
+		case 0:
+			return func(x float64) float64 { return x }, nil
+		case 1:
+			gamma := float64(binary.BigEndian.Uint16(tag[12:])) / 256
+			return func(x float64) float64 { return math.Pow(x, gamma) }, nil
+		}
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 65535
+		}
+		return func(x float64) float64 {
+			pos := x * float64(n-1)
+			i := int(pos)
+			if i >= n-1 {
+				return table[n-1]
+			}
+			return table[i] + (pos-float64(i))*(table[i+1]-table[i])
+		}, nil
+
+	case "para":
+		numParams := map[uint16]int{0: 1, 1: 3, 2: 4, 3: 5, 4: 7}
+		kind := binary.BigEndian.Uint16(tag[8:])
+		n, ok := numParams[kind]
+		if !ok || len(tag) < 12+4*n {
+			return nil, errUnsupportedICCProfile
+		}
+		var p [7]float64 // g, a, b, c, d, e, f
+		for i := 0; i < n; i++ {
+			p[i] = s15Fixed16(tag[12+4*i:])
+		}
+		g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+		return func(x float64) float64 {
+			switch kind {
+			case 0:
+				return math.Pow(x, g)
+			case 1:
+				if x >= -b/a {
+					return math.Pow(a*x+b, g)
+				}
+				return 0
+			case 2:
+				if x >= -b/a {
+					return math.Pow(a*x+b, g) + c
+				}
+				return c
+			case 3:
+				if x >= d {
+					return math.Pow(a*x+b, g)
+				}
+				return c * x
+			default:
+				if x >= d {
+					return math.Pow(a*x+b, g) + e
+				}
+				return c*x + f
+			}
+		}, nil
+	}
+	return nil, errUnsupportedICCProfile
+}
+
+// srgbEncodeLUTSize is the number of linear values in the lookup table for the sRGB encoding.
+const srgbEncodeLUTSize = 4096
+
+// srgbEncodeLUT maps linear values in [0, 1], scaled to the table size, to 8-bit sRGB values.
+var srgbEncodeLUT = func() (lut [srgbEncodeLUTSize + 1]uint8) {
+	for i := range lut {
+		v := float64(i) / srgbEncodeLUTSize
+		if v <= 0.0031308 {
+			v *= 12.92
+		} else {
+			v = 1.055*math.Pow(v, 1/2.4) - 0.055
+		}
+		lut[i] = uint8(math.Round(v * 255))
+	}
+	return lut
+}()
+
+// apply returns img with its colours converted to sRGB.
+func (t *iccTransform) apply(img image.Image) *image.NRGBA {
+	out := imaging.Clone(img)
+	for i := 0; i+3 < len(out.Pix); i += 4 {
+		r, g, b := t.curves[0][out.Pix[i]], t.curves[1][out.Pix[i+1]], t.curves[2][out.Pix[i+2]]
+		for c := 0; c < 3; c++ {
+			v := t.matrix[c][0]*r + t.matrix[c][1]*g + t.matrix[c][2]*b
+			v = math.Max(0, math.Min(1, v))
+			out.Pix[i+c] = srgbEncodeLUT[int(v*srgbEncodeLUTSize+0.5)]
+		}
+	}
+	return out
+}
+
+// convertToSRGB returns img, decoded from data in format, converted to sRGB as per its embedded
+// ICC profile. Returns img unchanged if it has no profile, and errUnsupportedICCProfile if its
+// profile is not an RGB matrix/TRC profile.
+func convertToSRGB(img image.Image, data []byte, format string) (image.Image, error) {
+	profile := embeddedICCProfile(data, format)
+	if profile == nil {
+		return img, nil
+	}
+	t, err := parseICCProfile(profile)
+	if err != nil {
+		return img, err
+	}
+	return t.apply(img), nil
+}
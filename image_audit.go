@@ -0,0 +1,175 @@
+package lblconv
+
+// Auditing of processed images, to catch output images that do not match their annotations, e.g.
+// because of a rotation or coordinates that were not scaled.
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"log"
+	"math"
+	"strings"
+	"sync"
+)
+
+// ImageAuditOptions are the options of an ImageAudit.
+type ImageAuditOptions struct {
+	// The fraction of the images to audit, in (0, 1]. The sample is selected by a hash of the image
+	// path, so that it is the same in every run.
+	SampleRate float64
+
+	// Return an error for the first inconsistent image instead of logging and recording it.
+	Strict bool
+}
+
+// imageAuditTolerance is the distance in pixels by which annotations may extend beyond the image,
+// to allow for rounding.
+const imageAuditTolerance = 1
+
+// ImageAuditIssue is an inconsistency between an audited image and its annotations.
+type ImageAuditIssue struct {
+	Path    string // The path of the image.
+	Message string // What is inconsistent.
+}
+
+func (i ImageAuditIssue) String() string {
+	return i.Path + ": " + i.Message
+}
+
+// ImageAudit re-opens a sample of images, typically the output of ProcessImages, and checks their
+// actual dimensions against the recorded image size and the extents of the annotations, and that
+// they have no EXIF orientation that would rotate them when displayed. It is safe for concurrent
+// use.
+type ImageAudit struct {
+	opts ImageAuditOptions
+
+	mu      sync.Mutex
+	audited int
+	issues  []ImageAuditIssue
+}
+
+// NewImageAudit returns an ImageAudit with the options opts.
+func NewImageAudit(opts ImageAuditOptions) (*ImageAudit, error) {
+	if !(opts.SampleRate > 0 && opts.SampleRate <= 1) {
+		return nil, fmt.Errorf("invalid image audit sample rate: %g", opts.SampleRate)
+	}
+	return &ImageAudit{opts: opts}, nil
+}
+
+// sampled returns whether the image at path is in the sample of a.
+func (a *ImageAudit) sampled(path string) bool {
+	if a.opts.SampleRate >= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(path))
+	return float64(h.Sum64())/math.Exp2(64) < a.opts.SampleRate
+}
+
+// Check audits the image of f if it is in the sample. The extents of the annotations are only
+// checked if they have AbsoluteCoords. If the image cannot be read or is inconsistent, it returns
+// an error if a is strict, and logs and records the issue otherwise.
+func (a *ImageAudit) Check(f AnnotatedFile) error {
+	if !a.sampled(f.FilePath) {
+		return nil
+	}
+
+	var msgs []string
+	data, err := readImage(f.FilePath)
+	if err == nil {
+		// Decode the header of the file itself rather than using the dimension cache, which may
+		// be out of date.
+		var config image.Config
+		var format string
+		config, format, err = image.DecodeConfig(bytes.NewReader(data))
+		if err == nil {
+			msgs = auditImage(f, config.Width, config.Height,
+				exifOrientation(embeddedExif(data, format)))
+		}
+	}
+	if err != nil {
+		msgs = []string{"the image cannot be read: " + err.Error()}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.audited++
+	if len(msgs) == 0 {
+		return nil
+	}
+	if a.opts.Strict {
+		return fmt.Errorf("inconsistent image %q: %s", f.FilePath, strings.Join(msgs, "; "))
+	}
+	for _, msg := range msgs {
+		issue := ImageAuditIssue{Path: f.FilePath, Message: msg}
+		log.Print("Image audit: ", issue)
+		a.issues = append(a.issues, issue)
+	}
+	return nil
+}
+
+// auditImage returns the inconsistencies of the image of f, which is width x height pixels and has
+// the EXIF orientation orientation, with f.
+func auditImage(f AnnotatedFile, width, height, orientation int) []string {
+	var msgs []string
+	if f.ImageWidth > 0 && f.ImageHeight > 0 &&
+			(f.ImageWidth != width || f.ImageHeight != height) {
+		msg := fmt.Sprintf("the image is %dx%d pixels, but %dx%d are recorded", width, height,
+			f.ImageWidth, f.ImageHeight)
+		if f.ImageWidth == height && f.ImageHeight == width {
+			msg += " (rotated by 90 degrees)"
+		}
+		msgs = append(msgs, msg)
+	}
+	if orientation != 1 {
+		msgs = append(msgs, fmt.Sprintf("the image has the EXIF orientation %d, which is applied"+
+				" when it is displayed, but not to the annotations", orientation))
+	}
+
+	if f.CoordSpace == NormalizedCoords {
+		return msgs
+	}
+	beyond := 0
+	for _, ann := range f.Annotations {
+		if ann.boolAttribute(ImageLabel) {
+			continue
+		}
+		if ann.Coords[0] < -imageAuditTolerance || ann.Coords[1] < -imageAuditTolerance ||
+				ann.Coords[2] > float64(width+imageAuditTolerance) ||
+				ann.Coords[3] > float64(height+imageAuditTolerance) {
+			beyond++
+		}
+	}
+	if beyond > 0 {
+		msgs = append(msgs, fmt.Sprintf("%d of %d annotations extend beyond the %dx%d image",
+			beyond, len(f.Annotations), width, height))
+	}
+	return msgs
+}
+
+// Audited returns the number of images audited so far.
+func (a *ImageAudit) Audited() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.audited
+}
+
+// Issues returns the inconsistencies found so far, in the order they were found.
+func (a *ImageAudit) Issues() []ImageAuditIssue {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]ImageAuditIssue(nil), a.issues...)
+}
+
+// ImageAuditStage returns a Stage that audits the image of each file with a and passes the file on
+// unchanged.
+func ImageAuditStage(a *ImageAudit) Stage {
+	return func(f AnnotatedFile) ([]AnnotatedFile, error) {
+		if err := a.Check(f); err != nil {
+			return nil, err
+		}
+		return []AnnotatedFile{f}, nil
+	}
+}
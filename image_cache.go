@@ -0,0 +1,150 @@
+package lblconv
+
+// Caching of image metadata.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// imageDimensionEntry is the cached metadata of a single image.
+type imageDimensionEntry struct {
+	ModTime int64 `json:"mtime"` // The modification time in ns since the Unix epoch.
+	Size    int64 `json:"size"`  // The file size in bytes.
+	Width   int   `json:"width"`
+	Height  int   `json:"height"`
+}
+
+// ImageDimensionCache is a persistent cache of image dimensions, keyed by the image file path. An
+// entry is only valid as long as the modification time and size of the file do not change.
+//
+// It is safe for concurrent use.
+type ImageDimensionCache struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]imageDimensionEntry
+	dirty   bool // Whether the entries changed since the cache was loaded.
+}
+
+// LoadImageDimensionCache loads the cache from the file at path. An empty cache is returned if the
+// file does not exist.
+func LoadImageDimensionCache(path string) (*ImageDimensionCache, error) {
+	c := &ImageDimensionCache{
+		path:    path,
+		entries: make(map[string]imageDimensionEntry),
+	}
+
+	enc, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(enc, &c.entries); err != nil {
+		return nil, fmt.Errorf("failed to parse the image dimension cache %q: %v", path, err)
+	}
+
+	return c, nil
+}
+
+// Save writes the cache to the file it was loaded from, if any entries changed.
+func (c *ImageDimensionCache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.dirty {
+		return nil
+	}
+
+	enc, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(c.path, enc); err != nil {
+		return fmt.Errorf("cannot write file %q: %v", c.path, err)
+	}
+	c.dirty = false
+
+	return nil
+}
+
+// Dimensions returns the width and height of the image at path, probing the image only if there is
+// no valid cache entry for it. Images that are not read by a LocalImageResolver, see
+// SetImageResolver, are always probed, as they cannot be checked for modifications.
+func (c *ImageDimensionCache) Dimensions(path string) (width, height int, err error) {
+	localPath, ok := localImagePath(path)
+	if !ok {
+		config, _, err := decodeImageConfig(path)
+		if err != nil {
+			return 0, 0, err
+		}
+		return config.Width, config.Height, nil
+	}
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return 0, 0, newImageError(path, err)
+	}
+
+	c.mu.Lock()
+	e, ok := c.entries[path]
+	c.mu.Unlock()
+	if ok && e.ModTime == info.ModTime().UnixNano() && e.Size == info.Size() {
+		return e.Width, e.Height, nil
+	}
+
+	config, _, err := decodeImageConfig(path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	c.mu.Lock()
+	c.entries[path] = imageDimensionEntry{
+		ModTime: info.ModTime().UnixNano(),
+		Size:    info.Size(),
+		Width:   config.Width,
+		Height:  config.Height,
+	}
+	c.dirty = true
+	c.mu.Unlock()
+
+	return config.Width, config.Height, nil
+}
+
+var (
+	imageDimCacheMu sync.RWMutex
+	imageDimCache   *ImageDimensionCache // The cache used by imageDimensions, if not nil.
+)
+
+// SetImageDimensionCache sets the cache that is used whenever image dimensions need to be probed
+// from an image file. A nil cache disables caching.
+func SetImageDimensionCache(c *ImageDimensionCache) {
+	imageDimCacheMu.Lock()
+	imageDimCache = c
+	imageDimCacheMu.Unlock()
+}
+
+// imageDimensions returns the width and height of the image at path, using the image dimension
+// manifest and cache if they are set.
+func imageDimensions(path string) (width, height int, err error) {
+	if width, height, ok := manifestDimensions(path); ok {
+		return width, height, nil
+	}
+
+	imageDimCacheMu.RLock()
+	c := imageDimCache
+	imageDimCacheMu.RUnlock()
+
+	if c != nil {
+		return c.Dimensions(path)
+	}
+
+	config, _, err := decodeImageConfig(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	return config.Width, config.Height, nil
+}
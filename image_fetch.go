@@ -0,0 +1,168 @@
+package lblconv
+
+// Downloading of remote images.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ImageFetchOptions configures the downloading of images that are referenced by URL.
+type ImageFetchOptions struct {
+	CacheDir      string        // The directory to store the downloaded images in. Required.
+	MaxConcurrent int           // The max. number of concurrent downloads. Defaults to 4.
+	Timeout       time.Duration // The timeout per download. Defaults to one minute.
+}
+
+// isRemoteImage returns true if path is an http(s) URL.
+func isRemoteImage(path string) bool {
+	lower := strings.ToLower(path)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+// imageFetcher downloads remote images to a cache directory. It is safe for concurrent use.
+type imageFetcher struct {
+	cacheDir string
+	client   *http.Client
+	sem      chan struct{} // Limits the number of concurrent downloads.
+
+	mu       sync.Mutex
+	inflight map[string]*imageFetch // The downloads in progress, by URL.
+}
+
+// imageFetch is a single download, which concurrent requests for the same URL wait for.
+type imageFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// FetchImagesStage returns a Stage that downloads the images of files whose FilePath is an
+// http(s) URL to opts.CacheDir and replaces the FilePath with the path of the local copy, so that
+// the image dependent functionality, e.g. image processing and TFRecord output, can be used. Images
+// that have been downloaded before are not downloaded again. Files with local paths are passed on
+// unchanged.
+//
+// Failed downloads are logged, and the files are passed on with their URL, i.e. they are handled
+// like files whose image does not exist.
+func FetchImagesStage(opts ImageFetchOptions) (Stage, error) {
+	if opts.CacheDir == "" {
+		return nil, fmt.Errorf("missing image cache directory")
+	}
+	if err := os.MkdirAll(opts.CacheDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create the image cache directory: %v", err)
+	}
+	if opts.MaxConcurrent <= 0 {
+		opts.MaxConcurrent = 4
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = time.Minute
+	}
+
+	fetcher := &imageFetcher{
+		cacheDir: opts.CacheDir,
+		client:   &http.Client{Timeout: opts.Timeout},
+		sem:      make(chan struct{}, opts.MaxConcurrent),
+		inflight: make(map[string]*imageFetch),
+	}
+
+	return func(f AnnotatedFile) ([]AnnotatedFile, error) {
+		if isRemoteImage(f.FilePath) {
+			localPath, err := fetcher.fetch(f.FilePath)
+			if err != nil {
+				log.Printf("Failed to download %q: %v", f.FilePath, err)
+			} else {
+				f.FilePath = localPath
+			}
+		}
+		return []AnnotatedFile{f}, nil
+	}, nil
+}
+
+// cachePath returns the path of the local copy of the image at rawURL. The file name is derived
+// from a hash of the URL, retaining the file extension.
+func (fetcher *imageFetcher) cachePath(rawURL string) string {
+	sum := sha256.Sum256([]byte(rawURL))
+	ext := ""
+	if u, err := url.Parse(rawURL); err == nil {
+		ext = strings.ToLower(path.Ext(u.Path))
+	}
+	return filepath.Join(fetcher.cacheDir, hex.EncodeToString(sum[:])+ext)
+}
+
+// fetch returns the path of the local copy of the image at rawURL, downloading it if it is not
+// cached yet.
+func (fetcher *imageFetcher) fetch(rawURL string) (string, error) {
+	localPath := fetcher.cachePath(rawURL)
+	if _, err := os.Stat(localPath); err == nil {
+		return localPath, nil
+	}
+
+	// Join a download of the same URL that is in progress.
+	fetcher.mu.Lock()
+	call, ok := fetcher.inflight[rawURL]
+	if !ok {
+		call = &imageFetch{done: make(chan struct{})}
+		fetcher.inflight[rawURL] = call
+	}
+	fetcher.mu.Unlock()
+	if ok {
+		<-call.done
+		return localPath, call.err
+	}
+
+	fetcher.sem <- struct{}{}
+	call.err = fetcher.download(rawURL, localPath)
+	<-fetcher.sem
+
+	fetcher.mu.Lock()
+	delete(fetcher.inflight, rawURL)
+	fetcher.mu.Unlock()
+	close(call.done)
+
+	return localPath, call.err
+}
+
+// download writes the response body for rawURL to localPath. The data is written to a temporary
+// file first, so that interrupted downloads do not leave partial images in the cache.
+func (fetcher *imageFetcher) download(rawURL, localPath string) (err error) {
+	resp, err := fetcher.client.Get(rawURL)
+	if err != nil {
+		return err
+	}
+	defer closeWithErrCheck(resp.Body, &err)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %q", resp.Status)
+	}
+
+	tmp, err := ioutil.TempFile(fetcher.cacheDir, ".download-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err := io.Copy(tmp, resp.Body); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), localPath)
+}
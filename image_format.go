@@ -0,0 +1,136 @@
+package lblconv
+
+// Image format detection independent of the file extension.
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// imageFormatExtensions maps the image formats, as named by the image package, to the file
+// extensions accepted for them. The first extension is the canonical one.
+var imageFormatExtensions = map[string][]string{
+	"jpeg": {".jpg", ".jpeg"},
+	"png":  {".png"},
+	"gif":  {".gif"},
+	"bmp":  {".bmp"},
+	"tiff": {".tif", ".tiff"},
+}
+
+// sniffImageFormat returns the format of the image at path, e.g. "jpeg", as detected from its
+// header rather than its file extension.
+func sniffImageFormat(path string) (string, error) {
+	_, format, err := decodeImageConfig(path)
+	return format, err
+}
+
+// imageFormatOfExt returns the image format of the file extension of path, e.g. "jpeg", or an
+// empty string if it is not an image file extension.
+func imageFormatOfExt(path string) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	for format, exts := range imageFormatExtensions {
+		for _, v := range exts {
+			if ext == v {
+				return format
+			}
+		}
+	}
+	return ""
+}
+
+// hasImageExtension returns whether path has a file extension of the image format.
+func hasImageExtension(path, format string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, v := range imageFormatExtensions[format] {
+		if ext == v {
+			return true
+		}
+	}
+	return false
+}
+
+// isImage returns true if path has the file extension of a JPEG or PNG image, or if it has no such
+// extension but is a JPEG or PNG image nevertheless.
+func isImage(path string) bool {
+	if isImageFile(path) {
+		return true
+	}
+	format, err := sniffImageFormat(path)
+	return err == nil && (format == "jpeg" || format == "png")
+}
+
+// ImageExtensionMode selects how ImageExtensionStage handles images whose file extension does not
+// match their format.
+type ImageExtensionMode int
+
+// The supported image extension modes.
+const (
+	ImageExtensionKeep ImageExtensionMode = iota // Keep the images unchanged.
+	ImageExtensionWarn                           // Log the mismatched images.
+	ImageExtensionFix                            // Copy the images with the correct extension.
+)
+
+// ImageExtensionStage returns a Stage that detects the format of each image from its data and
+// handles images with a file extension that does not match, e.g. crawled PNG images named
+// "*.jpg", as per mode. ImageExtensionFix copies these images to outDir with the canonical
+// extension of their format and updates the FilePath. Remote images and images that cannot be read
+// are passed on unchanged.
+//
+// Returns a nil Stage for ImageExtensionKeep.
+func ImageExtensionStage(mode ImageExtensionMode, outDir string) (Stage, error) {
+	switch mode {
+	case ImageExtensionKeep:
+		return nil, nil
+	case ImageExtensionFix:
+		if outDir == "" {
+			return nil, fmt.Errorf("missing output directory for the images with a fixed extension")
+		}
+	}
+
+	return func(f AnnotatedFile) ([]AnnotatedFile, error) {
+		if isRemoteImage(f.FilePath) {
+			return []AnnotatedFile{f}, nil
+		}
+		format, err := sniffImageFormat(f.FilePath)
+		if err != nil || hasImageExtension(f.FilePath, format) {
+			return []AnnotatedFile{f}, nil
+		}
+		exts, ok := imageFormatExtensions[format]
+		if mode == ImageExtensionWarn || !ok {
+			log.Printf("The file extension of %q does not match its image format %s", f.FilePath,
+				format)
+			return []AnnotatedFile{f}, nil
+		}
+
+		name := filepath.Base(f.FilePath)
+		outPath := filepath.Join(outDir, strings.TrimSuffix(name, filepath.Ext(name))+exts[0])
+		if err := copyImage(f.FilePath, outPath); err != nil {
+			return nil, err
+		}
+		f.FilePath = outPath
+		return []AnnotatedFile{f}, nil
+	}, nil
+}
+
+// copyImage copies the image at path to the file at outPath.
+func copyImage(path, outPath string) (err error) {
+	in, err := openImage(path)
+	if err != nil {
+		return err
+	}
+	defer closeWithErrCheck(in, &err)
+
+	out, err := createAtomicFile(outPath)
+	if err != nil {
+		return err
+	}
+	defer out.commit(&err)
+
+	if _, err := io.Copy(out, in); err != nil {
+		return newImageError(path, err)
+	}
+	return nil
+}
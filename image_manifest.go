@@ -0,0 +1,185 @@
+package lblconv
+
+// Image dimensions supplied by a manifest, for images that are not locally present.
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ImageDimensionManifestEntry holds the dimensions of an image in an ImageDimensionManifest.
+type ImageDimensionManifestEntry struct {
+	Path   string `json:"path"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// ImageDimensionManifest holds the dimensions of images as supplied by the user, e.g. to convert
+// between formats with normalized and absolute coordinates without the images being locally
+// present. Images are looked up by path, or by file name if the name is unique in the manifest.
+type ImageDimensionManifest struct {
+	byPath map[string]ImageDimensionManifestEntry
+	byName map[string]ImageDimensionManifestEntry
+	paths  []string // The image paths, in the order of the manifest.
+}
+
+// LoadImageDimensionManifest loads the manifest at path, which is either a JSON array of
+// ImageDimensionManifestEntry objects, if it has the extension .json, or a CSV file with the
+// columns path, width and height and an optional header row. Relative image paths are relative to
+// imageDir, if not empty, like the image paths of the label files.
+func LoadImageDimensionManifest(path, imageDir string) (m *ImageDimensionManifest, err error) {
+	var entries []ImageDimensionManifestEntry
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		enc, err := readFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(enc, &entries); err != nil {
+			return nil, newJSONParseError(path, enc, err)
+		}
+	} else if entries, err = readImageDimensionCSV(path); err != nil {
+		return nil, err
+	}
+
+	m = &ImageDimensionManifest{
+		byPath: make(map[string]ImageDimensionManifestEntry, len(entries)),
+		byName: make(map[string]ImageDimensionManifestEntry, len(entries)),
+	}
+	ambiguous := make(map[string]bool)
+	for i, e := range entries {
+		if e.Path == "" || e.Width <= 0 || e.Height <= 0 {
+			return nil, fmt.Errorf("invalid entry %d in image dimension manifest %q", i+1, path)
+		}
+		if imageDir != "" && !filepath.IsAbs(e.Path) && !isRemoteImage(e.Path) {
+			e.Path = filepath.Join(imageDir, e.Path)
+		}
+		key := imagePathKey(e.Path)
+		if _, ok := m.byPath[key]; ok {
+			return nil, fmt.Errorf("duplicate image %q in image dimension manifest %q", e.Path,
+				path)
+		}
+		m.byPath[key] = e
+		m.paths = append(m.paths, e.Path)
+
+		name := filepath.Base(e.Path)
+		if _, ok := m.byName[name]; ok {
+			ambiguous[name] = true
+		}
+		m.byName[name] = e
+	}
+	for name := range ambiguous {
+		delete(m.byName, name)
+	}
+
+	return m, nil
+}
+
+// readImageDimensionCSV reads the entries of the CSV image dimension manifest at path.
+func readImageDimensionCSV(path string) (entries []ImageDimensionManifestEntry, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image dimension manifest: %v", err)
+	}
+	defer closeWithErrCheck(f, &err)
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 3
+	r.TrimLeadingSpace = true
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse image dimension manifest %q: %v", path, err)
+		}
+		if line == 1 && strings.EqualFold(record[0], "path") {
+			continue
+		}
+
+		width, errW := strconv.Atoi(record[1])
+		height, errH := strconv.Atoi(record[2])
+		if errW != nil || errH != nil {
+			return nil, fmt.Errorf("invalid image dimensions in image dimension manifest %q, "+
+					"line %d", path, line)
+		}
+		entries = append(entries, ImageDimensionManifestEntry{
+			Path:   record[0],
+			Width:  width,
+			Height: height,
+		})
+	}
+
+	return entries, nil
+}
+
+// Dimensions returns the width and height of the image at path, and whether it is in the
+// manifest.
+func (m *ImageDimensionManifest) Dimensions(path string) (width, height int, ok bool) {
+	e, ok := m.byPath[imagePathKey(path)]
+	if !ok {
+		e, ok = m.byName[filepath.Base(path)]
+	}
+	return e.Width, e.Height, ok
+}
+
+// imagesInDir returns the paths of the images in the manifest that are in dir, or in its
+// subdirectories if recursive is true.
+func (m *ImageDimensionManifest) imagesInDir(dir string, recursive bool) []string {
+	dir = filepath.Clean(dir)
+	var paths []string
+	for _, path := range m.paths {
+		parent := filepath.Dir(path)
+		if parent == dir || recursive && strings.HasPrefix(parent, dir+string(filepath.Separator)) {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+var (
+	imageDimManifestMu sync.RWMutex
+	imageDimManifest   *ImageDimensionManifest // The manifest used by imageDimensions, if not nil.
+)
+
+// SetImageDimensionManifest sets the manifest that is consulted first whenever image dimensions are
+// needed. Images in the manifest are not read for their dimensions, and are matched to label files
+// even if they are not present. A nil manifest disables it.
+func SetImageDimensionManifest(m *ImageDimensionManifest) {
+	imageDimManifestMu.Lock()
+	imageDimManifest = m
+	imageDimManifestMu.Unlock()
+}
+
+// manifestDimensions returns the dimensions of the image at path from the image dimension
+// manifest, and whether it is in the manifest.
+func manifestDimensions(path string) (width, height int, ok bool) {
+	imageDimManifestMu.RLock()
+	m := imageDimManifest
+	imageDimManifestMu.RUnlock()
+
+	if m == nil {
+		return 0, 0, false
+	}
+	return m.Dimensions(path)
+}
+
+// manifestImagesInDir returns the paths of the images in the image dimension manifest that are in
+// dir, see ImageDimensionManifest.imagesInDir.
+func manifestImagesInDir(dir string, recursive bool) []string {
+	imageDimManifestMu.RLock()
+	m := imageDimManifest
+	imageDimManifestMu.RUnlock()
+
+	if m == nil {
+		return nil
+	}
+	return m.imagesInDir(dir, recursive)
+}
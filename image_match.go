@@ -0,0 +1,209 @@
+package lblconv
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ImageMatchOptions configures how formats with one label file per image (KITTI and the AWS
+// formats) match the label files to the images in the image directory.
+//
+// By default, the base name of a label file without its extension must equal the base name of an
+// image without its extension, e.g. "a.txt" matches "a.jpg".
+type ImageMatchOptions struct {
+	// Whether to also strip an image file extension from the label file names, e.g. to match
+	// "a.jpg.json" to "a.jpg".
+	StripImageExtensions bool
+
+	CaseInsensitive bool // Whether to compare the file names case-insensitively.
+
+	// Whether to search the subdirectories of the image directory, too. The base names of the
+	// images must be unique across all subdirectories.
+	Recursive bool
+
+	// The path to a CSV file with the columns label and image, which maps label file names to
+	// image paths, if not empty. Relative image paths are relative to the image directory. An
+	// optional header row "label,image" is skipped. Label files that are not listed in the
+	// manifest are matched by name.
+	ManifestPath string
+
+	// The file extension, e.g. ".png", of the image paths of label files without an image, for
+	// conversions that do not need the pixels. The image path is formed from the image directory
+	// and the label file name, and the image directory need not exist. If empty, label files
+	// without an image fail to parse.
+	MissingImageExt string
+}
+
+// imageMatcher matches label files to images according to ImageMatchOptions.
+type imageMatcher struct {
+	imageDir string
+	opts     ImageMatchOptions
+
+	images    map[string]string   // Maps the name keys of the images to their paths.
+	ambiguous map[string][]string // Maps the name keys of ambiguous images to their paths.
+	manifest  map[string]string   // Maps the label file name keys to the image paths.
+	missing   int                 // The number of label files matched to missing images.
+}
+
+// newImageMatcher indexes the images in imageDir and loads the manifest, if any.
+func newImageMatcher(imageDir string, opts ImageMatchOptions) (*imageMatcher, error) {
+	m := &imageMatcher{imageDir: imageDir, opts: opts}
+
+	// Find the image files and map their names to their paths.
+	var imageFiles []string
+	var err error
+	if opts.Recursive {
+		imageFiles, err = filesInDirRecursive(imageDir)
+	} else {
+		imageFiles, err = filesByExtInDir(imageDir, "")
+	}
+	if _, statErr := os.Stat(imageDir); os.IsNotExist(statErr) && opts.MissingImageExt != "" {
+		imageFiles, err = nil, nil
+	}
+
+	// The images in the image dimension manifest need not be present.
+	if manifestImages := manifestImagesInDir(imageDir, opts.Recursive); len(manifestImages) > 0 {
+		present := make(map[string]bool, len(imageFiles))
+		for _, path := range imageFiles {
+			present[filepath.Clean(path)] = true
+		}
+		for _, path := range manifestImages {
+			if !present[path] {
+				imageFiles = append(imageFiles, path)
+			}
+		}
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m.images, m.ambiguous = mapFileNamesToPaths(imageFiles, m.key)
+
+	if opts.ManifestPath != "" {
+		if m.manifest, err = m.loadManifest(opts.ManifestPath); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// key returns the key under which the file name name is looked up.
+func (m *imageMatcher) key(name string) string {
+	if m.opts.CaseInsensitive {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+// loadManifest reads the CSV manifest at path.
+func (m *imageMatcher) loadManifest(path string) (manifest map[string]string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image manifest: %v", err)
+	}
+	defer closeWithErrCheck(f, &err)
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 2
+	r.TrimLeadingSpace = true
+	manifest = make(map[string]string)
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse image manifest %q: %v", path, err)
+		}
+		if line == 1 && strings.EqualFold(record[0], "label") &&
+				strings.EqualFold(record[1], "image") {
+			continue
+		}
+
+		imagePath := record[1]
+		if !filepath.IsAbs(imagePath) {
+			imagePath = filepath.Join(m.imageDir, imagePath)
+		}
+		key := m.key(filepath.Base(record[0]))
+		if _, ok := manifest[key]; ok {
+			return nil, fmt.Errorf("duplicate label file %q in image manifest %q, line %d",
+				record[0], path, line)
+		}
+		manifest[key] = imagePath
+	}
+
+	return manifest, nil
+}
+
+// match returns the path of the image that belongs to the label file at labelPath, which has the
+// file extension labelFileExt.
+func (m *imageMatcher) match(labelPath, labelFileExt string) (string, error) {
+	labelName := filepath.Base(labelPath)
+	if imagePath, ok := m.manifest[m.key(labelName)]; ok {
+		return imagePath, nil
+	}
+
+	// Strip the label file extension and optionally an image file extension.
+	name := strings.TrimSuffix(labelName, labelFileExt)
+	if labelFileExt == "" {
+		_, baseNoExt, _, err := splitPath(labelPath)
+		if err != nil {
+			return "", err
+		}
+		name = baseNoExt
+	}
+	missingName := name + m.opts.MissingImageExt
+	if m.opts.StripImageExtensions && isImageFile(name) {
+		missingName = name
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+
+	key := m.key(name)
+	if paths, ok := m.ambiguous[key]; ok {
+		return "", fmt.Errorf("ambiguous image: %q matches %s", name, strings.Join(paths, ", "))
+	}
+	imagePath, found := m.images[key]
+	if !found && m.opts.MissingImageExt != "" {
+		m.missing++
+		return filepath.Join(m.imageDir, missingName), nil
+	}
+	if !found {
+		return "", &ImageError{Path: filepath.Join(m.imageDir, name+".*"), Err: ErrImageNotFound}
+	}
+
+	return imagePath, nil
+}
+
+// mapFileNamesToPaths maps the base names of the given file paths, with the file type extensions
+// stripped off and transformed by key, to the file paths. Names that occur several times, e.g. with
+// different extensions, are returned in ambiguous instead, mapped to all of their paths.
+func mapFileNamesToPaths(filePaths []string, key func(string) string) (
+		mapping map[string]string, ambiguous map[string][]string) {
+
+	mapping = make(map[string]string, len(filePaths))
+	ambiguous = make(map[string][]string)
+	for _, path := range filePaths {
+		_, baseNoExt, _, err := splitPath(path)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		k := key(baseNoExt)
+		if paths, ok := ambiguous[k]; ok {
+			ambiguous[k] = append(paths, path)
+		} else if prevPath, ok := mapping[k]; ok {
+			ambiguous[k] = []string{prevPath, path}
+			delete(mapping, k)
+		} else {
+			mapping[k] = path
+		}
+	}
+
+	return mapping, ambiguous
+}
@@ -0,0 +1,190 @@
+package lblconv
+
+// Resolving of image paths to image data.
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ImageResolver opens the images that AnnotatedFile.FilePath refers to, which allows the images to
+// be read from storage other than the local file system. Implementations must be safe for
+// concurrent use.
+type ImageResolver interface {
+	// Open returns a reader for the data of the image at path. The error is ErrImageNotFound, or
+	// satisfies os.IsNotExist, if the image does not exist.
+	Open(path string) (io.ReadCloser, error)
+}
+
+// LocalImageResolver opens images from the local file system, including the open Archives. This is
+// the default ImageResolver.
+type LocalImageResolver struct {
+	Dir string // The directory that relative paths are relative to, if not empty.
+}
+
+// Open implements ImageResolver.
+func (r LocalImageResolver) Open(path string) (io.ReadCloser, error) {
+	return openFile(r.resolve(path))
+}
+
+// resolve returns the local file path of the image at path.
+func (r LocalImageResolver) resolve(path string) string {
+	if r.Dir == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(r.Dir, path)
+}
+
+// HTTPImageResolver downloads images via HTTP(S). Unlike FetchImagesStage, it does not store the
+// images locally, i.e. every access downloads the image again.
+type HTTPImageResolver struct {
+	// The URL that relative paths are resolved against, if not empty, e.g.
+	// "https://example.com/images/".
+	BaseURL string
+
+	Client *http.Client // The HTTP client. Defaults to a client with a one minute timeout.
+}
+
+// Open implements ImageResolver.
+func (r HTTPImageResolver) Open(path string) (io.ReadCloser, error) {
+	rawURL := path
+	if r.BaseURL != "" && !isRemoteImage(path) {
+		base, err := url.Parse(r.BaseURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base URL %q: %v", r.BaseURL, err)
+		}
+		ref, err := url.Parse(filepath.ToSlash(path))
+		if err != nil {
+			return nil, fmt.Errorf("invalid image URL %q: %v", path, err)
+		}
+		rawURL = base.ResolveReference(ref).String()
+	}
+
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return getImage(r.Client, req)
+}
+
+// S3ImageResolver downloads images from an AWS S3 bucket. The image paths are either "s3://" URLs
+// or object keys relative to Prefix in Bucket.
+type S3ImageResolver struct {
+	Bucket      string         // The bucket of the object keys.
+	Prefix      string         // The prefix of the object keys, e.g. "images/".
+	Region      string         // The AWS region of the bucket(s).
+	Credentials AWSCredentials // The credentials used to sign the requests.
+
+	Client *http.Client // The HTTP client. Defaults to a client with a one minute timeout.
+}
+
+// Open implements ImageResolver.
+func (r S3ImageResolver) Open(path string) (io.ReadCloser, error) {
+	bucket, key := r.Bucket, r.Prefix+filepath.ToSlash(path)
+	if strings.HasPrefix(path, "s3://") {
+		u, err := url.Parse(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid S3 URL %q: %v", path, err)
+		}
+		bucket, key = u.Host, strings.TrimPrefix(u.Path, "/")
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("missing S3 bucket for image %q", path)
+	}
+
+	u := url.URL{
+		Scheme: "https",
+		Host:   bucket + ".s3." + r.Region + ".amazonaws.com",
+		Path:   "/" + key,
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+	signAWSRequest(req, nil, r.Credentials, "s3", r.Region, time.Now())
+	return getImage(r.Client, req)
+}
+
+// emptySHA256 is the hex-encoded SHA-256 of an empty request body.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// getImage sends the GET request req with client, or a default client if nil, and returns the
+// response body.
+func getImage(client *http.Client, req *http.Request) (io.ReadCloser, error) {
+	if client == nil {
+		client = &http.Client{Timeout: time.Minute}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		_ = resp.Body.Close()
+		return nil, ErrImageNotFound
+	case resp.StatusCode != http.StatusOK:
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp.Body, nil
+}
+
+var (
+	imageResolverMu sync.RWMutex
+	imageResolver   ImageResolver = LocalImageResolver{} // The resolver used by openImage.
+)
+
+// SetImageResolver sets the resolver that is used whenever an image is read, e.g. to probe its
+// dimensions, process it or embed it in a TFRecord. A nil resolver restores the default
+// LocalImageResolver.
+//
+// The image dimension cache, see SetImageDimensionCache, only applies to a LocalImageResolver.
+// Label files are always matched to images in local directories.
+func SetImageResolver(r ImageResolver) {
+	if r == nil {
+		r = LocalImageResolver{}
+	}
+	imageResolverMu.Lock()
+	imageResolver = r
+	imageResolverMu.Unlock()
+}
+
+// currentImageResolver returns the resolver set with SetImageResolver.
+func currentImageResolver() ImageResolver {
+	imageResolverMu.RLock()
+	defer imageResolverMu.RUnlock()
+	return imageResolver
+}
+
+// openImage opens the image at path with the current ImageResolver.
+func openImage(path string) (io.ReadCloser, error) {
+	rc, err := currentImageResolver().Open(path)
+	if err != nil {
+		return nil, newImageError(path, err)
+	}
+	return rc, nil
+}
+
+// localImagePath returns the local file path of the image at path and true, if the current
+// ImageResolver is a LocalImageResolver and the image is not in an Archive.
+func localImagePath(path string) (string, bool) {
+	local, ok := currentImageResolver().(LocalImageResolver)
+	if !ok {
+		return "", false
+	}
+	path = local.resolve(path)
+	if _, _, inArchive := archiveOf(path); inArchive {
+		return "", false
+	}
+	return path, true
+}
@@ -1,11 +1,17 @@
 package lblconv
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"image"
+	"image/draw"
 	"image/jpeg"
 	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
 	"math"
-	"os"
 	"path/filepath"
 	"strings"
 
@@ -62,41 +68,161 @@ func resizeImage(img image.Image, longerSide, shorterSide int,
 	return resized, scaleWidth, scaleHeight, nil
 }
 
-// decodeImageConfig opens the file at path and returns the results of image.DecodeConfig.
+// decodeImageConfig opens the image at path and returns the results of image.DecodeConfig.
 func decodeImageConfig(path string) (config image.Config, format string, err error) {
-	f, err := os.Open(path)
+	f, err := openImage(path)
 	if err != nil {
 		return image.Config{}, "", err
 	}
 	defer closeWithErrCheck(f, &err)
 
-	return image.DecodeConfig(f)
+	config, format, err = image.DecodeConfig(f)
+	if err != nil {
+		return image.Config{}, "", newImageError(path, err)
+	}
+	return config, format, nil
 }
 
-// loadImage reads and decodes the image at path and returns the results of image.Decode.
+// loadImage reads and decodes the image at path and returns the results of decodeImage.
 func loadImage(path string) (img image.Image, format string, err error) {
-	f, err := os.Open(path)
+	data, err := readImage(path)
 	if err != nil {
 		return nil, "", err
 	}
+
+	img, format, err = decodeImage(path, data)
+	if err != nil {
+		return nil, "", newImageError(path, err)
+	}
+	return img, format, nil
+}
+
+// decodeImage decodes the image in data, which is read from the file at path, like image.Decode,
+// but more tolerantly: A JPEG image that ends prematurely, e.g. after an interrupted download, is
+// padded so that the part that is present can be decoded, with the remainder of the image filled
+// in by the decoder. CMYK images, e.g. from print workflows, are converted to RGB.
+func decodeImage(path string, data []byte) (image.Image, string, error) {
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil && format == "jpeg" {
+		// Pad the scan data with zero bits and terminate it with an end-of-image marker.
+		padded := make([]byte, 2*len(data)+2)
+		copy(padded, data)
+		padded[len(padded)-2], padded[len(padded)-1] = 0xff, 0xd9
+		if recovered, recoveredErr := jpeg.Decode(bytes.NewReader(padded)); recoveredErr == nil {
+			log.Printf("Recovered the incomplete JPEG image %q (%v)", path, err)
+			img, err = recovered, nil
+		}
+	}
+	if err != nil {
+		return nil, format, err
+	}
+
+	if _, ok := img.(*image.CMYK); ok {
+		img = imaging.Clone(img)
+	}
+	return img, format, nil
+}
+
+// ImageColorMode selects the colour model of the output images of ProcessImagesWithOptions.
+type ImageColorMode int
+
+// The supported image colour modes.
+const (
+	ImageColorKeep ImageColorMode = iota // Keep the colour model of the (processed) images.
+	ImageColorGray                       // Convert the images to single-channel grayscale.
+	ImageColorRGB                        // Convert the images, e.g. grayscale ones, to RGB.
+)
+
+// convertColor returns img converted to the colour model of mode. Grayscale images are encoded
+// with a single channel, and RGB images with three, as they are opaque.
+func convertColor(img image.Image, mode ImageColorMode) image.Image {
+	switch mode {
+	case ImageColorGray:
+		if _, ok := img.(*image.Gray); ok {
+			return img
+		}
+		gray := image.NewGray(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+		draw.Draw(gray, gray.Bounds(), img, img.Bounds().Min, draw.Src)
+		return gray
+	case ImageColorRGB:
+		// Composite the image onto black to drop the alpha channel.
+		rgb := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+		draw.Draw(rgb, rgb.Bounds(), image.Black, image.Point{}, draw.Src)
+		draw.Draw(rgb, rgb.Bounds(), img, img.Bounds().Min, draw.Over)
+		return rgb
+	}
+	return img
+}
+
+// imageSHA256 returns the hex-encoded SHA-256 of the image file at path.
+func imageSHA256(path string) (sum string, err error) {
+	f, err := openImage(path)
+	if err != nil {
+		return "", err
+	}
 	defer closeWithErrCheck(f, &err)
 
-	return image.Decode(f)
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", newImageError(path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
-// Saves the image to path, encoding it as PNG or JPG, depending on the file extension of path.
-func saveImage(path string, img image.Image, jpegQuality int) (err error) {
-	f, err := os.Create(path)
+// readImage reads the encoded data of the image at path.
+func readImage(path string) (data []byte, err error) {
+	f, err := openImage(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer closeWithErrCheck(f, &err)
 
+	data, err = ioutil.ReadAll(f)
+	if err != nil {
+		return nil, newImageError(path, err)
+	}
+
+	return data, nil
+}
+
+// Saves the image to path, encoding it as PNG or JPG, depending on the file extension of path.
+// exif is the TIFF data of the EXIF metadata to embed, or nil for none.
+func saveImage(path string, img image.Image, jpegQuality int, exif []byte) (err error) {
+	var buf bytes.Buffer
+	var format string
 	switch strings.ToLower(filepath.Ext(path)) {
 	case ".png":
-		err = png.Encode(f, img)
+		format = "png"
+		err = png.Encode(&buf, img)
 	default:
-		err = jpeg.Encode(f, img, &jpeg.Options{Quality: jpegQuality})
+		format = "jpeg"
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality})
+	}
+	if err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	if exif != nil {
+		if data, err = insertExif(data, format, exif); err != nil {
+			return err
+		}
+	}
+
+	f, err := createAtomicFile(path)
+	if err != nil {
+		return err
 	}
+	defer f.commit(&err)
+
+	_, err = f.Write(data)
 	return err
 }
+
+// isImageFile returns true if path has the file extension of a JPEG or PNG image.
+func isImageFile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg", ".png":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,328 @@
+package lblconv
+
+// Pseudo-labelling via remote inference endpoints.
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// InferenceProtocol is the request and response format of an inference endpoint.
+type InferenceProtocol int
+
+// The supported inference protocols.
+const (
+	// InferenceJSON posts the encoded image as the request body and expects a JSON response of the
+	// form {"detections": [{"label": <string>, "score": <float>, "box": [x1, y1, x2, y2]}]}, with
+	// the box in pixels.
+	InferenceJSON InferenceProtocol = iota
+	// InferenceTFServing uses the TensorFlow Serving REST predict API, with the image as a base64
+	// encoded string instance. The response must have the outputs of the TensorFlow Object
+	// Detection API, i.e. detection_boxes, detection_classes and detection_scores.
+	InferenceTFServing
+	// InferenceTriton uses the KServe v2 inference protocol of the Triton Inference Server, with
+	// the image as a base64 encoded BYTES input. The outputs are as for InferenceTFServing.
+	InferenceTriton
+)
+
+// InferenceOptions configures the inference format.
+type InferenceOptions struct {
+	Protocol InferenceProtocol
+
+	// Maps the class IDs returned by the TF Serving and Triton protocols to labels. IDs that are
+	// not in the label map are used as labels.
+	LabelMap *TFRecordLabelMap
+
+	MinScore        float64       // The min. score in [0, 1] of the detections to keep.
+	Concurrency     int           // The number of concurrent requests. Defaults to SetWorkers.
+	Timeout         time.Duration // The timeout per request. Defaults to one minute.
+	TritonInputName string        // The name of the Triton input tensor. Defaults to "image".
+}
+
+// inferenceDetection is a single detection in pixel coordinates.
+type inferenceDetection struct {
+	Label string     `json:"label"`
+	Score float64    `json:"score"`
+	Box   [4]float64 `json:"box"`
+}
+
+// inferenceClient sends the images to an inference endpoint.
+type inferenceClient struct {
+	endpoint string
+	opts     InferenceOptions
+	http     *http.Client
+	labels   map[int64]string // The labels by class ID.
+}
+
+// NewInferenceSource returns a Source that sends each JPEG and PNG image in imageDir to the
+// inference endpoint and converts the returned detections to annotations. The detection scores are
+// stored as the Confidence attribute. Images for which the request fails are reported as
+// ParseErrors.
+func NewInferenceSource(endpoint, imageDir string, opts InferenceOptions) (Source, error) {
+	images, err := filesByExtInDir(imageDir, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Timeout <= 0 {
+		opts.Timeout = time.Minute
+	}
+	if opts.TritonInputName == "" {
+		opts.TritonInputName = "image"
+	}
+	c := &inferenceClient{
+		endpoint: endpoint,
+		opts:     opts,
+		http:     &http.Client{Timeout: opts.Timeout},
+		labels:   make(map[int64]string),
+	}
+	if opts.LabelMap != nil {
+		for _, item := range opts.LabelMap.items() {
+			c.labels[int64(item.ID)] = item.Name
+		}
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = numWorkers()
+	}
+	pool := newOrderedPool(concurrency)
+	go func() {
+		defer pool.closeInput()
+		for _, imagePath := range images {
+			if !isImage(imagePath) {
+				continue
+			}
+			imagePath := imagePath
+			ok := pool.submit(func() fileResult {
+				fileData, err := c.infer(imagePath)
+				if err != nil {
+					return fileResult{err: newParseError(imagePath, err)}
+				}
+				return fileResult{files: []AnnotatedFile{fileData}}
+			})
+			if !ok {
+				return
+			}
+		}
+	}()
+
+	return &oneToOneSource{pool: pool}, nil
+}
+
+// infer sends the image at imagePath to the endpoint and returns the detections as an
+// AnnotatedFile.
+func (c *inferenceClient) infer(imagePath string) (AnnotatedFile, error) {
+	width, height, err := imageDimensions(imagePath)
+	if err != nil {
+		return AnnotatedFile{}, err
+	}
+	imgData, err := readImage(imagePath)
+	if err != nil {
+		return AnnotatedFile{}, err
+	}
+
+	var detections []inferenceDetection
+	switch c.opts.Protocol {
+	case InferenceJSON:
+		detections, err = c.inferJSON(imgData)
+	case InferenceTFServing:
+		detections, err = c.inferTFServing(imgData, width, height)
+	case InferenceTriton:
+		detections, err = c.inferTriton(imgData, width, height)
+	default:
+		err = fmt.Errorf("unsupported inference protocol %d", c.opts.Protocol)
+	}
+	if err != nil {
+		return AnnotatedFile{}, err
+	}
+
+	fileData := AnnotatedFile{
+		Annotations: make([]Annotation, 0, len(detections)),
+		FilePath:    imagePath,
+		ImageWidth:  width,
+		ImageHeight: height,
+	}
+	for _, d := range detections {
+		if d.Score < c.opts.MinScore {
+			continue
+		}
+		fileData.Annotations = append(fileData.Annotations, Annotation{
+			Attributes: map[string]interface{}{Confidence: d.Score},
+			Coords:     d.Box,
+			Label:      d.Label,
+		})
+	}
+
+	return fileData, nil
+}
+
+// post sends body to the endpoint and decodes the JSON response into v.
+func (c *inferenceClient) post(contentType string, body []byte, v interface{}) (err error) {
+	resp, err := c.http.Post(c.endpoint, contentType, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer closeWithErrCheck(resp.Body, &err)
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %q: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode the response: %v", err)
+	}
+	return nil
+}
+
+// inferJSON implements InferenceJSON.
+func (c *inferenceClient) inferJSON(imgData []byte) ([]inferenceDetection, error) {
+	var resp struct {
+		Detections []inferenceDetection `json:"detections"`
+	}
+	if err := c.post(http.DetectContentType(imgData), imgData, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Detections, nil
+}
+
+// inferTFServing implements InferenceTFServing.
+func (c *inferenceClient) inferTFServing(imgData []byte, width, height int) (
+		[]inferenceDetection, error) {
+
+	req := map[string]interface{}{
+		"instances": []interface{}{
+			map[string]string{"b64": base64.StdEncoding.EncodeToString(imgData)},
+		},
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Predictions []struct {
+			Boxes   [][4]float64 `json:"detection_boxes"`
+			Classes []float64    `json:"detection_classes"`
+			Scores  []float64    `json:"detection_scores"`
+		} `json:"predictions"`
+	}
+	if err := c.post("application/json", body, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Predictions) != 1 {
+		return nil, fmt.Errorf("expected 1 prediction, got %d", len(resp.Predictions))
+	}
+
+	p := resp.Predictions[0]
+	return c.objectDetectionOutputs(p.Boxes, p.Classes, p.Scores, width, height)
+}
+
+// inferTriton implements InferenceTriton.
+func (c *inferenceClient) inferTriton(imgData []byte, width, height int) (
+		[]inferenceDetection, error) {
+
+	req := map[string]interface{}{
+		"inputs": []interface{}{
+			map[string]interface{}{
+				"name":     c.opts.TritonInputName,
+				"shape":    []int{1},
+				"datatype": "BYTES",
+				"data":     []string{base64.StdEncoding.EncodeToString(imgData)},
+			},
+		},
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Outputs []struct {
+			Name string    `json:"name"`
+			Data []float64 `json:"data"`
+		} `json:"outputs"`
+	}
+	if err := c.post("application/json", body, &resp); err != nil {
+		return nil, err
+	}
+
+	// The outputs are flattened tensors.
+	var boxes [][4]float64
+	var classes, scores []float64
+	for _, o := range resp.Outputs {
+		switch o.Name {
+		case "detection_boxes":
+			for i := 0; i+3 < len(o.Data); i += 4 {
+				boxes = append(boxes, [4]float64{o.Data[i], o.Data[i+1], o.Data[i+2], o.Data[i+3]})
+			}
+		case "detection_classes":
+			classes = o.Data
+		case "detection_scores":
+			scores = o.Data
+		}
+	}
+	return c.objectDetectionOutputs(boxes, classes, scores, width, height)
+}
+
+// objectDetectionOutputs converts the outputs of a TensorFlow Object Detection API model, with the
+// boxes as normalised [ymin, xmin, ymax, xmax], to detections in pixel coordinates.
+func (c *inferenceClient) objectDetectionOutputs(boxes [][4]float64, classes, scores []float64,
+		width, height int) ([]inferenceDetection, error) {
+
+	if len(boxes) != len(classes) || len(boxes) != len(scores) {
+		return nil, fmt.Errorf("inconsistent number of detection boxes, classes and scores")
+	}
+
+	detections := make([]inferenceDetection, len(boxes))
+	w, h := float64(width), float64(height)
+	for i, b := range boxes {
+		id := int64(classes[i])
+		label, ok := c.labels[id]
+		if !ok {
+			label = strconv.FormatInt(id, 10)
+		}
+		detections[i] = inferenceDetection{
+			Label: label,
+			Score: scores[i],
+			Box:   [4]float64{b[1] * w, b[0] * h, b[3] * w, b[2] * h},
+		}
+	}
+	return detections, nil
+}
+
+// inferenceFormat implements the Reader interface for inference endpoints.
+type inferenceFormat struct{}
+
+// Parse implements Reader.
+func (f inferenceFormat) Parse(endpoint string, opts FormatOptions) ([]AnnotatedFile, error) {
+	src, err := f.NewSource(endpoint, opts)
+	if err != nil {
+		return nil, err
+	}
+	return ReadAll(src)
+}
+
+// NewSource implements StreamReader.
+func (inferenceFormat) NewSource(endpoint string, opts FormatOptions) (Source, error) {
+	if err := requireImageDir(opts); err != nil {
+		return nil, err
+	}
+	return NewInferenceSource(endpoint, opts.ImageDir, opts.Inference)
+}
+
+func init() {
+	RegisterFormat(Format{
+		Name:        "inference",
+		Description: "Detections from an inference endpoint (json, TF Serving or Triton)",
+		Reader:      inferenceFormat{},
+		ReaderArgs:  "-labels <url> -images <dir> [-inference-protocol <protocol>]",
+	})
+}
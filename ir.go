@@ -3,6 +3,10 @@ package lblconv
 // The intermediate annotation metadata representation.
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"image"
 	"log"
@@ -10,10 +14,13 @@ import (
 	"math/rand"
 	"path/filepath"
 	"reflect"
-	"runtime"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/disintegration/imaging"
 )
@@ -21,9 +28,50 @@ import (
 // Keys for known annotation attributes.
 const (
 	AncestorLabels = "Ancestors"  // Ancestors in the label taxonomy. Type []string.
+	Area           = "Area"       // The object area in pixels, e.g. of its mask. Type float64.
 	Confidence     = "Confidence" // Type float64 in [0.0, 1.0].
 	CropCoords     = "CropCoords" // Absolute coords (x1,y1)(x2,y2) in the source image. Type string.
 	DetectedText   = "Text"       // Text that is associated with the bounding box. Type string.
+	Difficult      = "Difficult"  // Whether the object is difficult to recognise. Type bool.
+	Ignore         = "Ignore"     // Whether to ignore the object in training and eval. Type bool.
+	ImageLabel     = "ImageLabel" // An image-level label without a box. Type bool.
+	InputSource    = "Source"     // The input dataset, e.g. when merging datasets. Type string.
+	IsCrowd        = "IsCrowd"    // Whether the annotation covers a crowd of objects. Type bool.
+	Truncated      = "Truncated"  // Whether the object extends beyond the image. Type bool.
+)
+
+// Keys for known annotation attributes of object tracks in video datasets, e.g. from MOT.
+const (
+	TrackID      = "TrackID"      // The ID of the object track within its Sequence. Type int.
+	Interpolated = "Interpolated" // Whether the box was interpolated between keyframes. Type bool.
+	Visibility   = "Visibility"   // The visible fraction of the object. Type float64 in [0, 1].
+)
+
+// Keys for known annotation attributes of augmentations.
+const (
+	Synthetic = "Synthetic" // Whether the annotation was added by an augmentation. Type bool.
+)
+
+// Keys for known annotation attributes with additional confidence values, e.g. of AWS detect-labels
+// annotations, whose Confidence is that of the object instance.
+const (
+	// The confidence of the label, regardless of the instance. Type float64 in [0.0, 1.0].
+	LabelConfidence = "LabelConfidence"
+	// The label confidence by label in AncestorLabels, if known. Type map[string]float64.
+	AncestorConfidences = "AncestorConfidences"
+)
+
+// Keys for known annotation attributes of detected text, e.g. of AWS detect-text annotations.
+const (
+	TextID       = "TextID"       // The ID of the line or word. Type int.
+	TextParentID = "TextParentID" // The TextID of the line that contains a word. Type int.
+)
+
+// Keys for known file attributes.
+const (
+	ImageLabels = "ImageLabels" // The confidence by image-level label. Type map[string]float64.
+	Sequence    = "Sequence"    // The name of the video sequence of a frame. Type string.
+	Frame       = "Frame"       // The 1-based frame number within the Sequence. Type int.
 )
 
 // Annotation is the intermediate representation of an object label.
@@ -31,6 +79,45 @@ type Annotation struct {
 	Attributes map[string]interface{} // Additional attributes of this annotation.
 	Coords     [4]float64             // Absolute x1, y1, x2, y2 offsets from the top-left corner.
 	Label      string
+
+	// The vertices of the object outline as absolute x, y offsets, if it is a polygon. Coords is
+	// its bounding box then.
+	Polygon [][2]float64
+
+	// An optional ID that is unique within the dataset, to track the annotation across
+	// conversions. See AnnotatedFiles.AssignAnnotationIDs.
+	ID string
+}
+
+// AnnotationID returns a deterministic ID for an annotation with the given label and coordinates
+// in the file at filePath. n distinguishes identical annotations in the same file and is 0 for the
+// first of them.
+func AnnotationID(filePath, label string, coords [4]float64, n int) string {
+	key := fmt.Sprintf("%s\x00%s\x00%g,%g,%g,%g", filePath, label, coords[0], coords[1], coords[2],
+		coords[3])
+	if n > 0 {
+		key += fmt.Sprintf("\x00%d", n)
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// boolAttribute returns the value of the attribute key as a bool. Besides bool values, it accepts
+// numbers (true if not zero) and strings as parsed by strconv.ParseBool, e.g. from VIA attributes.
+// Returns false if the attribute is missing or has an unsupported value.
+func (a Annotation) boolAttribute(key string) bool {
+	switch v := a.Attributes[key].(type) {
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case int:
+		return v != 0
+	case string:
+		b, _ := strconv.ParseBool(v)
+		return b
+	}
+	return false
 }
 
 // Width is the object width from a.Coords.
@@ -43,23 +130,161 @@ func (a Annotation) Height() float64 {
 	return a.Coords[3] - a.Coords[1]
 }
 
+// Area is the area of the bounding box of a, or zero if it is empty or inverted. See CoordsArea.
+func (a Annotation) Area() float64 {
+	return CoordsArea(a.Coords)
+}
+
+// Intersect returns the coordinates of the intersection of the bounding boxes of a and other, and
+// whether they overlap. See IntersectCoords.
+func (a Annotation) Intersect(other Annotation) ([4]float64, bool) {
+	return IntersectCoords(a.Coords, other.Coords)
+}
+
+// Union returns the coordinates of the smallest bounding box that encloses the bounding boxes of a
+// and other. See UnionCoords.
+func (a Annotation) Union(other Annotation) [4]float64 {
+	return UnionCoords(a.Coords, other.Coords)
+}
+
+// IoU returns the intersection over union of the bounding boxes of a and other. See CoordsIoU.
+func (a Annotation) IoU(other Annotation) float64 {
+	return CoordsIoU(a.Coords, other.Coords)
+}
+
 // AnnotatedFile is the intermediate representation of file metadata.
 type AnnotatedFile struct {
 	Annotations []Annotation // The annotations.
 	FilePath    string       // The annotated file.
+	ImageWidth  int          // The image width in pixels, if known (zero otherwise).
+	ImageHeight int          // The image height in pixels, if known (zero otherwise).
+	ImageSHA256 string       // The hex-encoded SHA-256 of the image file, if known.
+
+	// The space of the coordinates and polygons of the annotations. Most functions of this package
+	// expect AbsoluteCoords, see ToAbsolute.
+	CoordSpace CoordinateSpace
+
+	Attributes map[string]interface{} // Additional attributes of the file, if any.
+}
+
+// Clone returns a copy of f that does not share its annotations, polygons or attribute maps, so
+// that it can be modified without changing f. The attribute values themselves are not copied.
+func (f AnnotatedFile) Clone() AnnotatedFile {
+	f.Attributes = cloneAttributes(f.Attributes)
+	if f.Annotations != nil {
+		annotations := make([]Annotation, len(f.Annotations))
+		for i, a := range f.Annotations {
+			a.Attributes = cloneAttributes(a.Attributes)
+			if a.Polygon != nil {
+				a.Polygon = append([][2]float64(nil), a.Polygon...)
+			}
+			annotations[i] = a
+		}
+		f.Annotations = annotations
+	}
+	return f
+}
+
+// cloneAttributes returns a shallow copy of attrs, or nil if attrs is nil.
+func cloneAttributes(attrs map[string]interface{}) map[string]interface{} {
+	if attrs == nil {
+		return nil
+	}
+	clone := make(map[string]interface{}, len(attrs))
+	for k, v := range attrs {
+		clone[k] = v
+	}
+	return clone
 }
 
-// scaleCoords scales all Annotations.Coords by the given scale factors.
+// imageLabels returns the ImageLabels attribute of f, or nil if it has none.
+func (f *AnnotatedFile) imageLabels() map[string]float64 {
+	labels, _ := f.Attributes[ImageLabels].(map[string]float64)
+	return labels
+}
+
+// scaleCoords scales all Annotations.Coords and polygons by the given scale factors.
 func (f *AnnotatedFile) scaleCoords(width, height float64) {
 	for i := range f.Annotations {
+		a := &f.Annotations[i]
 		for j := 0; j < 4; j++ {
 			if j&1 == 0 {
-				f.Annotations[i].Coords[j] *= width
+				a.Coords[j] *= width
 			} else {
-				f.Annotations[i].Coords[j] *= height
+				a.Coords[j] *= height
+			}
+		}
+		if a.Polygon != nil {
+			// Copy the points, which may be shared with other files.
+			polygon := make([][2]float64, len(a.Polygon))
+			for j, p := range a.Polygon {
+				polygon[j] = [2]float64{p[0] * width, p[1] * height}
+			}
+			a.Polygon = polygon
+		}
+	}
+}
+
+// clipPolygon clips the polygon to the rectangle r with the Sutherland-Hodgman algorithm and
+// translates it by -r.Min. Returns nil if the polygon lies outside of r.
+func clipPolygon(polygon [][2]float64, r image.Rectangle) [][2]float64 {
+	minX, minY := float64(r.Min.X), float64(r.Min.Y)
+	maxX, maxY := float64(r.Max.X), float64(r.Max.Y)
+
+	// Each edge of r is given by whether a point is inside and the intersection of the segment from
+	// p to q with the edge.
+	edges := []struct {
+		inside       func(p [2]float64) bool
+		intersection func(p, q [2]float64) [2]float64
+	}{
+		{
+			func(p [2]float64) bool { return p[0] >= minX },
+			func(p, q [2]float64) [2]float64 {
+				return [2]float64{minX, p[1] + (q[1]-p[1])*(minX-p[0])/(q[0]-p[0])}
+			},
+		}, {
+			func(p [2]float64) bool { return p[0] <= maxX },
+			func(p, q [2]float64) [2]float64 {
+				return [2]float64{maxX, p[1] + (q[1]-p[1])*(maxX-p[0])/(q[0]-p[0])}
+			},
+		}, {
+			func(p [2]float64) bool { return p[1] >= minY },
+			func(p, q [2]float64) [2]float64 {
+				return [2]float64{p[0] + (q[0]-p[0])*(minY-p[1])/(q[1]-p[1]), minY}
+			},
+		}, {
+			func(p [2]float64) bool { return p[1] <= maxY },
+			func(p, q [2]float64) [2]float64 {
+				return [2]float64{p[0] + (q[0]-p[0])*(maxY-p[1])/(q[1]-p[1]), maxY}
+			},
+		},
+	}
+
+	clipped := polygon
+	for _, edge := range edges {
+		in := clipped
+		clipped = make([][2]float64, 0, len(in)+1)
+		for i, q := range in {
+			p := in[(i+len(in)-1)%len(in)]
+			switch {
+			case edge.inside(q) && edge.inside(p):
+				clipped = append(clipped, q)
+			case edge.inside(q):
+				clipped = append(clipped, edge.intersection(p, q), q)
+			case edge.inside(p):
+				clipped = append(clipped, edge.intersection(p, q))
 			}
 		}
+		if len(clipped) == 0 {
+			return nil
+		}
+	}
+
+	for i := range clipped {
+		clipped[i][0] -= minX
+		clipped[i][1] -= minY
 	}
+	return clipped
 }
 
 type subImager interface {
@@ -105,16 +330,24 @@ func (f *AnnotatedFile) cropObjectsFromImage(img image.Image) (
 		ext := filepath.Ext(f.FilePath)
 		path := fmt.Sprintf("%s_%02d%s", f.FilePath[0:len(f.FilePath)-len(ext)], i, ext)
 
-		// Create the annotation for the crop with a bounding box covering the entire area.
+		// Create the annotation for the crop with a bounding box covering the entire area and the
+		// polygon, if any, in the coordinates of the crop.
+		var polygon [][2]float64
+		if a.Polygon != nil {
+			polygon = clipPolygon(a.Polygon, r)
+		}
 		fileData := AnnotatedFile{
 			Annotations: []Annotation{
 				{
 					Attributes: attrs,
 					Coords:     [4]float64{0, 0, float64(r.Dx()), float64(r.Dy())},
 					Label:      a.Label,
+					Polygon:    polygon,
 				},
 			},
-			FilePath: path,
+			FilePath:    path,
+			ImageWidth:  r.Dx(),
+			ImageHeight: r.Dy(),
 		}
 
 		crops = append(crops, img2.SubImage(r))
@@ -127,47 +360,188 @@ func (f *AnnotatedFile) cropObjectsFromImage(img image.Image) (
 // AnnotatedFiles is the annotation metadata for a list of files.
 type AnnotatedFiles []AnnotatedFile
 
-// MapLabels replaces label (sub-)strings with substitution values, as specified in mappings.
-//
-// The format of mappings is old=new.
-func (data *AnnotatedFiles) MapLabels(mappings []string) error {
-	if len(mappings) == 0 {
-		return nil
+// imagePathKey returns the key that identifies the image at path, i.e. the cleaned path for local
+// images and the unchanged URL for remote images.
+func imagePathKey(path string) string {
+	if isRemoteImage(path) {
+		return path
+	}
+	return filepath.Clean(path)
+}
+
+// MergeDuplicates merges files with the same image path into the first of them, appending the
+// annotations of the later files in order. The file attributes of the first file take precedence,
+// and its missing attributes, image dimensions and checksum are taken from the later files. If
+// strict is true, it returns an error for the first duplicate instead and leaves data unchanged.
+// Returns the number of files merged.
+func (data *AnnotatedFiles) MergeDuplicates(strict bool) (int, error) {
+	first := make(map[string]int, len(*data)) // The index of the first file by image path.
+	merged := make(AnnotatedFiles, 0, len(*data))
+	for _, f := range *data {
+		key := imagePathKey(f.FilePath)
+		i, ok := first[key]
+		if !ok {
+			first[key] = len(merged)
+			merged = append(merged, f)
+			continue
+		}
+		if strict {
+			return 0, fmt.Errorf("duplicate entries for image %q", f.FilePath)
+		}
+
+		merged[i].merge(f)
+	}
+
+	n := len(*data) - len(merged)
+	*data = merged
+	return n, nil
+}
+
+// merge merges other, a duplicate entry for the same image, into f, as described for
+// MergeDuplicates.
+func (f *AnnotatedFile) merge(other AnnotatedFile) {
+	f.Annotations = append(f.Annotations, other.Annotations...)
+	if f.ImageWidth == 0 || f.ImageHeight == 0 {
+		f.ImageWidth, f.ImageHeight = other.ImageWidth, other.ImageHeight
+	}
+	if f.ImageSHA256 == "" {
+		f.ImageSHA256 = other.ImageSHA256
+	}
+
+	// Copy the attributes before adding to them, as they may be shared with other files.
+	copied := false
+	for k, v := range other.Attributes {
+		if _, ok := f.Attributes[k]; ok {
+			continue
+		}
+		if !copied {
+			f.Attributes = cloneAttributes(f.Attributes)
+			if f.Attributes == nil {
+				f.Attributes = make(map[string]interface{}, len(other.Attributes))
+			}
+			copied = true
+		}
+		f.Attributes[k] = v
+	}
+}
+
+// mergeDuplicates applies AnnotatedFiles.MergeDuplicates to the files parsed from path, logging
+// the number of merged files.
+func mergeDuplicates(path string, data []AnnotatedFile, strict bool) ([]AnnotatedFile, error) {
+	files := AnnotatedFiles(data)
+	n, err := files.MergeDuplicates(strict)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if n > 0 {
+		log.Printf("Merged %d duplicate image entries in %q", n, path)
 	}
+	return files, nil
+}
 
-	// Extract the individual old and new strings to map between.
-	replacements := make([]struct{ old, new string }, len(mappings))
+// labelReplacement is a label (sub-)string replacement.
+type labelReplacement struct {
+	old, new string
+}
+
+// parseLabelMappings extracts the individual old and new strings to map between from mappings in
+// the format old=new.
+func parseLabelMappings(mappings []string) ([]labelReplacement, error) {
+	replacements := make([]labelReplacement, len(mappings))
 	for i, v := range mappings {
 		a := strings.Split(v, "=")
 		if len(a) != 2 {
-			return fmt.Errorf("invalid mapping: %v", v)
+			return nil, fmt.Errorf("invalid mapping: %v", v)
 		}
 
 		replacements[i].old = a[0]
 		replacements[i].new = a[1]
 	}
 
-	// Apply the replacements, in order, to all labels.
+	return replacements, nil
+}
+
+// mapLabels applies the replacements, in order, to all labels of f. Returns the number of labels
+// that changed.
+func (f *AnnotatedFile) mapLabels(replacements []labelReplacement) int {
 	count := 0
-	for _, f := range *data {
-		for i, aLen := 0, len(f.Annotations); i < aLen; i++ {
-			a := &f.Annotations[i]
+	for i, aLen := 0, len(f.Annotations); i < aLen; i++ {
+		a := &f.Annotations[i]
 
-			oldLabel := a.Label
-			for _, r := range replacements {
-				a.Label = strings.Replace(a.Label, r.old, r.new, -1)
-			}
+		oldLabel := a.Label
+		for _, r := range replacements {
+			a.Label = strings.Replace(a.Label, r.old, r.new, -1)
+		}
 
-			if a.Label != oldLabel {
-				count++
-			}
+		if a.Label != oldLabel {
+			count++
 		}
 	}
 
+	return count
+}
+
+// MapLabels replaces label (sub-)strings with substitution values, as specified in mappings.
+//
+// The format of mappings is old=new.
+func (data *AnnotatedFiles) MapLabels(mappings []string) error {
+	if len(mappings) == 0 {
+		return nil
+	}
+
+	replacements, err := parseLabelMappings(mappings)
+	if err != nil {
+		return err
+	}
+
+	// Apply the replacements to all labels.
+	count := 0
+	for i := range *data {
+		count += (*data)[i].mapLabels(replacements)
+	}
+
 	log.Printf("The label mappings changed %d labels", count)
 	return nil
 }
 
+// transformBboxes applies TransformBboxes to the annotations of f.
+func (f *AnnotatedFile) transformBboxes(scaleX, scaleY, aspectRatio float64) {
+	for i, aLen := 0, len(f.Annotations); i < aLen; i++ {
+		a := &f.Annotations[i]
+
+		// Scale about the centre.
+		if scaleX != 1 || scaleY != 1 {
+			cx, cy, w, h := CoordsToCXCYWH(a.Coords)
+			a.Coords = CoordsFromCXCYWH(cx, cy, w*scaleX, h*scaleY)
+		}
+
+		// Grow to match desired aspect ratio.
+		if aspectRatio > 0 {
+			// Calculate the ratio so that the expansion works even if one of width or height is zero.
+			w := a.Width()
+			h := a.Height()
+			var ratio float64
+			if h != 0 {
+				ratio = w / h
+			} else {
+				ratio = math.MaxFloat64
+			}
+
+			if ratio < aspectRatio {
+				// Expand horizontally.
+				dx := (h*aspectRatio - w) * 0.5
+				a.Coords[0] -= dx
+				a.Coords[2] += dx
+			} else if ratio > aspectRatio {
+				// Expand vertically.
+				dy := (w/aspectRatio - h) * 0.5
+				a.Coords[1] -= dy
+				a.Coords[3] += dy
+			}
+		}
+	}
+}
+
 // TransformBboxes transforms bounding boxes.
 //
 // First bboxes are scaled by the horizontal and vertical scale factors scaleX and scaleY.
@@ -175,67 +549,216 @@ func (data *AnnotatedFiles) MapLabels(mappings []string) error {
 // Next, the bounding box is grown (never shrunk) to match the desired aspect ratio. An aspectRatio
 // of zero disables this transformation.
 func (data *AnnotatedFiles) TransformBboxes(scaleX, scaleY, aspectRatio float64) {
-	for _, f := range *data {
-		for i, aLen := 0, len(f.Annotations); i < aLen; i++ {
-			a := &f.Annotations[i]
+	for i := range *data {
+		(*data)[i].transformBboxes(scaleX, scaleY, aspectRatio)
+	}
+}
 
-			// Scale.
-			if scaleX != 1 || scaleY != 1 {
-				w := a.Width()
-				h := a.Height()
-				dx := (w*scaleX - w) * 0.5
-				dy := (h*scaleY - h) * 0.5
+// BboxRepairs counts the bounding box repairs made by AnnotatedFiles.SanitizeBboxes.
+type BboxRepairs struct {
+	Swapped int // Boxes with inverted min. and max. coordinates, which are swapped.
+	Clamped int // Boxes that exceed the image bounds, which are clamped.
+	Dropped int // Boxes with a zero area after the other repairs, which are removed.
+}
 
-				a.Coords[0] -= dx
-				a.Coords[1] -= dy
-				a.Coords[2] += dx
-				a.Coords[3] += dy
+// add adds the counts of other to r.
+func (r *BboxRepairs) add(other BboxRepairs) {
+	r.Swapped += other.Swapped
+	r.Clamped += other.Clamped
+	r.Dropped += other.Dropped
+}
+
+// sanitizeBboxes repairs the bounding boxes of f and returns the repairs by label. The image
+// dimensions are read from the image if they are not known. If that fails, the coordinates are
+// only clamped to be >= 0.
+func (f *AnnotatedFile) sanitizeBboxes() map[string]BboxRepairs {
+	width, height := float64(f.ImageWidth), float64(f.ImageHeight)
+	if width <= 0 || height <= 0 {
+		if w, h, err := imageDimensions(f.FilePath); err == nil {
+			width, height = float64(w), float64(h)
+		} else {
+			width, height = math.Inf(1), math.Inf(1)
+		}
+	}
+	clamp := func(v, max float64) float64 {
+		return math.Max(0, math.Min(max, v))
+	}
+
+	var repairs map[string]BboxRepairs
+	record := func(label string, r BboxRepairs) {
+		if repairs == nil {
+			repairs = make(map[string]BboxRepairs)
+		}
+		total := repairs[label]
+		total.add(r)
+		repairs[label] = total
+	}
+
+	kept := f.Annotations[:0]
+	for _, a := range f.Annotations {
+		// Image-level labels have no bounding box.
+		if a.boolAttribute(ImageLabel) {
+			kept = append(kept, a)
+			continue
+		}
+
+		c := &a.Coords
+		if c[0] > c[2] || c[1] > c[3] {
+			c[0], c[2] = math.Min(c[0], c[2]), math.Max(c[0], c[2])
+			c[1], c[3] = math.Min(c[1], c[3]), math.Max(c[1], c[3])
+			record(a.Label, BboxRepairs{Swapped: 1})
+		}
+
+		clamped := [4]float64{
+			clamp(c[0], width), clamp(c[1], height), clamp(c[2], width), clamp(c[3], height),
+		}
+		if clamped != *c {
+			*c = clamped
+			record(a.Label, BboxRepairs{Clamped: 1})
+		}
+
+		if c[0] == c[2] || c[1] == c[3] {
+			record(a.Label, BboxRepairs{Dropped: 1})
+			continue
+		}
+		kept = append(kept, a)
+	}
+	f.Annotations = kept
+
+	return repairs
+}
+
+// SanitizeBboxes repairs invalid bounding boxes: It swaps inverted min. and max. coordinates,
+// clamps the coordinates to the image bounds and removes boxes with a zero area. Annotations with
+// the ImageLabel attribute are kept unchanged. The image dimensions are read from the images if
+// they are not known. Returns the repairs by label.
+func (data *AnnotatedFiles) SanitizeBboxes() map[string]BboxRepairs {
+	repairs := make(map[string]BboxRepairs)
+	for i := range *data {
+		for label, r := range (*data)[i].sanitizeBboxes() {
+			total := repairs[label]
+			total.add(r)
+			repairs[label] = total
+		}
+	}
+	return repairs
+}
+
+// assignAnnotationIDs sets the ID of the annotations of f that have none, see AnnotationID.
+func (f *AnnotatedFile) assignAnnotationIDs() {
+	used := make(map[string]bool, len(f.Annotations))
+	for _, a := range f.Annotations {
+		if a.ID != "" {
+			used[a.ID] = true
+		}
+	}
+
+	for i := range f.Annotations {
+		a := &f.Annotations[i]
+		if a.ID != "" {
+			continue
+		}
+		for n := 0; ; n++ {
+			if id := AnnotationID(f.FilePath, a.Label, a.Coords, n); !used[id] {
+				a.ID = id
+				used[id] = true
+				break
 			}
+		}
+	}
+}
 
-			// Grow to match desired aspect ratio.
-			if aspectRatio > 0 {
-				// Calculate the ratio so that the expansion works even if one of width or height is zero.
-				w := a.Width()
-				h := a.Height()
-				var ratio float64
-				if h != 0 {
-					ratio = w / h
-				} else {
-					ratio = math.MaxFloat64
-				}
+// AssignAnnotationIDs sets the ID of all annotations that have none, derived from the file path,
+// the label and the coordinates with AnnotationID. The IDs are therefore the same for the same
+// input across conversions, as long as they are assigned before any transformation.
+func (data *AnnotatedFiles) AssignAnnotationIDs() {
+	for i := range *data {
+		(*data)[i].assignAnnotationIDs()
+	}
+}
 
-				if ratio < aspectRatio {
-					// Expand horizontally.
-					dx := (h*aspectRatio - w) * 0.5
-					a.Coords[0] -= dx
-					a.Coords[2] += dx
-				} else if ratio > aspectRatio {
-					// Expand vertically.
-					dy := (w/aspectRatio - h) * 0.5
-					a.Coords[1] -= dy
-					a.Coords[3] += dy
-				}
+// sortAnnotations sorts the annotations of f by their coordinates, in the order x_min, y_min, x_max,
+// y_max, then by label and ID.
+func (f *AnnotatedFile) sortAnnotations() {
+	sort.SliceStable(f.Annotations, func(i, j int) bool {
+		a, b := f.Annotations[i], f.Annotations[j]
+		for k := range a.Coords {
+			if a.Coords[k] != b.Coords[k] {
+				return a.Coords[k] < b.Coords[k]
 			}
 		}
+		if a.Label != b.Label {
+			return a.Label < b.Label
+		}
+		return a.ID < b.ID
+	})
+}
+
+// Sort sorts the files by path, and the annotations of each file by their coordinates, so that the
+// output of the writers does not depend on the order of the input, e.g. to diff or cache it. Files
+// with the same path keep their order.
+func (data *AnnotatedFiles) Sort() {
+	sort.SliceStable(*data, func(i, j int) bool { return (*data)[i].FilePath < (*data)[j].FilePath })
+	for i := range *data {
+		(*data)[i].sortAnnotations()
 	}
 }
 
-// Filter filters out annotations which do not match any of the given labelNames, have a confidence
-// value less than minConfidence, a bounding box with less than minBboxWidth or minBboxHeight, or
-// do not match the required aspect ratio.
-//
-// The aspect ratio of width/height must be in [minAspectRatio, maxAspectRatio], except that a
-// min/max value of zero disables the respective filter.
-//
-// If attributes is non empty, only the listed attributes are kept. This only filters the list
-// of attributes, not the annotations themselve.
-//
-// Similarly, requiredAttrs specifies attributes that must be present with a value that is not the
-// Go zero value of their type. If this test fails for an annotation, that annotation is deleted.
-func (data *AnnotatedFiles) Filter(labelNames, attributes, requiredAttrs []string,
-		minConfidence float64, requireLabel bool, minBboxWidth, minBboxHeight, minAspectRatio,
-		maxAspectRatio float64) {
+// FilterOptions configures AnnotatedFiles.FilterWithOptions. The zero value keeps all annotations.
+type FilterOptions struct {
+	// Labels to keep; empty keeps all.
+	Labels []string
+	// InputSource attribute values to keep, see TagSource; empty keeps all.
+	Sources []string
+	// Attributes to keep; empty keeps all. This only filters the attributes, not the annotations.
+	Attributes []string
+	// Attributes that must be present with a value that is not the Go zero value of their type.
+	RequiredAttributes []string
+
+	MinConfidence float64 // Annotations without a confidence value pass this filter.
+
+	// The min. LabelConfidence. Annotations without a label confidence pass this filter.
+	MinLabelConfidence float64
+
+	RequireLabel  bool    // Whether to filter out files without annotations (after other filters).
 
+	// Image-level labels that files must have, see ImageLabels; files without all of them are
+	// filtered out.
+	RequiredImageLabels []string
+
+	MinBboxWidth  float64 // The min. bounding box width.
+	MinBboxHeight float64 // The min. bounding box height.
+
+	// The required range of the bounding box aspect ratio width/height; zero disables the filter.
+	MinAspectRatio, MaxAspectRatio float64
+
+	// Filters for the DetectedText attribute, e.g. of AWS detect-text annotations. Annotations
+	// without a DetectedText attribute pass them.
+	MinTextLength int            // The min. number of characters.
+	TextPattern   *regexp.Regexp // A pattern that the text must match, if not nil.
+	TextCharset   string         // The characters that the text may consist of; empty allows all.
+	NumericText   bool           // Whether the text must consist of digits.
+}
+
+// matchText returns whether the text passes the text filters.
+func (flt *FilterOptions) matchText(text string) bool {
+	if utf8.RuneCountInString(text) < flt.MinTextLength {
+		return false
+	}
+	if flt.TextPattern != nil && !flt.TextPattern.MatchString(text) {
+		return false
+	}
+	for _, r := range text {
+		if flt.TextCharset != "" && !strings.ContainsRune(flt.TextCharset, r) ||
+				flt.NumericText && (r < '0' || r > '9') {
+			return false
+		}
+	}
+	return !flt.NumericText || text != ""
+}
+
+// apply filters the annotations of f. Returns false if the file itself is filtered out.
+func (flt *FilterOptions) apply(f *AnnotatedFile) bool {
 	// Deletes the annotation at index i.
 	deleteAnnotation := func(annotations []Annotation, i int) []Annotation {
 		l := len(annotations)
@@ -253,89 +776,182 @@ func (data *AnnotatedFiles) Filter(labelNames, attributes, requiredAttrs []strin
 		return false
 	}
 
-	numFiles := len(*data)
-	numLabelsBeforeFilter := 0
-	numLabelsAfterFilter := 0
+	// Annotation filters.
+annotationLoop:
+	for i, aLen := 0, len(f.Annotations); i < aLen; i++ {
+		a := &f.Annotations[i]
 
-	// Apply filters.
-	for dataIdx, dataLen := 0, len(*data); dataIdx < dataLen; dataIdx++ {
-		d := &(*data)[dataIdx]
-		numLabelsBeforeFilter += len(d.Annotations)
+		// Filter by confidence. If the annotation has no confidence value then it passes the filter.
+		if c, ok := a.Attributes[Confidence].(float64); ok && c < flt.MinConfidence {
+			f.Annotations = deleteAnnotation(f.Annotations, i)
+			aLen--
+			i--
+			continue
+		}
+
+		// Filter by label confidence, which is distinct from the confidence of the instance.
+		if c, ok := a.Attributes[LabelConfidence].(float64); ok && c < flt.MinLabelConfidence {
+			f.Annotations = deleteAnnotation(f.Annotations, i)
+			aLen--
+			i--
+			continue
+		}
 
-		// Annotation filters.
-	annotationLoop:
-		for i, aLen := 0, len(d.Annotations); i < aLen; i++ {
-			a := &d.Annotations[i]
+		// Filter by bbox size. Image-level labels have no bounding box and pass the bbox filters.
+		imageLevel := a.boolAttribute(ImageLabel)
+		width := a.Width()
+		height := a.Height()
+		if !imageLevel && (flt.MinBboxWidth > width || flt.MinBboxHeight > height) {
+			f.Annotations = deleteAnnotation(f.Annotations, i)
+			aLen--
+			i--
+			continue
+		}
 
-			// Filter by confidence. If the annotation has no confidence value then it passes the filter.
-			if c, ok := a.Attributes[Confidence].(float64); ok && c < minConfidence {
-				d.Annotations = deleteAnnotation(d.Annotations, i)
+		// Filter by bbox aspect ratio.
+		if !imageLevel && (flt.MinAspectRatio != 0 || flt.MaxAspectRatio != 0) {
+			keep := height != 0
+			if keep {
+				ratio := width / height
+				keep = (flt.MinAspectRatio == 0 || ratio >= flt.MinAspectRatio) &&
+						(flt.MaxAspectRatio == 0 || ratio <= flt.MaxAspectRatio)
+			}
+			if !keep {
+				f.Annotations = deleteAnnotation(f.Annotations, i)
 				aLen--
 				i--
 				continue
 			}
+		}
 
-			// Filter by bbox size.
-			width := a.Width()
-			height := a.Height()
-			if minBboxWidth > width || minBboxHeight > height {
-				d.Annotations = deleteAnnotation(d.Annotations, i)
+		// Filter by labels.
+		if len(flt.Labels) > 0 && !inList(a.Label, flt.Labels) {
+			f.Annotations = deleteAnnotation(f.Annotations, i)
+			aLen--
+			i--
+			continue
+		}
+
+		// Filter by input source.
+		if len(flt.Sources) > 0 {
+			if source, _ := a.Attributes[InputSource].(string); !inList(source, flt.Sources) {
+				f.Annotations = deleteAnnotation(f.Annotations, i)
 				aLen--
 				i--
 				continue
 			}
+		}
 
-			// Filter by bbox aspect ratio.
-			if minAspectRatio != 0 || maxAspectRatio != 0 {
-				keep := height != 0
-				if keep {
-					ratio := width / height
-					keep = (minAspectRatio == 0 || ratio >= minAspectRatio) &&
-							(maxAspectRatio == 0 || ratio <= maxAspectRatio)
-				}
-				if !keep {
-					d.Annotations = deleteAnnotation(d.Annotations, i)
+		// Filter by text.
+		if text, ok := a.Attributes[DetectedText].(string); ok && !flt.matchText(text) {
+			f.Annotations = deleteAnnotation(f.Annotations, i)
+			aLen--
+			i--
+			continue
+		}
+
+		// Filter by required attributes with non zero value.
+		if len(flt.RequiredAttributes) > 0 {
+			for _, k := range flt.RequiredAttributes {
+				// Test against the zero value of the underlying type.
+				if v := a.Attributes[k]; v == nil || v == reflect.Zero(reflect.TypeOf(v)).Interface() {
+					f.Annotations = deleteAnnotation(f.Annotations, i)
 					aLen--
 					i--
-					continue
+					continue annotationLoop
 				}
 			}
+		}
 
-			// Filter by labels.
-			if len(labelNames) > 0 && !inList(a.Label, labelNames) {
-				d.Annotations = deleteAnnotation(d.Annotations, i)
-				aLen--
-				i--
-				continue
-			}
-
-			// Filter by required attributes with non zero value.
-			if len(requiredAttrs) > 0 {
-				for _, k := range requiredAttrs {
-					// Test against the zero value of the underlying type.
-					if v := a.Attributes[k]; v == nil || v == reflect.Zero(reflect.TypeOf(v)).Interface() {
-						d.Annotations = deleteAnnotation(d.Annotations, i)
-						aLen--
-						i--
-						continue annotationLoop
-					}
+		// Filter attributes.
+		if len(flt.Attributes) > 0 {
+			for k := range a.Attributes {
+				if !inList(k, flt.Attributes) {
+					delete(a.Attributes, k)
 				}
 			}
+		}
+	}
 
-			// Filter attributes.
-			if len(attributes) > 0 {
-				for k := range a.Attributes {
-					if !inList(k, attributes) {
-						delete(a.Attributes, k)
-					}
-				}
-			}
+	// Filter out the file if it lacks a required image-level label.
+	imageLabels := f.imageLabels()
+	for _, label := range flt.RequiredImageLabels {
+		if _, ok := imageLabels[label]; !ok {
+			return false
+		}
+	}
+
+	// Filter out the file if files with no labels are filtered out.
+	return !flt.RequireLabel || len(f.Annotations) > 0
+}
+
+// ApplyHook calls hook for each file, removing the files for which it returns false. The order of
+// the remaining files is retained. If hook fails, ApplyHook returns the error, and the files from
+// the failing one onwards remain unprocessed.
+func (data *AnnotatedFiles) ApplyHook(hook Hook) error {
+	kept := (*data)[:0]
+	for i := range *data {
+		f := (*data)[i]
+		keep, err := hook(&f)
+		if err != nil {
+			*data = append(kept, (*data)[i:]...)
+			return err
+		}
+		if keep {
+			kept = append(kept, f)
 		}
+	}
+	*data = kept
+
+	return nil
+}
+
+// Filter filters out annotations which do not match any of the given labelNames, have a confidence
+// value less than minConfidence, a bounding box with less than minBboxWidth or minBboxHeight, or
+// do not match the required aspect ratio.
+//
+// The aspect ratio of width/height must be in [minAspectRatio, maxAspectRatio], except that a
+// min/max value of zero disables the respective filter.
+//
+// If attributes is non empty, only the listed attributes are kept. This only filters the list
+// of attributes, not the annotations themselve.
+//
+// Similarly, requiredAttrs specifies attributes that must be present with a value that is not the
+// Go zero value of their type. If this test fails for an annotation, that annotation is deleted.
+//
+// Deprecated: Use FilterWithOptions.
+func (data *AnnotatedFiles) Filter(labelNames, attributes, requiredAttrs []string,
+		minConfidence float64, requireLabel bool, minBboxWidth, minBboxHeight, minAspectRatio,
+		maxAspectRatio float64) {
+
+	data.FilterWithOptions(FilterOptions{
+		Labels:             labelNames,
+		Attributes:         attributes,
+		RequiredAttributes: requiredAttrs,
+		MinConfidence:      minConfidence,
+		RequireLabel:       requireLabel,
+		MinBboxWidth:       minBboxWidth,
+		MinBboxHeight:      minBboxHeight,
+		MinAspectRatio:     minAspectRatio,
+		MaxAspectRatio:     maxAspectRatio,
+	})
+}
 
+// FilterWithOptions filters out annotations and files as specified by opts.
+func (data *AnnotatedFiles) FilterWithOptions(opts FilterOptions) {
+	numFiles := len(*data)
+	numLabelsBeforeFilter := 0
+	numLabelsAfterFilter := 0
+
+	// Apply filters.
+	for dataIdx, dataLen := 0, len(*data); dataIdx < dataLen; dataIdx++ {
+		d := &(*data)[dataIdx]
+		numLabelsBeforeFilter += len(d.Annotations)
+		keep := opts.apply(d)
 		numLabelsAfterFilter += len(d.Annotations)
 
-		// Delete the file annotation if files with no labels are filtered out.
-		if requireLabel && len(d.Annotations) == 0 {
+		// Delete the file annotation if it was filtered out.
+		if !keep {
 			dataLen--
 			(*data)[dataIdx] = (*data)[dataLen]
 			*data = (*data)[0:dataLen]
@@ -347,21 +963,129 @@ func (data *AnnotatedFiles) Filter(labelNames, attributes, requiredAttrs []strin
 		numLabelsBeforeFilter-numLabelsAfterFilter, numFiles-len(*data))
 }
 
-// ProcessImages resizes all referenced images and writes them to imageOutDir using the specified
-// encoding.
-//
-// If doCropObjects is true, individual objects as per the labels are cropped from the images. The
-// crops are resized instead of the original images in this case. The data changes accordingly, with
-// 0 or more cropped images replacing the original AnnotatedFile.
-func (data *AnnotatedFiles) ProcessImages(imageOutDir string, longerSide, shorterSide int,
-		downsamplingFilter, upsamplingFilter, encoding string, jpegQuality int,
-		doCropObjects bool) error {
+// ImageProcessingOptions configures AnnotatedFiles.ProcessImagesWithOptions. The zero value does
+// not require any image processing.
+type ImageProcessingOptions struct {
+	OutDir string // The output directory for the processed images.
+
+	// The target lengths for the longer and shorter sides of the images. If one of them is zero,
+	// the aspect ratio is kept. If both are zero, the images are not resized.
+	ResizeLonger, ResizeShorter int
+
+	// The resampling filters {nearest, box, linear, gaussian, lanczos}. Defaults to box for
+	// downsampling and linear for upsampling.
+	DownsamplingFilter, UpsamplingFilter string
+
+	Encoding    string // The output image encoding {jpg, png}. Defaults to jpg.
+	JPEGQuality int    // The quality for JPEG outputs in [1, 100]. Defaults to 90.
+
+	// The colour model of the output images, e.g. to convert infrared or document images to
+	// grayscale. Resized grayscale images are written as RGB unless ImageColorGray is set.
+	Color ImageColorMode
+
+	// Whether to convert images with an embedded ICC profile, e.g. Adobe RGB or Display P3, to
+	// sRGB, which is assumed for the output images. Otherwise, the pixel values are kept, which
+	// shifts the colours of such images. Only RGB matrix/TRC profiles are supported.
+	ConvertToSRGB bool
+
+	// The EXIF metadata to copy from the input images, e.g. the timestamp and GPS position. All
+	// metadata is stripped by default.
+	ExifTags ExifTags
+
+	// Whether to crop individual objects from the images and output these instead. The other
+	// options then apply to the crops.
+	CropObjects bool
+
+	// The objects to paste onto the output images after resizing, if not nil (copy-paste
+	// augmentation). This cannot be combined with CropObjects.
+	CopyPaste *CopyPastePool
+
+	// The cutout augmentation of the output images, which is applied after resizing and pasting
+	// objects.
+	Cutout CutoutOptions
+
+	// Whether to log and skip the files whose image cannot be read or decoded, e.g. unsupported
+	// JPEG variants, instead of failing.
+	SkipInvalidImages bool
+
+	// If not nil, the files whose image cannot be read or decoded are skipped and their images
+	// added to the Quarantine, regardless of SkipInvalidImages.
+	Quarantine *Quarantine
+
+	// The max. number of pixels of an input image in millions, e.g. to guard against decompression
+	// bombs. Larger images are not decoded, but treated like images that cannot be decoded, with
+	// the error ErrImageTooLarge. Zero for no limit.
+	MaxMegapixels float64
+
+	// The max. time to decode and transform an image, after which it is treated like an image that
+	// cannot be decoded, with the error ErrImageTimeout, so that a pathological image cannot stall
+	// a worker indefinitely. The decoding cannot be interrupted, so it goes on in the background
+	// until it finishes, but its result is discarded. Zero for no limit.
+	Timeout time.Duration
+}
 
-	doResizeImages := longerSide > 0 || shorterSide > 0
-	if !doResizeImages && !doCropObjects {
-		return nil
+// imageProcessor holds the parameters of ProcessImages.
+type imageProcessor struct {
+	imageOutDir    string
+	fileExt        string
+	longerSide     int
+	shorterSide    int
+	downsample     imaging.ResampleFilter
+	upsample       imaging.ResampleFilter
+	jpegQuality    int
+	doCropObjects  bool
+	doResizeImages bool
+	skipInvalid    bool
+	quarantine     *Quarantine
+	copyPaste      *CopyPastePool
+	cutout         CutoutOptions
+	color          ImageColorMode
+	toSRGB         bool
+	exifTags       ExifTags
+	maxPixels      int64
+	timeout        time.Duration
+}
+
+// newImageProcessor validates the image processing options and returns an imageProcessor for them.
+// Returns nil if the options do not require any image processing.
+func newImageProcessor(opts ImageProcessingOptions) (*imageProcessor, error) {
+	doResizeImages := opts.ResizeLonger > 0 || opts.ResizeShorter > 0
+	if !doResizeImages && !opts.CropObjects && opts.CopyPaste == nil && opts.Cutout.Count == 0 &&
+			opts.Color == ImageColorKeep && !opts.ConvertToSRGB {
+		return nil, nil
+	}
+	if opts.CopyPaste != nil && opts.CropObjects {
+		return nil, fmt.Errorf("pasting objects cannot be combined with cropping objects")
+	}
+	if err := opts.Cutout.validate(); err != nil {
+		return nil, err
+	}
+	if opts.MaxMegapixels < 0 {
+		return nil, fmt.Errorf("invalid max. number of megapixels %g", opts.MaxMegapixels)
+	}
+	if opts.Timeout < 0 {
+		return nil, fmt.Errorf("invalid image processing timeout %v", opts.Timeout)
+	}
+
+	// Apply the defaults.
+	downsamplingFilter := opts.DownsamplingFilter
+	if downsamplingFilter == "" {
+		downsamplingFilter = "box"
+	}
+	upsamplingFilter := opts.UpsamplingFilter
+	if upsamplingFilter == "" {
+		upsamplingFilter = "linear"
+	}
+	encoding := opts.Encoding
+	if encoding == "" {
+		encoding = "jpg"
+	}
+	jpegQuality := opts.JPEGQuality
+	if jpegQuality == 0 {
+		jpegQuality = 90
+	} else if jpegQuality < 1 || jpegQuality > 100 {
+		return nil, fmt.Errorf("invalid JPEG quality %d", jpegQuality)
 	}
-	log.Print("Processing images")
 
 	// Select the resampling algorithms.
 	downsample := imaging.Box
@@ -386,7 +1110,7 @@ func (data *AnnotatedFiles) ProcessImages(imageOutDir string, longerSide, shorte
 		case "lanczos":
 			*v.filter = imaging.Lanczos
 		default:
-			return fmt.Errorf("unknown resampling filter %q", v.name)
+			return nil, fmt.Errorf("unknown resampling filter %q", v.name)
 		}
 	}
 
@@ -398,25 +1122,99 @@ func (data *AnnotatedFiles) ProcessImages(imageOutDir string, longerSide, shorte
 	case "png":
 		fileExt = ".png"
 	default:
-		return fmt.Errorf("unsupported output encoding %q", encoding)
+		return nil, fmt.Errorf("unsupported output encoding %q", encoding)
+	}
+
+	return &imageProcessor{
+		imageOutDir:    opts.OutDir,
+		fileExt:        fileExt,
+		longerSide:     opts.ResizeLonger,
+		shorterSide:    opts.ResizeShorter,
+		downsample:     downsample,
+		upsample:       upsample,
+		jpegQuality:    jpegQuality,
+		doCropObjects:  opts.CropObjects,
+		doResizeImages: doResizeImages,
+		skipInvalid:    opts.SkipInvalidImages,
+		quarantine:     opts.Quarantine,
+		copyPaste:      opts.CopyPaste,
+		cutout:         opts.Cutout,
+		color:          opts.Color,
+		toSRGB:         opts.ConvertToSRGB,
+		exifTags:       opts.ExifTags,
+		maxPixels:      int64(opts.MaxMegapixels * 1e6),
+		timeout:        opts.Timeout,
+	}, nil
+}
+
+// ProcessImages resizes all referenced images and writes them to imageOutDir using the specified
+// encoding.
+//
+// If doCropObjects is true, individual objects as per the labels are cropped from the images. The
+// crops are resized instead of the original images in this case. The data changes accordingly, with
+// 0 or more cropped images replacing the original AnnotatedFile.
+//
+// Deprecated: Use ProcessImagesWithOptions.
+func (data *AnnotatedFiles) ProcessImages(imageOutDir string, longerSide, shorterSide int,
+		downsamplingFilter, upsamplingFilter, encoding string, jpegQuality int,
+		doCropObjects bool) error {
+
+	return data.ProcessImagesWithOptions(ImageProcessingOptions{
+		OutDir:             imageOutDir,
+		ResizeLonger:       longerSide,
+		ResizeShorter:      shorterSide,
+		DownsamplingFilter: downsamplingFilter,
+		UpsamplingFilter:   upsamplingFilter,
+		Encoding:           encoding,
+		JPEGQuality:        jpegQuality,
+		CropObjects:        doCropObjects,
+	})
+}
+
+// ProcessImagesWithOptions resizes all referenced images and writes them to opts.OutDir using the
+// specified encoding.
+//
+// If opts.CropObjects is true, individual objects as per the labels are cropped from the images.
+// The crops are resized instead of the original images in this case. The data changes accordingly,
+// with 0 or more cropped images replacing the original AnnotatedFile.
+//
+// All images are processed even if some of them fail. The files whose image failed are removed
+// from data, so that it only references images that were written, and the errors are returned as
+// an *ImageProcessingErrors.
+func (data *AnnotatedFiles) ProcessImagesWithOptions(opts ImageProcessingOptions) error {
+	return data.ProcessImagesContext(context.Background(), opts)
+}
+
+// ProcessImagesContext works like ProcessImagesWithOptions, but stops processing further images
+// when ctx is done, in which case it returns ctx.Err(). The images written so far are kept, but
+// data is left unchanged if opts.CropObjects is true, and partially updated otherwise.
+func (data *AnnotatedFiles) ProcessImagesContext(ctx context.Context,
+		opts ImageProcessingOptions) error {
+
+	p, err := newImageProcessor(opts)
+	if err != nil || p == nil {
+		return err
 	}
+	log.Print("Processing images")
 
 	// Prepare for concurrent processing. Limit the number of goroutines in flight, as they load
 	// potentially large images into memory.
-	numTasks := 2 * runtime.NumCPU()
+	numTasks := numWorkers()
 	if len(*data) < numTasks {
 		numTasks = len(*data)
 	}
-	workQueue := make(chan *AnnotatedFile, 2*numTasks)
+	workQueue := make(chan int, 2*numTasks)
+	skipped := make([]bool, len(*data)) // Whether the file at each index was skipped.
 
+	doCropObjects := opts.CropObjects
 	var croppedData []AnnotatedFile
-	var croppedDataCh chan *AnnotatedFile
+	var croppedDataCh chan []AnnotatedFile
 	if doCropObjects {
 		croppedData = make([]AnnotatedFile, 0, len(*data))
-		croppedDataCh = make(chan *AnnotatedFile, 2*numTasks)
+		croppedDataCh = make(chan []AnnotatedFile, 2*numTasks)
 	}
 
-	errors := make(chan error, 1)
+	errs := make([]error, len(*data)) // The error of the file at each index, if it failed.
 	var wg sync.WaitGroup
 
 	// Process images concurrently from a work queue.
@@ -424,9 +1222,28 @@ func (data *AnnotatedFiles) ProcessImages(imageOutDir string, longerSide, shorte
 	for i := 0; i < numTasks; i++ {
 		go func() {
 			defer wg.Done()
-			for d := range workQueue {
-				processImage(d, imageOutDir, fileExt, longerSide, shorterSide, downsample,
-					upsample, jpegQuality, doCropObjects, doResizeImages, croppedDataCh, errors)
+			for i := range workQueue {
+				d := &(*data)[i]
+				processed, err := p.processOrSkip(*d)
+				if err == ErrFileSkipped {
+					err = nil
+				}
+				if err != nil {
+					errs[i] = err
+					skipped[i] = true
+					continue
+				}
+				if processed == nil {
+					skipped[i] = true
+					continue
+				}
+
+				// Return the metadata for the cropped images or update the original metadata.
+				if doCropObjects {
+					croppedDataCh <- processed
+				} else {
+					*d = processed[0]
+				}
 			}
 		}()
 	}
@@ -438,112 +1255,249 @@ func (data *AnnotatedFiles) ProcessImages(imageOutDir string, longerSide, shorte
 		go func() {
 			defer wgAppend.Done()
 			for d := range croppedDataCh {
-				croppedData = append(croppedData, *d)
+				croppedData = append(croppedData, d...)
 			}
 		}()
 	}
 
 	// Feed the work queue.
+feedLoop:
 	for i := range *data {
-		workQueue <- &(*data)[i]
+		select {
+		case workQueue <- i:
+		case <-ctx.Done():
+			break feedLoop
+		}
 	}
 	close(workQueue)
 
 	// Wait for image processing to finish.
 	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		if doCropObjects {
+			close(croppedDataCh)
+			wgAppend.Wait()
+		}
+		return err
+	}
 	if doCropObjects {
 		// Wait for all new metadata to be appended and then replace the old data.
 		close(croppedDataCh)
 		wgAppend.Wait()
 		*data = croppedData
+	} else {
+		// Remove the skipped files.
+		kept := (*data)[:0]
+		for i, f := range *data {
+			if !skipped[i] {
+				kept = append(kept, f)
+			}
+		}
+		*data = kept
 	}
 
-	close(errors)
-	if len(errors) > 0 {
-		return <-errors
+	var failed []error
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) > 0 {
+		return &ImageProcessingErrors{Errors: failed}
 	}
 
 	return nil
 }
 
-// processImage processes the image described by data.
-//
-// If and only if doCropObjects is true, new metadata for the image crops is written to croppedData.
-func processImage(data *AnnotatedFile, imageOutDir, fileExt string, longerSide, shorterSide int,
-		downsample, upsample imaging.ResampleFilter, jpegQuality int, doCropObjects, doResizeImage bool,
-		croppedData chan<- *AnnotatedFile, errors chan<- error) {
+// processOrSkip works like process, but if p.quarantine is not nil or p.skipInvalid is true, it
+// quarantines or logs image errors respectively, and returns ErrFileSkipped instead.
+func (p *imageProcessor) processOrSkip(data AnnotatedFile) ([]AnnotatedFile, error) {
+	processed, err := p.process(data)
+	if err != nil && p.quarantine != nil {
+		return nil, quarantineOrFail(p.quarantine, data, err)
+	}
+	var imageErr *ImageError
+	if err != nil && p.skipInvalid && errors.As(err, &imageErr) {
+		log.Print("Skipping file: ", err)
+		return nil, ErrFileSkipped
+	}
+	return processed, err
+}
 
-	trySendError := func(err error) {
-		select {
-		case errors <- err:
-		default:
+// load reads and decodes the image at path like loadImage, converts it to sRGB if p.toSRGB is
+// true, and returns it with the EXIF metadata selected by p.exifTags, if any. Images with an
+// unsupported ICC profile are logged and their colours kept.
+func (p *imageProcessor) load(path string) (image.Image, []byte, error) {
+	data, err := readImage(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	img, format, err := decodeImage(path, data)
+	if err != nil {
+		return nil, nil, newImageError(path, err)
+	}
+
+	if p.toSRGB {
+		if img, err = convertToSRGB(img, data, format); err != nil {
+			log.Printf("Keeping the colours of image %q: %v", path, err)
 		}
 	}
+	return img, selectExif(embeddedExif(data, format), p.exifTags), nil
+}
 
-	// Read the image.
-	img, _, err := loadImage(data.FilePath)
+// process processes the image described by data and returns the metadata for the output image, or
+// for the object crops if p.doCropObjects is true.
+func (p *imageProcessor) process(data AnnotatedFile) ([]AnnotatedFile, error) {
+	// Read and transform the image, within the memory limit.
+	width, height, err := imageDimensions(data.FilePath)
 	if err != nil {
-		trySendError(err)
-		return
+		return nil, err
+	}
+	if p.maxPixels > 0 && int64(width)*int64(height) > p.maxPixels {
+		return nil, &ImageError{Path: data.FilePath, Err: ErrImageTooLarge}
+	}
+	release := reserveImageMemory(width, height)
+	r := p.loadAndTransform(data, release)
+	if r.err != nil {
+		return nil, r.err
+	}
+	// Keep the memory reserved until the images have been encoded.
+	defer release()
+	images, imageData, exif := r.images, r.imageData, r.exif
+
+	// Save the images, and update the image file paths.
+	for i, img := range images {
+		data := &imageData[i]
+		inName := filepath.Base(data.FilePath)
+		inFileExt := filepath.Ext(inName)
+		outName := inName[0:len(inName)-len(inFileExt)] + p.fileExt
+		outPath := filepath.Join(p.imageOutDir, outName)
+		if err := saveImage(outPath, img, p.jpegQuality, exif); err != nil {
+			return nil, err
+		}
+		data.FilePath = outPath
+		data.ImageSHA256 = ""
+	}
+
+	return imageData, nil
+}
+
+// transformResult is the result of imageProcessor.loadAndTransform.
+type transformResult struct {
+	images    []image.Image
+	imageData []AnnotatedFile
+	exif      []byte
+	err       error
+}
+
+// loadAndTransform loads the image of data with p.load and applies p.transform to it. If this takes
+// longer than p.timeout, it returns an ImageError wrapping ErrImageTimeout instead, while the image
+// is processed to completion in the background, on a copy of data.
+//
+// release frees the memory reserved for the images. It is called by loadAndTransform if it returns
+// an error, after the processing in the background has completed in case of a timeout. Otherwise,
+// the caller must call it once it is done with the images.
+func (p *imageProcessor) loadAndTransform(data AnnotatedFile, release func()) transformResult {
+	run := func(data AnnotatedFile) transformResult {
+		img, exif, err := p.load(data.FilePath)
+		if err != nil {
+			return transformResult{err: err}
+		}
+		images, imageData, err := p.transform(img, data)
+		return transformResult{images: images, imageData: imageData, exif: exif, err: err}
+	}
+	if p.timeout <= 0 {
+		r := run(data)
+		if r.err != nil {
+			release()
+		}
+		return r
 	}
 
+	done := make(chan transformResult, 1)
+	go func() { done <- run(data.Clone()) }()
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			release()
+		}
+		return r
+	case <-timer.C:
+		go func() {
+			<-done
+			release()
+		}()
+		return transformResult{err: &ImageError{Path: data.FilePath, Err: ErrImageTimeout}}
+	}
+}
+
+// transform applies the image processing to img, the image of data, and returns the processed
+// image, or the processed object crops if p.doCropObjects is true, with their metadata. The file
+// paths are those of the input image or the crops.
+func (p *imageProcessor) transform(img image.Image, data AnnotatedFile) (
+		[]image.Image, []AnnotatedFile, error) {
 	// Crop labelled objects from the image if requested.
 	var images []image.Image
-	var imageData []*AnnotatedFile
-	if doCropObjects {
+	var imageData []AnnotatedFile
+	var err error
+	if p.doCropObjects {
 		// The original image is not further processed in this case.
-		var tmpData []AnnotatedFile
-		images, tmpData, err = data.cropObjectsFromImage(img)
+		images, imageData, err = data.cropObjectsFromImage(img)
 		if err != nil {
-			trySendError(err)
-			return
-		}
-
-		imageData = make([]*AnnotatedFile, len(tmpData))
-		for i := range tmpData {
-			imageData[i] = &tmpData[i]
+			return nil, nil, err
 		}
 	} else {
 		images = []image.Image{img}
-		imageData = []*AnnotatedFile{data}
+		imageData = []AnnotatedFile{data}
 	}
 
 	// Process either the original image or the crops.
+	inPath := data.FilePath
 	for i, img := range images {
-		data := imageData[i]
+		data := &imageData[i]
 
 		// Resize.
 		var scaleWidth, scaleHeight float64
-		if doResizeImage {
+		if p.doResizeImages {
 			img, scaleWidth, scaleHeight, err =
-					resizeImage(img, longerSide, shorterSide, downsample, upsample)
+					resizeImage(img, p.longerSide, p.shorterSide, p.downsample, p.upsample)
 			if err != nil {
-				trySendError(err)
-				return
+				return nil, nil, err
 			}
+			data.scaleCoords(scaleWidth, scaleHeight)
 		}
 
-		// Save the image.
-		inName := filepath.Base(data.FilePath)
-		inFileExt := filepath.Ext(inName)
-		outName := inName[0:len(inName)-len(inFileExt)] + fileExt
-		outPath := filepath.Join(imageOutDir, outName)
-		if err := saveImage(outPath, img, jpegQuality); err != nil {
-			trySendError(err)
-			return
-		}
+		// Paste objects and occlude random rectangles. The crops of the same image are seeded
+		// differently.
+		img = p.copyPaste.paste(img, data, inPath)
+		img = p.cutout.apply(img, data, fmt.Sprintf("%s#%d", inPath, i))
+		images[i] = convertColor(img, p.color)
 
-		// Update the image file path and rescale the coordinates.
-		data.FilePath = outPath
-		if doResizeImage {
-			data.scaleCoords(scaleWidth, scaleHeight)
-		}
+		// Update the image dimensions.
+		data.ImageWidth = images[i].Bounds().Dx()
+		data.ImageHeight = images[i].Bounds().Dy()
+	}
 
-		// Return the metadata for the cropped image.
-		if doCropObjects {
-			croppedData <- data
-		}
+	return images, imageData, nil
+}
+
+// ProcessImage applies the image processing of opts to img, the decoded image of f, in memory,
+// e.g. to process single images in a service without writing them. Returns the processed image,
+// or the object crops if opts.CropObjects is true, and their metadata. The file paths are kept,
+// and the output options, e.g. opts.OutDir and opts.Encoding, as well as opts.ConvertToSRGB and
+// opts.ExifTags, which apply to the encoded input images, are ignored. Returns img and f if opts
+// do not require any image processing.
+func ProcessImage(img image.Image, f AnnotatedFile, opts ImageProcessingOptions) (
+		[]image.Image, []AnnotatedFile, error) {
+	p, err := newImageProcessor(opts)
+	if err != nil {
+		return nil, nil, err
+	} else if p == nil {
+		return []image.Image{img}, []AnnotatedFile{f}, nil
 	}
+	return p.transform(img, f.Clone())
 }
 
 // Split randomly splits the data into multiple datasets.
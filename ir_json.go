@@ -0,0 +1,328 @@
+package lblconv
+
+// The intermediate representation as JSON, for chaining conversions and editing datasets.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// IRFile is the JSON representation of an AnnotatedFile in the IR format ("ir").
+//
+// The IR format carries everything that the intermediate representation holds, unlike the other
+// formats, so that conversions can be chained across runs and datasets edited programmatically
+// without losing attributes. A file with the extension .jsonl holds one IRFile object per line
+// (JSON Lines), any other file a JSON array of them, e.g.:
+//
+//	[
+//	  {
+//	    "path": "images/000001.jpg",
+//	    "width": 1920,
+//	    "height": 1080,
+//	    "attributes": {"Sequence": "MOT17-02", "Frame": 1},
+//	    "annotations": [
+//	      {
+//	        "label": "Pedestrian",
+//	        "bbox": [912, 484, 1009, 593],
+//	        "id": "2b1e5fa1c7f0d3e4",
+//	        "attributes": {"TrackID": 1, "Visibility": 0.86}
+//	      }
+//	    ]
+//	  }
+//	]
+//
+// Both layouts are accepted when reading, regardless of the extension. The coordinates are pixel
+// offsets, unless "coords" is "normalized", in which case they are fractions of the image width and
+// height. The attributes are JSON values. The known attributes, e.g. TrackID or AncestorLabels, are
+// converted to their documented Go types when reading, while the others keep the types of
+// encoding/json, e.g. float64 for all numbers.
+type IRFile struct {
+	Path        string                 `json:"path"`
+	Width       int                    `json:"width,omitempty"`  // Zero if unknown.
+	Height      int                    `json:"height,omitempty"` // Zero if unknown.
+	SHA256      string                 `json:"sha256,omitempty"` // The hex-encoded image SHA-256.
+	Coords      CoordinateSpace        `json:"coords,omitempty"` // Absolute if omitted.
+	Attributes  map[string]interface{} `json:"attributes,omitempty"`
+	Annotations []IRAnnotation         `json:"annotations"`
+}
+
+// IRAnnotation is the JSON representation of an Annotation in the IR format.
+type IRAnnotation struct {
+	Label      string                 `json:"label"`
+	BBox       [4]float64             `json:"bbox"` // The x1, y1, x2, y2 coordinates.
+	Polygon    [][2]float64           `json:"polygon,omitempty"`
+	ID         string                 `json:"id,omitempty"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+// irIntAttributes, irStringsAttributes and irConfidencesAttributes are the known attributes that
+// are not decoded to their Go types by encoding/json, by type.
+var (
+	irIntAttributes         = []string{TrackID, TextID, TextParentID, Frame}
+	irStringsAttributes     = []string{AncestorLabels}
+	irConfidencesAttributes = []string{AncestorConfidences, ImageLabels}
+)
+
+// ToIRFile converts f to the IR format.
+func ToIRFile(f AnnotatedFile) IRFile {
+	irFile := IRFile{
+		Path:        f.FilePath,
+		Width:       f.ImageWidth,
+		Height:      f.ImageHeight,
+		SHA256:      f.ImageSHA256,
+		Coords:      f.CoordSpace,
+		Attributes:  f.Attributes,
+		Annotations: make([]IRAnnotation, len(f.Annotations)),
+	}
+	for i, a := range f.Annotations {
+		irFile.Annotations[i] = IRAnnotation{
+			Label:      a.Label,
+			BBox:       a.Coords,
+			Polygon:    a.Polygon,
+			ID:         a.ID,
+			Attributes: a.Attributes,
+		}
+	}
+	return irFile
+}
+
+// AnnotatedFile converts the IR file to the intermediate representation, with the known attributes
+// converted to their Go types.
+func (irFile IRFile) AnnotatedFile() AnnotatedFile {
+	f := AnnotatedFile{
+		Annotations: make([]Annotation, len(irFile.Annotations)),
+		FilePath:    irFile.Path,
+		ImageWidth:  irFile.Width,
+		ImageHeight: irFile.Height,
+		ImageSHA256: irFile.SHA256,
+		CoordSpace:  irFile.Coords,
+		Attributes:  irFile.Attributes,
+	}
+	convertIRAttributes(f.Attributes)
+	for i, a := range irFile.Annotations {
+		f.Annotations[i] = Annotation{
+			Attributes: a.Attributes,
+			Coords:     a.BBox,
+			Label:      a.Label,
+			Polygon:    a.Polygon,
+			ID:         a.ID,
+		}
+		convertIRAttributes(a.Attributes)
+	}
+	return f
+}
+
+// convertIRAttributes converts the values of the known attributes in attrs, as decoded by
+// encoding/json, to their Go types. Values that cannot be converted are kept.
+func convertIRAttributes(attrs map[string]interface{}) {
+	for _, key := range irIntAttributes {
+		if v, ok := attrs[key].(float64); ok && v == float64(int(v)) {
+			attrs[key] = int(v)
+		}
+	}
+	for _, key := range irStringsAttributes {
+		values, ok := attrs[key].([]interface{})
+		if !ok {
+			continue
+		}
+		strs := make([]string, 0, len(values))
+		for _, v := range values {
+			if s, ok := v.(string); ok {
+				strs = append(strs, s)
+			}
+		}
+		if len(strs) == len(values) {
+			attrs[key] = strs
+		}
+	}
+	for _, key := range irConfidencesAttributes {
+		values, ok := attrs[key].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		confidences := make(map[string]float64, len(values))
+		for label, v := range values {
+			if c, ok := v.(float64); ok {
+				confidences[label] = c
+			}
+		}
+		if len(confidences) == len(values) {
+			attrs[key] = confidences
+		}
+	}
+}
+
+// FromIR parses the IR JSON or JSON Lines file at path.
+func FromIR(path string) ([]AnnotatedFile, error) {
+	return fromIR(path, false)
+}
+
+// fromIR implements FromIR. If strict is true, duplicate entries are an error.
+func fromIR(path string, strict bool) ([]AnnotatedFile, error) {
+	enc, err := readFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var irFiles []IRFile
+	if trimmed := bytes.TrimSpace(enc); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(enc, &irFiles); err != nil {
+			return nil, newJSONParseError(path, enc, err)
+		}
+	} else {
+		dec := json.NewDecoder(bytes.NewReader(enc))
+		for {
+			var irFile IRFile
+			if err := dec.Decode(&irFile); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, newJSONParseError(path, enc, err)
+			}
+			irFiles = append(irFiles, irFile)
+		}
+	}
+
+	data := make([]AnnotatedFile, len(irFiles))
+	for i, irFile := range irFiles {
+		data[i] = irFile.AnnotatedFile()
+	}
+	return mergeDuplicates(path, data, strict)
+}
+
+// isJSONLines returns whether path has the extension of a JSON Lines file.
+func isJSONLines(path string) bool {
+	return strings.ToLower(filepath.Ext(path)) == ".jsonl"
+}
+
+// WriteIR writes data to outFile in the IR format, as JSON Lines if outFile has the extension
+// .jsonl.
+func WriteIR(outFile string, data []AnnotatedFile) (err error) {
+	sink, err := NewIRSink(outFile)
+	if err != nil {
+		return err
+	}
+	for _, f := range data {
+		if err := sink.Write(f); err != nil {
+			_ = AbortSink(sink)
+			return err
+		}
+	}
+	return sink.Close()
+}
+
+// irSink is a Sink that writes an IR file incrementally.
+type irSink struct {
+	file  *atomicFile
+	w     *bufio.Writer
+	lines bool // Whether to write JSON Lines.
+	n     int  // The number of elements written.
+}
+
+// NewIRSink returns a Sink that writes the IR format to outFile, as JSON Lines if outFile has the
+// extension .jsonl.
+func NewIRSink(outFile string) (Sink, error) {
+	file, err := createAtomicFile(outFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot write file %q: %v", outFile, err)
+	}
+	return &irSink{file: file, w: bufio.NewWriter(file), lines: isJSONLines(outFile)}, nil
+}
+
+// Write implements Sink.
+func (s *irSink) Write(f AnnotatedFile) error {
+	var enc []byte
+	var err error
+	if s.lines {
+		enc, err = json.Marshal(ToIRFile(f))
+	} else {
+		enc, err = json.MarshalIndent(ToIRFile(f), "  ", "  ")
+	}
+	if err != nil {
+		return err
+	}
+
+	// Write the opening bracket of the JSON array or the separator from the previous element.
+	sep := ",\n  "
+	switch {
+	case s.lines:
+		sep = ""
+	case s.n == 0:
+		sep = "[\n  "
+	}
+	if _, err := s.w.WriteString(sep); err != nil {
+		return err
+	}
+	if _, err := s.w.Write(enc); err != nil {
+		return err
+	}
+	if s.lines {
+		if err := s.w.WriteByte('\n'); err != nil {
+			return err
+		}
+	}
+	s.n++
+
+	return nil
+}
+
+// Close implements Sink.
+func (s *irSink) Close() (err error) {
+	defer s.file.commit(&err)
+
+	end := "\n]"
+	switch {
+	case s.lines:
+		end = ""
+	case s.n == 0:
+		end = "[]"
+	}
+	if _, err := s.w.WriteString(end); err != nil {
+		return err
+	}
+
+	return s.w.Flush()
+}
+
+// Abort implements Aborter. It removes the partially written file.
+func (s *irSink) Abort() error {
+	return s.file.Abort()
+}
+
+// irFormat implements the Reader and Writer interfaces for the IR format.
+type irFormat struct{}
+
+// Parse implements Reader.
+func (irFormat) Parse(path string, opts FormatOptions) ([]AnnotatedFile, error) {
+	return fromIR(path, opts.StrictDuplicates)
+}
+
+// Write implements Writer.
+func (irFormat) Write(outFile string, data AnnotatedFiles, opts FormatOptions) error {
+	return WriteIR(outFile, data)
+}
+
+// NewSink implements StreamWriter.
+func (irFormat) NewSink(outFile string, opts FormatOptions) (Sink, error) {
+	return NewIRSink(outFile)
+}
+
+// AcceptsNormalizedCoords implements NormalizedWriter.
+func (irFormat) AcceptsNormalizedCoords() bool {
+	return true
+}
+
+func init() {
+	RegisterFormat(Format{
+		Name:        "ir",
+		Description: "lblconv intermediate representation (JSON or JSON Lines)",
+		Reader:      irFormat{},
+		Writer:      irFormat{},
+		ReaderArgs:  "-labels <file>",
+		WriterArgs:  "-labels-out <file>",
+	})
+}
@@ -0,0 +1,222 @@
+package lblconv
+
+// Validation of JSON input files against JSON Schemas, to report where they are malformed.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// JSONSchema is a JSON Schema that supports the keywords type, enum, minimum, properties, required,
+// additionalProperties and items (with a single schema), with the semantics of draft-07. Other
+// keywords are ignored.
+type JSONSchema struct {
+	Type                 jsonSchemaTypes        `json:"type,omitempty"`
+	Enum                 []interface{}          `json:"enum,omitempty"`
+	Minimum              *float64               `json:"minimum,omitempty"`
+	Properties           map[string]*JSONSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties *JSONSchema            `json:"additionalProperties,omitempty"`
+	Items                *JSONSchema            `json:"items,omitempty"`
+}
+
+// jsonSchemaTypes are the types allowed by a JSONSchema, which are encoded as a string if there is
+// a single one.
+type jsonSchemaTypes []string
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (t *jsonSchemaTypes) UnmarshalJSON(data []byte) error {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '"' {
+		var typ string
+		if err := json.Unmarshal(data, &typ); err != nil {
+			return err
+		}
+		*t = jsonSchemaTypes{typ}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(t))
+}
+
+// ParseJSONSchema parses the JSON Schema in text.
+func ParseJSONSchema(text []byte) (*JSONSchema, error) {
+	var s JSONSchema
+	if err := json.Unmarshal(text, &s); err != nil {
+		return nil, fmt.Errorf("invalid JSON Schema: %v", err)
+	}
+	return &s, nil
+}
+
+// mustParseJSONSchema parses the bundled JSON Schema in text, and panics if it is invalid.
+func mustParseJSONSchema(text string) *JSONSchema {
+	s, err := ParseJSONSchema([]byte(text))
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// JSONSchemaViolation is a value that does not match its JSONSchema.
+type JSONSchemaViolation struct {
+	Path    string // The location of the value, as a JSON Pointer, e.g. /0/annotations/1/x.
+	Message string // What is wrong with the value.
+}
+
+func (v JSONSchemaViolation) String() string {
+	if v.Path == "" {
+		return v.Message
+	}
+	return v.Path + ": " + v.Message
+}
+
+// JSONSchemaError lists the violations of a JSON document of its JSONSchema.
+type JSONSchemaError struct {
+	Violations []JSONSchemaViolation
+}
+
+// maxReportedViolations is the max. number of violations in the message of a JSONSchemaError.
+const maxReportedViolations = 10
+
+func (e *JSONSchemaError) Error() string {
+	violations := e.Violations
+	if len(violations) > maxReportedViolations {
+		violations = violations[:maxReportedViolations]
+	}
+	msgs := make([]string, len(violations))
+	for i, v := range violations {
+		msgs[i] = v.String()
+	}
+	msg := "invalid entries: " + strings.Join(msgs, "; ")
+	if n := len(e.Violations) - len(violations); n > 0 {
+		msg += fmt.Sprintf(" (and %d more)", n)
+	}
+	return msg
+}
+
+// ValidateJSON validates the JSON document data against s. It returns a *JSONSchemaError if data
+// violates s, or the error of json.Unmarshal if data is not valid JSON.
+func ValidateJSON(data []byte, s *JSONSchema) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if violations := s.Validate(v); len(violations) > 0 {
+		return &JSONSchemaError{Violations: violations}
+	}
+	return nil
+}
+
+// Validate returns the violations of s by v, a value decoded by json.Unmarshal into an
+// interface{}, in document order (with the properties of objects sorted by name).
+func (s *JSONSchema) Validate(v interface{}) []JSONSchemaViolation {
+	var violations []JSONSchemaViolation
+	s.validate(v, "", &violations)
+	return violations
+}
+
+// validate appends the violations of s by v at the JSON Pointer path to violations.
+func (s *JSONSchema) validate(v interface{}, path string, violations *[]JSONSchemaViolation) {
+	violate := func(format string, args ...interface{}) {
+		*violations = append(*violations, JSONSchemaViolation{
+			Path:    path,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	if len(s.Type) > 0 && !s.Type.match(v) {
+		violate("expected %s, got %s", strings.Join(s.Type, " or "), jsonTypeName(v))
+		return
+	}
+	if len(s.Enum) > 0 && !jsonEnumContains(s.Enum, v) {
+		enc, _ := json.Marshal(v)
+		violate("%s is not one of the allowed values", enc)
+	}
+
+	switch v := v.(type) {
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			violate("%g is less than the minimum %g", v, *s.Minimum)
+		}
+
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				violate("missing property %q", name)
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			ps, ok := s.Properties[name]
+			if !ok {
+				ps = s.AdditionalProperties
+			}
+			if ps != nil {
+				ps.validate(v[name], path+"/"+jsonPointerEscape(name), violations)
+			}
+		}
+
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.validate(item, path+"/"+strconv.Itoa(i), violations)
+			}
+		}
+	}
+}
+
+// match returns whether v has one of the types t.
+func (t jsonSchemaTypes) match(v interface{}) bool {
+	for _, typ := range t {
+		if typ == jsonTypeName(v) || typ == "number" && jsonTypeName(v) == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonTypeName returns the JSON Schema type name of v, a value decoded by json.Unmarshal. Whole
+// numbers are integers.
+func jsonTypeName(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// jsonEnumContains returns whether enum contains v.
+func jsonEnumContains(enum []interface{}, v interface{}) bool {
+	for _, e := range enum {
+		if reflect.DeepEqual(e, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonPointerEscape escapes a property name for a JSON Pointer.
+func jsonPointerEscape(name string) string {
+	return strings.Replace(strings.Replace(name, "~", "~0", -1), "/", "~1", -1)
+}
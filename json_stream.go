@@ -0,0 +1,400 @@
+package lblconv
+
+// Incremental decoding of JSON label files, e.g. multi-gigabyte Sloth or VIA exports, one entry at
+// a time.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+)
+
+// jsonEntries decodes the entries of a JSON label file one at a time, so that the file need not fit
+// into memory. The entries are the elements of the top-level array, or, if member is not empty, the
+// members of the object in the top-level member with that name, e.g. _via_img_metadata of VIA
+// projects.
+type jsonEntries struct {
+	path   string
+	member string
+	file   io.ReadCloser
+	dec    *json.Decoder
+
+	started, done bool
+	index         int // The index of the next entry.
+}
+
+// openJSONEntries opens the JSON label file at path for decoding its entries, see jsonEntries.
+func openJSONEntries(path, member string) (*jsonEntries, error) {
+	file, err := openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonEntries{path: path, member: member, file: file, dec: json.NewDecoder(file)}, nil
+}
+
+// next returns the next entry and its location as a JSON Pointer, or io.EOF after the last entry.
+// Other errors are fatal, as the decoder cannot recover from them.
+func (e *jsonEntries) next() (json.RawMessage, string, error) {
+	if e.done {
+		return nil, "", io.EOF
+	}
+	if !e.started {
+		if err := e.start(); err != nil {
+			return nil, "", e.fail(err)
+		}
+		e.started = true
+	}
+	if !e.dec.More() {
+		if err := e.finish(); err != nil {
+			return nil, "", e.fail(err)
+		}
+		e.done = true
+		return nil, "", io.EOF
+	}
+
+	pointer := "/" + strconv.Itoa(e.index)
+	if e.member != "" {
+		key, err := e.key()
+		if err != nil {
+			return nil, "", e.fail(err)
+		}
+		pointer = "/" + jsonPointerEscape(e.member) + "/" + jsonPointerEscape(key)
+	}
+	var raw json.RawMessage
+	if err := e.dec.Decode(&raw); err != nil {
+		return nil, "", e.fail(err)
+	}
+	e.index++
+	return raw, pointer, nil
+}
+
+// start reads the file up to the first entry.
+func (e *jsonEntries) start() error {
+	if e.member == "" {
+		return e.delim('[', "")
+	}
+	if err := e.delim('{', ""); err != nil {
+		return err
+	}
+	for e.dec.More() {
+		key, err := e.key()
+		if err != nil {
+			return err
+		}
+		if key == e.member {
+			return e.delim('{', "/"+jsonPointerEscape(key))
+		}
+		if err := e.dec.Decode(&json.RawMessage{}); err != nil {
+			return err
+		}
+	}
+	return &JSONSchemaError{Violations: []JSONSchemaViolation{
+		{Message: fmt.Sprintf("missing property %q", e.member)},
+	}}
+}
+
+// finish reads the rest of the file after the last entry.
+func (e *jsonEntries) finish() error {
+	if _, err := e.dec.Token(); err != nil {
+		return err
+	}
+	if e.member == "" {
+		return nil
+	}
+	for e.dec.More() {
+		if _, err := e.key(); err != nil {
+			return err
+		}
+		if err := e.dec.Decode(&json.RawMessage{}); err != nil {
+			return err
+		}
+	}
+	_, err := e.dec.Token()
+	return err
+}
+
+// delim reads the opening delimiter d of the array or object at the JSON Pointer pointer.
+func (e *jsonEntries) delim(d json.Delim, pointer string) error {
+	tok, err := e.dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != d {
+		expected := "object"
+		if d == '[' {
+			expected = "array"
+		}
+		return &JSONSchemaError{Violations: []JSONSchemaViolation{{
+			Path:    pointer,
+			Message: fmt.Sprintf("expected %s, got %s", expected, jsonTokenTypeName(tok)),
+		}}}
+	}
+	return nil
+}
+
+// key reads the key of an object member.
+func (e *jsonEntries) key() (string, error) {
+	tok, err := e.dec.Token()
+	if err != nil {
+		return "", err
+	}
+	key, ok := tok.(string)
+	if !ok {
+		return "", fmt.Errorf("expected an object key, got %v", tok)
+	}
+	return key, nil
+}
+
+// fail stops the decoding and returns err with the path of the file.
+func (e *jsonEntries) fail(err error) error {
+	e.done = true
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if se, ok := err.(*json.SyntaxError); ok {
+		return fmt.Errorf("failed to parse %q at offset %d: %v", e.path, se.Offset, err)
+	}
+	return fmt.Errorf("failed to parse %q: %v", e.path, err)
+}
+
+// Close closes the file.
+func (e *jsonEntries) Close() error {
+	return e.file.Close()
+}
+
+// jsonTokenTypeName returns the JSON Schema type name of the value that starts with tok.
+func jsonTokenTypeName(tok json.Token) string {
+	switch tok {
+	case json.Delim('['):
+		return "array"
+	case json.Delim('{'):
+		return "object"
+	}
+	return jsonTypeName(tok)
+}
+
+// decodeJSONEntry unmarshals the entry raw of the JSON label file at path, located at the JSON
+// Pointer pointer, into v. If validate is true, the entry is validated against schema first.
+// Otherwise, it is only validated to report the location of the errors if it fails to decode. The
+// errors are ParseErrors.
+func decodeJSONEntry(path, pointer string, raw json.RawMessage, schema *JSONSchema, validate bool,
+		v interface{}) error {
+
+	var err error
+	if !validate {
+		if err = json.Unmarshal(raw, v); err == nil {
+			return nil
+		}
+	}
+	var value interface{}
+	if json.Unmarshal(raw, &value) == nil {
+		var violations []JSONSchemaViolation
+		schema.validate(value, pointer, &violations)
+		if len(violations) > 0 {
+			return &ParseError{Path: path, Err: &JSONSchemaError{Violations: violations}}
+		}
+	}
+	if validate {
+		err = json.Unmarshal(raw, v)
+	}
+	if err != nil {
+		return &ParseError{Path: path, Err: fmt.Errorf("%s: %v", pointer, err)}
+	}
+	return nil
+}
+
+// jsonEntryConverter converts the entry raw of a JSON label file, located at the JSON Pointer
+// pointer, to an AnnotatedFile. Its errors are ParseErrors.
+type jsonEntryConverter func(raw json.RawMessage, pointer string) (AnnotatedFile, error)
+
+// readJSONEntries reads and converts all entries of the JSON label file at path (see jsonEntries)
+// in order, and merges the duplicate entries for the same image (see mergeDuplicates). The schema
+// violations of all entries are reported together.
+func readJSONEntries(path, member string, convert jsonEntryConverter, strict bool) (
+		data []AnnotatedFile, err error) {
+
+	entries, err := openJSONEntries(path, member)
+	if err != nil {
+		return nil, err
+	}
+	defer closeWithErrCheck(entries, &err)
+
+	var violations []JSONSchemaViolation
+	for {
+		raw, pointer, err := entries.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		f, err := convert(raw, pointer)
+		if pe, ok := err.(*ParseError); ok {
+			if se, ok := pe.Err.(*JSONSchemaError); ok {
+				violations = append(violations, se.Violations...)
+				continue
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, f)
+	}
+	if len(violations) > 0 {
+		return nil, &ParseError{Path: path, Err: &JSONSchemaError{Violations: violations}}
+	}
+
+	return mergeDuplicates(path, data, strict)
+}
+
+// jsonEntrySource is a Source that reads and converts the entries of a JSON label file one at a
+// time. Invalid entries are returned as ParseErrors.
+//
+// The duplicate entries for the same image are merged as by AnnotatedFiles.MergeDuplicates, except
+// that the merged file takes the place of the last entry: the images are counted in a first pass
+// over the file, so that only the files of the images with duplicate entries are held in memory,
+// until their last entry is read.
+type jsonEntrySource struct {
+	path    string
+	entries *jsonEntries
+	convert jsonEntryConverter
+
+	remaining map[string]int            // The number of entries left, by image with duplicates.
+	pending   map[string]*AnnotatedFile // The merged files of the images with entries left.
+	first     map[string]int            // The index of the first entry of each key of pending.
+	index     int                       // The index of the next entry.
+	rest      []string                  // The keys of pending by first entry, once all are read.
+	merged    int                       // The number of entries merged.
+}
+
+// newJSONEntrySource returns a jsonEntrySource for the JSON label file at path, see jsonEntries. If
+// strict is true, duplicate entries for the same image are an error.
+func newJSONEntrySource(path, member string, convert jsonEntryConverter, strict bool) (Source,
+		error) {
+
+	remaining, err := countDuplicateImages(path, member, strict)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := openJSONEntries(path, member)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonEntrySource{
+		path:      path,
+		entries:   entries,
+		convert:   convert,
+		remaining: remaining,
+		pending:   make(map[string]*AnnotatedFile),
+		first:     make(map[string]int),
+	}, nil
+}
+
+// countDuplicateImages returns the number of entries of the images with duplicate entries in the
+// JSON label file at path, by imagePathKey. Only the filename of the entries is decoded, and
+// invalid entries are left to be reported when they are converted. If strict is true, it returns
+// an error for the first duplicate instead.
+func countDuplicateImages(path, member string, strict bool) (counts map[string]int, err error) {
+	entries, err := openJSONEntries(path, member)
+	if err != nil {
+		return nil, err
+	}
+	defer closeWithErrCheck(entries, &err)
+
+	counts = make(map[string]int)
+	for {
+		raw, _, err := entries.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		var entry struct {
+			FilePath string `json:"filename"`
+		}
+		if json.Unmarshal(raw, &entry) != nil {
+			continue
+		}
+		key := imagePathKey(entry.FilePath)
+		counts[key]++
+		if strict && counts[key] > 1 {
+			return nil, fmt.Errorf("%s: duplicate entries for image %q", path, entry.FilePath)
+		}
+	}
+
+	for key, n := range counts {
+		if n == 1 {
+			delete(counts, key)
+		}
+	}
+	return counts, nil
+}
+
+// Next implements Source.
+func (s *jsonEntrySource) Next() (AnnotatedFile, error) {
+	for {
+		raw, pointer, err := s.entries.next()
+		if err == io.EOF {
+			return s.nextPending()
+		} else if err != nil {
+			return AnnotatedFile{}, err
+		}
+		index := s.index
+		s.index++
+		f, err := s.convert(raw, pointer)
+		if err != nil {
+			return AnnotatedFile{}, err
+		}
+
+		key := imagePathKey(f.FilePath)
+		n, ok := s.remaining[key]
+		if !ok {
+			return f, nil
+		}
+		if p, ok := s.pending[key]; ok {
+			p.merge(f)
+			s.merged++
+		} else {
+			s.pending[key] = &f
+			s.first[key] = index
+		}
+		if s.remaining[key] = n - 1; n > 1 {
+			continue
+		}
+		p := s.pending[key]
+		delete(s.pending, key)
+		delete(s.first, key)
+		delete(s.remaining, key)
+		return *p, nil
+	}
+}
+
+// nextPending returns the next merged file whose entries were not all read, e.g. because some
+// were invalid, in the order of their first entries, or io.EOF if there are none.
+func (s *jsonEntrySource) nextPending() (AnnotatedFile, error) {
+	if s.rest == nil {
+		s.rest = make([]string, 0, len(s.pending))
+		for key := range s.pending {
+			s.rest = append(s.rest, key)
+		}
+		sort.Slice(s.rest, func(i, j int) bool { return s.first[s.rest[i]] < s.first[s.rest[j]] })
+	}
+	if len(s.rest) == 0 {
+		return AnnotatedFile{}, io.EOF
+	}
+	key := s.rest[0]
+	s.rest = s.rest[1:]
+	p := s.pending[key]
+	delete(s.pending, key)
+	return *p, nil
+}
+
+// Close implements Source.
+func (s *jsonEntrySource) Close() error {
+	if s.merged > 0 {
+		log.Printf("Merged %d duplicate image entries in %q", s.merged, s.path)
+	}
+	return s.entries.Close()
+}
@@ -3,6 +3,8 @@ package lblconv
 // KITTI specific functionality.
 
 import (
+	"bufio"
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -11,11 +13,38 @@ import (
 	"strings"
 )
 
+// kittiDontCare is the KITTI label of regions to ignore, e.g. objects that are too far away.
+const kittiDontCare = "DontCare"
+
 // KITTIAnnotation is a single annotation within a KITTI file.
 type KITTIAnnotation struct {
 	Coords [4]float64 // x1, y1, x2, y2
 	Label  string
 	Score  float64 // Optional, linear confidence value. No fixed range.
+
+	// Whether the optional score is set. The score column is omitted otherwise, as in KITTI
+	// ground truth label files.
+	HasScore bool
+}
+
+// KITTIOptions configures the conversion of KITTI scores to and from the Confidence attribute.
+type KITTIOptions struct {
+	// The score that corresponds to a confidence of 1.0, e.g. 100 for percentages. Scores are
+	// divided by it to get the Confidence, and Confidence values are multiplied by it to get the
+	// score. Defaults to 1.
+	ScoreScale float64
+
+	// The rounding of the coordinates. If it is set, the coordinates are written in their shortest
+	// exact representation after rounding, and with two decimal places otherwise.
+	Rounding CoordRounding
+}
+
+// scoreScale returns the score scale, or 1 if it is not set.
+func (opts KITTIOptions) scoreScale() float64 {
+	if opts.ScoreScale <= 0 {
+		return 1
+	}
+	return opts.ScoreScale
 }
 
 // KITTIAnnotatedFile defines the KITTI annotation structure for a single file.
@@ -27,68 +56,74 @@ type KITTIAnnotatedFile struct {
 // FromKitti reads and parses KITTI annotations from labelDir and matches them to the images in
 // imageDir.
 func FromKitti(labelDir, imageDir string) ([]AnnotatedFile, error) {
-	labelFiles, err := filesByExtInDir(labelDir, ".txt")
-	if err != nil {
-		return nil, err
-	}
-	log.Printf("Parsing KITTI labels for %d files", len(labelFiles))
+	return FromKittiContext(context.Background(), labelDir, imageDir)
+}
 
-	data, err := parseKittiAnnotations(labelFiles, imageDir)
-	if err != nil {
-		return nil, err
-	}
+// FromKittiContext works like FromKitti, but stops parsing when ctx is done, in which case it
+// returns ctx.Err().
+func FromKittiContext(ctx context.Context, labelDir, imageDir string) ([]AnnotatedFile, error) {
+	return FromKittiWithOptions(ctx, labelDir, imageDir, KITTIOptions{})
+}
 
-	return data, nil
+// FromKittiWithOptions works like FromKittiContext, with the scores converted to Confidence
+// values as configured by opts.
+func FromKittiWithOptions(ctx context.Context, labelDir, imageDir string, opts KITTIOptions) (
+		[]AnnotatedFile, error) {
+
+	return parseLabelsWithOneToOneImages(ctx, labelDir, ".txt", imageDir, ImageMatchOptions{},
+		kittiFileParser(opts))
+}
+
+// NewKittiSource returns a Source that streams the KITTI annotations from labelDir, matched to the
+// images in imageDir.
+func NewKittiSource(labelDir, imageDir string) (Source, error) {
+	return NewKittiSourceWithOptions(labelDir, imageDir, KITTIOptions{})
+}
+
+// NewKittiSourceWithOptions works like NewKittiSource, with the scores converted to Confidence
+// values as configured by opts.
+func NewKittiSourceWithOptions(labelDir, imageDir string, opts KITTIOptions) (Source, error) {
+	return newOneToOneSource(labelDir, ".txt", imageDir, ImageMatchOptions{}, kittiFileParser(opts))
+}
+
+// kittiFileParser returns a function that parses a KITTI label file with opts, see
+// parseKittiFile.
+func kittiFileParser(opts KITTIOptions) func(labelPath, imagePath string) (AnnotatedFile, error) {
+	return func(labelPath, imagePath string) (AnnotatedFile, error) {
+		return parseKittiFile(labelPath, imagePath, opts)
+	}
 }
 
-// parseKittiAnnotations parses the KITTI annotations from labelFiles. Expects to find the
-// corresponding images in imageDir, with identical base name except for the file extension.
-func parseKittiAnnotations(labelFiles []string, imageDir string) ([]AnnotatedFile, error) {
-	// Find the image files and create a map from base file name without ext to ext.
-	imageFiles, err := filesByExtInDir(imageDir, "")
+// parseKittiFile parses the KITTI annotations in the label file at labelPath and constructs an
+// AnnotatedFile for the image at imagePath. The scores are stored as the Confidence attribute.
+func parseKittiFile(labelPath, imagePath string, opts KITTIOptions) (AnnotatedFile, error) {
+	lines, err := readLines(labelPath)
 	if err != nil {
-		return nil, err
+		return AnnotatedFile{}, err
 	}
-	imageNamesToExt := mapFileNamesToExtensions(imageFiles)
 
-	// Read the label files and store into the in-memory struct.
-	data := make([]AnnotatedFile, 0, len(labelFiles))
-	for _, path := range labelFiles {
-		// Parse the file.
-		lines, err := readLines(path)
+	annotations := make([]Annotation, 0, len(lines))
+	for i := 0; i < len(lines); i++ {
+		a, err := parseKittiAnnotation(lines[i])
 		if err != nil {
-			log.Printf("Error while parsing, skipping %q: %v", path, err)
+			err = &ParseError{Path: labelPath, Line: i + 1, Err: err}
+			log.Print("Skipping annotation: ", err)
 			continue
 		}
-
-		annotations := make([]Annotation, 0, len(lines))
-		for i := 0; i < len(lines); i++ {
-			a, err := parseKittiAnnotation(lines[i])
-			if err != nil {
-				log.Printf("Error while parsing, skipping %q: %v", path, err)
-				continue
-			}
-			annotation := Annotation{Coords: a.Coords, Label: a.Label}
-			annotations = append(annotations, annotation)
-		}
-
-		// Find the corresponding image.
-		_, baseNoExt, _, err := splitPath(path)
-		if err != nil {
-			log.Print(err)
-			continue
+		annotation := Annotation{Coords: a.Coords, Label: a.Label}
+		if a.HasScore {
+			annotation.Attributes = map[string]interface{}{Confidence: a.Score / opts.scoreScale()}
 		}
-		imageExt, found := imageNamesToExt[baseNoExt]
-		if !found {
-			log.Print("Could not find the corresponding image file, skipping ", path)
-			continue
+		if a.Label == kittiDontCare {
+			if annotation.Attributes == nil {
+				annotation.Attributes = make(map[string]interface{}, 1)
+			}
+			annotation.Attributes[Ignore] = true
 		}
-		imagePath := filepath.Join(imageDir, baseNoExt+"."+imageExt)
-
-		data = append(data, AnnotatedFile{Annotations: annotations, FilePath: imagePath})
+		annotations = append(annotations, annotation)
 	}
 
-	return data, nil
+	return AnnotatedFile{Annotations: annotations, FilePath: imagePath}, nil
 }
 
 // parseKittiAnnotation parses the line of values for a single annotation.
@@ -112,6 +147,7 @@ func parseKittiAnnotation(line string) (KITTIAnnotation, error) {
 	// Parse the optional confidence score.
 	if len(tokens) >= 16 {
 		a.Score, err = strconv.ParseFloat(tokens[15], 64)
+		a.HasScore = err == nil
 	}
 	if err != nil {
 		return a, fmt.Errorf("unexpected score format in %q: %v", line, err)
@@ -120,27 +156,43 @@ func parseKittiAnnotation(line string) (KITTIAnnotation, error) {
 	return a, nil
 }
 
+// toKittiFile converts the intermediate representation for a single file to KITTI format.
+// Annotations with the Ignore attribute are written as DontCare regions.
+func toKittiFile(fileData AnnotatedFile, opts KITTIOptions) KITTIAnnotatedFile {
+	kittiFileData := KITTIAnnotatedFile{
+		Annotations: make([]KITTIAnnotation, len(fileData.Annotations)),
+		FilePath:    fileData.FilePath,
+	}
+	// Convert all annotations.
+	for i, a := range fileData.Annotations {
+		kittiLabel := KITTIAnnotation{Coords: a.Coords, Label: a.Label}
+		if a.boolAttribute(Ignore) {
+			kittiLabel.Label = kittiDontCare
+		}
+
+		// Add the optional score.
+		if confidence, ok := a.Attributes[Confidence].(float64); ok {
+			kittiLabel.Score = confidence * opts.scoreScale()
+			kittiLabel.HasScore = true
+		}
+
+		kittiFileData.Annotations[i] = kittiLabel
+	}
+
+	return kittiFileData
+}
+
 // ToKitti converts the intermediate representation to KITTI format.
 func ToKitti(data []AnnotatedFile) []KITTIAnnotatedFile {
+	return ToKittiWithOptions(data, KITTIOptions{})
+}
+
+// ToKittiWithOptions converts the intermediate representation to KITTI format, with the
+// Confidence values converted to scores as configured by opts.
+func ToKittiWithOptions(data []AnnotatedFile, opts KITTIOptions) []KITTIAnnotatedFile {
 	kittiData := make([]KITTIAnnotatedFile, 0, len(data))
 	for _, fileData := range data {
-		// Per file data.
-		kittiFileData := KITTIAnnotatedFile{
-			Annotations: make([]KITTIAnnotation, len(fileData.Annotations)),
-			FilePath:    fileData.FilePath,
-		}
-		// Convert all annotations.
-		for i, a := range fileData.Annotations {
-			kittiLabel := KITTIAnnotation{Coords: a.Coords, Label: a.Label}
-
-			// Add the optional score.
-			if score, ok := a.Attributes[Confidence].(float64); ok {
-				kittiLabel.Score = score
-			}
-
-			kittiFileData.Annotations[i] = kittiLabel
-		}
-		kittiData = append(kittiData, kittiFileData)
+		kittiData = append(kittiData, toKittiFile(fileData, opts))
 	}
 
 	return kittiData
@@ -148,38 +200,202 @@ func ToKitti(data []AnnotatedFile) []KITTIAnnotatedFile {
 
 // WriteKitti writes data to dirPath, one file per element.
 func WriteKitti(dirPath string, data []KITTIAnnotatedFile) error {
+	return WriteKittiContext(context.Background(), dirPath, data)
+}
+
+// WriteKittiContext works like WriteKitti, but stops writing when ctx is done, in which case it
+// removes the label files written so far and returns ctx.Err().
+func WriteKittiContext(ctx context.Context, dirPath string, data []KITTIAnnotatedFile) error {
+	sink, err := newKittiSink(dirPath, KITTIOptions{})
+	if err != nil {
+		return err
+	}
+
+	for _, fileData := range data {
+		if err := ctx.Err(); err != nil {
+			if abortErr := sink.Abort(); abortErr != nil {
+				log.Print("Failed to remove the partial output: ", abortErr)
+			}
+			return err
+		}
+		if err := sink.writeKittiFile(fileData); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkKittiDir checks that the KITTI output directory at dirPath exists.
+func checkKittiDir(dirPath string) error {
 	dirInfo, err := os.Stat(dirPath)
 	if err != nil || !dirInfo.IsDir() {
 		return fmt.Errorf("cannot access directory %q: %v", dirPath, err)
 	}
+	return nil
+}
 
-	labelDirWithSep := dirPath + string(os.PathSeparator)
-	for _, fileData := range data {
-		// Use the image file name with .txt extension as label file name.
-		_, baseNoExt, _, err := splitPath(fileData.FilePath)
-		if err != nil {
-			return err
+// ExistingKittiLabelFiles returns the paths of the label files in the KITTI output directory at
+// dirPath, e.g. of a previous export, which would otherwise mix with the files written to it. It
+// returns nil if the directory does not exist.
+func ExistingKittiLabelFiles(dirPath string) ([]string, error) {
+	if _, err := os.Stat(dirPath); os.IsNotExist(err) {
+		return nil, nil
+	}
+	return filesByExtInDir(dirPath, ".txt")
+}
+
+// kittiSink is a Sink that writes KITTI label files.
+type kittiSink struct {
+	dirPath string
+	opts    KITTIOptions
+	written []string // The paths of the label files written.
+}
+
+// NewKittiSink returns a Sink that writes KITTI label files to dirPath, one file per element.
+func NewKittiSink(dirPath string) (Sink, error) {
+	return newKittiSink(dirPath, KITTIOptions{})
+}
+
+// NewKittiSinkWithOptions works like NewKittiSink, with the Confidence values converted to scores
+// as configured by opts.
+func NewKittiSinkWithOptions(dirPath string, opts KITTIOptions) (Sink, error) {
+	return newKittiSink(dirPath, opts)
+}
+
+// newKittiSink returns a kittiSink for dirPath.
+func newKittiSink(dirPath string, opts KITTIOptions) (*kittiSink, error) {
+	if err := checkKittiDir(dirPath); err != nil {
+		return nil, err
+	}
+	return &kittiSink{dirPath: dirPath, opts: opts}, nil
+}
+
+// writeKittiFile writes the annotations in fileData to a label file in s.dirPath.
+func (s *kittiSink) writeKittiFile(fileData KITTIAnnotatedFile) (err error) {
+	// Use the image file name with .txt extension as label file name.
+	_, baseNoExt, _, err := splitPath(fileData.FilePath)
+	if err != nil {
+		return err
+	}
+	filePath := filepath.Join(s.dirPath, baseNoExt+".txt")
+	file, err := createAtomicFile(filePath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		file.commit(&err)
+		if err == nil {
+			s.written = append(s.written, filePath)
+		}
+	}()
+	w := bufio.NewWriter(file)
+
+	// Write annotations to file. The score column is only written if there is a score.
+	formatCoord := func(v float64) string {
+		if s.opts.Rounding.Mode == RoundNone {
+			return strconv.FormatFloat(v, 'f', 2, 64)
+		}
+		return strconv.FormatFloat(s.opts.Rounding.Round(v), 'f', -1, 64)
+	}
+	for _, a := range fileData.Annotations {
+		_, err = fmt.Fprintf(w, "%s 0.0 0 0.0 %s %s %s %s 0.0 0.0 0.0 0.0 0.0 0.0 0.0",
+			a.Label, formatCoord(a.Coords[0]), formatCoord(a.Coords[1]), formatCoord(a.Coords[2]),
+			formatCoord(a.Coords[3]))
+		if err == nil && a.HasScore {
+			_, err = fmt.Fprintf(w, " %f", a.Score)
+		}
+		if err == nil {
+			_, err = fmt.Fprintln(w)
 		}
-		filePath := labelDirWithSep + baseNoExt + ".txt"
-		file, err := os.Create(filePath)
 		if err != nil {
 			return err
 		}
+	}
 
-		// Write annotations to file.
-		for _, a := range fileData.Annotations {
-			_, err = fmt.Fprintf(file,
-				"%s 0.0 0 0.0 %.2f %.2f %.2f %.2f 0.0 0.0 0.0 0.0 0.0 0.0 0.0 %f\n",
-				a.Label, a.Coords[0], a.Coords[1], a.Coords[2], a.Coords[3], a.Score)
-			if err != nil {
-				return err
-			}
+	return w.Flush()
+}
+
+// Write implements Sink.
+func (s *kittiSink) Write(f AnnotatedFile) error {
+	return s.writeKittiFile(toKittiFile(f, s.opts))
+}
+
+// Close implements Sink.
+func (s *kittiSink) Close() error {
+	return nil
+}
+
+// Abort implements Aborter. It removes the label files written so far.
+func (s *kittiSink) Abort() (err error) {
+	for _, path := range s.written {
+		if removeErr := os.Remove(path); removeErr != nil && err == nil {
+			err = removeErr
 		}
+	}
+	s.written = nil
+	return err
+}
+
+// kittiFormat implements the Reader and Writer interfaces for the KITTI format.
+type kittiFormat struct{}
+
+// Parse implements Reader.
+func (kittiFormat) Parse(labelDir string, opts FormatOptions) ([]AnnotatedFile, error) {
+	if err := requireImageDir(opts); err != nil {
+		return nil, err
+	}
+	return parseLabelsWithOneToOneImages(context.Background(), labelDir, ".txt", opts.ImageDir,
+		opts.ImageMatch, kittiFileParser(opts.KITTI))
+}
 
-		if err := file.Close(); err != nil {
+// NewSource implements StreamReader.
+func (kittiFormat) NewSource(labelDir string, opts FormatOptions) (Source, error) {
+	if err := requireImageDir(opts); err != nil {
+		return nil, err
+	}
+	return newOneToOneSource(labelDir, ".txt", opts.ImageDir, opts.ImageMatch,
+		kittiFileParser(opts.KITTI))
+}
+
+// Write implements Writer.
+func (f kittiFormat) Write(dirPath string, data AnnotatedFiles, opts FormatOptions) error {
+	sink, err := newKittiSink(dirPath, f.options(opts))
+	if err != nil {
+		return err
+	}
+	for _, fileData := range data {
+		if err := sink.Write(fileData); err != nil {
+			if abortErr := sink.Abort(); abortErr != nil {
+				log.Print("Failed to remove the partial output: ", abortErr)
+			}
 			return err
 		}
 	}
+	return sink.Close()
+}
 
-	return nil
+// NewSink implements StreamWriter.
+func (f kittiFormat) NewSink(dirPath string, opts FormatOptions) (Sink, error) {
+	return NewKittiSinkWithOptions(dirPath, f.options(opts))
+}
+
+// options returns the KITTI options of opts, with the rounding of opts unless it is set already.
+func (kittiFormat) options(opts FormatOptions) KITTIOptions {
+	kittiOpts := opts.KITTI
+	if kittiOpts.Rounding.Mode == RoundNone {
+		kittiOpts.Rounding = opts.Rounding
+	}
+	return kittiOpts
+}
+
+func init() {
+	RegisterFormat(Format{
+		Name:        "kitti",
+		Description: "KITTI 2D object detection",
+		Reader:      kittiFormat{},
+		Writer:      kittiFormat{},
+		ReaderArgs:  "-labels <dir> -images <dir>",
+		WriterArgs:  "-labels-out <dir>",
+	})
 }
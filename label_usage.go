@@ -0,0 +1,121 @@
+package lblconv
+
+// Label usage statistics, to find the classes of a label map without training data.
+
+import (
+	"encoding/csv"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// LabelUsage counts the files and annotations of each label. It is safe for concurrent use.
+type LabelUsage struct {
+	mu          sync.Mutex
+	files       map[string]int // The number of files by label.
+	annotations map[string]int // The number of annotations by label.
+}
+
+// NewLabelUsage returns an empty LabelUsage.
+func NewLabelUsage() *LabelUsage {
+	return &LabelUsage{
+		files:       make(map[string]int),
+		annotations: make(map[string]int),
+	}
+}
+
+// Add counts the annotations of f, and f once for each of their labels.
+func (u *LabelUsage) Add(f AnnotatedFile) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	seen := make(map[string]bool, len(f.Annotations))
+	for _, a := range f.Annotations {
+		u.annotations[a.Label]++
+		if !seen[a.Label] {
+			seen[a.Label] = true
+			u.files[a.Label]++
+		}
+	}
+}
+
+// Files returns the number of files with the label.
+func (u *LabelUsage) Files(label string) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.files[label]
+}
+
+// Annotations returns the number of annotations with the label.
+func (u *LabelUsage) Annotations(label string) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.annotations[label]
+}
+
+// Unused returns the labels of labelMap without annotations, sorted by ID.
+func (u *LabelUsage) Unused(labelMap *TFRecordLabelMap) []string {
+	var unused []string
+	for _, label := range labelMap.Labels() {
+		if u.Annotations(label) == 0 {
+			unused = append(unused, label)
+		}
+	}
+	return unused
+}
+
+// WriteCSV writes the usage to path as CSV with the header label,id,images,annotations. The
+// labels of labelMap come first, sorted by ID and including those without annotations, followed
+// by the other labels counted, sorted by label and without an ID. labelMap may be nil.
+func (u *LabelUsage) WriteCSV(path string, labelMap *TFRecordLabelMap) (err error) {
+	file, err := createAtomicFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot write file %q: %v", path, err)
+	}
+	defer file.commit(&err)
+
+	w := csv.NewWriter(file)
+	if err := w.Write([]string{"label", "id", "images", "annotations"}); err != nil {
+		return err
+	}
+	write := func(label, id string) error {
+		return w.Write([]string{label, id, strconv.Itoa(u.Files(label)),
+			strconv.Itoa(u.Annotations(label))})
+	}
+
+	mapped := make(map[string]bool)
+	if labelMap != nil {
+		for _, item := range labelMap.items() {
+			mapped[item.Name] = true
+			if err := write(item.Name, strconv.Itoa(int(item.ID))); err != nil {
+				return err
+			}
+		}
+	}
+
+	u.mu.Lock()
+	var others []string
+	for label := range u.annotations {
+		if !mapped[label] {
+			others = append(others, label)
+		}
+	}
+	u.mu.Unlock()
+	sort.Strings(others)
+	for _, label := range others {
+		if err := write(label, ""); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// LabelUsageStage returns a Stage that adds each file to u and passes it on unchanged.
+func LabelUsageStage(u *LabelUsage) Stage {
+	return func(f AnnotatedFile) ([]AnnotatedFile, error) {
+		u.Add(f)
+		return []AnnotatedFile{f}, nil
+	}
+}
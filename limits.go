@@ -0,0 +1,111 @@
+package lblconv
+
+// Concurrency and memory limits.
+
+import (
+	"runtime"
+	"sync"
+)
+
+var (
+	limitsMu        sync.RWMutex
+	workers         int            // The number of workers, or 0 for the default.
+	imageMemLimiter *memoryLimiter // Limits the memory of the decoded images, if not nil.
+)
+
+// SetWorkers sets the number of goroutines that parse, process and encode files concurrently,
+// e.g. in Stream and the TFRecord writer. A value <= 0 restores the default of twice the number of
+// CPUs.
+func SetWorkers(n int) {
+	limitsMu.Lock()
+	workers = n
+	limitsMu.Unlock()
+}
+
+// numWorkers returns the number of workers set with SetWorkers, or the default.
+func numWorkers() int {
+	limitsMu.RLock()
+	n := workers
+	limitsMu.RUnlock()
+
+	if n <= 0 {
+		return 2 * runtime.NumCPU()
+	}
+	return n
+}
+
+// SetMaxImageMemory limits the approximate memory used by the images that are decoded
+// concurrently, e.g. for image processing, to maxBytes. Workers wait until enough memory is
+// available before decoding an image. An image that exceeds the limit on its own is decoded when
+// no other image is in flight. A value <= 0 removes the limit.
+//
+// It must not be called while images are being decoded.
+func SetMaxImageMemory(maxBytes int64) {
+	limitsMu.Lock()
+	defer limitsMu.Unlock()
+
+	if maxBytes <= 0 {
+		imageMemLimiter = nil
+		return
+	}
+	imageMemLimiter = newMemoryLimiter(maxBytes)
+}
+
+// reserveImageMemory blocks until the memory for a decoded image of the given dimensions is
+// available. It returns a function that releases the memory.
+func reserveImageMemory(width, height int) (release func()) {
+	limitsMu.RLock()
+	l := imageMemLimiter
+	limitsMu.RUnlock()
+
+	if l == nil {
+		return func() {}
+	}
+
+	// Estimate the memory as that of an RGBA image.
+	n := 4 * int64(width) * int64(height)
+	l.acquire(n)
+	return func() { l.release(n) }
+}
+
+// memoryLimiter is a weighted semaphore for memory in bytes.
+type memoryLimiter struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	limit int64
+	used  int64
+}
+
+// newMemoryLimiter returns a memoryLimiter with limit bytes available.
+func newMemoryLimiter(limit int64) *memoryLimiter {
+	l := &memoryLimiter{limit: limit}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// acquire blocks until n bytes are available and reserves them. Requests for more than the limit
+// are treated as requests for the whole limit.
+func (l *memoryLimiter) acquire(n int64) {
+	if n > l.limit {
+		n = l.limit
+	}
+
+	l.mu.Lock()
+	for l.used+n > l.limit {
+		l.cond.Wait()
+	}
+	l.used += n
+	l.mu.Unlock()
+}
+
+// release returns n bytes reserved with acquire.
+func (l *memoryLimiter) release(n int64) {
+	if n > l.limit {
+		n = l.limit
+	}
+
+	l.mu.Lock()
+	l.used -= n
+	l.mu.Unlock()
+	l.cond.Broadcast()
+}
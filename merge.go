@@ -0,0 +1,158 @@
+package lblconv
+
+// Merging of multiple input datasets.
+
+import (
+	"io"
+	"sort"
+	"sync"
+)
+
+// taggedSource tags the annotations read from a Source with the name of the input.
+type taggedSource struct {
+	Source
+	name string
+}
+
+// TagSource returns a Source that sets the InputSource attribute of the annotations read from src
+// to name, e.g. to keep track of the input dataset when merging several of them. Annotations that
+// already have an InputSource attribute, e.g. from a previous merge, keep it.
+func TagSource(src Source, name string) Source {
+	return &taggedSource{Source: src, name: name}
+}
+
+// Next implements Source.
+func (s *taggedSource) Next() (AnnotatedFile, error) {
+	f, err := s.Source.Next()
+	if err != nil {
+		return f, err
+	}
+
+	// Copy the annotations, which may be shared with the Source.
+	annotations := make([]Annotation, len(f.Annotations))
+	for i, a := range f.Annotations {
+		if _, ok := a.Attributes[InputSource].(string); !ok {
+			attrs := make(map[string]interface{}, 1+len(a.Attributes))
+			for k, v := range a.Attributes {
+				attrs[k] = v
+			}
+			attrs[InputSource] = s.name
+			a.Attributes = attrs
+		}
+		annotations[i] = a
+	}
+	f.Annotations = annotations
+	return f, nil
+}
+
+// concatSource reads multiple Sources in turn.
+type concatSource struct {
+	sources []Source
+	next    int // The index of the Source to read from.
+}
+
+// ConcatSources returns a Source that streams the files of all sources in order. Closing it closes
+// all sources.
+func ConcatSources(sources ...Source) Source {
+	return &concatSource{sources: sources}
+}
+
+// Next implements Source.
+func (s *concatSource) Next() (AnnotatedFile, error) {
+	for s.next < len(s.sources) {
+		f, err := s.sources[s.next].Next()
+		if err == io.EOF {
+			s.next++
+			continue
+		}
+		return f, err
+	}
+	return AnnotatedFile{}, io.EOF
+}
+
+// Close implements Source. It closes all sources, returning the first error encountered.
+func (s *concatSource) Close() (err error) {
+	for _, src := range s.sources {
+		closeWithErrCheck(src, &err)
+	}
+	return err
+}
+
+// SourceStats counts the annotations by InputSource attribute and label. It is safe for concurrent
+// use.
+type SourceStats struct {
+	mu     sync.Mutex
+	counts map[string]map[string]int // The number of annotations by source and label.
+	files  map[string]int            // The number of files with annotations by source.
+}
+
+// NewSourceStats returns an empty SourceStats.
+func NewSourceStats() *SourceStats {
+	return &SourceStats{
+		counts: make(map[string]map[string]int),
+		files:  make(map[string]int),
+	}
+}
+
+// Add counts the annotations of f. Annotations without an InputSource attribute are counted for
+// the source "".
+func (s *SourceStats) Add(f AnnotatedFile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := make(map[string]bool)
+	for _, a := range f.Annotations {
+		source, _ := a.Attributes[InputSource].(string)
+		byLabel := s.counts[source]
+		if byLabel == nil {
+			byLabel = make(map[string]int)
+			s.counts[source] = byLabel
+		}
+		byLabel[a.Label]++
+		if !seen[source] {
+			seen[source] = true
+			s.files[source]++
+		}
+	}
+}
+
+// Sources returns the sources counted, sorted.
+func (s *SourceStats) Sources() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sources := make([]string, 0, len(s.counts))
+	for source := range s.counts {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	return sources
+}
+
+// Files returns the number of files with annotations from source.
+func (s *SourceStats) Files(source string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.files[source]
+}
+
+// ByLabel returns a copy of the number of annotations from source by label.
+func (s *SourceStats) ByLabel(source string) map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	byLabel := make(map[string]int, len(s.counts[source]))
+	for label, n := range s.counts[source] {
+		byLabel[label] = n
+	}
+	return byLabel
+}
+
+// SourceStatsStage returns a Stage that adds each file to s and passes it on unchanged.
+func SourceStatsStage(s *SourceStats) Stage {
+	return func(f AnnotatedFile) ([]AnnotatedFile, error) {
+		s.Add(f)
+		return []AnnotatedFile{f}, nil
+	}
+}
@@ -0,0 +1,222 @@
+package lblconv
+
+// MOT Challenge multi-object tracking specific functionality.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// motClassNames maps the class IDs of the MOT ground truth to labels.
+var motClassNames = map[int]string{
+	1:  "pedestrian",
+	2:  "person_on_vehicle",
+	3:  "car",
+	4:  "bicycle",
+	5:  "motorbike",
+	6:  "non_motorized_vehicle",
+	7:  "static_person",
+	8:  "distractor",
+	9:  "occluder",
+	10: "occluder_on_ground",
+	11: "occluder_full",
+	12: "reflection",
+	13: "crowd",
+}
+
+// motSequence holds the settings of a MOT sequence from its seqinfo.ini file.
+type motSequence struct {
+	name          string
+	imageDir      string
+	imageExt      string
+	length        int // The number of frames, or 0 if unknown.
+	width, height int // The image dimensions, or 0 if unknown.
+}
+
+// readMOTSequence reads the seqinfo.ini file of the sequence in dirPath, if any. The defaults of
+// the MOT Challenge apply otherwise.
+func readMOTSequence(dirPath string) (motSequence, error) {
+	seq := motSequence{
+		name:     filepath.Base(dirPath),
+		imageDir: filepath.Join(dirPath, "img1"),
+		imageExt: ".jpg",
+	}
+
+	infoPath := filepath.Join(dirPath, "seqinfo.ini")
+	if _, err := os.Stat(infoPath); os.IsNotExist(err) {
+		return seq, nil
+	}
+	lines, err := readLines(infoPath)
+	if err != nil {
+		return seq, err
+	}
+	for _, line := range lines {
+		sep := strings.Index(line, "=")
+		if sep < 0 {
+			continue
+		}
+		key, value := strings.TrimSpace(line[:sep]), strings.TrimSpace(line[sep+1:])
+		switch key {
+		case "name":
+			seq.name = value
+		case "imDir":
+			seq.imageDir = filepath.Join(dirPath, value)
+		case "imExt":
+			seq.imageExt = value
+		case "seqLength":
+			seq.length, _ = strconv.Atoi(value)
+		case "imWidth":
+			seq.width, _ = strconv.Atoi(value)
+		case "imHeight":
+			seq.height, _ = strconv.Atoi(value)
+		}
+	}
+	return seq, nil
+}
+
+// FromMOT reads the MOT Challenge ground truth of the sequence in dirPath, i.e. the file
+// gt/gt.txt and the images in img1 or as per seqinfo.ini, or of all sequences in the
+// subdirectories of dirPath.
+//
+// Each frame of a sequence results in an AnnotatedFile, including the frames without annotations,
+// with the Sequence and Frame attributes. The annotations have the TrackID attribute, and the
+// Ignore and Visibility attributes from the ground truth. The 1-based MOT coordinates are converted
+// to 0-based ones.
+func FromMOT(dirPath string) ([]AnnotatedFile, error) {
+	if _, err := os.Stat(filepath.Join(dirPath, "gt", "gt.txt")); err == nil {
+		return parseMOTSequence(dirPath)
+	}
+
+	entries, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read directory %q: %v", dirPath, err)
+	}
+	var data []AnnotatedFile
+	for _, e := range entries {
+		seqPath := filepath.Join(dirPath, e.Name())
+		if _, err := os.Stat(filepath.Join(seqPath, "gt", "gt.txt")); !e.IsDir() || err != nil {
+			continue
+		}
+		seqData, err := parseMOTSequence(seqPath)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, seqData...)
+	}
+	if data == nil {
+		return nil, fmt.Errorf("no MOT sequences with ground truth in %q", dirPath)
+	}
+	return data, nil
+}
+
+// parseMOTSequence parses the ground truth of the sequence in dirPath, see FromMOT.
+func parseMOTSequence(dirPath string) ([]AnnotatedFile, error) {
+	seq, err := readMOTSequence(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	gtPath := filepath.Join(dirPath, "gt", "gt.txt")
+	lines, err := readLines(gtPath)
+	if err != nil {
+		return nil, err
+	}
+
+	byFrame := make(map[int][]Annotation)
+	numFrames := seq.length
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		frame, a, err := parseMOTAnnotation(line)
+		if err != nil {
+			log.Print("Skipping annotation: ", &ParseError{Path: gtPath, Line: i + 1, Err: err})
+			continue
+		}
+		byFrame[frame] = append(byFrame[frame], a)
+		if frame > numFrames {
+			numFrames = frame
+		}
+	}
+
+	data := make([]AnnotatedFile, numFrames)
+	for i := range data {
+		frame := i + 1
+		annotations := byFrame[frame]
+		sort.SliceStable(annotations, func(i, j int) bool {
+			return annotations[i].Attributes[TrackID].(int) < annotations[j].Attributes[TrackID].(int)
+		})
+		data[i] = AnnotatedFile{
+			Annotations: annotations,
+			FilePath:    filepath.Join(seq.imageDir, fmt.Sprintf("%06d%s", frame, seq.imageExt)),
+			ImageWidth:  seq.width,
+			ImageHeight: seq.height,
+			Attributes:  map[string]interface{}{Sequence: seq.name, Frame: frame},
+		}
+	}
+	return data, nil
+}
+
+// parseMOTAnnotation parses a line of a MOT ground truth file in the format
+// "frame,id,left,top,width,height[,consider,class,visibility]". Returns the frame number and the
+// annotation.
+func parseMOTAnnotation(line string) (int, Annotation, error) {
+	fields := strings.Split(line, ",")
+	if len(fields) < 6 {
+		return 0, Annotation{}, fmt.Errorf("expected at least 6 fields, got %d", len(fields))
+	}
+	values := make([]float64, len(fields))
+	for i, field := range fields {
+		v, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return 0, Annotation{}, fmt.Errorf("invalid value %q in field %d", field, i+1)
+		}
+		values[i] = v
+	}
+	frame := int(values[0])
+	if frame < 1 {
+		return 0, Annotation{}, fmt.Errorf("invalid frame number %d", frame)
+	}
+
+	a := Annotation{
+		Coords:     CoordsFromXYWH(values[2]-1, values[3]-1, values[4], values[5]),
+		Label:      motClassNames[1],
+		Attributes: map[string]interface{}{TrackID: int(values[1])},
+	}
+	if len(values) >= 7 && values[6] == 0 {
+		a.Attributes[Ignore] = true
+	}
+	// The MOT15 format has 10 fields, with world coordinates instead of the class and visibility.
+	if len(values) == 9 {
+		class := int(values[7])
+		if name, ok := motClassNames[class]; ok {
+			a.Label = name
+		} else {
+			a.Label = strconv.Itoa(class)
+		}
+		a.Attributes[Visibility] = values[8]
+	}
+	return frame, a, nil
+}
+
+// motFormat implements the Format functions for the MOT Challenge ground truth.
+type motFormat struct{}
+
+// Parse implements Reader.
+func (motFormat) Parse(dirPath string, opts FormatOptions) ([]AnnotatedFile, error) {
+	return FromMOT(dirPath)
+}
+
+func init() {
+	RegisterFormat(Format{
+		Name:        "mot",
+		Description: "MOT Challenge multi-object tracking ground truth (gt/gt.txt per sequence)",
+		Reader:      motFormat{},
+		ReaderArgs:  "-labels <sequence dir or dir of sequences>",
+	})
+}
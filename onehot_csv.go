@@ -0,0 +1,204 @@
+package lblconv
+
+// Multi-label one-hot CSV files, e.g. to train image classifiers or tagging models on the labels of
+// object detection datasets.
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"sort"
+)
+
+// OneHotOptions holds the settings of the one-hot CSV writer.
+type OneHotOptions struct {
+	// The labels that an image is tagged with: "boxes" for the labels of its bounding boxes,
+	// "image" for its image-level labels, i.e. the annotations with the ImageLabel attribute and
+	// the ImageLabels file attribute, or "all" (default) for both.
+	Labels string
+
+	// The classes, i.e. the label columns, in order. Other labels are ignored. If empty, there is a
+	// column for each label of the dataset, sorted by label.
+	Classes []string
+}
+
+// validate returns an error if opts are invalid.
+func (opts OneHotOptions) validate() error {
+	switch opts.Labels {
+	case "", "all", "boxes", "image":
+		return nil
+	}
+	return fmt.Errorf("unsupported one-hot label source %q", opts.Labels)
+}
+
+// ImageClasses returns the labels that f is tagged with from source, see OneHotOptions.Labels, in
+// order of first occurrence. Empty labels are omitted.
+func ImageClasses(f AnnotatedFile, source string) []string {
+	var labels []string
+	seen := make(map[string]bool)
+	add := func(label string) {
+		if label != "" && !seen[label] {
+			seen[label] = true
+			labels = append(labels, label)
+		}
+	}
+	for _, a := range f.Annotations {
+		if a.boolAttribute(ImageLabel) && source != "boxes" ||
+				!a.boolAttribute(ImageLabel) && source != "image" {
+			add(a.Label)
+		}
+	}
+	if source != "boxes" {
+		imageLabels := make([]string, 0, len(f.imageLabels()))
+		for label := range f.imageLabels() {
+			imageLabels = append(imageLabels, label)
+		}
+		sort.Strings(imageLabels)
+		for _, label := range imageLabels {
+			add(label)
+		}
+	}
+	return labels
+}
+
+// oneHotSink is a Sink that writes a one-hot CSV file. The rows are written when the Sink is
+// closed, as the columns are only known then.
+type oneHotSink struct {
+	file *atomicFile
+	opts OneHotOptions
+
+	paths   []string        // The image paths, in order.
+	classes [][]string      // The labels of the images.
+	columns map[string]bool // The labels seen, if opts.Classes is empty.
+	ignored map[string]int  // The number of images by label that is not a class.
+}
+
+// NewOneHotSink returns a Sink that writes a multi-label one-hot CSV file to outFile, with a header
+// row and a row per image with the image path followed by a column per class that is 1 if the
+// image is tagged with the class and 0 otherwise. Images without labels have a row of zeros.
+func NewOneHotSink(outFile string, opts OneHotOptions) (Sink, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	file, err := createAtomicFile(outFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot write file %q: %v", outFile, err)
+	}
+	return &oneHotSink{
+		file:    file,
+		opts:    opts,
+		columns: make(map[string]bool),
+		ignored: make(map[string]int),
+	}, nil
+}
+
+// Write implements Sink.
+func (s *oneHotSink) Write(f AnnotatedFile) error {
+	s.paths = append(s.paths, f.FilePath)
+	s.classes = append(s.classes, ImageClasses(f, s.opts.Labels))
+	if len(s.opts.Classes) == 0 {
+		for _, label := range s.classes[len(s.classes)-1] {
+			s.columns[label] = true
+		}
+	}
+	return nil
+}
+
+// Close implements Sink.
+func (s *oneHotSink) Close() (err error) {
+	defer s.file.commit(&err)
+
+	columns := s.opts.Classes
+	if len(columns) == 0 {
+		for label := range s.columns {
+			columns = append(columns, label)
+		}
+		sort.Strings(columns)
+	}
+	index := make(map[string]int, len(columns))
+	for i, label := range columns {
+		index[label] = i
+	}
+
+	w := bufio.NewWriter(s.file)
+	c := csv.NewWriter(w)
+	if err := c.Write(append([]string{"image"}, columns...)); err != nil {
+		return err
+	}
+	row := make([]string, 1+len(columns))
+	for i, path := range s.paths {
+		row[0] = path
+		for j := range columns {
+			row[1+j] = "0"
+		}
+		for _, label := range s.classes[i] {
+			if j, ok := index[label]; ok {
+				row[1+j] = "1"
+			} else {
+				s.ignored[label]++
+			}
+		}
+		if err := c.Write(row); err != nil {
+			return err
+		}
+	}
+	c.Flush()
+	if err := c.Error(); err != nil {
+		return err
+	}
+
+	labels := make([]string, 0, len(s.ignored))
+	for label := range s.ignored {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		log.Printf("Ignored the label %q of %d images, which is not a one-hot class", label,
+			s.ignored[label])
+	}
+	return w.Flush()
+}
+
+// Abort implements Aborter. It removes the output file.
+func (s *oneHotSink) Abort() error {
+	return s.file.Abort()
+}
+
+// oneHotFormat implements the Writer interface for one-hot CSV files.
+type oneHotFormat struct{}
+
+// Write implements Writer.
+func (o oneHotFormat) Write(outFile string, data AnnotatedFiles, opts FormatOptions) (err error) {
+	s, err := o.NewSink(outFile, opts)
+	if err != nil {
+		return err
+	}
+	defer closeWithErrCheck(s, &err)
+
+	for _, f := range data {
+		if err := s.Write(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewSink implements StreamWriter.
+func (oneHotFormat) NewSink(outFile string, opts FormatOptions) (Sink, error) {
+	return NewOneHotSink(outFile, opts.OneHot)
+}
+
+// AcceptsNormalizedCoords implements NormalizedWriter, as the coordinates are not written.
+func (oneHotFormat) AcceptsNormalizedCoords() bool {
+	return true
+}
+
+func init() {
+	RegisterFormat(Format{
+		Name:        "onehot-csv",
+		Description: "Multi-label classification CSV with a one-hot column per label",
+		Writer:      oneHotFormat{},
+		WriterArgs:  "-labels-out <file> [-onehot-labels <source>]",
+	})
+}
@@ -0,0 +1,249 @@
+package lblconv
+
+// Packaging of a converted dataset into a single archive or directory with a manifest.
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// PackageManifestFile is the name of the manifest in a package.
+const PackageManifestFile = "manifest.json"
+
+// PackageEntry is a file or directory to include in a package.
+type PackageEntry struct {
+	Path string // The path of the file or directory.
+	Name string // The slash-separated path in the package; directories are included recursively.
+}
+
+// PackageFile describes a file in a package.
+type PackageFile struct {
+	Path   string `json:"path"` // The slash-separated path in the package.
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"` // The hex-encoded SHA-256 of the contents.
+}
+
+// PackageManifest describes the contents of a package. It is written to PackageManifestFile in the
+// package.
+type PackageManifest struct {
+	Name       string      `json:"name"`
+	Version    string      `json:"version"`
+	Provenance *Provenance `json:"provenance,omitempty"`
+
+	// The summary of the conversion run, e.g. the number of files by output dataset.
+	Summary interface{} `json:"summary,omitempty"`
+
+	Files []PackageFile `json:"files"` // The files in the package, sorted by path.
+}
+
+// PackageOptions holds the settings of WritePackage.
+type PackageOptions struct {
+	Name       string      // The name of the dataset. Defaults to the base name of the output path.
+	Version    string      // The version of the dataset, e.g. "1" or "2020-06-01".
+	Provenance *Provenance // How the dataset was created.
+	Summary    interface{} // The summary of the conversion run, as a JSON-encodable value.
+}
+
+// WritePackage bundles the files and directories of entries, e.g. the labels, images, label map
+// and statistics of a converted dataset, into a single artifact at outPath, with a manifest
+// listing the size and checksum of every file.
+//
+// If outPath ends in ".tar.gz" or ".tgz", a gzip-compressed tar archive with the top-level
+// directory "<name>-<version>" is written. Its contents only depend on the packaged files, i.e.
+// the files are sorted by path and the timestamps and owners are omitted, so that packaging the
+// same dataset twice results in the same archive. Otherwise, the files are copied to the
+// directory outPath, which must not exist or be empty.
+func WritePackage(outPath string, entries []PackageEntry, opts PackageOptions) (
+		manifest *PackageManifest, err error) {
+
+	name := opts.Name
+	if name == "" {
+		name = filepath.Base(outPath)
+		for _, ext := range []string{".tar.gz", ".tgz"} {
+			name = strings.TrimSuffix(name, ext)
+		}
+	}
+	if opts.Version == "" {
+		return nil, fmt.Errorf("missing package version")
+	}
+
+	files, err := packageFiles(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest = &PackageManifest{
+		Name:       name,
+		Version:    opts.Version,
+		Provenance: opts.Provenance,
+		Summary:    opts.Summary,
+		Files:      make([]PackageFile, 0, len(files)),
+	}
+
+	lower := strings.ToLower(outPath)
+	if strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".tgz") {
+		err = writeTarPackage(outPath, name+"-"+opts.Version, files, manifest)
+	} else {
+		err = writeDirPackage(outPath, files, manifest)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// packageSource is a file to copy into a package.
+type packageSource struct {
+	path string // The path of the file.
+	name string // The slash-separated path in the package.
+	size int64
+}
+
+// packageFiles returns the files of entries, with the directories expanded, sorted by name.
+func packageFiles(entries []PackageEntry) ([]packageSource, error) {
+	var files []packageSource
+	names := make(map[string]bool)
+	for _, e := range entries {
+		err := filepath.Walk(e.Path, func(p string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(e.Path, p)
+			if err != nil {
+				return err
+			}
+			name := path.Join(e.Name, filepath.ToSlash(rel))
+			if name == PackageManifestFile || names[name] {
+				return fmt.Errorf("duplicate file %q in package", name)
+			}
+			names[name] = true
+			files = append(files, packageSource{path: p, name: name, size: info.Size()})
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("cannot package %q: %v", e.Path, err)
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+	return files, nil
+}
+
+// copyPackageFile copies the file f to w and adds it to manifest.
+func copyPackageFile(w io.Writer, f packageSource, manifest *PackageManifest) (err error) {
+	in, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer closeWithErrCheck(in, &err)
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, h), in)
+	if err != nil {
+		return err
+	}
+	if n != f.size {
+		return fmt.Errorf("file %q changed while packaging", f.path)
+	}
+	manifest.Files = append(manifest.Files, PackageFile{
+		Path:   f.name,
+		Size:   n,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	})
+	return nil
+}
+
+// writeTarPackage writes the files and the manifest to the gzip-compressed tar archive at outPath,
+// in the directory root.
+func writeTarPackage(outPath, root string, files []packageSource,
+		manifest *PackageManifest) (err error) {
+
+	file, err := createAtomicFile(outPath)
+	if err != nil {
+		return err
+	}
+	defer file.commit(&err)
+	gz := gzip.NewWriter(file)
+	defer closeWithErrCheck(gz, &err)
+	tw := tar.NewWriter(gz)
+	defer closeWithErrCheck(tw, &err)
+
+	for _, f := range files {
+		hdr := &tar.Header{
+			Name:     path.Join(root, f.name),
+			Mode:     0644,
+			Size:     f.size,
+			Typeflag: tar.TypeReg,
+			Format:   tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if err := copyPackageFile(tw, f, manifest); err != nil {
+			return err
+		}
+	}
+
+	enc, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Name:     path.Join(root, PackageManifestFile),
+		Mode:     0644,
+		Size:     int64(len(enc)),
+		Typeflag: tar.TypeReg,
+		Format:   tar.FormatPAX,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = tw.Write(enc)
+	return err
+}
+
+// writeDirPackage copies the files to the directory outPath and writes the manifest.
+func writeDirPackage(outPath string, files []packageSource, manifest *PackageManifest) error {
+	if dir, err := os.Open(outPath); err == nil {
+		names, _ := dir.Readdirnames(1)
+		dir.Close()
+		if len(names) > 0 {
+			return fmt.Errorf("package directory %q is not empty", outPath)
+		}
+	}
+
+	for _, f := range files {
+		outFilePath := filepath.Join(outPath, filepath.FromSlash(f.name))
+		if err := os.MkdirAll(filepath.Dir(outFilePath), 0755); err != nil {
+			return err
+		}
+		out, err := createAtomicFile(outFilePath)
+		if err != nil {
+			return err
+		}
+		err = copyPackageFile(out, f, manifest)
+		out.commit(&err)
+		if err != nil {
+			return err
+		}
+	}
+
+	enc, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(outPath, 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(outPath, PackageManifestFile), enc)
+}
@@ -0,0 +1,527 @@
+package lblconv
+
+// Parquet output of the flattened annotation table.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// ParquetOptions configures the Parquet output.
+type ParquetOptions struct {
+	// The names of the annotation attributes to write as additional string columns, e.g.
+	// DetectedText. Non-string values are written as JSON.
+	Attributes []string
+
+	RowGroupSize int // The max. number of rows per row group. Defaults to 100000.
+}
+
+// The Parquet physical types, repetition types and encodings used by the writer.
+const (
+	parquetInt32     = 1
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetRequired = 0
+	parquetOptional = 1
+
+	parquetPlain = 0
+	parquetRLE   = 3
+)
+
+// parquetColumn holds the values of a column for the current row group.
+type parquetColumn struct {
+	name     string
+	typ      int32 // The physical type.
+	optional bool
+	utf8     bool // Whether the byte arrays are UTF-8 strings.
+
+	values    bytes.Buffer // The PLAIN encoded non-null values.
+	defined   []byte       // The definition level per value (1 if not null), for optional columns.
+	numValues int
+}
+
+// appendString appends the string s, or null if !ok.
+func (c *parquetColumn) appendString(s string, ok bool) {
+	if c.define(ok) {
+		var n [4]byte
+		binary.LittleEndian.PutUint32(n[:], uint32(len(s)))
+		c.values.Write(n[:])
+		c.values.WriteString(s)
+	}
+}
+
+// appendInt32 appends v, or null if !ok.
+func (c *parquetColumn) appendInt32(v int32, ok bool) {
+	if c.define(ok) {
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], uint32(v))
+		c.values.Write(b[:])
+	}
+}
+
+// appendDouble appends v, or null if !ok.
+func (c *parquetColumn) appendDouble(v float64, ok bool) {
+	if c.define(ok) {
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+		c.values.Write(b[:])
+	}
+}
+
+// define records a value that is null if !ok and returns whether the value must be encoded.
+func (c *parquetColumn) define(ok bool) bool {
+	c.numValues++
+	if !c.optional {
+		return true
+	}
+	if ok {
+		c.defined = append(c.defined, 1)
+	} else {
+		c.defined = append(c.defined, 0)
+	}
+	return ok
+}
+
+// page returns the data of a DataPage with the values of the column.
+func (c *parquetColumn) page() []byte {
+	var page bytes.Buffer
+	if c.optional {
+		// The definition levels use the RLE encoding with a bit width of 1, with a length prefix.
+		var levels bytes.Buffer
+		for i := 0; i < len(c.defined); {
+			j := i + 1
+			for j < len(c.defined) && c.defined[j] == c.defined[i] {
+				j++
+			}
+			writeUvarint(&levels, uint64(j-i)<<1)
+			levels.WriteByte(c.defined[i])
+			i = j
+		}
+		var n [4]byte
+		binary.LittleEndian.PutUint32(n[:], uint32(levels.Len()))
+		page.Write(n[:])
+		page.Write(levels.Bytes())
+	}
+	page.Write(c.values.Bytes())
+	return page.Bytes()
+}
+
+// reset clears the values of the column.
+func (c *parquetColumn) reset() {
+	c.values.Reset()
+	c.defined = c.defined[:0]
+	c.numValues = 0
+}
+
+// parquetRowGroup is the metadata of a written row group.
+type parquetRowGroup struct {
+	numRows int64
+	chunks  []parquetColumnChunk
+}
+
+// parquetColumnChunk is the metadata of a written column chunk.
+type parquetColumnChunk struct {
+	offset    int64 // The file offset of the data page.
+	size      int64 // The total size including the page header.
+	numValues int64
+}
+
+// parquetSink is a Sink that writes the annotations as rows of a Parquet file.
+type parquetSink struct {
+	file   *atomicFile
+	w      *bufio.Writer
+	offset int64 // The number of bytes written.
+	opts   ParquetOptions
+
+	columns   []*parquetColumn
+	numRows   int
+	rowGroups []parquetRowGroup
+}
+
+// WriteParquet writes the annotations to the Parquet file outFile, see NewParquetSink.
+func WriteParquet(outFile string, data []AnnotatedFile, opts ParquetOptions) (err error) {
+	s, err := NewParquetSinkWithOptions(outFile, opts)
+	if err != nil {
+		return err
+	}
+	defer closeWithErrCheck(s, &err)
+
+	for _, f := range data {
+		if err := s.Write(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewParquetSink returns a Sink that writes the annotations to the Parquet file outFile, with one
+// row per annotation. The columns are image_path, image_width, image_height, image_sha256,
+// annotation_id, label, x_min, y_min, x_max, y_max and confidence. Unknown values are null. Files
+// without annotations have no rows.
+func NewParquetSink(outFile string) (Sink, error) {
+	return NewParquetSinkWithOptions(outFile, ParquetOptions{})
+}
+
+// NewParquetSinkWithOptions works like NewParquetSink, with the output configured by opts.
+func NewParquetSinkWithOptions(outFile string, opts ParquetOptions) (Sink, error) {
+	if opts.RowGroupSize <= 0 {
+		opts.RowGroupSize = 100000
+	}
+
+	s := &parquetSink{opts: opts}
+	s.columns = []*parquetColumn{
+		{name: "image_path", typ: parquetByteArray, utf8: true},
+		{name: "image_width", typ: parquetInt32, optional: true},
+		{name: "image_height", typ: parquetInt32, optional: true},
+		{name: "image_sha256", typ: parquetByteArray, optional: true, utf8: true},
+		{name: "annotation_id", typ: parquetByteArray, optional: true, utf8: true},
+		{name: "label", typ: parquetByteArray, utf8: true},
+		{name: "x_min", typ: parquetDouble},
+		{name: "y_min", typ: parquetDouble},
+		{name: "x_max", typ: parquetDouble},
+		{name: "y_max", typ: parquetDouble},
+		{name: "confidence", typ: parquetDouble, optional: true},
+	}
+	names := make(map[string]bool, len(s.columns)+len(opts.Attributes))
+	for _, c := range s.columns {
+		names[c.name] = true
+	}
+	for _, attr := range opts.Attributes {
+		if names[attr] {
+			return nil, fmt.Errorf("duplicate Parquet column %q", attr)
+		}
+		names[attr] = true
+		s.columns = append(s.columns, &parquetColumn{name: attr, typ: parquetByteArray,
+			optional: true, utf8: true})
+	}
+
+	file, err := createAtomicFile(outFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot write file %q: %v", outFile, err)
+	}
+	s.file = file
+	s.w = bufio.NewWriter(file)
+	if err := s.write([]byte("PAR1")); err != nil {
+		_ = s.Abort()
+		return nil, err
+	}
+	return s, nil
+}
+
+// write writes b to the file.
+func (s *parquetSink) write(b []byte) error {
+	n, err := s.w.Write(b)
+	s.offset += int64(n)
+	return err
+}
+
+// Write implements Sink.
+func (s *parquetSink) Write(f AnnotatedFile) error {
+	for _, a := range f.Annotations {
+		c := s.columns
+		c[0].appendString(f.FilePath, true)
+		c[1].appendInt32(int32(f.ImageWidth), f.ImageWidth > 0)
+		c[2].appendInt32(int32(f.ImageHeight), f.ImageHeight > 0)
+		c[3].appendString(f.ImageSHA256, f.ImageSHA256 != "")
+		c[4].appendString(a.ID, a.ID != "")
+		c[5].appendString(a.Label, true)
+		for i := 0; i < 4; i++ {
+			c[6+i].appendDouble(a.Coords[i], true)
+		}
+		confidence, ok := a.Attributes[Confidence].(float64)
+		c[10].appendDouble(confidence, ok)
+		for i, attr := range s.opts.Attributes {
+			value, ok := a.Attributes[attr]
+			c[11+i].appendString(parquetString(value), ok && value != nil)
+		}
+
+		s.numRows++
+		if s.numRows == s.opts.RowGroupSize {
+			if err := s.writeRowGroup(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parquetString returns the string value of the attribute value v, i.e. v itself for strings and
+// JSON otherwise.
+func parquetString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	enc, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(enc)
+}
+
+// writeRowGroup writes the buffered rows as a row group with a single page per column.
+func (s *parquetSink) writeRowGroup() error {
+	rg := parquetRowGroup{numRows: int64(s.numRows)}
+	for _, c := range s.columns {
+		page := c.page()
+
+		// PageHeader with a DataPageHeader.
+		var t thriftCompactWriter
+		t.i32(1, 0) // DATA_PAGE
+		t.i32(2, int32(len(page)))
+		t.i32(3, int32(len(page)))
+		t.beginStruct(5)
+		t.i32(1, int32(c.numValues))
+		t.i32(2, parquetPlain)
+		t.i32(3, parquetRLE)
+		t.i32(4, parquetRLE)
+		t.endStruct()
+		t.stop()
+
+		chunk := parquetColumnChunk{
+			offset:    s.offset,
+			size:      int64(t.buf.Len() + len(page)),
+			numValues: int64(c.numValues),
+		}
+		if err := s.write(t.buf.Bytes()); err != nil {
+			return err
+		}
+		if err := s.write(page); err != nil {
+			return err
+		}
+		rg.chunks = append(rg.chunks, chunk)
+		c.reset()
+	}
+
+	s.rowGroups = append(s.rowGroups, rg)
+	s.numRows = 0
+	return nil
+}
+
+// footer returns the encoded FileMetaData.
+func (s *parquetSink) footer() []byte {
+	var t thriftCompactWriter
+	t.i32(1, 1) // The format version.
+
+	// The schema, as a root element with a child per column.
+	t.listHeader(2, len(s.columns)+1, thriftStruct)
+	t.beginStruct(-1)
+	t.binary(4, "schema")
+	t.i32(5, int32(len(s.columns)))
+	t.endStruct()
+	for _, c := range s.columns {
+		t.beginStruct(-1)
+		t.i32(1, c.typ)
+		repetition := int32(parquetRequired)
+		if c.optional {
+			repetition = parquetOptional
+		}
+		t.i32(3, repetition)
+		t.binary(4, c.name)
+		if c.utf8 {
+			t.i32(6, 0) // UTF8
+		}
+		t.endStruct()
+	}
+
+	var numRows int64
+	for _, rg := range s.rowGroups {
+		numRows += rg.numRows
+	}
+	t.i64(3, numRows)
+
+	t.listHeader(4, len(s.rowGroups), thriftStruct)
+	for _, rg := range s.rowGroups {
+		t.beginStruct(-1)
+		var totalSize int64
+		t.listHeader(1, len(rg.chunks), thriftStruct)
+		for i, chunk := range rg.chunks {
+			c := s.columns[i]
+			totalSize += chunk.size
+
+			t.beginStruct(-1) // ColumnChunk
+			t.i64(2, chunk.offset)
+			t.beginStruct(3) // ColumnMetaData
+			t.i32(1, c.typ)
+			t.listHeader(2, 2, thriftI32)
+			t.rawI32(parquetPlain)
+			t.rawI32(parquetRLE)
+			t.listHeader(3, 1, thriftBinary)
+			t.rawBinary(c.name)
+			t.i32(4, 0) // UNCOMPRESSED
+			t.i64(5, chunk.numValues)
+			t.i64(6, chunk.size)
+			t.i64(7, chunk.size)
+			t.i64(9, chunk.offset)
+			t.endStruct()
+			t.endStruct()
+		}
+		t.i64(2, totalSize)
+		t.i64(3, rg.numRows)
+		t.endStruct()
+	}
+
+	t.binary(6, "lblconv")
+	t.stop()
+	return t.buf.Bytes()
+}
+
+// Close implements Sink.
+func (s *parquetSink) Close() (err error) {
+	defer s.file.commit(&err)
+
+	if s.numRows > 0 {
+		if err := s.writeRowGroup(); err != nil {
+			return err
+		}
+	}
+
+	footer := s.footer()
+	var n [4]byte
+	binary.LittleEndian.PutUint32(n[:], uint32(len(footer)))
+	for _, b := range [][]byte{footer, n[:], []byte("PAR1")} {
+		if err := s.write(b); err != nil {
+			return err
+		}
+	}
+	return s.w.Flush()
+}
+
+// Abort implements Aborter. It removes the partially written file.
+func (s *parquetSink) Abort() error {
+	return s.file.Abort()
+}
+
+// The Thrift compact protocol types used by thriftCompactWriter.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftCompactWriter encodes Thrift structs with the compact protocol, as used by the Parquet
+// metadata.
+type thriftCompactWriter struct {
+	buf    bytes.Buffer
+	lastID int16   // The ID of the previous field of the current struct.
+	stack  []int16 // The lastID of the enclosing structs.
+}
+
+// fieldHeader writes the header of the field with id and the compact type typ.
+func (t *thriftCompactWriter) fieldHeader(id int16, typ byte) {
+	if delta := id - t.lastID; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		writeUvarint(&t.buf, zigzag(int64(id)))
+	}
+	t.lastID = id
+}
+
+// i32 writes the i32 field id.
+func (t *thriftCompactWriter) i32(id int16, v int32) {
+	t.fieldHeader(id, thriftI32)
+	t.rawI32(v)
+}
+
+// rawI32 writes an i32 value, e.g. a list element.
+func (t *thriftCompactWriter) rawI32(v int32) {
+	writeUvarint(&t.buf, zigzag(int64(v)))
+}
+
+// i64 writes the i64 field id.
+func (t *thriftCompactWriter) i64(id int16, v int64) {
+	t.fieldHeader(id, thriftI64)
+	writeUvarint(&t.buf, zigzag(v))
+}
+
+// binary writes the binary (string) field id.
+func (t *thriftCompactWriter) binary(id int16, s string) {
+	t.fieldHeader(id, thriftBinary)
+	t.rawBinary(s)
+}
+
+// rawBinary writes a binary value, e.g. a list element.
+func (t *thriftCompactWriter) rawBinary(s string) {
+	writeUvarint(&t.buf, uint64(len(s)))
+	t.buf.WriteString(s)
+}
+
+// listHeader writes the header of the list field id with size elements of the type elemType.
+func (t *thriftCompactWriter) listHeader(id int16, size int, elemType byte) {
+	t.fieldHeader(id, thriftList)
+	if size < 15 {
+		t.buf.WriteByte(byte(size)<<4 | elemType)
+	} else {
+		t.buf.WriteByte(0xf0 | elemType)
+		writeUvarint(&t.buf, uint64(size))
+	}
+}
+
+// beginStruct starts the struct field id, or a struct list element if id is negative.
+func (t *thriftCompactWriter) beginStruct(id int16) {
+	if id >= 0 {
+		t.fieldHeader(id, thriftStruct)
+	}
+	t.stack = append(t.stack, t.lastID)
+	t.lastID = 0
+}
+
+// endStruct ends the current struct.
+func (t *thriftCompactWriter) endStruct() {
+	t.stop()
+	t.lastID = t.stack[len(t.stack)-1]
+	t.stack = t.stack[:len(t.stack)-1]
+}
+
+// stop writes the stop field, which ends a struct.
+func (t *thriftCompactWriter) stop() {
+	t.buf.WriteByte(0)
+}
+
+// zigzag returns the zigzag encoding of v.
+func zigzag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+// writeUvarint writes the varint encoding of v to w.
+func writeUvarint(w io.ByteWriter, v uint64) {
+	for v >= 0x80 {
+		_ = w.WriteByte(byte(v) | 0x80)
+		v >>= 7
+	}
+	_ = w.WriteByte(byte(v))
+}
+
+// parquetFormat implements the Writer interface for Parquet files.
+type parquetFormat struct{}
+
+// Write implements Writer.
+func (parquetFormat) Write(outFile string, data AnnotatedFiles, opts FormatOptions) error {
+	return WriteParquet(outFile, data, opts.Parquet)
+}
+
+// NewSink implements StreamWriter.
+func (parquetFormat) NewSink(outFile string, opts FormatOptions) (Sink, error) {
+	return NewParquetSinkWithOptions(outFile, opts.Parquet)
+}
+
+func init() {
+	RegisterFormat(Format{
+		Name:        "parquet",
+		Description: "Parquet table with one row per annotation",
+		Writer:      parquetFormat{},
+		WriterArgs:  "-labels-out <file> [-parquet-attributes <name>[,...]]",
+	})
+}
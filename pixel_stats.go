@@ -0,0 +1,124 @@
+package lblconv
+
+// Pixel statistics functionality, to compute the normalisation constants of a dataset.
+
+import (
+	"image"
+	"log"
+	"math"
+	"sync"
+)
+
+// PixelStats accumulates the per-channel pixel mean and standard deviation of images, with the
+// channel values in [0, 1]. It is safe for concurrent use.
+type PixelStats struct {
+	mu     sync.Mutex
+	seen   map[string]bool // The image paths added, so that each image is counted once.
+	pixels int64
+	sum    [3]float64 // The sums of the R, G and B values.
+	sumSq  [3]float64 // The sums of the squared R, G and B values.
+}
+
+// NewPixelStats returns an empty PixelStats.
+func NewPixelStats() *PixelStats {
+	return &PixelStats{seen: make(map[string]bool)}
+}
+
+// Add adds the pixels of img.
+func (s *PixelStats) Add(img image.Image) {
+	// Accumulate per image to keep the lock short.
+	var sum, sumSq [3]float64
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			for i, v := range [3]uint32{r, g, b} {
+				f := float64(v) / 0xffff
+				sum[i] += f
+				sumSq[i] += f * f
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pixels += int64(bounds.Dx() * bounds.Dy())
+	for i := range sum {
+		s.sum[i] += sum[i]
+		s.sumSq[i] += sumSq[i]
+	}
+}
+
+// AddFile adds the pixels of the image at path, unless it has been added before.
+func (s *PixelStats) AddFile(path string) error {
+	s.mu.Lock()
+	seen := s.seen[path]
+	s.seen[path] = true
+	s.mu.Unlock()
+	if seen {
+		return nil
+	}
+
+	width, height, err := imageDimensions(path)
+	if err != nil {
+		return err
+	}
+	release := reserveImageMemory(width, height)
+	defer release()
+	img, _, err := loadImage(path)
+	if err != nil {
+		return err
+	}
+	s.Add(img)
+	return nil
+}
+
+// Pixels returns the number of pixels added.
+func (s *PixelStats) Pixels() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.pixels
+}
+
+// Mean returns the mean R, G and B values in [0, 1].
+func (s *PixelStats) Mean() [3]float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var mean [3]float64
+	if s.pixels > 0 {
+		for i := range mean {
+			mean[i] = s.sum[i] / float64(s.pixels)
+		}
+	}
+	return mean
+}
+
+// Std returns the standard deviations of the R, G and B values in [0, 1].
+func (s *PixelStats) Std() [3]float64 {
+	mean := s.Mean()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var std [3]float64
+	if s.pixels > 0 {
+		for i := range std {
+			std[i] = math.Sqrt(math.Max(0, s.sumSq[i]/float64(s.pixels)-mean[i]*mean[i]))
+		}
+	}
+	return std
+}
+
+// PixelStatsStage returns a Stage that adds the image of each file to s and passes the file on
+// unchanged. Images that cannot be read are logged and not added.
+func PixelStatsStage(s *PixelStats) Stage {
+	return func(f AnnotatedFile) ([]AnnotatedFile, error) {
+		if err := s.AddFile(f.FilePath); err != nil {
+			log.Printf("Failed to add %q to the pixel statistics: %v", f.FilePath, err)
+		}
+		return []AnnotatedFile{f}, nil
+	}
+}
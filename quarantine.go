@@ -0,0 +1,192 @@
+package lblconv
+
+// Quarantine of images that cannot be read or decoded.
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// QuarantineReasonsFile is the name of the file in the quarantine directory that lists the
+// quarantined images and the reasons.
+const QuarantineReasonsFile = "reasons.csv"
+
+// QuarantineMode selects what a Quarantine does with the images added to it.
+type QuarantineMode int
+
+// The supported quarantine modes.
+const (
+	QuarantineList QuarantineMode = iota // Only list the images in the reasons file.
+	QuarantineMove                       // Move the images to the quarantine directory.
+)
+
+// QuarantineEntry is an image added to a Quarantine.
+type QuarantineEntry struct {
+	Path string // The path of the image as referenced by the labels.
+
+	// The path of the image in the quarantine directory, or "" if it was not moved, e.g. in
+	// QuarantineList mode or for a remote or missing image.
+	QuarantinedPath string
+
+	Reason string
+}
+
+// Quarantine collects the images that fail to decode or verify, so that a dataset can be cleaned
+// iteratively: The images are listed with the reasons in QuarantineReasonsFile, and moved to the
+// quarantine directory in QuarantineMove mode. It is safe for concurrent use.
+type Quarantine struct {
+	dir  string
+	mode QuarantineMode
+
+	mu      sync.Mutex
+	entries []QuarantineEntry
+	names   map[string]bool // The file names used in dir.
+}
+
+// NewQuarantine returns a Quarantine for the directory dir, which is created if necessary.
+func NewQuarantine(dir string, mode QuarantineMode) (*Quarantine, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("missing quarantine directory")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Quarantine{dir: dir, mode: mode, names: make(map[string]bool)}, nil
+}
+
+// Add quarantines the image at path for the reason err. Remote images, images in archives and
+// missing images are listed, but never moved.
+func (q *Quarantine) Add(path string, err error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entry := QuarantineEntry{Path: path, Reason: err.Error()}
+	var imageErr *ImageError
+	if errors.As(err, &imageErr) {
+		entry.Reason = imageErr.Err.Error()
+	}
+
+	localPath, ok := localImagePath(path)
+	if q.mode == QuarantineMove && ok && !isRemoteImage(path) && !errors.Is(err,
+			ErrImageNotFound) {
+		outPath := filepath.Join(q.dir, q.uniqueName(filepath.Base(localPath)))
+		if err := moveFile(localPath, outPath); err != nil {
+			return fmt.Errorf("cannot quarantine image %q: %v", path, err)
+		}
+		entry.QuarantinedPath = outPath
+	}
+
+	q.entries = append(q.entries, entry)
+	return nil
+}
+
+// uniqueName returns name, or name with a numeric suffix if it is already used in the quarantine
+// directory, as images from different directories may have the same name.
+func (q *Quarantine) uniqueName(name string) string {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		if !q.names[name] {
+			if _, err := os.Stat(filepath.Join(q.dir, name)); os.IsNotExist(err) {
+				q.names[name] = true
+				return name
+			}
+		}
+		name = base + "-" + strconv.Itoa(i) + ext
+	}
+}
+
+// moveFile moves the file at path to outPath, copying it if it cannot be renamed, e.g. across
+// file systems.
+func moveFile(path, outPath string) error {
+	if err := os.Rename(path, outPath); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	out, err := createAtomicFile(outPath)
+	if err != nil {
+		in.Close()
+		return err
+	}
+	_, err = io.Copy(out, in)
+	in.Close()
+	out.commit(&err)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Entries returns a copy of the quarantined images, sorted by path.
+func (q *Quarantine) Entries() []QuarantineEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entries := make([]QuarantineEntry, len(q.entries))
+	copy(entries, q.entries)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries
+}
+
+// Close writes QuarantineReasonsFile to the quarantine directory, with a header row and a row per
+// quarantined image with the path, the quarantined path and the reason.
+func (q *Quarantine) Close() (err error) {
+	path := filepath.Join(q.dir, QuarantineReasonsFile)
+	file, err := createAtomicFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot write file %q: %v", path, err)
+	}
+	defer file.commit(&err)
+
+	w := csv.NewWriter(file)
+	if err := w.Write([]string{"path", "quarantined_path", "reason"}); err != nil {
+		return err
+	}
+	for _, e := range q.Entries() {
+		if err := w.Write([]string{e.Path, e.QuarantinedPath, e.Reason}); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// quarantineOrFail adds the image of f to q and returns ErrFileSkipped, if err is an ImageError.
+// Returns err otherwise, or if q is nil.
+func quarantineOrFail(q *Quarantine, f AnnotatedFile, err error) error {
+	var imageErr *ImageError
+	if q == nil || !errors.As(err, &imageErr) {
+		return err
+	}
+	log.Print("Quarantining file: ", err)
+	if err := q.Add(f.FilePath, err); err != nil {
+		return err
+	}
+	return ErrFileSkipped
+}
+
+// VerifyImagesStage returns a Stage that decodes the image of each file and skips the files whose
+// image cannot be read or decoded (see ErrFileSkipped), adding them to q. The files are passed on
+// unchanged otherwise.
+// If q is nil, the first image that cannot be decoded fails the Stage.
+func VerifyImagesStage(q *Quarantine) Stage {
+	return func(f AnnotatedFile) ([]AnnotatedFile, error) {
+		if _, _, err := loadImage(f.FilePath); err != nil {
+			return nil, quarantineOrFail(q, f, err)
+		}
+		return []AnnotatedFile{f}, nil
+	}
+}
@@ -0,0 +1,86 @@
+package lblconv
+
+// Rounding of the coordinates written to label files.
+
+import (
+	"math"
+)
+
+// RoundingMode is the direction in which coordinates are rounded.
+type RoundingMode int
+
+// The supported rounding modes.
+const (
+	RoundNone    RoundingMode = iota // Coordinates are written as formatted by each Writer.
+	RoundNearest                     // Round half away from zero.
+	RoundFloor                       // Round towards negative infinity.
+	RoundCeil                        // Round towards positive infinity.
+)
+
+// CoordRounding is a rounding policy for the absolute pixel coordinates of bounding boxes and
+// polygons, which OpenSink applies before the coordinates are passed to a Writer. This makes the
+// output of all formats consistent, e.g. when round-tripping a dataset between formats that
+// otherwise format coordinates differently. The zero value does not round.
+type CoordRounding struct {
+	Mode     RoundingMode
+	Decimals int // The number of decimal places to keep, e.g. 0 for whole pixels.
+}
+
+// roundingEpsilon is the tolerance, in units of the last decimal place kept, within which a value
+// is considered to be rounded already, so that rounding is idempotent despite the floating point
+// error of scaling by the number of decimals.
+const roundingEpsilon = 1e-6
+
+// Round returns v rounded as per r.
+func (r CoordRounding) Round(v float64) float64 {
+	if r.Mode == RoundNone || math.IsInf(v, 0) || math.IsNaN(v) {
+		return v
+	}
+
+	scale := math.Pow10(r.Decimals)
+	x := v * scale
+	if n := math.Round(x); math.Abs(x-n) < roundingEpsilon {
+		return n / scale
+	}
+	switch r.Mode {
+	case RoundNearest:
+		x = math.Round(x)
+	case RoundFloor:
+		x = math.Floor(x)
+	case RoundCeil:
+		x = math.Ceil(x)
+	}
+	return x / scale
+}
+
+// round rounds the coordinates and polygon of f as per r.
+func (r CoordRounding) round(f *AnnotatedFile) {
+	if r.Mode == RoundNone {
+		return
+	}
+
+	// Copy the annotations and polygons, which may be shared with other files.
+	annotations := make([]Annotation, len(f.Annotations))
+	for i, a := range f.Annotations {
+		for j := range a.Coords {
+			a.Coords[j] = r.Round(a.Coords[j])
+		}
+		if a.Polygon != nil {
+			polygon := make([][2]float64, len(a.Polygon))
+			for j, p := range a.Polygon {
+				polygon[j] = [2]float64{r.Round(p[0]), r.Round(p[1])}
+			}
+			a.Polygon = polygon
+		}
+		annotations[i] = a
+	}
+	f.Annotations = annotations
+}
+
+// RoundCoordsStage returns a Stage that rounds the coordinates of each file as per r.
+func RoundCoordsStage(r CoordRounding) Stage {
+	return func(f AnnotatedFile) ([]AnnotatedFile, error) {
+		r.round(&f)
+		return []AnnotatedFile{f}, nil
+	}
+}
@@ -0,0 +1,306 @@
+package lblconv
+
+// Round trips through a format to find out what information it does not retain.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Diff describes the information lost when writing and re-reading a dataset, see RoundTrip.
+type Diff struct {
+	MissingFiles []string // The paths of the input files that were not read back.
+	ExtraFiles   []string // The paths of the files that were read back without an input file.
+
+	MissingAnnotations int // The number of annotations that were not read back.
+	ExtraAnnotations   int // The number of annotations that were read back in addition.
+	ChangedLabels      int // The number of annotations that were read back with another label.
+
+	// The number of annotations whose attribute was not read back, or read back with a different
+	// value, by attribute key. The keys of file attributes are prefixed with "file:".
+	DroppedAttributes, ChangedAttributes map[string]int
+
+	// The number of files or annotations whose field was not read back, by field name, e.g.
+	// "ImageSHA256", "ID" or "Polygon".
+	DroppedFields map[string]int
+
+	MaxCoordDrift  float64 // The max. absolute difference of a coordinate of an annotation.
+	MeanCoordDrift float64 // The mean absolute difference of the coordinates of the annotations.
+}
+
+// Lossless returns whether the round trip retained all information.
+func (d Diff) Lossless() bool {
+	return len(d.MissingFiles) == 0 && len(d.ExtraFiles) == 0 && d.MissingAnnotations == 0 &&
+			d.ExtraAnnotations == 0 && d.ChangedLabels == 0 && len(d.DroppedAttributes) == 0 &&
+			len(d.ChangedAttributes) == 0 && len(d.DroppedFields) == 0 && d.MaxCoordDrift == 0
+}
+
+// String returns a summary of the lost information.
+func (d Diff) String() string {
+	if d.Lossless() {
+		return "lossless"
+	}
+
+	var parts []string
+	counts := []struct {
+		n    int
+		desc string
+	}{
+		{len(d.MissingFiles), "missing files"},
+		{len(d.ExtraFiles), "extra files"},
+		{d.MissingAnnotations, "missing annotations"},
+		{d.ExtraAnnotations, "extra annotations"},
+		{d.ChangedLabels, "changed labels"},
+	}
+	for _, c := range counts {
+		if c.n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", c.n, c.desc))
+		}
+	}
+	keyCounts := []struct {
+		counts map[string]int
+		desc   string
+	}{
+		{d.DroppedFields, "dropped fields"},
+		{d.DroppedAttributes, "dropped attributes"},
+		{d.ChangedAttributes, "changed attributes"},
+	}
+	for _, c := range keyCounts {
+		if len(c.counts) == 0 {
+			continue
+		}
+		keys := make([]string, 0, len(c.counts))
+		for key := range c.counts {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for i, key := range keys {
+			keys[i] = fmt.Sprintf("%s (%d)", key, c.counts[key])
+		}
+		parts = append(parts, c.desc+" "+strings.Join(keys, ", "))
+	}
+	if d.MaxCoordDrift > 0 {
+		parts = append(parts, fmt.Sprintf("coordinate drift max. %g, mean %g", d.MaxCoordDrift,
+			d.MeanCoordDrift))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// RoundTrip writes data in the registered format and reads it back, and returns the data read and
+// what information was lost, e.g. to choose a target format or to test a format implementation.
+func RoundTrip(format string, data AnnotatedFiles) (AnnotatedFiles, Diff, error) {
+	return RoundTripWithOptions(format, data, FormatOptions{})
+}
+
+// RoundTripWithOptions works like RoundTrip, but writes and reads the data with opts. opts.ImageDir
+// is required for the formats that match label files to images.
+func RoundTripWithOptions(format string, data AnnotatedFiles, opts FormatOptions) (
+		AnnotatedFiles, Diff, error) {
+	f, ok := LookupFormat(format)
+	if !ok {
+		return nil, Diff{}, fmt.Errorf("unknown format %q", format)
+	}
+	if f.Reader == nil || f.Writer == nil {
+		return nil, Diff{}, fmt.Errorf("format %q cannot be both written and read", format)
+	}
+
+	dir, err := ioutil.TempDir("", "lblconv-roundtrip-")
+	if err != nil {
+		return nil, Diff{}, err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "labels")
+	if strings.Contains(f.WriterArgs, "-labels-out <dir>") {
+		if err := os.Mkdir(path, 0755); err != nil {
+			return nil, Diff{}, err
+		}
+	}
+
+	sink, err := OpenSink(f.Writer, path, opts)
+	if err != nil {
+		return nil, Diff{}, err
+	}
+	for _, file := range data {
+		if err := sink.Write(file); err != nil {
+			_ = AbortSink(sink)
+			return nil, Diff{}, err
+		}
+	}
+	if err := sink.Close(); err != nil {
+		return nil, Diff{}, err
+	}
+	out, err := f.Reader.Parse(path, opts)
+	if err != nil {
+		return nil, Diff{}, err
+	}
+	return out, DiffData(data, out), nil
+}
+
+// DiffData compares the data written with the data read back, see Diff. The files are matched by
+// image path, or by file name if the format changes the directories. The annotations of each file
+// are matched by label and coordinates.
+func DiffData(in, out AnnotatedFiles) Diff {
+	d := Diff{
+		DroppedAttributes: make(map[string]int),
+		ChangedAttributes: make(map[string]int),
+		DroppedFields:     make(map[string]int),
+	}
+
+	byPath := make(map[string]int, len(out))
+	byName := make(map[string]int, len(out))
+	for i, f := range out {
+		byPath[imagePathKey(f.FilePath)] = i
+		byName[filepath.Base(f.FilePath)] = i
+	}
+	matched := make([]bool, len(out))
+	var drift float64
+	numCoords := 0
+	for _, f := range in {
+		i, ok := byPath[imagePathKey(f.FilePath)]
+		if !ok {
+			i, ok = byName[filepath.Base(f.FilePath)]
+		}
+		if !ok || matched[i] {
+			d.MissingFiles = append(d.MissingFiles, f.FilePath)
+			d.MissingAnnotations += len(f.Annotations)
+			continue
+		}
+		matched[i] = true
+		fileDrift, numMatched := d.diffFile(f, out[i])
+		drift += fileDrift
+		numCoords += 4 * numMatched
+	}
+	for i, f := range out {
+		if !matched[i] {
+			d.ExtraFiles = append(d.ExtraFiles, f.FilePath)
+			d.ExtraAnnotations += len(f.Annotations)
+		}
+	}
+	if numCoords > 0 {
+		d.MeanCoordDrift = drift / float64(numCoords)
+	}
+
+	for _, m := range []*map[string]int{&d.DroppedAttributes, &d.ChangedAttributes,
+		&d.DroppedFields} {
+		if len(*m) == 0 {
+			*m = nil
+		}
+	}
+	return d
+}
+
+// diffFile adds the differences between the matching files to d, and returns the sum of the
+// absolute coordinate differences of the matched annotations and their number.
+func (d *Diff) diffFile(in, out AnnotatedFile) (float64, int) {
+	if in.ImageWidth != 0 && out.ImageWidth == 0 || in.ImageHeight != 0 && out.ImageHeight == 0 {
+		d.DroppedFields["ImageSize"]++
+	}
+	if in.ImageSHA256 != "" && out.ImageSHA256 == "" {
+		d.DroppedFields["ImageSHA256"]++
+	}
+	d.diffAttributes("file:", in.Attributes, out.Attributes)
+
+	// Greedily match each annotation to the closest remaining one, preferring the same label.
+	used := make([]bool, len(out.Annotations))
+	drift, numMatched := 0.0, 0
+	for _, a := range in.Annotations {
+		best, bestDist := -1, math.Inf(1)
+		for j, b := range out.Annotations {
+			if used[j] {
+				continue
+			}
+			dist := maxCoordDiff(a, b)
+			if a.Label != b.Label {
+				dist += 1e9
+			}
+			if dist < bestDist {
+				best, bestDist = j, dist
+			}
+		}
+		if best < 0 {
+			d.MissingAnnotations++
+			continue
+		}
+		used[best] = true
+		numMatched++
+		b := out.Annotations[best]
+
+		if a.Label != b.Label {
+			d.ChangedLabels++
+		}
+		for k := range a.Coords {
+			diff := math.Abs(a.Coords[k] - b.Coords[k])
+			d.MaxCoordDrift = math.Max(d.MaxCoordDrift, diff)
+			drift += diff
+		}
+		if a.ID != "" && b.ID == "" {
+			d.DroppedFields["ID"]++
+		}
+		if len(a.Polygon) > 0 && len(b.Polygon) == 0 {
+			d.DroppedFields["Polygon"]++
+		}
+		d.diffAttributes("", a.Attributes, b.Attributes)
+	}
+	for _, u := range used {
+		if !u {
+			d.ExtraAnnotations++
+		}
+	}
+	return drift, numMatched
+}
+
+// diffAttributes counts the attributes of in that are missing from out or have a different value,
+// with their keys prefixed with prefix.
+func (d *Diff) diffAttributes(prefix string, in, out map[string]interface{}) {
+	for key, v := range in {
+		w, ok := out[key]
+		switch {
+		case !ok:
+			d.DroppedAttributes[prefix+key]++
+		case !attributeValuesEqual(v, w):
+			d.ChangedAttributes[prefix+key]++
+		}
+	}
+}
+
+// attributeValuesEqual returns whether the attribute values are equal, with numbers of different
+// types compared by value.
+func attributeValuesEqual(v, w interface{}) bool {
+	if x, ok := numberValue(v); ok {
+		y, ok := numberValue(w)
+		return ok && x == y
+	}
+	return reflect.DeepEqual(v, w)
+}
+
+// numberValue returns v as float64 if it is a number.
+func numberValue(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// maxCoordDiff returns the max. absolute difference between the coordinates of a and b.
+func maxCoordDiff(a, b Annotation) float64 {
+	diff := 0.0
+	for k := range a.Coords {
+		diff = math.Max(diff, math.Abs(a.Coords[k]-b.Coords[k]))
+	}
+	return diff
+}
@@ -0,0 +1,140 @@
+package lblconv
+
+// Per-image sampling weights for importance sampling during training.
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// SamplingWeightMethod selects how SamplingWeights derives the weight of an image from the
+// frequencies of its labels. The frequency of a label is the fraction of images that contain it.
+type SamplingWeightMethod int
+
+// The supported sampling weight methods.
+const (
+	// The max. inverse frequency of the labels of an image, normalised to a mean weight of 1.
+	// Images without labels have the weight of a label in all images.
+	InverseFrequency SamplingWeightMethod = iota
+
+	// The LVIS repeat factor max(1, sqrt(t / f)), with the threshold t and the max. over the label
+	// frequencies f of an image. Images without labels have a repeat factor of 1.
+	RepeatFactor
+)
+
+// SamplingWeights accumulates the labels of each image to compute per-image sampling weights from
+// the label frequencies, e.g. to oversample images of rare classes. It is safe for concurrent use.
+type SamplingWeights struct {
+	method    SamplingWeightMethod
+	threshold float64
+
+	mu     sync.Mutex
+	paths  []string
+	labels [][]string     // The distinct labels by image, in the order of paths.
+	counts map[string]int // The number of images by label.
+}
+
+// NewSamplingWeights returns an empty SamplingWeights for method. threshold is the frequency
+// threshold t for RepeatFactor, e.g. 0.001, and is ignored otherwise.
+func NewSamplingWeights(method SamplingWeightMethod, threshold float64) (*SamplingWeights, error) {
+	if method == RepeatFactor && (threshold <= 0 || threshold > 1) {
+		return nil, fmt.Errorf("invalid repeat factor threshold %g", threshold)
+	}
+	return &SamplingWeights{method: method, threshold: threshold, counts: make(map[string]int)}, nil
+}
+
+// Add records the labels of f. Image-level labels are not counted.
+func (w *SamplingWeights) Add(f AnnotatedFile) {
+	seen := make(map[string]bool)
+	var labels []string
+	for _, a := range f.Annotations {
+		if !seen[a.Label] && !a.boolAttribute(ImageLabel) {
+			seen[a.Label] = true
+			labels = append(labels, a.Label)
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.paths = append(w.paths, f.FilePath)
+	w.labels = append(w.labels, labels)
+	for _, label := range labels {
+		w.counts[label]++
+	}
+}
+
+// Weights returns the image paths, sorted, and their sampling weights.
+func (w *SamplingWeights) Weights() ([]string, []float64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	numImages := float64(len(w.paths))
+	weights := make([]float64, len(w.paths))
+	sum := 0.0
+	for i, labels := range w.labels {
+		weight := 1.0
+		for _, label := range labels {
+			freq := float64(w.counts[label]) / numImages
+			switch w.method {
+			case InverseFrequency:
+				weight = math.Max(weight, 1/freq)
+			case RepeatFactor:
+				weight = math.Max(weight, math.Sqrt(w.threshold/freq))
+			}
+		}
+		weights[i] = weight
+		sum += weight
+	}
+	if w.method == InverseFrequency && sum > 0 {
+		for i := range weights {
+			weights[i] *= numImages / sum
+		}
+	}
+
+	order := make([]int, len(w.paths))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return w.paths[order[i]] < w.paths[order[j]] })
+	paths := make([]string, len(order))
+	sorted := make([]float64, len(order))
+	for i, j := range order {
+		paths[i], sorted[i] = w.paths[j], weights[j]
+	}
+	return paths, sorted
+}
+
+// WriteCSV writes the sampling weights to path as CSV with the columns image and weight.
+func (w *SamplingWeights) WriteCSV(path string) (err error) {
+	file, err := createAtomicFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot write file %q: %v", path, err)
+	}
+	defer file.commit(&err)
+
+	paths, weights := w.Weights()
+	cw := csv.NewWriter(file)
+	if err := cw.Write([]string{"image", "weight"}); err != nil {
+		return err
+	}
+	for i, path := range paths {
+		if err := cw.Write([]string{path, strconv.FormatFloat(weights[i], 'g', 6, 64)}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// SamplingWeightsStage returns a Stage that adds each file to w and passes it on unchanged.
+func SamplingWeightsStage(w *SamplingWeights) Stage {
+	return func(f AnnotatedFile) ([]AnnotatedFile, error) {
+		w.Add(f)
+		return []AnnotatedFile{f}, nil
+	}
+}
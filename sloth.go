@@ -3,9 +3,9 @@ package lblconv
 // Sloth specific functionality.
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 )
 
 // SlothAnnotation is a single annotation within a Sloth file.
@@ -16,6 +16,74 @@ type SlothAnnotation struct {
 	Y      float64 `json:"y,omitempty"`
 	Width  float64 `json:"width,omitempty"`
 	Height float64 `json:"height,omitempty"`
+	ID     string  `json:"id,omitempty"`
+
+	// Additional free-form key-value pairs, which are stored alongside the fields above.
+	Attributes map[string]interface{} `json:"-"`
+}
+
+// slothAnnotationFields are the JSON keys of the SlothAnnotation fields.
+var slothAnnotationFields = map[string]bool{
+	"class": true, "type": true, "x": true, "y": true, "width": true, "height": true, "id": true,
+}
+
+// slothAnnotation has the fields of SlothAnnotation but not its JSON methods.
+type slothAnnotation SlothAnnotation
+
+// MarshalJSON implements json.Marshaler. The Attributes are merged into the annotation object,
+// except for those whose key is the key of a field.
+func (a SlothAnnotation) MarshalJSON() ([]byte, error) {
+	enc, err := json.Marshal(slothAnnotation(a))
+	if err != nil || len(a.Attributes) == 0 {
+		return enc, err
+	}
+
+	var obj map[string]interface{}
+	if err := json.Unmarshal(enc, &obj); err != nil {
+		return nil, err
+	}
+	for k, v := range a.Attributes {
+		if !slothAnnotationFields[k] {
+			obj[k] = v
+		}
+	}
+	return json.Marshal(obj)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Keys that are not the key of a field are stored in
+// Attributes.
+func (a *SlothAnnotation) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, (*slothAnnotation)(a)); err != nil {
+		return err
+	}
+
+	var obj map[string]interface{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return err
+	}
+	for k, v := range obj {
+		if slothAnnotationFields[k] {
+			continue
+		}
+		if a.Attributes == nil {
+			a.Attributes = make(map[string]interface{})
+		}
+		a.Attributes[k] = v
+	}
+	return nil
+}
+
+// SlothOptions configures the Sloth output.
+type SlothOptions struct {
+	FileClass      string // The class of the files. Defaults to "image".
+	AnnotationType string // The type of the annotations. Defaults to "rect".
+
+	// Whether to write the annotation attributes, e.g. Confidence and DetectedText, as additional
+	// key-value pairs of the annotations. Sloth ignores unknown keys.
+	Attributes bool
+
+	// The rounding of the coordinates, which also applies to the width and height.
+	Rounding CoordRounding
 }
 
 // SlothAnnotatedFile defines the Sloth annotation structure for a single file.
@@ -25,62 +93,126 @@ type SlothAnnotatedFile struct {
 	FilePath    string            `json:"filename,omitempty"`
 }
 
-// FromSloth reads and parses Sloth annotations from the file at path.
+// SlothJSONSchema is the JSON Schema of the Sloth files read by FromSloth.
+const SlothJSONSchema = `{
+  "type": "array",
+  "items": {
+    "type": "object",
+    "required": ["filename"],
+    "properties": {
+      "class": {"type": "string"},
+      "filename": {"type": "string"},
+      "annotations": {
+        "type": ["array", "null"],
+        "items": {
+          "type": "object",
+          "properties": {
+            "class": {"type": "string"},
+            "type": {"type": "string"},
+            "x": {"type": "number"},
+            "y": {"type": "number"},
+            "width": {"type": "number"},
+            "height": {"type": "number"},
+            "id": {"type": "string"}
+          }
+        }
+      }
+    }
+  }
+}`
+
+// slothSchema is the parsed SlothJSONSchema.
+var slothSchema = mustParseJSONSchema(SlothJSONSchema)
+
+// FromSloth reads and parses Sloth annotations from the file at path. The annotations of entries
+// for the same image are merged, see AnnotatedFiles.MergeDuplicates.
 func FromSloth(path string) ([]AnnotatedFile, error) {
-	enc, err := ioutil.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
+	return readJSONEntries(path, "", slothEntryConverter(path, false), false)
+}
 
-	var slothData []SlothAnnotatedFile
-	err = json.Unmarshal(enc, &slothData)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse Sloth input from %q: %v", path, err)
-	}
+// NewSlothSource returns a Source that parses the Sloth file at path one entry at a time, so that
+// the file need not fit into memory. The annotations of entries for the same image are merged into
+// the last of them. If strict is true, such entries are an error instead. If validate is true, the
+// entries are validated against SlothJSONSchema. Otherwise, they are only validated to report the
+// location of the errors if they fail to decode. Invalid entries are returned as ParseErrors.
+func NewSlothSource(path string, strict, validate bool) (Source, error) {
+	return newJSONEntrySource(path, "", slothEntryConverter(path, validate), strict)
+}
+
+// slothEntryConverter returns a jsonEntryConverter for the entries of the Sloth file at path. If
+// validate is true, the entries are validated against SlothJSONSchema, see decodeJSONEntry.
+func slothEntryConverter(path string, validate bool) jsonEntryConverter {
+	return func(raw json.RawMessage, pointer string) (AnnotatedFile, error) {
+		var slothFileData SlothAnnotatedFile
+		err := decodeJSONEntry(path, pointer, raw, slothSchema.Items, validate, &slothFileData)
+		if err != nil {
+			return AnnotatedFile{}, err
+		}
 
-	// Convert to the intermediate representation.
-	data := make([]AnnotatedFile, 0, len(slothData))
-	for _, slothFileData := range slothData {
-		// Per file data. Convert all annotations.
+		// Convert all annotations to the intermediate representation.
 		fileData := AnnotatedFile{
 			Annotations: make([]Annotation, len(slothFileData.Annotations)),
 			FilePath:    slothFileData.FilePath,
 		}
 		for i, a := range slothFileData.Annotations {
-			annotation := Annotation{Label: a.Class}
-			annotation.Coords[0] = a.X
-			annotation.Coords[1] = a.Y
-			annotation.Coords[2] = a.X + a.Width
-			annotation.Coords[3] = a.Y + a.Height
-			fileData.Annotations[i] = annotation
+			fileData.Annotations[i] = Annotation{
+				Attributes: a.Attributes,
+				Coords:     CoordsFromXYWH(a.X, a.Y, a.Width, a.Height),
+				Label:      a.Class,
+				ID:         a.ID,
+			}
+		}
+		return fileData, nil
+	}
+}
+
+// toSlothFile converts the intermediate representation for a single file to Sloth format.
+func toSlothFile(fileData AnnotatedFile, opts SlothOptions) SlothAnnotatedFile {
+	fileClass := opts.FileClass
+	if fileClass == "" {
+		fileClass = "image"
+	}
+	annotationType := opts.AnnotationType
+	if annotationType == "" {
+		annotationType = "rect"
+	}
+
+	slothFileData := SlothAnnotatedFile{
+		Annotations: make([]SlothAnnotation, len(fileData.Annotations)),
+		Class:       fileClass,
+		FilePath:    fileData.FilePath,
+	}
+	for i, a := range fileData.Annotations {
+		x, y, width, height := CoordsToXYWH(a.Coords)
+		slothLabel := SlothAnnotation{
+			Class:  a.Label,
+			Type:   annotationType,
+			X:      opts.Rounding.Round(x),
+			Y:      opts.Rounding.Round(y),
+			Width:  opts.Rounding.Round(width),
+			Height: opts.Rounding.Round(height),
+			ID:     a.ID,
+		}
+		if opts.Attributes {
+			slothLabel.Attributes = a.Attributes
 		}
-		data = append(data, fileData)
+		slothFileData.Annotations[i] = slothLabel
 	}
 
-	return data, nil
+	return slothFileData
 }
 
 // ToSloth converts the intermediate representation to Sloth format.
 func ToSloth(data []AnnotatedFile) []SlothAnnotatedFile {
+	return ToSlothWithOptions(data, SlothOptions{})
+}
+
+// ToSlothWithOptions converts the intermediate representation to Sloth format as configured by
+// opts.
+func ToSlothWithOptions(data []AnnotatedFile, opts SlothOptions) []SlothAnnotatedFile {
 	slothData := make([]SlothAnnotatedFile, 0, len(data))
 	for _, fileData := range data {
-		slothFileData := SlothAnnotatedFile{
-			Annotations: make([]SlothAnnotation, len(fileData.Annotations)),
-			Class:       "image",
-			FilePath:    fileData.FilePath,
-		}
-		for i, a := range fileData.Annotations {
-			slothLabel := SlothAnnotation{
-				Class:  a.Label,
-				Type:   "rect",
-				X:      a.Coords[0],
-				Y:      a.Coords[1],
-				Width:  a.Coords[2] - a.Coords[0],
-				Height: a.Coords[3] - a.Coords[1],
-			}
-			slothFileData.Annotations[i] = slothLabel
-		}
-		slothData = append(slothData, slothFileData)
+		slothData = append(slothData, toSlothFile(fileData, opts))
 	}
 
 	return slothData
@@ -92,8 +224,119 @@ func WriteSloth(outFile string, data []SlothAnnotatedFile) error {
 	if err != nil {
 		return err
 	}
-	if err := ioutil.WriteFile(outFile, enc, 0644); err != nil {
+	if err := writeFileAtomic(outFile, enc); err != nil {
 		return fmt.Errorf("cannot write file %q: %v", outFile, err)
 	}
 	return nil
 }
+
+// slothSink is a Sink that writes a Sloth file incrementally.
+type slothSink struct {
+	file *atomicFile
+	w    *bufio.Writer
+	opts SlothOptions
+	n    int // The number of elements written.
+}
+
+// NewSlothSink returns a Sink that writes Sloth annotations to outFile. The output is identical to
+// that of WriteSloth.
+func NewSlothSink(outFile string) (Sink, error) {
+	return NewSlothSinkWithOptions(outFile, SlothOptions{})
+}
+
+// NewSlothSinkWithOptions returns a Sink that writes Sloth annotations configured by opts to
+// outFile.
+func NewSlothSinkWithOptions(outFile string, opts SlothOptions) (Sink, error) {
+	file, err := createAtomicFile(outFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot write file %q: %v", outFile, err)
+	}
+	return &slothSink{file: file, w: bufio.NewWriter(file), opts: opts}, nil
+}
+
+// Write implements Sink.
+func (s *slothSink) Write(f AnnotatedFile) error {
+	enc, err := json.MarshalIndent(toSlothFile(f, s.opts), "  ", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write the opening bracket of the JSON array or the separator from the previous element.
+	sep := ",\n  "
+	if s.n == 0 {
+		sep = "[\n  "
+	}
+	if _, err := s.w.WriteString(sep); err != nil {
+		return err
+	}
+	if _, err := s.w.Write(enc); err != nil {
+		return err
+	}
+	s.n++
+
+	return nil
+}
+
+// Close implements Sink.
+func (s *slothSink) Close() (err error) {
+	defer s.file.commit(&err)
+
+	end := "\n]"
+	if s.n == 0 {
+		end = "[]"
+	}
+	if _, err := s.w.WriteString(end); err != nil {
+		return err
+	}
+
+	return s.w.Flush()
+}
+
+// Abort implements Aborter. It removes the partially written file.
+func (s *slothSink) Abort() error {
+	return s.file.Abort()
+}
+
+// slothFormat implements the Reader and Writer interfaces for the Sloth format.
+type slothFormat struct{}
+
+// Parse implements Reader.
+func (slothFormat) Parse(path string, opts FormatOptions) ([]AnnotatedFile, error) {
+	convert := slothEntryConverter(path, opts.ValidateInput)
+	return readJSONEntries(path, "", convert, opts.StrictDuplicates)
+}
+
+// NewSource implements StreamReader.
+func (slothFormat) NewSource(path string, opts FormatOptions) (Source, error) {
+	return NewSlothSource(path, opts.StrictDuplicates, opts.ValidateInput)
+}
+
+// Write implements Writer.
+func (f slothFormat) Write(outFile string, data AnnotatedFiles, opts FormatOptions) error {
+	return WriteSloth(outFile, ToSlothWithOptions(data, f.options(opts)))
+}
+
+// NewSink implements StreamWriter.
+func (f slothFormat) NewSink(outFile string, opts FormatOptions) (Sink, error) {
+	return NewSlothSinkWithOptions(outFile, f.options(opts))
+}
+
+// options returns the Sloth options of opts, with the rounding of opts unless it is set already.
+func (slothFormat) options(opts FormatOptions) SlothOptions {
+	slothOpts := opts.Sloth
+	if slothOpts.Rounding.Mode == RoundNone {
+		slothOpts.Rounding = opts.Rounding
+	}
+	return slothOpts
+}
+
+func init() {
+	RegisterFormat(Format{
+		Name:        "sloth",
+		Description: "Sloth",
+		Reader:      slothFormat{},
+		Writer:      slothFormat{},
+		ReaderArgs:  "-labels <file>",
+		WriterArgs:  "-labels-out <file>",
+	})
+}
@@ -0,0 +1,116 @@
+package lblconv
+
+// Verification that the classes of a dataset appear in each of its splits.
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SplitCoverage counts the annotations by label in each split of a dataset, to verify that every
+// class appears in every split, or at least in the training split. A class that is missing from
+// the validation split otherwise only surfaces at training time. It is safe for concurrent use.
+type SplitCoverage struct {
+	mu      sync.Mutex
+	splits  []string                  // The split names, in order.
+	byLabel map[string]map[string]int // The number of annotations by label, by split.
+}
+
+// MissingClass is a class that is missing from a split.
+type MissingClass struct {
+	Label string
+	Split string
+	Total int // The number of annotations of the class in all splits.
+}
+
+// NewSplitCoverage returns an empty SplitCoverage for the splits with the given names.
+func NewSplitCoverage(splits []string) *SplitCoverage {
+	c := &SplitCoverage{
+		splits:  splits,
+		byLabel: make(map[string]map[string]int, len(splits)),
+	}
+	for _, split := range splits {
+		c.byLabel[split] = make(map[string]int)
+	}
+	return c
+}
+
+// Add counts the annotations of f, a file of the split with the given name.
+func (c *SplitCoverage) Add(split string, f AnnotatedFile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	counts, ok := c.byLabel[split]
+	if !ok {
+		counts = make(map[string]int)
+		c.byLabel[split] = counts
+		c.splits = append(c.splits, split)
+	}
+	for _, a := range f.Annotations {
+		counts[a.Label]++
+	}
+}
+
+// TrainingSplit returns the name of the training split: the first split named train or training
+// (in any case), or the first split if none is. Returns "" if there are no splits.
+func (c *SplitCoverage) TrainingSplit() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, split := range c.splits {
+		if mlUses[strings.ToLower(split)] == "training" {
+			return split
+		}
+	}
+	if len(c.splits) == 0 {
+		return ""
+	}
+	return c.splits[0]
+}
+
+// Missing returns the classes, i.e. the labels of all splits, that are missing from the splits
+// with the given names, or from any split if no names are given. They are sorted by the order of
+// the splits, then by label.
+func (c *SplitCoverage) Missing(splits ...string) []MissingClass {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(splits) == 0 {
+		splits = c.splits
+	}
+	totals := make(map[string]int)
+	for _, counts := range c.byLabel {
+		for label, n := range counts {
+			totals[label] += n
+		}
+	}
+	labels := make([]string, 0, len(totals))
+	for label := range totals {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	var missing []MissingClass
+	for _, split := range splits {
+		for _, label := range labels {
+			if c.byLabel[split][label] == 0 {
+				missing = append(missing, MissingClass{
+					Label: label,
+					Split: split,
+					Total: totals[label],
+				})
+			}
+		}
+	}
+	return missing
+}
+
+// SplitCoverageStage returns a Stage that adds each file to c as a file of the split with the
+// given name. Like DatasetCardStage, apply it to the files that the sink of the split accepts.
+func SplitCoverageStage(c *SplitCoverage, split string) Stage {
+	return func(f AnnotatedFile) ([]AnnotatedFile, error) {
+		c.Add(split, f)
+		return []AnnotatedFile{f}, nil
+	}
+}
@@ -0,0 +1,274 @@
+package lblconv
+
+// SQL script output for SQLite databases.
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SQLOptions configures the SQL output.
+type SQLOptions struct {
+	EmbedImages bool // Whether to store the image files in the data column of the images table.
+}
+
+// sqlSchema creates the tables of the SQL output. Attributes with a NULL annotation_id belong to
+// the image. Polygons are stored as JSON arrays of [x, y] vertices.
+const sqlSchema = `PRAGMA foreign_keys = ON;
+BEGIN TRANSACTION;
+CREATE TABLE images (
+  id INTEGER PRIMARY KEY,
+  path TEXT NOT NULL,
+  width INTEGER,
+  height INTEGER,
+  sha256 TEXT,
+  data BLOB
+);
+CREATE TABLE annotations (
+  id INTEGER PRIMARY KEY,
+  image_id INTEGER NOT NULL REFERENCES images(id),
+  uid TEXT,
+  label TEXT NOT NULL,
+  x_min REAL,
+  y_min REAL,
+  x_max REAL,
+  y_max REAL,
+  polygon TEXT
+);
+CREATE TABLE attributes (
+  image_id INTEGER NOT NULL REFERENCES images(id),
+  annotation_id INTEGER REFERENCES annotations(id),
+  name TEXT NOT NULL,
+  value
+);
+`
+
+// sqlIndexes are created after the data is inserted, which is faster than updating them per row.
+const sqlIndexes = `CREATE INDEX images_path ON images(path);
+CREATE INDEX annotations_image_id ON annotations(image_id);
+CREATE INDEX annotations_label ON annotations(label);
+CREATE INDEX attributes_image_id ON attributes(image_id);
+CREATE INDEX attributes_annotation_id ON attributes(annotation_id);
+CREATE INDEX attributes_name ON attributes(name);
+COMMIT;
+`
+
+// sqlSink is a Sink that writes a SQL script incrementally.
+type sqlSink struct {
+	file *atomicFile
+	w    *bufio.Writer
+	opts SQLOptions
+
+	numImages      int // The number of images written, i.e. the last image ID.
+	numAnnotations int // The number of annotations written, i.e. the last annotation ID.
+}
+
+// WriteSQL writes the annotations as a SQL script to outFile, see NewSQLSink.
+func WriteSQL(outFile string, data []AnnotatedFile, opts SQLOptions) (err error) {
+	s, err := NewSQLSinkWithOptions(outFile, opts)
+	if err != nil {
+		return err
+	}
+	defer closeWithErrCheck(s, &err)
+
+	for _, f := range data {
+		if err := s.Write(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewSQLSink returns a Sink that writes the annotations as a SQL script to outFile, which creates
+// the tables images, annotations and attributes (of images and annotations) when it is executed by
+// SQLite, e.g. with "sqlite3 dataset.db < outFile". The database can then be queried with SQL, e.g.
+// "SELECT label, COUNT(*) FROM annotations GROUP BY label".
+func NewSQLSink(outFile string) (Sink, error) {
+	return NewSQLSinkWithOptions(outFile, SQLOptions{})
+}
+
+// NewSQLSinkWithOptions works like NewSQLSink, with the output configured by opts.
+func NewSQLSinkWithOptions(outFile string, opts SQLOptions) (Sink, error) {
+	file, err := createAtomicFile(outFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot write file %q: %v", outFile, err)
+	}
+	s := &sqlSink{file: file, w: bufio.NewWriter(file), opts: opts}
+	if _, err := s.w.WriteString(sqlSchema); err != nil {
+		_ = s.Abort()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Write implements Sink.
+func (s *sqlSink) Write(f AnnotatedFile) error {
+	s.numImages++
+	imageID := s.numImages
+
+	data := "NULL"
+	if s.opts.EmbedImages {
+		if imgData, err := readImage(f.FilePath); err != nil {
+			log.Printf("Omitting the image data: %v", err)
+		} else {
+			data = "X'" + hex.EncodeToString(imgData) + "'"
+		}
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "INSERT INTO images VALUES (%d, %s, %s, %s, %s, %s);\n", imageID,
+		sqlString(f.FilePath), sqlOptionalInt(f.ImageWidth), sqlOptionalInt(f.ImageHeight),
+		sqlOptionalString(f.ImageSHA256), data)
+	writeSQLAttributes(&b, imageID, "NULL", f.Attributes)
+
+	for _, a := range f.Annotations {
+		s.numAnnotations++
+		annotationID := strconv.Itoa(s.numAnnotations)
+
+		polygon := "NULL"
+		if len(a.Polygon) > 0 {
+			enc, err := json.Marshal(a.Polygon)
+			if err != nil {
+				return err
+			}
+			polygon = sqlString(string(enc))
+		}
+		fmt.Fprintf(&b, "INSERT INTO annotations VALUES (%s, %d, %s, %s, %s, %s, %s, %s, %s);\n",
+			annotationID, imageID, sqlOptionalString(a.ID), sqlString(a.Label),
+			sqlFloat(a.Coords[0]), sqlFloat(a.Coords[1]), sqlFloat(a.Coords[2]),
+			sqlFloat(a.Coords[3]), polygon)
+		writeSQLAttributes(&b, imageID, annotationID, a.Attributes)
+	}
+
+	_, err := s.w.WriteString(b.String())
+	return err
+}
+
+// writeSQLAttributes writes the statements that insert attrs, sorted by name, into the attributes
+// table.
+func writeSQLAttributes(b *strings.Builder, imageID int, annotationID string,
+		attrs map[string]interface{}) {
+
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(b, "INSERT INTO attributes VALUES (%d, %s, %s, %s);\n", imageID, annotationID,
+			sqlString(name), sqlValue(attrs[name]))
+	}
+}
+
+// sqlValue returns the SQL literal for the attribute value v. Numbers and booleans are stored as
+// numeric values, strings as text and other values as JSON text.
+func sqlValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return sqlString(v)
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float32:
+		return sqlFloat(float64(v))
+	case float64:
+		return sqlFloat(v)
+	}
+
+	enc, err := json.Marshal(v)
+	if err != nil {
+		return sqlString(fmt.Sprint(v))
+	}
+	return sqlString(string(enc))
+}
+
+// sqlString returns the SQL string literal for s.
+func sqlString(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// sqlOptionalString returns the SQL string literal for s, or NULL if s is empty.
+func sqlOptionalString(s string) string {
+	if s == "" {
+		return "NULL"
+	}
+	return sqlString(s)
+}
+
+// sqlOptionalInt returns the SQL literal for i, or NULL if i is zero, i.e. unknown.
+func sqlOptionalInt(i int) string {
+	if i == 0 {
+		return "NULL"
+	}
+	return strconv.Itoa(i)
+}
+
+// sqlFloat returns the SQL literal for f, which always has a decimal point or exponent, so that
+// SQLite stores it as REAL. NaN is stored as NULL.
+func sqlFloat(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "NULL"
+	case math.IsInf(f, 1):
+		return "9e999"
+	case math.IsInf(f, -1):
+		return "-9e999"
+	}
+
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s
+}
+
+// Close implements Sink.
+func (s *sqlSink) Close() (err error) {
+	defer s.file.commit(&err)
+
+	if _, err := s.w.WriteString(sqlIndexes); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+// Abort implements Aborter. It removes the partially written file.
+func (s *sqlSink) Abort() error {
+	return s.file.Abort()
+}
+
+// sqlFormat implements the Writer interface for SQL scripts.
+type sqlFormat struct{}
+
+// Write implements Writer.
+func (sqlFormat) Write(outFile string, data AnnotatedFiles, opts FormatOptions) error {
+	return WriteSQL(outFile, data, opts.SQL)
+}
+
+// NewSink implements StreamWriter.
+func (sqlFormat) NewSink(outFile string, opts FormatOptions) (Sink, error) {
+	return NewSQLSinkWithOptions(outFile, opts.SQL)
+}
+
+func init() {
+	RegisterFormat(Format{
+		Name:        "sql",
+		Description: "SQL script that creates a SQLite database (images, annotations, attributes)",
+		Writer:      sqlFormat{},
+		WriterArgs:  "-labels-out <file> [-sql-embed-images]",
+	})
+}
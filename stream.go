@@ -0,0 +1,606 @@
+package lblconv
+
+// Streaming conversion pipeline.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Source is a stream of annotated files, e.g. parsed incrementally from an input dataset.
+type Source interface {
+	// Next returns the next AnnotatedFile. It returns io.EOF when the stream is exhausted.
+	//
+	// A ParseError indicates that a single file could not be parsed. Next can be called again to
+	// skip that file. Other errors are fatal.
+	Next() (AnnotatedFile, error)
+
+	// Close releases the resources held by the Source. It can be called before the stream is
+	// exhausted.
+	Close() error
+}
+
+// Sink consumes a stream of annotated files, e.g. to serialise them to an output dataset.
+type Sink interface {
+	// Write adds the AnnotatedFile to the output. It returns ErrFileSkipped if it logged and left
+	// out the file because of an error that does not affect the other files.
+	Write(f AnnotatedFile) error
+
+	// Close finalises the output. The output is incomplete until Close returns without error.
+	Close() error
+}
+
+// Aborter is implemented by Sinks that can discard their partial output, e.g. when a conversion
+// fails or is cancelled. Abort is called instead of Close.
+type Aborter interface {
+	Abort() error
+}
+
+// AbortSink discards the partial output of sink if it implements Aborter. Otherwise it closes sink.
+func AbortSink(sink Sink) error {
+	if a, ok := sink.(Aborter); ok {
+		return a.Abort()
+	}
+	return sink.Close()
+}
+
+// writeFiles writes data to sink, leaving out the files that sink skips (see ErrFileSkipped), e.g.
+// to implement Writer with a Sink.
+func writeFiles(sink Sink, data AnnotatedFiles) error {
+	for _, f := range data {
+		if err := sink.Write(f); err != nil && err != ErrFileSkipped {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stage is a per-file processing step of a streaming conversion. It returns the files that are
+// passed on to the next stage, which can be none (to drop the file) or several (e.g. object crops).
+//
+// Stages may be invoked concurrently for different files.
+type Stage func(f AnnotatedFile) ([]AnnotatedFile, error)
+
+// ErrFileSkipped is returned by a Stage or Sink for a file that it logged and left out of the
+// output because of an error, e.g. because its image cannot be decoded, without failing the
+// conversion. Stream counts such files instead of failing.
+var ErrFileSkipped = errors.New("the file was skipped")
+
+// StreamStats are the counts of a conversion by Stream.
+type StreamStats struct {
+	Written int // The number of files written to the sink.
+
+	// The number of files that were logged and left out of the output because of errors, i.e.
+	// that the source failed to parse or for which a stage or the sink returned ErrFileSkipped. A
+	// non-zero count means that the conversion only succeeded partially.
+	Skipped int
+}
+
+// Stream reads all files from src, passes each through the stages in order, and writes the results
+// to sink. Both src and sink are closed before Stream returns, unless the conversion fails, in
+// which case sink is aborted (see AbortSink). Files that src fails to parse are logged and skipped,
+// as are the files for which a stage or sink returns ErrFileSkipped.
+//
+// The stages are applied to multiple files concurrently, but the results are written to sink in the
+// order in which they are read from src. Only a bounded number of files are held in memory at any
+// time.
+//
+// Returns the number of files written to sink and skipped.
+func Stream(src Source, sink Sink, stages ...Stage) (StreamStats, error) {
+	return StreamContext(context.Background(), src, sink, stages...)
+}
+
+// StreamContext works like Stream, but stops the conversion when ctx is done, in which case it
+// returns ctx.Err(). Stages that are already executing run to completion.
+func StreamContext(ctx context.Context, src Source, sink Sink, stages ...Stage) (
+		stats StreamStats, err error) {
+
+	defer func() {
+		if err == nil {
+			err = sink.Close()
+		} else if abortErr := AbortSink(sink); abortErr != nil {
+			log.Print("Failed to discard the partial output: ", abortErr)
+		}
+	}()
+	defer closeWithErrCheck(src, &err)
+
+	// Applies all stages to a single file.
+	process := func(f AnnotatedFile) fileResult {
+		files := []AnnotatedFile{f}
+		for _, stage := range stages {
+			var next []AnnotatedFile
+			for _, f := range files {
+				out, err := stage(f)
+				if err != nil {
+					return fileResult{err: err}
+				}
+				next = append(next, out...)
+			}
+			files = next
+		}
+		return fileResult{files: files}
+	}
+
+	// Feed the files from src to the pool of workers. The source is only closed after the feeding
+	// goroutine has returned, as Sources need not be safe for concurrent use.
+	pool := newOrderedPool(numWorkers())
+	srcErr := make(chan error, 1)
+	fed := make(chan struct{})
+	defer func() {
+		pool.stop()
+		<-fed
+	}()
+	go func() {
+		defer close(fed)
+		defer pool.closeInput()
+		for ctx.Err() == nil {
+			f, err := src.Next()
+			if err != nil {
+				if isSkippable(err) {
+					log.Print("Skipping file: ", err)
+					// Count the file in order with the others.
+					if !pool.submit(func() fileResult { return fileResult{err: ErrFileSkipped} }) {
+						return
+					}
+					continue
+				}
+				if err != io.EOF {
+					srcErr <- err
+				}
+				return
+			}
+			if !pool.submit(func() fileResult { return process(f) }) {
+				return
+			}
+		}
+	}()
+
+	// Stop the pool when the context is done.
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			pool.stop()
+		case <-finished:
+		}
+	}()
+
+	// Write the results in order.
+	for {
+		r, ok := pool.next()
+		if !ok {
+			break
+		}
+		if r.err == ErrFileSkipped {
+			stats.Skipped++
+			continue
+		} else if r.err != nil {
+			return stats, r.err
+		}
+		for _, f := range r.files {
+			if err := sink.Write(f); err == ErrFileSkipped {
+				stats.Skipped++
+				continue
+			} else if err != nil {
+				return stats, err
+			}
+			stats.Written++
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return stats, err
+	}
+	select {
+	case err := <-srcErr:
+		return stats, err
+	default:
+	}
+
+	return stats, nil
+}
+
+// ReadAll reads all files from src and closes it. Files that src fails to parse are logged and
+// skipped, but unlike with Stream, they are not counted.
+func ReadAll(src Source) ([]AnnotatedFile, error) {
+	return ReadAllContext(context.Background(), src)
+}
+
+// ReadAllContext works like ReadAll, but stops reading when ctx is done, in which case it returns
+// ctx.Err().
+func ReadAllContext(ctx context.Context, src Source) (data []AnnotatedFile, err error) {
+	defer closeWithErrCheck(src, &err)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		f, err := src.Next()
+		if err == io.EOF {
+			return data, nil
+		} else if isSkippable(err) {
+			log.Print("Skipping file: ", err)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		data = append(data, f)
+	}
+}
+
+// sliceSource is a Source for in-memory data.
+type sliceSource struct {
+	data []AnnotatedFile
+}
+
+// NewSliceSource returns a Source that streams the elements of data.
+func NewSliceSource(data []AnnotatedFile) Source {
+	return &sliceSource{data: data}
+}
+
+// Next implements Source.
+func (s *sliceSource) Next() (AnnotatedFile, error) {
+	if len(s.data) == 0 {
+		return AnnotatedFile{}, io.EOF
+	}
+	f := s.data[0]
+	s.data = s.data[1:]
+	return f, nil
+}
+
+// Close implements Source.
+func (s *sliceSource) Close() error {
+	s.data = nil
+	return nil
+}
+
+// splitSink randomly distributes files to multiple sinks.
+type splitSink struct {
+	cumulativeSplits []int
+	sinks            []Sink
+	rng              *rand.Rand
+}
+
+// NewSplitSink returns a Sink that randomly splits the data into multiple datasets, like
+// AnnotatedFiles.Split, writing each dataset to the corresponding element of sinks.
+//
+// The cumulativeSplits specify the cumulative distribution according to which the data is split.
+// Its values must add up to 100!
+func NewSplitSink(cumulativeSplits []int, sinks []Sink) (Sink, error) {
+	if len(cumulativeSplits) != len(sinks) {
+		return nil, fmt.Errorf("the number of splits and sinks do not match")
+	}
+	if len(cumulativeSplits) == 0 || cumulativeSplits[len(cumulativeSplits)-1] != 100 {
+		return nil, fmt.Errorf("the split percentages do not add up to 100")
+	}
+
+	return &splitSink{
+		cumulativeSplits: cumulativeSplits,
+		sinks:            sinks,
+		rng:              rand.New(rand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+// Write implements Sink.
+func (s *splitSink) Write(f AnnotatedFile) error {
+	r := s.rng.Intn(100)
+	for i, split := range s.cumulativeSplits {
+		if r < split {
+			return s.sinks[i].Write(f)
+		}
+	}
+	return nil
+}
+
+// Close implements Sink. It closes all sinks, returning the first error encountered.
+func (s *splitSink) Close() (err error) {
+	for _, sink := range s.sinks {
+		closeWithErrCheck(sink, &err)
+	}
+	return err
+}
+
+// Abort implements Aborter. It aborts all sinks, returning the first error encountered.
+func (s *splitSink) Abort() (err error) {
+	for _, sink := range s.sinks {
+		if abortErr := AbortSink(sink); abortErr != nil && err == nil {
+			err = abortErr
+		}
+	}
+	return err
+}
+
+// stageSink applies stages to the files before writing them to a sink.
+type stageSink struct {
+	sink   Sink
+	stages []Stage
+}
+
+// NewStageSink returns a Sink that passes each file through the stages in order and writes the
+// results to sink, e.g. to process the images of each split dataset differently. Unlike the stages
+// passed to Stream, the stages are applied sequentially.
+func NewStageSink(sink Sink, stages ...Stage) Sink {
+	return &stageSink{sink: sink, stages: stages}
+}
+
+// Write implements Sink. If sink skips any of the resulting files, the others are still written
+// and ErrFileSkipped is returned.
+func (s *stageSink) Write(f AnnotatedFile) error {
+	files, err := applyStages(f, s.stages)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if writeErr := s.sink.Write(f); writeErr == ErrFileSkipped {
+			err = writeErr
+		} else if writeErr != nil {
+			return writeErr
+		}
+	}
+	return err
+}
+
+// Close implements Sink.
+func (s *stageSink) Close() error {
+	return s.sink.Close()
+}
+
+// Abort implements Aborter.
+func (s *stageSink) Abort() error {
+	return AbortSink(s.sink)
+}
+
+// Unwrap returns the Sink that the files are written to.
+func (s *stageSink) Unwrap() Sink {
+	return s.sink
+}
+
+// ErrFileDropped is returned by ConvertFile if a stage drops the file, e.g. a filter.
+var ErrFileDropped = errors.New("the file was dropped")
+
+// ConvertFile passes a copy of the single file in through the stages in order and returns the
+// result, e.g. to convert the labels of one image at a time in a service without building a
+// Source and Sink. in is not modified. Returns ErrFileDropped if a stage drops the file, and an
+// error if a stage produces multiple files, e.g. object crops, for which ConvertFileAll can be
+// used instead.
+func ConvertFile(in AnnotatedFile, stages ...Stage) (AnnotatedFile, error) {
+	out, err := ConvertFileAll(in, stages...)
+	if err != nil {
+		return AnnotatedFile{}, err
+	}
+	switch len(out) {
+	case 0:
+		return AnnotatedFile{}, ErrFileDropped
+	case 1:
+		return out[0], nil
+	}
+	return AnnotatedFile{}, fmt.Errorf("the stages produced %d files from %q", len(out), in.FilePath)
+}
+
+// ConvertFileAll works like ConvertFile, but returns all files that the stages produce, which may
+// be none.
+func ConvertFileAll(in AnnotatedFile, stages ...Stage) ([]AnnotatedFile, error) {
+	return applyStages(in.Clone(), stages)
+}
+
+// applyStages passes f through the stages in order and returns the resulting files.
+func applyStages(f AnnotatedFile, stages []Stage) ([]AnnotatedFile, error) {
+	files := []AnnotatedFile{f}
+	for _, stage := range stages {
+		var next []AnnotatedFile
+		for _, f := range files {
+			out, err := stage(f)
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, out...)
+		}
+		files = next
+	}
+	return files, nil
+}
+
+// Hook inspects and optionally modifies a single AnnotatedFile in place, e.g. to add custom
+// attributes or to collect metrics. It returns false to drop the file from the output.
+//
+// Like Stages, hooks may be invoked concurrently for different files.
+type Hook func(f *AnnotatedFile) (keep bool, err error)
+
+// HookStage returns a Stage that applies hook to each file.
+func HookStage(hook Hook) Stage {
+	return func(f AnnotatedFile) ([]AnnotatedFile, error) {
+		keep, err := hook(&f)
+		if err != nil || !keep {
+			return nil, err
+		}
+		return []AnnotatedFile{f}, nil
+	}
+}
+
+// LabelMappingStats counts the labels changed by MapLabelsStage. It is safe for concurrent use.
+type LabelMappingStats struct {
+	mu      sync.Mutex
+	changed int
+}
+
+// NewLabelMappingStats returns an empty LabelMappingStats.
+func NewLabelMappingStats() *LabelMappingStats {
+	return &LabelMappingStats{}
+}
+
+// Changed returns the number of labels changed.
+func (s *LabelMappingStats) Changed() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.changed
+}
+
+// MapLabelsStage returns a Stage that applies AnnotatedFiles.MapLabels to each file. The number of
+// labels changed is added to stats, unless it is nil.
+func MapLabelsStage(mappings []string, stats *LabelMappingStats) (Stage, error) {
+	replacements, err := parseLabelMappings(mappings)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(f AnnotatedFile) ([]AnnotatedFile, error) {
+		changed := f.mapLabels(replacements)
+		if stats != nil && changed > 0 {
+			stats.mu.Lock()
+			stats.changed += changed
+			stats.mu.Unlock()
+		}
+		return []AnnotatedFile{f}, nil
+	}, nil
+}
+
+// TransformBboxesStage returns a Stage that applies AnnotatedFiles.TransformBboxes to each file.
+func TransformBboxesStage(scaleX, scaleY, aspectRatio float64) Stage {
+	return func(f AnnotatedFile) ([]AnnotatedFile, error) {
+		f.transformBboxes(scaleX, scaleY, aspectRatio)
+		return []AnnotatedFile{f}, nil
+	}
+}
+
+// BboxRepairStats accumulates the bounding box repairs of SanitizeBboxesStage by label. It is
+// safe for concurrent use.
+type BboxRepairStats struct {
+	mu      sync.Mutex
+	byLabel map[string]BboxRepairs
+}
+
+// NewBboxRepairStats returns an empty BboxRepairStats.
+func NewBboxRepairStats() *BboxRepairStats {
+	return &BboxRepairStats{byLabel: make(map[string]BboxRepairs)}
+}
+
+// ByLabel returns a copy of the repairs by label.
+func (s *BboxRepairStats) ByLabel() map[string]BboxRepairs {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	byLabel := make(map[string]BboxRepairs, len(s.byLabel))
+	for label, r := range s.byLabel {
+		byLabel[label] = r
+	}
+	return byLabel
+}
+
+// SanitizeBboxesStage returns a Stage that applies AnnotatedFiles.SanitizeBboxes to each file.
+// The repairs are added to stats, unless it is nil.
+func SanitizeBboxesStage(stats *BboxRepairStats) Stage {
+	return func(f AnnotatedFile) ([]AnnotatedFile, error) {
+		repairs := f.sanitizeBboxes()
+		if stats != nil && len(repairs) > 0 {
+			stats.mu.Lock()
+			for label, r := range repairs {
+				total := stats.byLabel[label]
+				total.add(r)
+				stats.byLabel[label] = total
+			}
+			stats.mu.Unlock()
+		}
+		return []AnnotatedFile{f}, nil
+	}
+}
+
+// AnnotationIDStage returns a Stage that applies AnnotatedFiles.AssignAnnotationIDs to each file.
+func AnnotationIDStage() Stage {
+	return func(f AnnotatedFile) ([]AnnotatedFile, error) {
+		f.assignAnnotationIDs()
+		return []AnnotatedFile{f}, nil
+	}
+}
+
+// SortAnnotationsStage returns a Stage that sorts the annotations of each file like
+// AnnotatedFiles.Sort. The files themselves can only be sorted once the whole dataset is read.
+func SortAnnotationsStage() Stage {
+	return func(f AnnotatedFile) ([]AnnotatedFile, error) {
+		f.sortAnnotations()
+		return []AnnotatedFile{f}, nil
+	}
+}
+
+// ImageChecksumStage returns a Stage that sets the ImageSHA256 of each file from its image file. A
+// mismatch with a previously recorded checksum is logged. Files whose image cannot be read are
+// logged and passed on without a checksum.
+func ImageChecksumStage() Stage {
+	return func(f AnnotatedFile) ([]AnnotatedFile, error) {
+		sum, err := imageSHA256(f.FilePath)
+		if err != nil {
+			log.Printf("Failed to compute the checksum of %q: %v", f.FilePath, err)
+			f.ImageSHA256 = ""
+			return []AnnotatedFile{f}, nil
+		}
+		if f.ImageSHA256 != "" && f.ImageSHA256 != sum {
+			log.Printf("The image %q does not match its recorded checksum", f.FilePath)
+		}
+		f.ImageSHA256 = sum
+		return []AnnotatedFile{f}, nil
+	}
+}
+
+// FilterStats counts the annotations and files removed by FilterStage. It is safe for concurrent
+// use.
+type FilterStats struct {
+	mu     sync.Mutex
+	labels int // The number of annotations filtered out.
+	files  int // The number of files filtered out.
+}
+
+// NewFilterStats returns an empty FilterStats.
+func NewFilterStats() *FilterStats {
+	return &FilterStats{}
+}
+
+// Removed returns the number of annotations and files filtered out.
+func (s *FilterStats) Removed() (labels, files int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.labels, s.files
+}
+
+// FilterStage returns a Stage that applies AnnotatedFiles.FilterWithOptions to each file. The
+// annotations and files filtered out are added to stats, unless it is nil.
+func FilterStage(opts FilterOptions, stats *FilterStats) Stage {
+	return func(f AnnotatedFile) ([]AnnotatedFile, error) {
+		numLabels := len(f.Annotations)
+		keep := opts.apply(&f)
+		if stats != nil {
+			stats.mu.Lock()
+			stats.labels += numLabels - len(f.Annotations)
+			if !keep {
+				stats.files++
+			}
+			stats.mu.Unlock()
+		}
+		if !keep {
+			return nil, nil
+		}
+		return []AnnotatedFile{f}, nil
+	}
+}
+
+// ProcessImagesStage returns a Stage that applies AnnotatedFiles.ProcessImagesWithOptions to each
+// file. Unlike ProcessImagesWithOptions, an image processing error aborts the stream, unless it is
+// an image error that opts.SkipInvalidImages skips or opts.Quarantine quarantines.
+//
+// Returns a nil Stage if the options do not require any image processing.
+func ProcessImagesStage(opts ImageProcessingOptions) (Stage, error) {
+	p, err := newImageProcessor(opts)
+	if err != nil || p == nil {
+		return nil, err
+	}
+	log.Print("Processing images")
+
+	return p.processOrSkip, nil
+}
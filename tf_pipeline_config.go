@@ -0,0 +1,671 @@
+package lblconv
+
+// TensorFlow Object Detection API pipeline configs, to train a model on TFRecord output without
+// editing the config of a base model by hand.
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// TFPipelineModel is a base model of the TensorFlow 2 Detection Model Zoo that
+// WriteTFPipelineConfig can write a config for.
+type TFPipelineModel struct {
+	Name        string // The name of the model, e.g. as used on the command line.
+	Description string // The model zoo name of the model.
+
+	// The default input resolution and training batch size of the model.
+	InputWidth, InputHeight int
+	BatchSize               int
+
+	template *template.Template // The config, see tfPipelineConfigParams.
+}
+
+// tfPipelineConfigParams are the parameters of the config templates of the TFPipelineModels.
+type tfPipelineConfigParams struct {
+	NumClasses int
+
+	// The input resolution, and its shorter and longer sides for resizers that keep the aspect
+	// ratio.
+	InputWidth, InputHeight int
+	MinDimension            int
+	MaxDimension            int
+
+	BatchSize int
+
+	FineTuneCheckpoint string // Quoted.
+	LabelMapPath       string // Quoted.
+	TrainInputPaths    []string
+	EvalInputPaths     []string
+}
+
+// tfPipelinePlaceholder is the value of the paths that are not known, as in the configs of the
+// model zoo.
+const tfPipelinePlaceholder = "PATH_TO_BE_CONFIGURED"
+
+// tfPipelineInputConfigs is the part of the config templates that configures the inputs, which is
+// the same for all models.
+const tfPipelineInputConfigs = `
+train_input_reader {
+  label_map_path: {{.LabelMapPath}}
+  tf_record_input_reader {
+{{- range .TrainInputPaths}}
+    input_path: {{.}}
+{{- end}}
+  }
+}
+eval_config {
+  metrics_set: "coco_detection_metrics"
+  use_moving_averages: false
+}
+eval_input_reader {
+  label_map_path: {{.LabelMapPath}}
+  shuffle: false
+  num_epochs: 1
+  tf_record_input_reader {
+{{- range .EvalInputPaths}}
+    input_path: {{.}}
+{{- end}}
+  }
+}
+`
+
+// tfPipelineModels are the supported base models by name. The configs follow those of the model
+// zoo, without the TPU specific settings.
+var tfPipelineModels = map[string]*TFPipelineModel{
+	"ssd-mobilenet-v2-fpnlite": {
+		Description: "SSD MobileNet V2 FPNLite 320x320",
+		InputWidth:  320,
+		InputHeight: 320,
+		BatchSize:   128,
+		template: mustParseTFPipelineTemplate(`model {
+  ssd {
+    num_classes: {{.NumClasses}}
+    image_resizer {
+      fixed_shape_resizer {
+        height: {{.InputHeight}}
+        width: {{.InputWidth}}
+      }
+    }
+    feature_extractor {
+      type: "ssd_mobilenet_v2_fpn_keras"
+      depth_multiplier: 1.0
+      min_depth: 16
+      conv_hyperparams {
+        regularizer {
+          l2_regularizer {
+            weight: 4e-05
+          }
+        }
+        initializer {
+          random_normal_initializer {
+            mean: 0.0
+            stddev: 0.01
+          }
+        }
+        activation: RELU_6
+        batch_norm {
+          decay: 0.997
+          scale: true
+          epsilon: 0.001
+        }
+      }
+      use_depthwise: true
+      override_base_feature_extractor_hyperparams: true
+      fpn {
+        min_level: 3
+        max_level: 7
+        additional_layer_depth: 128
+      }
+    }
+    box_coder {
+      faster_rcnn_box_coder {
+        y_scale: 10.0
+        x_scale: 10.0
+        height_scale: 5.0
+        width_scale: 5.0
+      }
+    }
+    matcher {
+      argmax_matcher {
+        matched_threshold: 0.5
+        unmatched_threshold: 0.5
+        ignore_thresholds: false
+        negatives_lower_than_unmatched: true
+        force_match_for_each_row: true
+        use_matmul_gather: true
+      }
+    }
+    similarity_calculator {
+      iou_similarity {
+      }
+    }
+    box_predictor {
+      weight_shared_convolutional_box_predictor {
+        conv_hyperparams {
+          regularizer {
+            l2_regularizer {
+              weight: 4e-05
+            }
+          }
+          initializer {
+            random_normal_initializer {
+              mean: 0.0
+              stddev: 0.01
+            }
+          }
+          activation: RELU_6
+          batch_norm {
+            decay: 0.997
+            scale: true
+            epsilon: 0.001
+          }
+        }
+        depth: 128
+        num_layers_before_predictor: 4
+        kernel_size: 3
+        class_prediction_bias_init: -4.6
+        share_prediction_tower: true
+        use_depthwise: true
+      }
+    }
+    anchor_generator {
+      multiscale_anchor_generator {
+        min_level: 3
+        max_level: 7
+        anchor_scale: 4.0
+        aspect_ratios: 1.0
+        aspect_ratios: 2.0
+        aspect_ratios: 0.5
+        scales_per_octave: 2
+      }
+    }
+    post_processing {
+      batch_non_max_suppression {
+        score_threshold: 1e-08
+        iou_threshold: 0.6
+        max_detections_per_class: 100
+        max_total_detections: 100
+        use_static_shapes: false
+      }
+      score_converter: SIGMOID
+    }
+    normalize_loss_by_num_matches: true
+    loss {
+      localization_loss {
+        weighted_smooth_l1 {
+        }
+      }
+      classification_loss {
+        weighted_sigmoid_focal {
+          gamma: 2.0
+          alpha: 0.25
+        }
+      }
+      classification_weight: 1.0
+      localization_weight: 1.0
+    }
+    encode_background_as_zeros: true
+    normalize_loc_loss_by_codesize: true
+    inplace_batchnorm_update: true
+    freeze_batchnorm: false
+  }
+}
+train_config {
+  batch_size: {{.BatchSize}}
+  data_augmentation_options {
+    random_horizontal_flip {
+    }
+  }
+  data_augmentation_options {
+    random_crop_image {
+      min_object_covered: 0.0
+      min_aspect_ratio: 0.75
+      max_aspect_ratio: 3.0
+      min_area: 0.75
+      max_area: 1.0
+      overlap_thresh: 0.0
+    }
+  }
+  optimizer {
+    momentum_optimizer {
+      learning_rate {
+        cosine_decay_learning_rate {
+          learning_rate_base: 0.08
+          total_steps: 50000
+          warmup_learning_rate: 0.026666
+          warmup_steps: 1000
+        }
+      }
+      momentum_optimizer_value: 0.9
+    }
+    use_moving_average: false
+  }
+  fine_tune_checkpoint: {{.FineTuneCheckpoint}}
+  num_steps: 50000
+  startup_delay_steps: 0.0
+  max_number_of_boxes: 100
+  unpad_groundtruth_tensors: false
+  fine_tune_checkpoint_type: "detection"
+  fine_tune_checkpoint_version: V2
+}`),
+	},
+
+	"efficientdet-d0": {
+		Description: "EfficientDet D0 512x512",
+		InputWidth:  512,
+		InputHeight: 512,
+		BatchSize:   128,
+		template: mustParseTFPipelineTemplate(`model {
+  ssd {
+    inplace_batchnorm_update: true
+    freeze_batchnorm: false
+    num_classes: {{.NumClasses}}
+    add_background_class: false
+    box_coder {
+      faster_rcnn_box_coder {
+        y_scale: 1.0
+        x_scale: 1.0
+        height_scale: 1.0
+        width_scale: 1.0
+      }
+    }
+    matcher {
+      argmax_matcher {
+        matched_threshold: 0.5
+        unmatched_threshold: 0.5
+        ignore_thresholds: false
+        negatives_lower_than_unmatched: true
+        force_match_for_each_row: true
+        use_matmul_gather: true
+      }
+    }
+    similarity_calculator {
+      iou_similarity {
+      }
+    }
+    encode_background_as_zeros: true
+    anchor_generator {
+      multiscale_anchor_generator {
+        min_level: 3
+        max_level: 7
+        anchor_scale: 4.0
+        aspect_ratios: [1.0, 2.0, 0.5]
+        scales_per_octave: 3
+      }
+    }
+    image_resizer {
+      keep_aspect_ratio_resizer {
+        min_dimension: {{.MinDimension}}
+        max_dimension: {{.MaxDimension}}
+        pad_to_max_dimension: true
+      }
+    }
+    box_predictor {
+      weight_shared_convolutional_box_predictor {
+        depth: 64
+        class_prediction_bias_init: -4.6
+        conv_hyperparams {
+          force_use_bias: true
+          activation: SWISH
+          regularizer {
+            l2_regularizer {
+              weight: 4e-05
+            }
+          }
+          initializer {
+            random_normal_initializer {
+              stddev: 0.01
+              mean: 0.0
+            }
+          }
+          batch_norm {
+            scale: true
+            decay: 0.99
+            epsilon: 0.001
+          }
+        }
+        num_layers_before_predictor: 3
+        kernel_size: 3
+        use_depthwise: true
+      }
+    }
+    feature_extractor {
+      type: "ssd_efficientnet-b0_bifpn_keras"
+      bifpn {
+        min_level: 3
+        max_level: 7
+        num_iterations: 3
+        num_filters: 64
+      }
+      conv_hyperparams {
+        force_use_bias: true
+        activation: SWISH
+        regularizer {
+          l2_regularizer {
+            weight: 4e-05
+          }
+        }
+        initializer {
+          truncated_normal_initializer {
+            stddev: 0.03
+            mean: 0.0
+          }
+        }
+        batch_norm {
+          scale: true
+          decay: 0.99
+          epsilon: 0.001
+        }
+      }
+    }
+    loss {
+      classification_loss {
+        weighted_sigmoid_focal {
+          alpha: 0.25
+          gamma: 1.5
+        }
+      }
+      localization_loss {
+        weighted_smooth_l1 {
+        }
+      }
+      classification_weight: 1.0
+      localization_weight: 1.0
+    }
+    normalize_loss_by_num_matches: true
+    normalize_loc_loss_by_codesize: true
+    post_processing {
+      batch_non_max_suppression {
+        score_threshold: 1e-08
+        iou_threshold: 0.5
+        max_detections_per_class: 100
+        max_total_detections: 100
+      }
+      score_converter: SIGMOID
+    }
+  }
+}
+train_config {
+  fine_tune_checkpoint: {{.FineTuneCheckpoint}}
+  fine_tune_checkpoint_version: V2
+  fine_tune_checkpoint_type: "detection"
+  batch_size: {{.BatchSize}}
+  startup_delay_steps: 0
+  num_steps: 300000
+  data_augmentation_options {
+    random_horizontal_flip {
+    }
+  }
+  data_augmentation_options {
+    random_scale_crop_and_pad_to_square {
+      output_size: {{.MaxDimension}}
+      scale_min: 0.1
+      scale_max: 2.0
+    }
+  }
+  optimizer {
+    momentum_optimizer {
+      learning_rate {
+        cosine_decay_learning_rate {
+          learning_rate_base: 0.08
+          total_steps: 300000
+          warmup_learning_rate: 0.001
+          warmup_steps: 2500
+        }
+      }
+      momentum_optimizer_value: 0.9
+    }
+    use_moving_average: false
+  }
+  max_number_of_boxes: 100
+  unpad_groundtruth_tensors: false
+}`),
+	},
+
+	"faster-rcnn-resnet50": {
+		Description: "Faster R-CNN ResNet50 V1 640x640",
+		InputWidth:  640,
+		InputHeight: 640,
+		BatchSize:   64,
+		template: mustParseTFPipelineTemplate(`model {
+  faster_rcnn {
+    num_classes: {{.NumClasses}}
+    image_resizer {
+      keep_aspect_ratio_resizer {
+        min_dimension: {{.MinDimension}}
+        max_dimension: {{.MaxDimension}}
+        pad_to_max_dimension: true
+      }
+    }
+    feature_extractor {
+      type: "faster_rcnn_resnet50_keras"
+      batch_norm_trainable: true
+    }
+    first_stage_anchor_generator {
+      grid_anchor_generator {
+        scales: [0.25, 0.5, 1.0, 2.0]
+        aspect_ratios: [0.5, 1.0, 2.0]
+        height_stride: 16
+        width_stride: 16
+      }
+    }
+    first_stage_box_predictor_conv_hyperparams {
+      op: CONV
+      regularizer {
+        l2_regularizer {
+          weight: 0.0
+        }
+      }
+      initializer {
+        truncated_normal_initializer {
+          stddev: 0.01
+        }
+      }
+    }
+    first_stage_nms_score_threshold: 0.0
+    first_stage_nms_iou_threshold: 0.7
+    first_stage_max_proposals: 300
+    first_stage_localization_loss_weight: 2.0
+    first_stage_objectness_loss_weight: 1.0
+    initial_crop_size: 14
+    maxpool_kernel_size: 2
+    maxpool_stride: 2
+    second_stage_box_predictor {
+      mask_rcnn_box_predictor {
+        use_dropout: false
+        dropout_keep_probability: 1.0
+        fc_hyperparams {
+          op: FC
+          regularizer {
+            l2_regularizer {
+              weight: 0.0
+            }
+          }
+          initializer {
+            variance_scaling_initializer {
+              factor: 1.0
+              uniform: true
+              mode: FAN_AVG
+            }
+          }
+        }
+        share_box_across_classes: true
+      }
+    }
+    second_stage_post_processing {
+      batch_non_max_suppression {
+        score_threshold: 0.0
+        iou_threshold: 0.6
+        max_detections_per_class: 100
+        max_total_detections: 300
+      }
+      score_converter: SOFTMAX
+    }
+    second_stage_localization_loss_weight: 2.0
+    second_stage_classification_loss_weight: 1.0
+    use_static_shapes: true
+    use_matmul_crop_and_resize: true
+    clip_anchors_to_image: true
+    use_static_balanced_label_sampler: true
+    use_matmul_gather_in_matcher: true
+  }
+}
+train_config {
+  batch_size: {{.BatchSize}}
+  startup_delay_steps: 0
+  num_steps: 25000
+  optimizer {
+    momentum_optimizer {
+      learning_rate {
+        cosine_decay_learning_rate {
+          learning_rate_base: 0.04
+          total_steps: 25000
+          warmup_learning_rate: 0.013333
+          warmup_steps: 2000
+        }
+      }
+      momentum_optimizer_value: 0.9
+    }
+    use_moving_average: false
+  }
+  fine_tune_checkpoint_version: V2
+  fine_tune_checkpoint: {{.FineTuneCheckpoint}}
+  fine_tune_checkpoint_type: "detection"
+  data_augmentation_options {
+    random_horizontal_flip {
+    }
+  }
+  max_number_of_boxes: 100
+  unpad_groundtruth_tensors: false
+}`),
+	},
+}
+
+func init() {
+	for name, m := range tfPipelineModels {
+		m.Name = name
+	}
+}
+
+// mustParseTFPipelineTemplate parses the model config text, followed by tfPipelineInputConfigs,
+// and panics if it is invalid.
+func mustParseTFPipelineTemplate(text string) *template.Template {
+	return template.Must(template.New("pipeline.config").Parse(text + tfPipelineInputConfigs))
+}
+
+// TFPipelineModels returns the supported base models, sorted by name.
+func TFPipelineModels() []TFPipelineModel {
+	models := make([]TFPipelineModel, 0, len(tfPipelineModels))
+	for _, m := range tfPipelineModels {
+		models = append(models, *m)
+	}
+	sort.Slice(models, func(i, j int) bool {
+		return models[i].Name < models[j].Name
+	})
+	return models
+}
+
+// TFPipelineConfigOptions configures the pipeline config written by WriteTFPipelineConfig.
+type TFPipelineConfigOptions struct {
+	Model string // The name of the base model, see TFPipelineModels.
+
+	NumClasses   int    // The number of classes, i.e. labels of the label map.
+	LabelMapPath string // The path to the prototxt label map.
+
+	// The paths or glob patterns of the TFRecord files to train and evaluate the model on, see
+	// TFRecordInputPattern.
+	TrainInputPaths []string
+	EvalInputPaths  []string
+
+	// The input resolution and training batch size, or zero for the defaults of the model.
+	InputWidth, InputHeight int
+	BatchSize               int
+
+	// The path to the checkpoint of the base model to fine-tune, e.g. the "checkpoint/ckpt-0" of
+	// the model zoo archive. A placeholder is written if it is empty.
+	FineTuneCheckpoint string
+}
+
+// TFPipelineConfig returns a TensorFlow Object Detection API pipeline config for the base model
+// opts.Model, configured to train and evaluate on the given TFRecord files. Paths that are empty
+// are written as placeholders.
+func TFPipelineConfig(opts TFPipelineConfigOptions) ([]byte, error) {
+	model, ok := tfPipelineModels[opts.Model]
+	if !ok {
+		return nil, fmt.Errorf("unsupported base model %q", opts.Model)
+	}
+	if opts.NumClasses <= 0 {
+		return nil, fmt.Errorf("invalid number of classes: %d", opts.NumClasses)
+	}
+	if opts.InputWidth < 0 || opts.InputHeight < 0 ||
+			(opts.InputWidth == 0) != (opts.InputHeight == 0) {
+		return nil, fmt.Errorf("invalid input resolution: %dx%d", opts.InputWidth, opts.InputHeight)
+	}
+	if opts.BatchSize < 0 {
+		return nil, fmt.Errorf("invalid batch size: %d", opts.BatchSize)
+	}
+
+	params := tfPipelineConfigParams{
+		NumClasses:         opts.NumClasses,
+		InputWidth:         model.InputWidth,
+		InputHeight:        model.InputHeight,
+		BatchSize:          model.BatchSize,
+		FineTuneCheckpoint: tfPipelineQuote(opts.FineTuneCheckpoint),
+		LabelMapPath:       tfPipelineQuote(opts.LabelMapPath),
+		TrainInputPaths:    tfPipelineQuoteAll(opts.TrainInputPaths),
+		EvalInputPaths:     tfPipelineQuoteAll(opts.EvalInputPaths),
+	}
+	if opts.InputWidth > 0 {
+		params.InputWidth, params.InputHeight = opts.InputWidth, opts.InputHeight
+	}
+	params.MinDimension, params.MaxDimension = params.InputWidth, params.InputHeight
+	if params.MinDimension > params.MaxDimension {
+		params.MinDimension, params.MaxDimension = params.MaxDimension, params.MinDimension
+	}
+	if opts.BatchSize > 0 {
+		params.BatchSize = opts.BatchSize
+	}
+
+	var buf bytes.Buffer
+	if err := model.template.Execute(&buf, params); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// WriteTFPipelineConfig writes the pipeline config of TFPipelineConfig to path.
+func WriteTFPipelineConfig(path string, opts TFPipelineConfigOptions) error {
+	config, err := TFPipelineConfig(opts)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, config)
+}
+
+// tfPipelineQuote returns the prototxt string literal of path, or of the placeholder if path is
+// empty.
+func tfPipelineQuote(path string) string {
+	if path == "" {
+		path = tfPipelinePlaceholder
+	}
+	return `"` + tfPipelineEscaper.Replace(path) + `"`
+}
+
+// tfPipelineEscaper escapes strings for prototxt string literals.
+var tfPipelineEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// tfPipelineQuoteAll returns the tfPipelineQuote of each path, or a placeholder if there are none.
+func tfPipelineQuoteAll(paths []string) []string {
+	if len(paths) == 0 {
+		return []string{tfPipelineQuote("")}
+	}
+	quoted := make([]string, len(paths))
+	for i, path := range paths {
+		quoted[i] = tfPipelineQuote(path)
+	}
+	return quoted
+}
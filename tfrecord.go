@@ -3,15 +3,23 @@ package lblconv
 // TFRecord object detection specific functionality.
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"image"
+	"image/jpeg"
 	"io"
-	"io/ioutil"
 	"log"
-	"math"
-	"os"
+	"math/rand"
+	"sync/atomic"
 
 	"github.com/golang/protobuf/proto"
-	protos "github.com/sensorable/lblconv/protos"
 	"github.com/sensorable/lblconv/third-party/github.com/ryszard/tfutils/go/example"
 	"github.com/sensorable/lblconv/third-party/github.com/ryszard/tfutils/go/tfrecord"
 	tensorflow "github.com/sensorable/lblconv/third-party/github.com/ryszard/tfutils/proto/tensorflow/core/example"
@@ -27,23 +35,74 @@ type TFRecordAnnotatedFile struct {
 	FilePath    string
 }
 
-var (
-	tfRecordLabelMap    map[string]int32 // The active label mappings.
-	tfRecordNextLabelID int32 = 1        // The ID for the next label mapping.
-)
-
 // toTFRecord converts the intermediate representation for a single file to the TFRecord format.
-func toTFRecord(fileData AnnotatedFile) (TFRecordAnnotatedFile, error) {
-	// Get the image width and height.
-	img, format, err := decodeImageConfig(fileData.FilePath)
+// The class IDs are taken from labelMap, which is extended with any new labels. Only the image
+// encoding and attribute feature options of opts apply.
+func toTFRecord(fileData AnnotatedFile, labelMap *TFRecordLabelMap, opts TFRecordOptions) (
+		TFRecordAnnotatedFile, error) {
+
+	tfFileData, err := toTFRecordWithImage(fileData, labelMap, opts)
 	if err != nil {
-		return TFRecordAnnotatedFile{}, fmt.Errorf("failed to decode the image metadata: %v", err)
+		return TFRecordAnnotatedFile{}, err
+	}
+	addAttributeFeatures(tfFileData.Annotations, fileData, opts.AttributeFeatures)
+	return tfFileData, nil
+}
+
+// toTFRecordWithImage implements toTFRecord without the attribute features.
+func toTFRecordWithImage(fileData AnnotatedFile, labelMap *TFRecordLabelMap,
+		opts TFRecordOptions) (TFRecordAnnotatedFile, error) {
+
+	// Only read the image header if the image data is not embedded, and the image dimension
+	// manifest does not already have the dimensions.
+	if opts.OmitImageData {
+		if width, height, ok := manifestDimensions(fileData.FilePath); ok {
+			img := image.Config{Width: width, Height: height}
+			return newTFRecordAnnotatedFile(fileData, labelMap, img, imageFormatOfExt(
+				fileData.FilePath), nil), nil
+		}
+		img, format, err := decodeImageConfig(fileData.FilePath)
+		if err != nil {
+			return TFRecordAnnotatedFile{}, err
+		}
+		return newTFRecordAnnotatedFile(fileData, labelMap, img, format, nil), nil
 	}
 
 	// Read the image data.
-	imgData, err := readFile(fileData.FilePath)
+	imgData, err := readImage(fileData.FilePath)
 	if err != nil {
-		return TFRecordAnnotatedFile{}, fmt.Errorf("failed to read the image: %v", err)
+		return TFRecordAnnotatedFile{}, err
+	}
+
+	// Get the image width and height from the data in memory, rather than opening the file again.
+	img, format, err := image.DecodeConfig(bytes.NewReader(imgData))
+	if err != nil {
+		return TFRecordAnnotatedFile{}, fmt.Errorf("failed to decode the image metadata: %v", err)
+	}
+
+	// Transcode the image if necessary.
+	if opts.TranscodeToJPEG && format != "jpeg" {
+		release := reserveImageMemory(img.Width, img.Height)
+		imgData, err = transcodeToJPEG(fileData.FilePath, imgData, opts.JPEGQuality)
+		release()
+		if err != nil {
+			return TFRecordAnnotatedFile{}, fmt.Errorf("failed to transcode the image: %v", err)
+		}
+		format = "jpeg"
+	}
+
+	return newTFRecordAnnotatedFile(fileData, labelMap, img, format, imgData), nil
+}
+
+// newTFRecordAnnotatedFile builds the feature map for fileData, whose image has the dimensions in
+// img and the given format. The image is only embedded if imgData is not nil.
+func newTFRecordAnnotatedFile(fileData AnnotatedFile, labelMap *TFRecordLabelMap,
+		img image.Config, format string, imgData []byte) TFRecordAnnotatedFile {
+
+	// Normalized coordinates are converted with the dimensions just read, for the box areas.
+	if fileData.CoordSpace == NormalizedCoords {
+		fileData.ImageWidth, fileData.ImageHeight = img.Width, img.Height
+		_ = fileData.ToAbsolute()
 	}
 
 	// Prepare the feature map for the per file data.
@@ -52,8 +111,14 @@ func toTFRecord(fileData AnnotatedFile) (TFRecordAnnotatedFile, error) {
 	f["image/width"] = img.Width
 	f["image/filename"] = fileData.FilePath
 	f["image/source_id"] = fileData.FilePath
-	f["image/encoded"] = imgData
 	f["image/format"] = format
+	if imgData != nil {
+		f["image/encoded"] = imgData
+		sum := sha256.Sum256(imgData)
+		f["image/key/sha256"] = hex.EncodeToString(sum[:])
+	} else if fileData.ImageSHA256 != "" {
+		f["image/key/sha256"] = fileData.ImageSHA256
+	}
 
 	// Prepare the per label data.
 	numLabels := len(fileData.Annotations)
@@ -63,19 +128,36 @@ func toTFRecord(fileData AnnotatedFile) (TFRecordAnnotatedFile, error) {
 	ymaxs := make([]float32, numLabels)
 	classes := make([]string, numLabels)
 	classIDs := make([]int64, numLabels)
+	difficult := make([]int64, numLabels)
+	truncated := make([]int64, numLabels)
+	isCrowd := make([]int64, numLabels)
+	areas := make([]float32, numLabels)
+	boolToInt := func(b bool) int64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	for i, a := range fileData.Annotations {
+		classes[i] = a.Label
+	}
+	labelMap.assignIDs(classes)
 	for i, a := range fileData.Annotations {
 		xmins[i] = float32(a.Coords[0]) / float32(img.Width)
 		ymins[i] = float32(a.Coords[1]) / float32(img.Height)
 		xmaxs[i] = float32(a.Coords[2]) / float32(img.Width)
 		ymaxs[i] = float32(a.Coords[3]) / float32(img.Height)
-		classes[i] = a.Label
-
-		// Assign the ID for the string label, selecting a new one if no mapping exists.
-		classIDs[i] = int64(tfRecordLabelMap[a.Label])
-		if classIDs[i] == 0 {
-			tfRecordLabelMap[a.Label] = tfRecordNextLabelID
-			classIDs[i] = int64(tfRecordNextLabelID)
-			tfRecordNextLabelID++
+		classIDs[i] = int64(labelMap.ID(a.Label))
+		difficult[i] = boolToInt(a.boolAttribute(Difficult))
+		truncated[i] = boolToInt(a.boolAttribute(Truncated))
+		// Ignored objects are marked as crowds, which are not evaluated, like COCO ignore regions.
+		isCrowd[i] = boolToInt(a.boolAttribute(IsCrowd) || a.boolAttribute(Ignore))
+
+		// Use the bounding box area if no (e.g. mask) area is given.
+		if area, ok := a.Attributes[Area].(float64); ok {
+			areas[i] = float32(area)
+		} else {
+			areas[i] = float32(a.Width() * a.Height())
 		}
 	}
 	f["image/object/bbox/xmin"] = xmins
@@ -84,12 +166,34 @@ func toTFRecord(fileData AnnotatedFile) (TFRecordAnnotatedFile, error) {
 	f["image/object/bbox/ymax"] = ymaxs
 	f["image/object/class/text"] = classes
 	f["image/object/class/label"] = classIDs
+	f["image/object/difficult"] = difficult
+	f["image/object/truncated"] = truncated
+	f["image/object/is_crowd"] = isCrowd
+	f["image/object/area"] = areas
 
 	// Create the example.
 	return TFRecordAnnotatedFile{
 		Annotations: f,
 		FilePath:    fileData.FilePath,
-	}, nil
+	}
+}
+
+// transcodeToJPEG decodes the image in data, read from the file at path, and returns it encoded as
+// JPEG with the given quality, or 90 if zero.
+func transcodeToJPEG(path string, data []byte, quality int) ([]byte, error) {
+	img, _, err := decodeImage(path, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if quality == 0 {
+		quality = 90
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
 // WriteCustomTFRecord works like WriteTFRecord, except that it allows for the TFFeatureMap to be
@@ -100,100 +204,90 @@ func toTFRecord(fileData AnnotatedFile) (TFRecordAnnotatedFile, error) {
 // passed to customiseFeature, which may modify the feature map to its liking, as long as all of its
 // values can be converted to tensorflow.Feature.
 func WriteCustomTFRecord(recordFilePath, labelMapPath string, data []AnnotatedFile,
-		numShards int, customiseFeature func(f AnnotatedFile, m TFFeatureMap)) (err error) {
-	defer func() {
-		if e := recover(); e != nil {
-			err = fmt.Errorf("conversion to TensorFlow Example failed: %v", e)
-		}
-	}()
+		numShards int, customiseFeature func(f AnnotatedFile, m TFFeatureMap)) error {
+	return WriteCustomTFRecordContext(context.Background(), recordFilePath, labelMapPath, data,
+		numShards, customiseFeature)
+}
 
-	if numShards <= 0 {
-		numShards = 1
-	}
+// WriteCustomTFRecordContext works like WriteCustomTFRecord, but stops writing when ctx is done, in
+// which case it removes the shard files written so far and returns ctx.Err().
+func WriteCustomTFRecordContext(ctx context.Context, recordFilePath, labelMapPath string,
+		data []AnnotatedFile, numShards int,
+		customiseFeature func(f AnnotatedFile, m TFFeatureMap)) error {
+
+	_, err := WriteTFRecordWithOptions(ctx, recordFilePath, labelMapPath, data, TFRecordOptions{
+		NumShards:        numShards,
+		Concurrency:      1, // customiseFeature need not be safe for concurrent use.
+		CustomiseFeature: customiseFeature,
+	})
+	return err
+}
 
-	if tfRecordLabelMap == nil {
-		// Try to load an existing label map. It is not an error if the file does not exist.
-		if labelMap, maxID, err := loadTFRecordLabelMap(labelMapPath); err == nil {
-			log.Print("Label map loaded successfully")
-			tfRecordLabelMap = labelMap
-			tfRecordNextLabelID = maxID + 1
-		} else if os.IsNotExist(err) {
-			log.Print("Creating a new label map")
-			tfRecordLabelMap = make(map[string]int32)
-			tfRecordNextLabelID = 1
-		} else {
-			return fmt.Errorf("failed to read the label map from %q: %v", labelMapPath, err)
-		}
-	}
+// WriteTFRecordWithOptions writes the annotation data with a TFRecordWriter opened with opts, see
+// OpenTFRecordWriter, and returns the number of files written, skipped and failed. Like
+// WriteCustomTFRecordContext, it stops writing when ctx is done, in which case it removes the shard
+// files written so far and returns ctx.Err().
+func WriteTFRecordWithOptions(ctx context.Context, recordFilePath, labelMapPath string,
+		data []AnnotatedFile, opts TFRecordOptions) (TFRecordStats, error) {
 
-	fmtShardSuffix := func(idx int) string {
-		return fmt.Sprintf("-%05d-of-%05d", idx, numShards)
+	w, err := OpenTFRecordWriter(recordFilePath, labelMapPath, opts)
+	if err != nil {
+		return TFRecordStats{}, err
 	}
-
-	var shardFile *os.File
-	shardSize := int(math.Ceil(float64(len(data)) / float64(numShards)))
-	shardIdx := -1
-
-	// Convert and serialise one data element at a time.
-	for i, fileData := range data {
-		// Check if a new shard file needs to be opened for writing.
-		if i%shardSize == 0 {
-			shardIdx++
-
-			// Close the previous shard file.
-			if shardFile != nil {
-				_ = shardFile.Close()
-				shardFile = nil
-			}
-
-			// Create the new shard file.
-			shardPath := recordFilePath
-			if numShards > 1 {
-				shardPath += fmtShardSuffix(shardIdx)
-			}
-			f, err := os.Create(shardPath)
-			if err != nil {
-				return fmt.Errorf("failed to create shard at %q: %v", shardPath, err)
-			}
-			shardFile = f
+	for _, fileData := range data {
+		if err := ctx.Err(); err != nil {
+			_ = w.Abort()
+			return w.Stats(), err
 		}
-
-		// Convert the file data to an example.
-		tfFileData, err := toTFRecord(fileData)
-		if err != nil {
-			log.Printf("Failed to convert %q: %v", fileData.FilePath, err)
-			continue
-		}
-		if customiseFeature != nil {
-			customiseFeature(fileData, tfFileData.Annotations)
-		}
-		tfExample := example.New(tfFileData.Annotations)
-
-		// Write the example.
-		if err := writeTFRecordExample(shardFile, tfExample); err != nil {
-			log.Print("Failed to write example: ", err)
-			break
+		if err := w.WriteExample(fileData); err != nil {
+			_ = w.Abort()
+			return w.Stats(), err
 		}
 	}
+	if err := w.Close(); err != nil {
+		return w.Stats(), err
+	}
 
-	if shardFile != nil {
-		err = shardFile.Close()
-		if err != nil {
-			return err
-		}
+	stats := w.Stats()
+	log.Printf("Wrote %d of %d files as TFRecord examples", stats.Written, len(data))
+	return stats, nil
+}
+
+// tfRecordShardPath returns the path of the shard file with index shardIdx. A suffix is only added
+// to recordFilePath if there are multiple shards.
+func tfRecordShardPath(recordFilePath string, shardIdx, numShards int) string {
+	if numShards <= 1 {
+		return recordFilePath
 	}
+	return recordFilePath + fmt.Sprintf("-%05d-of-%05d", shardIdx, numShards)
+}
 
-	return saveTFRecordLabelMap(labelMapPath, tfRecordLabelMap)
+// TFRecordInputPattern returns the glob pattern that matches the shard files of the TFRecord
+// output at recordFilePath with numShards shards, see OpenTFRecordWriter, e.g. as the input path of
+// a training pipeline. It is recordFilePath itself if there is a single shard.
+func TFRecordInputPattern(recordFilePath string, numShards int) string {
+	if numShards <= 1 {
+		return recordFilePath
+	}
+	return recordFilePath + fmt.Sprintf("-?????-of-%05d", numShards)
 }
 
 // WriteTFRecord does a streaming conversion, serialisation and file write for the annotation data
 // to one or more TFRecord files stored under recordFilePath (with suffixes added when numShards>1).
 //
-// A label map is generated and written to labelMapPath.
+// A label map is generated and written to labelMapPath. If the file exists, its mappings are
+// retained and extended with any new labels.
 func WriteTFRecord(recordFilePath, labelMapPath string, data []AnnotatedFile, numShards int) error {
 	return WriteCustomTFRecord(recordFilePath, labelMapPath, data, numShards, nil)
 }
 
+// WriteTFRecordContext works like WriteTFRecord, but stops writing when ctx is done, in which case
+// it removes the shard files written so far and returns ctx.Err().
+func WriteTFRecordContext(ctx context.Context, recordFilePath, labelMapPath string,
+		data []AnnotatedFile, numShards int) error {
+	return WriteCustomTFRecordContext(ctx, recordFilePath, labelMapPath, data, numShards, nil)
+}
+
 // writeTFRecordExample serialises the example and writes it as a TFRecord to w.
 func writeTFRecordExample(w io.Writer, e *tensorflow.Example) error {
 	enc, err := proto.Marshal(e)
@@ -204,71 +298,546 @@ func writeTFRecordExample(w io.Writer, e *tensorflow.Example) error {
 	return tfrecord.Write(w, enc)
 }
 
-// saveTFRecordLabelMap converts the labelMap to prototxt format and writes it to path.
-func saveTFRecordLabelMap(path string, labelMap map[string]int32) (err error) {
-	// Copy the label map into the protobuf structure.
-	siLabelMap := &protos.StringIntLabelMap{}
-	siLabelMap.Item = make([]*protos.StringIntLabelMapItem, 0, len(labelMap))
-	for k, v := range labelMap {
-		siLabelMap.Item = append(siLabelMap.Item, &protos.StringIntLabelMapItem{
-			Name: proto.String(k),
-			Id:   proto.Int32(v),
-		})
+// TFRecordShardAssignment selects how a TFRecordWriter distributes the examples to the shards.
+type TFRecordShardAssignment int
+
+// The supported shard assignment strategies.
+const (
+	// TFRecordRoundRobin assigns the examples to the shards in turn.
+	TFRecordRoundRobin TFRecordShardAssignment = iota
+	// TFRecordClassBalanced assigns each example to the shard with the fewest examples of its
+	// dominant class, i.e. the most frequent label in the file, so that each class is spread evenly
+	// across the shards.
+	TFRecordClassBalanced
+)
+
+// TFRecordCompression is the compression type of TFRecord files, as per TensorFlow's
+// TFRecordCompressionType.
+type TFRecordCompression int
+
+// The supported compression types.
+const (
+	TFRecordNoCompression TFRecordCompression = iota
+	TFRecordGZIP
+	TFRecordZLIB
+)
+
+// defaultTFRecordShuffleBufferSize is the default number of files that a shuffling TFRecordWriter
+// holds in memory.
+const defaultTFRecordShuffleBufferSize = 10000
+
+// TFRecordOptions configures a TFRecordWriter.
+type TFRecordOptions struct {
+	NumShards       int                     // The number of shard files to create. Defaults to 1.
+	ShardAssignment TFRecordShardAssignment // How to distribute the examples to the shards.
+	Compression     TFRecordCompression     // The compression of the shard files.
+
+	// Shuffle randomises the order of the examples, using a random number generator seeded with
+	// Seed. Up to ShuffleBufferSize files (10000 if zero) are buffered to do so, i.e. files are
+	// only shuffled within a window of that size.
+	Shuffle           bool
+	Seed              int64
+	ShuffleBufferSize int
+
+	// The label map to use, e.g. to share it between multiple writers. If nil, the label map is
+	// loaded from the label map path.
+	LabelMap *TFRecordLabelMap
+
+	// TranscodeToJPEG re-encodes images in other formats, e.g. PNG, as JPEG with JPEGQuality
+	// (90 if zero), so that all examples have the same image/format.
+	TranscodeToJPEG bool
+	JPEGQuality     int
+
+	// OmitImageData writes path-only examples without the image/encoded feature, e.g. for
+	// pipelines that load the images separately. Only the image header is read to determine the
+	// dimensions and format. The image/key/sha256 feature is only written if the ImageSHA256 of the
+	// file is known. TranscodeToJPEG does not apply.
+	OmitImageData bool
+
+	// The number of goroutines that read and encode the examples concurrently. Defaults to the
+	// number set with SetWorkers.
+	Concurrency int
+
+	// MaxErrorRate is the maximum fraction of files in (0, 1] that may be skipped or fail to
+	// convert. If it is exceeded, Close removes the shard files and returns an error. Zero disables
+	// the check.
+	MaxErrorRate float64
+
+	// The attributes to write as additional features, which may replace default features.
+	AttributeFeatures []TFRecordAttributeFeature
+
+	// If not nil, CustomiseFeature is called for each file with the default TFFeatureMap, which it
+	// may modify as described for WriteCustomTFRecord. It is called concurrently from multiple
+	// goroutines unless Concurrency is 1.
+	CustomiseFeature func(f AnnotatedFile, m TFFeatureMap)
+
+	// If not nil, OnWrite is called with each file whose example is written, in the order of the
+	// records, e.g. to describe the written files rather than all files passed to the writer, some
+	// of which may be skipped. It is called from a goroutine of the writer.
+	OnWrite func(f AnnotatedFile)
+}
+
+// TFRecordStats counts the files passed to a TFRecordWriter by outcome.
+type TFRecordStats struct {
+	Written int // The number of examples written.
+	Skipped int // The number of files skipped because their image does not exist.
+	Failed  int // The number of files skipped because their conversion failed otherwise.
+}
+
+// Total returns the number of files passed to the writer.
+func (s TFRecordStats) Total() int {
+	return s.Written + s.Skipped + s.Failed
+}
+
+// ErrorRate returns the fraction of files that were skipped or failed to convert.
+func (s TFRecordStats) ErrorRate() float64 {
+	if s.Total() == 0 {
+		return 0
+	}
+	return float64(s.Skipped+s.Failed) / float64(s.Total())
+}
+
+// TFRecordWriter converts annotated files to TensorFlow Examples and appends them to one or more
+// TFRecord shard files as they arrive. Since the number of elements is not known in advance, the
+// shard for each element is chosen as it is written, as per TFRecordOptions.ShardAssignment.
+//
+// The examples are read and encoded by a pool of goroutines, but written in the order of the
+// WriteExample calls (after shuffling, if enabled). Errors writing the shards may therefore be
+// returned by a later call, or by Close.
+//
+// TFRecordWriter implements Sink and Aborter. It is not safe for concurrent use.
+type TFRecordWriter struct {
+	opts             TFRecordOptions
+	labelMap         *TFRecordLabelMap
+	labelMapPath     string
+	shards           []*tfRecordShard
+	customiseFeature func(f AnnotatedFile, m TFFeatureMap)
+	n                int // The number of elements written.
+
+	shardAssignment TFRecordShardAssignment
+	classCounts     map[string][]int // The number of examples per class and shard.
+	shardCounts     []int            // The number of examples per shard.
+
+	rng            *rand.Rand // Nil if the examples are not shuffled.
+	shuffleBuf     []AnnotatedFile
+	shuffleBufSize int
+
+	pool        *orderedPool  // Encodes the examples.
+	inputClosed bool          // Whether the pool input has been closed.
+	consumed    chan struct{} // Closed when writeRecords returns.
+	err         error         // The first error of writeRecords. Read after consumed is closed.
+
+	skipped, failed int64 // The number of files that failed to convert. Updated atomically.
+}
+
+// OpenTFRecordWriter creates the shard files under recordFilePath (with suffixes added when there
+// are multiple shards) and returns a TFRecordWriter for them. The label map is written to
+// labelMapPath when the writer is closed.
+func OpenTFRecordWriter(recordFilePath, labelMapPath string, opts TFRecordOptions) (
+		*TFRecordWriter, error) {
+
+	numShards := opts.NumShards
+	if numShards <= 0 {
+		numShards = 1
+	}
+	opts.AttributeFeatures = withAttributeFeatureTypes(opts.AttributeFeatures, nil)
+
+	labelMap := opts.LabelMap
+	if labelMap == nil {
+		var err error
+		if labelMap, err = LoadTFRecordLabelMap(labelMapPath); err != nil {
+			return nil, err
+		}
+	}
+
+	// Create all shard files.
+	w := &TFRecordWriter{
+		opts:             opts,
+		labelMap:         labelMap,
+		labelMapPath:     labelMapPath,
+		shards:           make([]*tfRecordShard, 0, numShards),
+		customiseFeature: opts.CustomiseFeature,
+		shardAssignment:  opts.ShardAssignment,
+		classCounts:      make(map[string][]int),
+		shardCounts:      make([]int, numShards),
+	}
+	if opts.Shuffle {
+		w.rng = rand.New(rand.NewSource(opts.Seed))
+		w.shuffleBufSize = opts.ShuffleBufferSize
+		if w.shuffleBufSize <= 0 {
+			w.shuffleBufSize = defaultTFRecordShuffleBufferSize
+		}
+	}
+	for i := 0; i < numShards; i++ {
+		shardPath := tfRecordShardPath(recordFilePath, i, numShards)
+		shard, err := createTFRecordShard(shardPath, opts.Compression)
+		if err != nil {
+			_ = w.Abort()
+			return nil, fmt.Errorf("failed to create shard at %q: %v", shardPath, err)
+		}
+		w.shards = append(w.shards, shard)
+	}
+
+	// Start encoding.
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = numWorkers()
 	}
+	w.pool = newOrderedPool(concurrency)
+	w.consumed = make(chan struct{})
+	go w.writeRecords()
+
+	return w, nil
+}
 
-	// Write the label map.
-	file, err := os.Create(path)
+// tfRecordShard is an open shard file.
+type tfRecordShard struct {
+	file       *atomicFile
+	buf        *bufio.Writer
+	w          io.Writer      // The writer for the records, i.e. buf or compressor.
+	compressor io.WriteCloser // The compressing writer, or nil if the file is not compressed.
+}
+
+// createTFRecordShard creates the shard file at path with the given compression. The file only
+// appears at path once the shard is closed successfully.
+func createTFRecordShard(path string, compression TFRecordCompression) (*tfRecordShard, error) {
+	f, err := createAtomicFile(path)
 	if err != nil {
-		return fmt.Errorf("failed to create the label map file %q: %v", path, err)
+		return nil, err
 	}
-	defer closeWithErrCheck(file, &err)
 
-	if err := proto.MarshalText(file, siLabelMap); err != nil {
-		return fmt.Errorf("failed to write the label map %q: %v", path, err)
+	buf := bufio.NewWriter(f)
+	shard := &tfRecordShard{file: f, buf: buf, w: buf}
+	switch compression {
+	case TFRecordNoCompression:
+	case TFRecordGZIP:
+		shard.compressor = gzip.NewWriter(buf)
+	case TFRecordZLIB:
+		shard.compressor = zlib.NewWriter(buf)
+	default:
+		_ = f.Abort()
+		return nil, fmt.Errorf("unsupported compression type %d", compression)
+	}
+	if shard.compressor != nil {
+		shard.w = shard.compressor
 	}
 
-	return nil
+	return shard, nil
+}
+
+// Close flushes the compressor, if any, and commits the file.
+func (s *tfRecordShard) Close() (err error) {
+	defer s.file.commit(&err)
+
+	if s.compressor != nil {
+		if err := s.compressor.Close(); err != nil {
+			return err
+		}
+	}
+	return s.buf.Flush()
 }
 
-// loadTFRecordLabelMap loads the label map from path. It also returns the largest ID value
-// encountered in the map.
+// NewTFRecordSink returns a Sink that works like WriteCustomTFRecord.
 //
-// If an error occurs because the file does not exist, then os.IsNotExist will return true for the
-// error.
-func loadTFRecordLabelMap(path string) (labelMap map[string]int32, maxID int32, err error) {
-	file, err := os.Open(path)
+// Deprecated: Use OpenTFRecordWriter.
+func NewTFRecordSink(recordFilePath, labelMapPath string, numShards int,
+		customiseFeature func(f AnnotatedFile, m TFFeatureMap)) (Sink, error) {
+
+	w, err := OpenTFRecordWriter(recordFilePath, labelMapPath, TFRecordOptions{
+		NumShards:        numShards,
+		Concurrency:      1, // customiseFeature need not be safe for concurrent use.
+		CustomiseFeature: customiseFeature,
+	})
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
-	defer closeWithErrCheck(file, &err)
+	return w, nil
+}
+
+// WriteExample converts fileData to an Example and writes it to the next shard. Files that cannot
+// be converted are logged and skipped.
+//
+// If the examples are shuffled, fileData is buffered and a random file from the buffer is written
+// once it is full. The remaining files are written by Close.
+func (w *TFRecordWriter) WriteExample(fileData AnnotatedFile) error {
+	if w.rng == nil {
+		return w.writeExample(fileData)
+	}
+
+	w.shuffleBuf = append(w.shuffleBuf, fileData)
+	if len(w.shuffleBuf) < w.shuffleBufSize {
+		return nil
+	}
+	return w.writeExample(w.popRandom())
+}
 
-	text, err := ioutil.ReadAll(file)
+// popRandom removes a random file from the shuffle buffer and returns it.
+func (w *TFRecordWriter) popRandom() AnnotatedFile {
+	last := len(w.shuffleBuf) - 1
+	i := w.rng.Intn(last + 1)
+	f := w.shuffleBuf[i]
+	w.shuffleBuf[i] = w.shuffleBuf[last]
+	w.shuffleBuf = w.shuffleBuf[:last]
+	return f
+}
+
+// nextShard returns the index of the shard to write fileData to.
+func (w *TFRecordWriter) nextShard(fileData AnnotatedFile) int {
+	if w.shardAssignment != TFRecordClassBalanced {
+		return w.n % len(w.shards)
+	}
+
+	// Find the dominant class of the file. Files without annotations form a class of their own.
+	counts := make(map[string]int, len(fileData.Annotations))
+	class := ""
+	for _, a := range fileData.Annotations {
+		counts[a.Label]++
+		if c := counts[a.Label]; c > counts[class] || c == counts[class] && a.Label < class {
+			class = a.Label
+		}
+	}
+
+	classCounts := w.classCounts[class]
+	if classCounts == nil {
+		classCounts = make([]int, len(w.shards))
+		w.classCounts[class] = classCounts
+	}
+
+	// Select the shard with the fewest examples of the class, then the fewest examples overall.
+	shard := 0
+	for i := 1; i < len(classCounts); i++ {
+		if classCounts[i] < classCounts[shard] ||
+				classCounts[i] == classCounts[shard] && w.shardCounts[i] < w.shardCounts[shard] {
+			shard = i
+		}
+	}
+	classCounts[shard]++
+
+	return shard
+}
+
+// writeExample queues fileData for conversion to an Example, which writeRecords then writes to
+// the next shard.
+func (w *TFRecordWriter) writeExample(fileData AnnotatedFile) error {
+	select {
+	case <-w.consumed:
+		return w.err
+	default:
+	}
+
+	// Assign the IDs of new labels in write order, rather than in the order in which the concurrent
+	// conversions complete, so that the label map is deterministic.
+	labels := make([]string, len(fileData.Annotations))
+	for i, a := range fileData.Annotations {
+		labels[i] = a.Label
+	}
+	w.labelMap.assignIDs(labels)
+
+	if !w.pool.submit(func() fileResult { return w.encodeExample(fileData) }) {
+		<-w.consumed
+		return w.err
+	}
+	return nil
+}
+
+// encodeExample converts fileData to a serialised Example. Files that cannot be converted are
+// logged and result in no record.
+func (w *TFRecordWriter) encodeExample(fileData AnnotatedFile) (r fileResult) {
+	defer func() {
+		if e := recover(); e != nil {
+			r = fileResult{err: fmt.Errorf("conversion to TensorFlow Example failed: %v", e)}
+		}
+	}()
+
+	// Convert the file data to an example.
+	tfFileData, err := toTFRecord(fileData, w.labelMap, w.opts)
+	if err != nil {
+		log.Printf("Failed to convert %q: %v", fileData.FilePath, err)
+		if errors.Is(err, ErrImageNotFound) {
+			atomic.AddInt64(&w.skipped, 1)
+		} else {
+			atomic.AddInt64(&w.failed, 1)
+		}
+		return fileResult{}
+	}
+	if w.customiseFeature != nil {
+		w.customiseFeature(fileData, tfFileData.Annotations)
+	}
+	enc, err := proto.Marshal(example.New(tfFileData.Annotations))
 	if err != nil {
-		return nil, 0, err
+		return fileResult{err: fmt.Errorf("failed to serialise example: %v", err)}
+	}
+
+	return fileResult{files: []AnnotatedFile{fileData}, record: enc}
+}
+
+// writeRecords writes the encoded examples to the shards in order, until the pool is drained or
+// an error occurs, which is stored in w.err.
+func (w *TFRecordWriter) writeRecords() {
+	defer close(w.consumed)
+
+	for {
+		r, ok := w.pool.next()
+		if !ok {
+			return
+		}
+
+		// Write the example to the next shard.
+		if r.err == nil && len(r.files) > 0 {
+			shard := w.nextShard(r.files[0])
+			if err := tfrecord.Write(w.shards[shard].w, r.record); err != nil {
+				r.err = fmt.Errorf("failed to write example: %v", err)
+			} else {
+				w.shardCounts[shard]++
+				w.n++
+				if w.opts.OnWrite != nil {
+					w.opts.OnWrite(r.files[0])
+				}
+			}
+		}
+		if r.err != nil {
+			w.err = r.err
+			w.pool.stop()
+			return
+		}
 	}
+}
 
-	var siLabelMap protos.StringIntLabelMap
-	if err := proto.UnmarshalText(string(text), &siLabelMap); err != nil {
-		return nil, 0, err
+// finishRecords waits until all queued examples have been written and returns the first error.
+func (w *TFRecordWriter) finishRecords() error {
+	if !w.inputClosed {
+		w.inputClosed = true
+		w.pool.closeInput()
 	}
+	<-w.consumed
+	return w.err
+}
 
-	max := func(a, b int32) int32 {
-		if a > b {
-			return a
+// Stats returns the number of files written, skipped and failed. It must only be called after
+// Close or Abort.
+func (w *TFRecordWriter) Stats() TFRecordStats {
+	return TFRecordStats{
+		Written: w.n,
+		Skipped: int(atomic.LoadInt64(&w.skipped)),
+		Failed:  int(atomic.LoadInt64(&w.failed)),
+	}
+}
+
+// Write implements Sink. It is equivalent to WriteExample.
+func (w *TFRecordWriter) Write(fileData AnnotatedFile) error {
+	return w.WriteExample(fileData)
+}
+
+// Close implements Sink. It writes any buffered files, closes the shard files and writes the label
+// map. If this fails, or too many files could not be converted (see TFRecordOptions.MaxErrorRate),
+// the shard files are removed.
+func (w *TFRecordWriter) Close() (err error) {
+	for len(w.shuffleBuf) > 0 {
+		if err := w.writeExample(w.popRandom()); err != nil {
+			_ = w.Abort()
+			return err
 		}
-		return b
+	}
+	if err := w.finishRecords(); err != nil {
+		_ = w.Abort()
+		return err
 	}
 
-	labelMap = make(map[string]int32, len(siLabelMap.Item))
-	for _, item := range siLabelMap.Item {
-		k, v := item.GetName(), item.GetId()
-		if k == "" || v <= 0 {
-			return nil, 0, fmt.Errorf("invalid entry: %s: %d", k, v)
+	stats := w.Stats()
+	if w.opts.MaxErrorRate > 0 && stats.ErrorRate() > w.opts.MaxErrorRate {
+		_ = w.Abort()
+		return fmt.Errorf("%d of %d files could not be converted, exceeding the maximum error rate"+
+				" of %g", stats.Skipped+stats.Failed, stats.Total(), w.opts.MaxErrorRate)
+	}
+
+	// Remove all shards if any of them may be incomplete.
+	for _, shard := range w.shards {
+		closeWithErrCheck(shard, &err)
+	}
+	if err != nil {
+		if abortErr := w.Abort(); abortErr != nil {
+			log.Print("Failed to remove the partial output: ", abortErr)
 		}
+		return fmt.Errorf("failed to close the shards: %v", err)
+	}
 
-		labelMap[k] = v
-		maxID = max(maxID, v)
+	return w.labelMap.Save(w.labelMapPath)
+}
+
+// Abort implements Aborter. It removes the shard files and does not write the label map.
+func (w *TFRecordWriter) Abort() (err error) {
+	if w.pool != nil {
+		w.pool.stop()
+		_ = w.finishRecords()
+	}
+	for _, shard := range w.shards {
+		if removeErr := shard.file.Abort(); removeErr != nil && err == nil {
+			err = removeErr
+		}
+	}
+	w.shards = nil
+	w.shuffleBuf = nil
+	return err
+}
+
+// tfRecordFormat implements the Writer interface for the TFRecord format.
+type tfRecordFormat struct{}
+
+// Write implements Writer.
+func (f tfRecordFormat) Write(recordFilePath string, data AnnotatedFiles,
+		opts FormatOptions) error {
+
+	// Shuffle all data, rather than a window of it.
+	if opts.TFRecord.Shuffle && opts.TFRecord.ShuffleBufferSize < len(data) {
+		opts.TFRecord.ShuffleBufferSize = len(data)
+	}
+
+	w, err := f.NewSink(recordFilePath, opts)
+	if err != nil {
+		return err
+	}
+	for _, fileData := range data {
+		if err := w.Write(fileData); err != nil {
+			_ = AbortSink(w)
+			return err
+		}
 	}
+	return w.Close()
+}
+
+// NewSink implements StreamWriter.
+func (tfRecordFormat) NewSink(recordFilePath string, opts FormatOptions) (Sink, error) {
+	if opts.TFRecordLabelMapPath == "" {
+		return nil, fmt.Errorf("missing TFRecord label map path")
+	}
+
+	tfOpts := opts.TFRecord
+	if tfOpts.LabelMap == nil {
+		labelMap, err := LoadTFRecordLabelMapWithOptions(opts.TFRecordLabelMapPath, opts.LabelMap)
+		if err != nil {
+			return nil, err
+		}
+		labelMap.DisplayNames = opts.LabelMapDisplayNames
+		labelMap.SetDisplayNames(opts.DisplayNames)
+		tfOpts.LabelMap = labelMap
+	}
+	if opts.Provenance != nil {
+		tfOpts.LabelMap.Comment = opts.Provenance.String()
+	}
+	tfOpts.AttributeFeatures = withAttributeFeatureTypes(tfOpts.AttributeFeatures, opts.Attributes)
+	return OpenTFRecordWriter(recordFilePath, opts.TFRecordLabelMapPath, tfOpts)
+}
+
+// AcceptsNormalizedCoords implements NormalizedWriter.
+func (tfRecordFormat) AcceptsNormalizedCoords() bool {
+	return true
+}
 
-	return labelMap, maxID, nil
+func init() {
+	RegisterFormat(Format{
+		Name:        "tfrecord",
+		Description: "TensorFlow TFRecord",
+		Writer:      tfRecordFormat{},
+		WriterArgs:  "-labels-out <file> -tfrecord-label-map-file <file> [-num-shards <int>]",
+	})
 }
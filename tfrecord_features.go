@@ -0,0 +1,148 @@
+package lblconv
+
+// Attributes written as additional TFRecord features.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// tfRecordObjectFeaturePrefix is the prefix of the names of per-object features.
+const tfRecordObjectFeaturePrefix = "image/object/"
+
+// TFRecordAttributeFeature maps an attribute to an additional TFRecord feature.
+//
+// Features whose names start with "image/object/" hold the values of the annotation attribute as a
+// list with one value per annotation, in the order of the other per-object features. Annotations
+// without the attribute, or with a value that cannot be coerced to the type, have the zero value.
+// String lists are written as comma-separated strings. Other features hold the value of the file
+// attribute, and are omitted for files without it.
+type TFRecordAttributeFeature struct {
+	Attribute string // The attribute key, e.g. "Text".
+	Feature   string // The feature name, e.g. "image/object/text".
+
+	// The type of the attribute values, which determines the feature type: floats are written as
+	// float lists, ints and bools (0 or 1) as int64 lists, and strings as bytes lists. Defaults to
+	// the type declared by FormatOptions.Attributes or DefaultAttributeSchema, or to string if the
+	// attribute is not declared.
+	Type AttributeType
+}
+
+// ParseTFRecordAttributeFeatures parses a comma-separated list of attribute=feature mappings, e.g.
+// "Text=image/object/text,Ancestors=image/object/parents".
+func ParseTFRecordAttributeFeatures(spec string) ([]TFRecordAttributeFeature, error) {
+	var features []TFRecordAttributeFeature
+	seen := make(map[string]bool)
+	for _, mapping := range strings.Split(spec, ",") {
+		parts := strings.Split(mapping, "=")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid attribute feature mapping %q, must be attribute=feature",
+				mapping)
+		}
+		f := TFRecordAttributeFeature{
+			Attribute: strings.TrimSpace(parts[0]),
+			Feature:   strings.TrimSpace(parts[1]),
+		}
+		if f.Attribute == "" || f.Feature == "" {
+			return nil, fmt.Errorf("invalid attribute feature mapping %q, must be attribute=feature",
+				mapping)
+		}
+		if seen[f.Feature] {
+			return nil, fmt.Errorf("duplicate feature %q", f.Feature)
+		}
+		seen[f.Feature] = true
+		features = append(features, f)
+	}
+	return features, nil
+}
+
+// withAttributeFeatureTypes returns a copy of features with the unset types taken from schema and
+// its defaults.
+func withAttributeFeatureTypes(features []TFRecordAttributeFeature, schema AttributeSchema) (
+		[]TFRecordAttributeFeature) {
+
+	schema = schema.withDefaults()
+	typed := make([]TFRecordAttributeFeature, len(features))
+	for i, f := range features {
+		if f.Type == "" {
+			f.Type = schema[f.Attribute]
+		}
+		if f.Type == "" {
+			f.Type = StringAttribute
+		}
+		typed[i] = f
+	}
+	return typed
+}
+
+// addAttributeFeatures adds the attribute features of fileData to the feature map m. The types of
+// the features must be set, see withAttributeFeatureTypes.
+func addAttributeFeatures(m TFFeatureMap, fileData AnnotatedFile,
+		features []TFRecordAttributeFeature) {
+
+	for _, f := range features {
+		if !strings.HasPrefix(f.Feature, tfRecordObjectFeaturePrefix) {
+			if v, ok := fileData.Attributes[f.Attribute]; ok {
+				if value := tfRecordAttributeValue(v, f.Type); value != nil {
+					m[f.Feature] = value
+				}
+			}
+			continue
+		}
+
+		n := len(fileData.Annotations)
+		value := func(a Annotation) interface{} {
+			v, ok := a.Attributes[f.Attribute]
+			if !ok {
+				return nil
+			}
+			return tfRecordAttributeValue(v, f.Type)
+		}
+		switch f.Type {
+		case FloatAttribute:
+			values := make([]float32, n)
+			for i, a := range fileData.Annotations {
+				values[i], _ = value(a).(float32)
+			}
+			m[f.Feature] = values
+		case IntAttribute, BoolAttribute:
+			values := make([]int64, n)
+			for i, a := range fileData.Annotations {
+				values[i], _ = value(a).(int64)
+			}
+			m[f.Feature] = values
+		default:
+			values := make([]string, n)
+			for i, a := range fileData.Annotations {
+				switch v := value(a).(type) {
+				case string:
+					values[i] = v
+				case []string:
+					values[i] = strings.Join(v, ",")
+				}
+			}
+			m[f.Feature] = values
+		}
+	}
+}
+
+// tfRecordAttributeValue returns the attribute value v coerced to t as a feature value, i.e. a
+// float32, int64, string or []string, or nil if it cannot be coerced.
+func tfRecordAttributeValue(v interface{}, t AttributeType) interface{} {
+	v, err := coerceAttribute(v, t)
+	if err != nil {
+		return nil
+	}
+	switch v := v.(type) {
+	case float64:
+		return float32(v)
+	case int:
+		return int64(v)
+	case bool:
+		if v {
+			return int64(1)
+		}
+		return int64(0)
+	}
+	return v
+}
@@ -0,0 +1,578 @@
+package lblconv
+
+// TFRecord label map functionality.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	protos "github.com/sensorable/lblconv/protos"
+)
+
+// TFRecordLabelMap maps string labels to the integer class IDs used in TFRecord files. New labels
+// are assigned the next free ID. It is safe for concurrent use, so that multiple writers can share
+// a label map, e.g. for the splits of a dataset.
+//
+// Label maps are loaded and saved in the format given by the file extension:
+//   - .json: A JSON array of {"id": <int>, "name": <string>, "display_name": <string>} objects.
+//     Label maps are also loaded from an object with such an array in "categories", e.g. a COCO
+//     dataset or categories file.
+//   - .csv: CSV with the header id,name,display_name.
+//   - .names: One name per line, as used by YOLO. The IDs start at the first ID (see
+//     LabelMapOptions) on the first line, and missing IDs are written as empty lines.
+//   - Any other extension: The TensorFlow Object Detection API StringIntLabelMap prototxt format.
+type TFRecordLabelMap struct {
+	// DisplayNames enables writing a display_name for each item. Labels without a display name in
+	// the loaded label map use their name.
+	DisplayNames bool
+
+	// Comment is written as a comment at the top of prototxt label maps, e.g. to record the
+	// provenance. The other formats do not support comments.
+	Comment string
+
+	mu           sync.Mutex
+	ids          map[string]int32  // The active label mappings.
+	displayNames map[string]string // The display names from the loaded label map.
+	firstID      int32             // The lowest valid ID.
+	nextID       int32             // The ID for the next label mapping.
+}
+
+// LabelMapOptions holds the settings for the IDs of label maps. Some frameworks expect the class
+// IDs to start at 0, others at 1, and some reserve the first ID for the background class.
+type LabelMapOptions struct {
+	// ZeroBased starts the IDs at 0 rather than 1.
+	ZeroBased bool
+
+	// Background, if not empty, is the label of an explicit background entry with the first ID,
+	// e.g. "background", so that the classes start at the next ID. A loaded label map must map it
+	// to the first ID, unless the label map is empty.
+	Background string
+}
+
+// NewTFRecordLabelMap returns an empty label map whose IDs start at 1.
+func NewTFRecordLabelMap() *TFRecordLabelMap {
+	return NewTFRecordLabelMapWithOptions(LabelMapOptions{})
+}
+
+// NewTFRecordLabelMapWithOptions returns a label map with the IDs given by opts. It is empty,
+// except for the background entry, if any.
+func NewTFRecordLabelMapWithOptions(opts LabelMapOptions) *TFRecordLabelMap {
+	m := newTFRecordLabelMap(opts)
+	if opts.Background != "" {
+		m.ids[opts.Background] = m.firstID
+		m.nextID++
+	}
+	return m
+}
+
+// newTFRecordLabelMap returns an empty label map with the first ID given by opts.
+func newTFRecordLabelMap(opts LabelMapOptions) *TFRecordLabelMap {
+	firstID := int32(1)
+	if opts.ZeroBased {
+		firstID = 0
+	}
+	return &TFRecordLabelMap{
+		ids:          make(map[string]int32),
+		displayNames: make(map[string]string),
+		firstID:      firstID,
+		nextID:       firstID,
+	}
+}
+
+// addBackground maps label to the first ID, if not empty. It returns an error if the label map has
+// other entries, but does not map label to the first ID.
+func (m *TFRecordLabelMap) addBackground(label string) error {
+	if label == "" {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if id, ok := m.ids[label]; ok && id != m.firstID {
+		return fmt.Errorf("background %q has the ID %d instead of %d", label, id, m.firstID)
+	} else if !ok && len(m.ids) > 0 {
+		return fmt.Errorf("missing background %q with the ID %d", label, m.firstID)
+	}
+	m.id(label)
+	return nil
+}
+
+// LoadTFRecordLabelMap loads the label map from the prototxt file at path. It returns an empty
+// label map if the file does not exist.
+func LoadTFRecordLabelMap(path string) (*TFRecordLabelMap, error) {
+	return LoadTFRecordLabelMapWithOptions(path, LabelMapOptions{})
+}
+
+// LoadTFRecordLabelMapWithOptions loads the label map from path like LoadTFRecordLabelMap, with the
+// IDs given by opts. The IDs of the file must not be below the first ID.
+func LoadTFRecordLabelMapWithOptions(path string, opts LabelMapOptions) (*TFRecordLabelMap,
+		error) {
+
+	// It is not an error if the file does not exist.
+	m, err := loadTFRecordLabelMap(path, opts)
+	if os.IsNotExist(err) {
+		log.Print("Creating a new label map")
+		return NewTFRecordLabelMapWithOptions(opts), nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read the label map from %q: %v", path, err)
+	}
+	if err := m.addBackground(opts.Background); err != nil {
+		return nil, fmt.Errorf("invalid label map %q: %v", path, err)
+	}
+	log.Print("Label map loaded successfully")
+
+	return m, nil
+}
+
+// ID returns the class ID for label, assigning a new one if the label is not mapped yet.
+func (m *TFRecordLabelMap) ID(label string) int32 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.id(label)
+}
+
+// id implements ID. The caller must hold m.mu.
+func (m *TFRecordLabelMap) id(label string) int32 {
+	id, ok := m.ids[label]
+	if !ok {
+		id = m.nextID
+		m.ids[label] = id
+		m.nextID++
+	}
+	return id
+}
+
+// PinIDs assigns the IDs of the labels in categories, e.g. the categories of an existing dataset,
+// so that new data can be concatenated with it. The other labels keep their IDs, and new labels
+// are assigned IDs above those in categories. It returns an error, and leaves m unchanged, if a
+// label or ID is already mapped differently than in categories.
+func (m *TFRecordLabelMap) PinIDs(categories *TFRecordLabelMap) error {
+	items := categories.items()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	labelsByID := make(map[int32]string, len(m.ids))
+	for label, id := range m.ids {
+		labelsByID[id] = label
+	}
+	for _, item := range items {
+		if id, ok := m.ids[item.Name]; ok && id != item.ID {
+			return fmt.Errorf("label %q has the ID %d instead of %d", item.Name, id, item.ID)
+		}
+		if label, ok := labelsByID[item.ID]; ok && label != item.Name {
+			return fmt.Errorf("ID %d is assigned to %q instead of %q", item.ID, label, item.Name)
+		}
+	}
+
+	for _, item := range items {
+		m.ids[item.Name] = item.ID
+		if _, ok := m.displayNames[item.Name]; !ok && item.DisplayName != "" {
+			m.displayNames[item.Name] = item.DisplayName
+		}
+		if item.ID >= m.nextID {
+			m.nextID = item.ID + 1
+		}
+	}
+	return nil
+}
+
+// LoadTFRecordLabelMapCategories loads the label map from path like LoadTFRecordLabelMap, e.g. to
+// pin its IDs with PinIDs, but returns an error if the file does not exist.
+func LoadTFRecordLabelMapCategories(path string) (*TFRecordLabelMap, error) {
+	m, err := loadTFRecordLabelMap(path, LabelMapOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the categories from %q: %v", path, err)
+	}
+	return m, nil
+}
+
+// assignIDs assigns IDs to the labels that are not mapped yet, in sorted order. This makes the
+// IDs independent of the order of the annotations within a file.
+func (m *TFRecordLabelMap) assignIDs(labels []string) {
+	sorted := make([]string, len(labels))
+	copy(sorted, labels)
+	sort.Strings(sorted)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, label := range sorted {
+		m.id(label)
+	}
+}
+
+// Save writes the label map to path, in the format given by its file extension. The items are
+// sorted by ID.
+func (m *TFRecordLabelMap) Save(path string) (err error) {
+	items := m.items()
+
+	file, err := createAtomicFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to create the label map file %q: %v", path, err)
+	}
+	defer file.commit(&err)
+
+	switch labelMapFileFormat(path) {
+	case ".json":
+		err = writeJSONLabelMap(file, items)
+	case ".csv":
+		err = writeCSVLabelMap(file, items)
+	case ".names":
+		err = writeNamesLabelMap(file, items, m.firstID)
+	default:
+		err = writeProtoTextLabelMap(file, items, m.Comment)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write the label map %q: %v", path, err)
+	}
+
+	return nil
+}
+
+// SetDisplayNames sets the display names of labels, e.g. from LoadDisplayNames, which are written
+// for the mapped labels regardless of DisplayNames. They replace the display names of the loaded
+// label map.
+func (m *TFRecordLabelMap) SetDisplayNames(names map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for label, name := range names {
+		m.displayNames[label] = name
+	}
+}
+
+// Labels returns the mapped labels sorted by ID.
+func (m *TFRecordLabelMap) Labels() []string {
+	items := m.items()
+	labels := make([]string, len(items))
+	for i, item := range items {
+		labels[i] = item.Name
+	}
+	return labels
+}
+
+// labelMapItem is a single entry of a label map.
+type labelMapItem struct {
+	ID          int32  `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name,omitempty"`
+}
+
+// items returns the label map items sorted by ID.
+func (m *TFRecordLabelMap) items() []labelMapItem {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	items := make([]labelMapItem, 0, len(m.ids))
+	for k, v := range m.ids {
+		item := labelMapItem{ID: v, Name: k}
+		if displayName, ok := m.displayNames[k]; ok {
+			item.DisplayName = displayName
+		} else if m.DisplayNames {
+			item.DisplayName = k
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+
+	return items
+}
+
+// labelMapFileFormat returns the lower case file extension of path, which selects the label map
+// format.
+func labelMapFileFormat(path string) string {
+	return strings.ToLower(filepath.Ext(path))
+}
+
+// writeProtoTextLabelMap writes the items in StringIntLabelMap prototxt format to w, preceded by
+// comment, if not empty.
+func writeProtoTextLabelMap(w io.Writer, items []labelMapItem, comment string) error {
+	if comment != "" {
+		for _, line := range strings.Split(comment, "\n") {
+			if _, err := fmt.Fprintf(w, "# %s\n", line); err != nil {
+				return err
+			}
+		}
+	}
+
+	siLabelMap := &protos.StringIntLabelMap{}
+	siLabelMap.Item = make([]*protos.StringIntLabelMapItem, len(items))
+	for i, item := range items {
+		siLabelMap.Item[i] = &protos.StringIntLabelMapItem{
+			Name: proto.String(item.Name),
+			Id:   proto.Int32(item.ID),
+		}
+		if item.DisplayName != "" {
+			siLabelMap.Item[i].DisplayName = proto.String(item.DisplayName)
+		}
+	}
+
+	return proto.MarshalText(w, siLabelMap)
+}
+
+// writeJSONLabelMap writes the items as a JSON array to w.
+func writeJSONLabelMap(w io.Writer, items []labelMapItem) error {
+	enc, err := json.MarshalIndent(items, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(enc, '\n'))
+	return err
+}
+
+// writeCSVLabelMap writes the items as CSV with a header row to w.
+func writeCSVLabelMap(w io.Writer, items []labelMapItem) error {
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"id", "name", "display_name"})
+	for _, item := range items {
+		_ = cw.Write([]string{strconv.Itoa(int(item.ID)), item.Name, item.DisplayName})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeNamesLabelMap writes one name per line to w, where line i has the item with ID firstID+i.
+func writeNamesLabelMap(w io.Writer, items []labelMapItem, firstID int32) error {
+	bw := bufio.NewWriter(w)
+	nextID := firstID
+	for _, item := range items {
+		for ; nextID < item.ID; nextID++ {
+			_, _ = bw.WriteString("\n")
+		}
+		_, _ = bw.WriteString(item.Name + "\n")
+		nextID++
+	}
+	return bw.Flush()
+}
+
+// loadTFRecordLabelMap loads the label map from path, in the format given by its file extension,
+// with the first ID given by opts. The background entry is not added.
+//
+// If an error occurs because the file does not exist, then os.IsNotExist will return true for the
+// error.
+func loadTFRecordLabelMap(path string, opts LabelMapOptions) (m *TFRecordLabelMap, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer closeWithErrCheck(file, &err)
+
+	text, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	m = newTFRecordLabelMap(opts)
+	var items []labelMapItem
+	switch labelMapFileFormat(path) {
+	case ".json":
+		items, err = parseJSONLabelMap(text)
+	case ".csv":
+		items, err = parseCSVLabelMap(text)
+	case ".names":
+		items = parseNamesLabelMap(text, m.firstID)
+	default:
+		items, err = parseProtoTextLabelMap(text)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	labelsByID := make(map[int32]string, len(items))
+	for _, item := range items {
+		if item.Name == "" || item.ID < m.firstID {
+			return nil, fmt.Errorf("invalid entry: %s: %d", item.Name, item.ID)
+		}
+		if label, ok := labelsByID[item.ID]; ok {
+			return nil, fmt.Errorf("duplicate ID %d of %q and %q", item.ID, label, item.Name)
+		}
+		if _, ok := m.ids[item.Name]; ok {
+			return nil, fmt.Errorf("duplicate label %q", item.Name)
+		}
+		labelsByID[item.ID] = item.Name
+
+		m.ids[item.Name] = item.ID
+		if item.DisplayName != "" {
+			m.displayNames[item.Name] = item.DisplayName
+		}
+		if item.ID >= m.nextID {
+			m.nextID = item.ID + 1
+		}
+	}
+
+	return m, nil
+}
+
+// parseJSONLabelMap parses a label map in JSON format, either as an array of items or as an object
+// with the items in "categories".
+func parseJSONLabelMap(text []byte) ([]labelMapItem, error) {
+	if trimmed := bytes.TrimSpace(text); len(trimmed) > 0 && trimmed[0] == '{' {
+		var categories struct {
+			Categories []labelMapItem `json:"categories"`
+		}
+		if err := json.Unmarshal(text, &categories); err != nil {
+			return nil, err
+		}
+		return categories.Categories, nil
+	}
+
+	var items []labelMapItem
+	err := json.Unmarshal(text, &items)
+	return items, err
+}
+
+// parseProtoTextLabelMap parses a label map in StringIntLabelMap prototxt format.
+func parseProtoTextLabelMap(text []byte) ([]labelMapItem, error) {
+	var siLabelMap protos.StringIntLabelMap
+	if err := proto.UnmarshalText(string(text), &siLabelMap); err != nil {
+		return nil, err
+	}
+
+	items := make([]labelMapItem, len(siLabelMap.Item))
+	for i, item := range siLabelMap.Item {
+		items[i] = labelMapItem{
+			ID:          item.GetId(),
+			Name:        item.GetName(),
+			DisplayName: item.GetDisplayName(),
+		}
+	}
+	return items, nil
+}
+
+// parseCSVLabelMap parses a label map in CSV format with the columns id, name and, optionally,
+// display_name. The first row is skipped if it is a header.
+func parseCSVLabelMap(text []byte) ([]labelMapItem, error) {
+	r := csv.NewReader(strings.NewReader(string(text)))
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]labelMapItem, 0, len(records))
+	for i, record := range records {
+		if i == 0 && len(record) > 0 && record[0] == "id" {
+			continue
+		}
+		if len(record) < 2 {
+			return nil, fmt.Errorf("insufficient columns in line %d", i+1)
+		}
+		id, err := strconv.ParseInt(record[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ID in line %d: %v", i+1, err)
+		}
+		item := labelMapItem{ID: int32(id), Name: record[1]}
+		if len(record) > 2 {
+			item.DisplayName = record[2]
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// parseNamesLabelMap parses a label map with one name per line, where line i has ID firstID+i.
+// Empty lines are skipped.
+func parseNamesLabelMap(text []byte, firstID int32) []labelMapItem {
+	var items []labelMapItem
+	for i, line := range strings.Split(string(text), "\n") {
+		if name := strings.TrimSpace(line); name != "" {
+			items = append(items, labelMapItem{ID: firstID + int32(i), Name: name})
+		}
+	}
+	return items
+}
+
+// labelMapSink is a Sink that only collects the labels of the files and writes them as a label map.
+type labelMapSink struct {
+	path     string
+	labelMap *TFRecordLabelMap
+}
+
+// NewLabelMapSink returns a Sink that writes the label map for the files, rather than the files
+// themselves, to path when it is closed. If the label map at path exists, it is extended.
+// Otherwise, a label map is created. The format is selected by the file extension, as for
+// TFRecordLabelMap.
+func NewLabelMapSink(path string) (Sink, error) {
+	return newLabelMapSink(path, LabelMapOptions{})
+}
+
+// newLabelMapSink returns a labelMapSink for path, with the IDs given by opts.
+func newLabelMapSink(path string, opts LabelMapOptions) (*labelMapSink, error) {
+	labelMap, err := LoadTFRecordLabelMapWithOptions(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &labelMapSink{path: path, labelMap: labelMap}, nil
+}
+
+// Write implements Sink.
+func (s *labelMapSink) Write(f AnnotatedFile) error {
+	labels := make([]string, len(f.Annotations))
+	for i, a := range f.Annotations {
+		labels[i] = a.Label
+	}
+	s.labelMap.assignIDs(labels)
+	return nil
+}
+
+// Close implements Sink.
+func (s *labelMapSink) Close() error {
+	return s.labelMap.Save(s.path)
+}
+
+// labelMapFormat implements the Writer interface for standalone label maps.
+type labelMapFormat struct{}
+
+// Write implements Writer.
+func (f labelMapFormat) Write(path string, data AnnotatedFiles, opts FormatOptions) error {
+	sink, err := f.NewSink(path, opts)
+	if err != nil {
+		return err
+	}
+	for _, fileData := range data {
+		_ = sink.Write(fileData)
+	}
+	return sink.Close()
+}
+
+// NewSink implements StreamWriter.
+func (labelMapFormat) NewSink(path string, opts FormatOptions) (Sink, error) {
+	sink, err := newLabelMapSink(path, opts.LabelMap)
+	if err != nil {
+		return nil, err
+	}
+	sink.labelMap.DisplayNames = opts.LabelMapDisplayNames
+	sink.labelMap.SetDisplayNames(opts.DisplayNames)
+
+	return sink, nil
+}
+
+// AcceptsNormalizedCoords implements NormalizedWriter. Label maps have no coordinates.
+func (labelMapFormat) AcceptsNormalizedCoords() bool {
+	return true
+}
+
+func init() {
+	RegisterFormat(Format{
+		Name:        "labelmap",
+		Description: "Label map only (pbtxt, json, csv or names, by file extension)",
+		Writer:      labelMapFormat{},
+		WriterArgs:  "-labels-out <file>",
+	})
+}
@@ -0,0 +1,194 @@
+package lblconv
+
+// TFRecord verification functionality.
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/sensorable/lblconv/third-party/github.com/ryszard/tfutils/go/tfrecord"
+	tensorflow "github.com/sensorable/lblconv/third-party/github.com/ryszard/tfutils/proto/tensorflow/core/example"
+)
+
+// TFRecordShardReport summarises the verification of a single TFRecord shard file.
+type TFRecordShardReport struct {
+	Path    string
+	Records int // The number of records read.
+	Objects int // The number of objects in the valid records.
+	Invalid int // The number of records that failed a check.
+
+	// The error that stopped reading the shard, e.g. a checksum mismatch or a truncated record, or
+	// nil if the shard was read in full.
+	Err error
+}
+
+// OK returns true if the shard was read in full and all of its records are valid.
+func (r TFRecordShardReport) OK() bool {
+	return r.Err == nil && r.Invalid == 0
+}
+
+// VerifyTFRecord reads back the TFRecord shard files written to recordFilePath (see
+// OpenTFRecordWriter) with the given compression. It verifies the record checksums, decodes each
+// Example and checks that the bounding box coordinates are in [0, 1] and, if labelMap is not nil,
+// that the class IDs exist in the label map. The invalid records are logged.
+//
+// Returns a report per shard, in shard order. An error is only returned if the shard files cannot
+// be found or opened.
+func VerifyTFRecord(recordFilePath string, labelMap *TFRecordLabelMap,
+		compression TFRecordCompression) ([]TFRecordShardReport, error) {
+
+	// Find the shard files. There is no suffix if there is a single shard.
+	shardPaths, err := filepath.Glob(recordFilePath + "-[0-9][0-9][0-9][0-9][0-9]-of-" +
+			"[0-9][0-9][0-9][0-9][0-9]")
+	if err != nil {
+		return nil, err
+	}
+	if len(shardPaths) == 0 {
+		shardPaths = []string{recordFilePath}
+	}
+
+	var classIDs map[int64]bool
+	if labelMap != nil {
+		classIDs = make(map[int64]bool)
+		for _, item := range labelMap.items() {
+			classIDs[int64(item.ID)] = true
+		}
+	}
+
+	reports := make([]TFRecordShardReport, 0, len(shardPaths))
+	for _, path := range shardPaths {
+		report, err := verifyTFRecordShard(path, classIDs, compression)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+
+	return reports, nil
+}
+
+// verifyTFRecordShard verifies the shard file at path, as described for VerifyTFRecord. If
+// classIDs is not nil, it holds the valid class IDs.
+func verifyTFRecordShard(path string, classIDs map[int64]bool,
+		compression TFRecordCompression) (report TFRecordShardReport, err error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return report, fmt.Errorf("failed to open shard %q: %v", path, err)
+	}
+	defer closeWithErrCheck(file, &err)
+
+	var r io.Reader = bufio.NewReader(file)
+	switch compression {
+	case TFRecordNoCompression:
+	case TFRecordGZIP:
+		r, err = gzip.NewReader(r)
+	case TFRecordZLIB:
+		r, err = zlib.NewReader(r)
+	default:
+		err = fmt.Errorf("unsupported compression type %d", compression)
+	}
+	report.Path = path
+	if err != nil {
+		report.Err = err
+		return report, nil
+	}
+
+	// tfrecord.Read expects that each Read call fills the buffer, which decompressors do not
+	// guarantee.
+	fr := &fullReader{r: r}
+
+	for {
+		start := fr.n
+		data, err := tfrecord.Read(fr)
+		if err == io.EOF && fr.n == start {
+			break
+		} else if err == io.EOF || err == io.ErrUnexpectedEOF {
+			report.Err = fmt.Errorf("truncated record %d", report.Records+1)
+			break
+		} else if err != nil {
+			report.Err = fmt.Errorf("record %d: %v", report.Records+1, err)
+			break
+		}
+		report.Records++
+
+		numObjects, err := verifyTFRecordExample(data, classIDs)
+		if err != nil {
+			log.Printf("Invalid record %d in %q: %v", report.Records, path, err)
+			report.Invalid++
+			continue
+		}
+		report.Objects += numObjects
+	}
+
+	return report, nil
+}
+
+// verifyTFRecordExample decodes the serialised Example in data and checks its object annotations.
+// Returns the number of objects.
+func verifyTFRecordExample(data []byte, classIDs map[int64]bool) (int, error) {
+	var e tensorflow.Example
+	if err := proto.Unmarshal(data, &e); err != nil {
+		return 0, fmt.Errorf("failed to decode the example: %v", err)
+	}
+	features := e.GetFeatures().GetFeature()
+
+	floats := func(key string) []float32 {
+		if l := features[key].GetFloatList(); l != nil {
+			return l.Value
+		}
+		return nil
+	}
+	xmins := floats("image/object/bbox/xmin")
+	ymins := floats("image/object/bbox/ymin")
+	xmaxs := floats("image/object/bbox/xmax")
+	ymaxs := floats("image/object/bbox/ymax")
+	var labels []int64
+	if l := features["image/object/class/label"].GetInt64List(); l != nil {
+		labels = l.Value
+	}
+
+	numObjects := len(labels)
+	if len(xmins) != numObjects || len(ymins) != numObjects || len(xmaxs) != numObjects ||
+			len(ymaxs) != numObjects {
+		return 0, fmt.Errorf("inconsistent number of bounding box coordinates and class labels")
+	}
+
+	inUnitRange := func(v float32) bool { return v >= 0 && v <= 1 }
+	for i := 0; i < numObjects; i++ {
+		if !inUnitRange(xmins[i]) || !inUnitRange(ymins[i]) || !inUnitRange(xmaxs[i]) ||
+				!inUnitRange(ymaxs[i]) {
+			return 0, fmt.Errorf("bounding box %d is not within [0, 1]: %v, %v, %v, %v", i,
+				xmins[i], ymins[i], xmaxs[i], ymaxs[i])
+		}
+		if xmins[i] > xmaxs[i] || ymins[i] > ymaxs[i] {
+			return 0, fmt.Errorf("bounding box %d has a min. > max. coordinate", i)
+		}
+		if classIDs != nil && !classIDs[labels[i]] {
+			return 0, fmt.Errorf("class ID %d of object %d is not in the label map", labels[i], i)
+		}
+	}
+
+	return numObjects, nil
+}
+
+// fullReader is an io.Reader that reads exactly len(p) bytes, unless an error occurs. It counts
+// the bytes read.
+type fullReader struct {
+	r io.Reader
+	n int64
+}
+
+// Read implements io.Reader.
+func (r *fullReader) Read(p []byte) (int, error) {
+	n, err := io.ReadFull(r.r, p)
+	r.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,289 @@
+package lblconv
+
+// Precision and recall of predictions against ground truth by confidence threshold.
+
+import (
+	"encoding/csv"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// ThresholdSweepOptions configures a ThresholdSweep.
+type ThresholdSweepOptions struct {
+	// The min. IoU of a prediction with a ground truth box of the same label to match it. Defaults
+	// to 0.5.
+	IoU float64
+
+	// The number of confidence thresholds, evenly spaced in [0, 1). Defaults to 20, i.e. 0, 0.05,
+	// ..., 0.95.
+	Steps int
+
+	// The min. precision of the suggested operating points, which are the thresholds with the
+	// highest recall at that precision. If zero, or if no threshold reaches it, the thresholds
+	// with the highest F1 score are suggested instead.
+	MinPrecision float64
+}
+
+// ThresholdPoint holds the precision and recall of the predictions of a label with at least the
+// confidence Threshold.
+type ThresholdPoint struct {
+	Threshold float64
+	Precision float64 // 1 if there are no predictions.
+	Recall    float64 // 1 if there is no ground truth.
+	F1        float64
+
+	TruePositives, FalsePositives, FalseNegatives int
+}
+
+// LabelThresholds holds the threshold sweep of a label.
+type LabelThresholds struct {
+	Label     string
+	NumTruth  int // The number of ground truth boxes, excluding ignored ones.
+	Points    []ThresholdPoint
+	Suggested int // The index of the suggested operating point in Points.
+}
+
+// sweepPrediction is a prediction with the result of its matching.
+type sweepPrediction struct {
+	confidence float64
+	matched    bool
+}
+
+// ThresholdSweep matches predictions to ground truth boxes to compute the precision and recall by
+// confidence threshold, and to suggest an operating point for each label. It is safe for
+// concurrent use.
+//
+// Within each file and label, the predictions are matched greedily in the order of decreasing
+// confidence to the unmatched ground truth box with the highest IoU, like in the COCO and Pascal
+// VOC evaluations. Predictions without a Confidence attribute have a confidence of 1. Predictions
+// that match a ground truth box with the Ignore attribute are neither true nor false positives,
+// and image-level labels are not evaluated.
+type ThresholdSweep struct {
+	opts   ThresholdSweepOptions
+	truth  map[string]*AnnotatedFile // The ground truth files by image path key.
+	byName map[string]*AnnotatedFile // The ground truth files by file name.
+
+	mu          sync.Mutex
+	predictions map[string][]sweepPrediction // The matched predictions by label.
+}
+
+// NewThresholdSweep returns a ThresholdSweep that evaluates predictions against the ground truth
+// files in truth. Predictions are matched to ground truth files by image path, or by file name if
+// the paths differ.
+func NewThresholdSweep(truth AnnotatedFiles, opts ThresholdSweepOptions) (*ThresholdSweep, error) {
+	if opts.IoU == 0 {
+		opts.IoU = 0.5
+	}
+	if opts.Steps == 0 {
+		opts.Steps = 20
+	}
+	if opts.IoU < 0 || opts.IoU > 1 {
+		return nil, fmt.Errorf("invalid IoU threshold %g", opts.IoU)
+	}
+	if opts.Steps < 0 {
+		return nil, fmt.Errorf("invalid number of threshold steps %d", opts.Steps)
+	}
+	if opts.MinPrecision < 0 || opts.MinPrecision > 1 {
+		return nil, fmt.Errorf("invalid min. precision %g", opts.MinPrecision)
+	}
+
+	s := &ThresholdSweep{
+		opts:        opts,
+		truth:       make(map[string]*AnnotatedFile, len(truth)),
+		byName:      make(map[string]*AnnotatedFile, len(truth)),
+		predictions: make(map[string][]sweepPrediction),
+	}
+	for i := range truth {
+		f := &truth[i]
+		s.truth[imagePathKey(f.FilePath)] = f
+		s.byName[filepath.Base(f.FilePath)] = f
+	}
+	return s, nil
+}
+
+// Add matches the predictions of f against the ground truth of its image. All predictions of an
+// image without ground truth are false positives. Each image must only be added once.
+func (s *ThresholdSweep) Add(f AnnotatedFile) {
+	truth, ok := s.truth[imagePathKey(f.FilePath)]
+	if !ok {
+		truth = s.byName[filepath.Base(f.FilePath)]
+	}
+
+	// Sort the predictions by decreasing confidence, and match them to the ground truth.
+	var preds []Annotation
+	for _, a := range f.Annotations {
+		if !a.boolAttribute(ImageLabel) {
+			preds = append(preds, a)
+		}
+	}
+	sort.SliceStable(preds, func(i, j int) bool {
+		return predictionConfidence(preds[i]) > predictionConfidence(preds[j])
+	})
+	var truthBoxes []Annotation
+	if truth != nil {
+		truthBoxes = truth.Annotations
+	}
+	used := make([]bool, len(truthBoxes))
+	results := make(map[string][]sweepPrediction)
+	for _, p := range preds {
+		best, bestIoU := -1, s.opts.IoU
+		for j, t := range truthBoxes {
+			if used[j] || t.Label != p.Label || t.boolAttribute(ImageLabel) {
+				continue
+			}
+			if iou := p.IoU(t); iou >= bestIoU {
+				best, bestIoU = j, iou
+			}
+		}
+		if best >= 0 {
+			used[best] = true
+			if truthBoxes[best].boolAttribute(Ignore) {
+				continue
+			}
+		}
+		results[p.Label] = append(results[p.Label], sweepPrediction{
+			confidence: predictionConfidence(p),
+			matched:    best >= 0,
+		})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for label, r := range results {
+		s.predictions[label] = append(s.predictions[label], r...)
+	}
+}
+
+// predictionConfidence returns the Confidence attribute of a, or 1 if it has none.
+func predictionConfidence(a Annotation) float64 {
+	if c, ok := a.Attributes[Confidence].(float64); ok {
+		return c
+	}
+	return 1
+}
+
+// Results returns the threshold sweep of each label with ground truth or predictions, sorted by
+// label. The ground truth of images that were not added counts as false negatives.
+func (s *ThresholdSweep) Results() []LabelThresholds {
+	numTruth := make(map[string]int)
+	for _, f := range s.truth {
+		for _, a := range f.Annotations {
+			if !a.boolAttribute(ImageLabel) && !a.boolAttribute(Ignore) {
+				numTruth[a.Label]++
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	labels := make([]string, 0, len(numTruth))
+	for label := range numTruth {
+		labels = append(labels, label)
+	}
+	for label := range s.predictions {
+		if _, ok := numTruth[label]; !ok {
+			labels = append(labels, label)
+		}
+	}
+	sort.Strings(labels)
+
+	results := make([]LabelThresholds, len(labels))
+	for i, label := range labels {
+		results[i] = s.sweep(label, numTruth[label])
+	}
+	return results
+}
+
+// sweep computes the threshold sweep of label with numTruth ground truth boxes.
+func (s *ThresholdSweep) sweep(label string, numTruth int) LabelThresholds {
+	r := LabelThresholds{Label: label, NumTruth: numTruth}
+	for step := 0; step < s.opts.Steps; step++ {
+		p := ThresholdPoint{Threshold: float64(step) / float64(s.opts.Steps)}
+		for _, pred := range s.predictions[label] {
+			switch {
+			case pred.confidence < p.Threshold:
+			case pred.matched:
+				p.TruePositives++
+			default:
+				p.FalsePositives++
+			}
+		}
+		p.FalseNegatives = numTruth - p.TruePositives
+
+		p.Precision, p.Recall = 1, 1
+		if n := p.TruePositives + p.FalsePositives; n > 0 {
+			p.Precision = float64(p.TruePositives) / float64(n)
+		}
+		if numTruth > 0 {
+			p.Recall = float64(p.TruePositives) / float64(numTruth)
+		}
+		if p.Precision+p.Recall > 0 {
+			p.F1 = 2 * p.Precision * p.Recall / (p.Precision + p.Recall)
+		}
+		r.Points = append(r.Points, p)
+	}
+
+	// Suggest the threshold with the highest recall at the min. precision, or the highest F1.
+	// Higher thresholds win ties, as they produce fewer predictions for the same result.
+	r.Suggested = -1
+	if s.opts.MinPrecision > 0 {
+		for i, p := range r.Points {
+			if p.Precision >= s.opts.MinPrecision &&
+					(r.Suggested < 0 || p.Recall >= r.Points[r.Suggested].Recall) {
+				r.Suggested = i
+			}
+		}
+	}
+	if r.Suggested < 0 {
+		for i, p := range r.Points {
+			if r.Suggested < 0 || p.F1 >= r.Points[r.Suggested].F1 {
+				r.Suggested = i
+			}
+		}
+	}
+	return r
+}
+
+// WriteCSV writes the threshold sweeps to path as CSV with the columns label, threshold,
+// precision, recall, f1, tp, fp, fn and suggested, which is true for the suggested operating
+// points.
+func (s *ThresholdSweep) WriteCSV(path string) (err error) {
+	file, err := createAtomicFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot write file %q: %v", path, err)
+	}
+	defer file.commit(&err)
+
+	cw := csv.NewWriter(file)
+	header := []string{"label", "threshold", "precision", "recall", "f1", "tp", "fp", "fn",
+		"suggested"}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	format := func(v float64) string { return strconv.FormatFloat(v, 'g', 6, 64) }
+	for _, r := range s.Results() {
+		for i, p := range r.Points {
+			record := []string{r.Label, format(p.Threshold), format(p.Precision), format(p.Recall),
+				format(p.F1), strconv.Itoa(p.TruePositives), strconv.Itoa(p.FalsePositives),
+				strconv.Itoa(p.FalseNegatives), strconv.FormatBool(i == r.Suggested)}
+			if err := cw.Write(record); err != nil {
+				return err
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ThresholdSweepStage returns a Stage that adds each file to s and passes it on unchanged.
+func ThresholdSweepStage(s *ThresholdSweep) Stage {
+	return func(f AnnotatedFile) ([]AnnotatedFile, error) {
+		s.Add(f)
+		return []AnnotatedFile{f}, nil
+	}
+}
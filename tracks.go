@@ -0,0 +1,131 @@
+package lblconv
+
+// Object tracks in video datasets.
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+// trackKey returns the TrackID attribute of a as a comparable key and true, or false if it has
+// none. IDs read from JSON are float64 values, and compare equal to the same int IDs.
+func (a Annotation) trackKey() (string, bool) {
+	switch v := a.Attributes[TrackID].(type) {
+	case int, float64, string:
+		return fmt.Sprint(v), true
+	}
+	return "", false
+}
+
+// fileFrame returns the Frame attribute of f, or 0 if it has none.
+func (f *AnnotatedFile) fileFrame() int {
+	switch v := f.Attributes[Frame].(type) {
+	case int:
+		return v
+	case float64:
+		return int(v)
+	}
+	return 0
+}
+
+// trackFrame is a frame of a sequence in AnnotatedFiles.
+type trackFrame struct {
+	index  int // The index of the file in the AnnotatedFiles.
+	number int // The frame number.
+}
+
+// sequenceFrames returns the frames of the sequences in data, by sequence name, sorted by frame
+// number. The sequence of a file is its Sequence attribute or its directory otherwise, and the
+// frame number is its Frame attribute or its 1-based position in the sequence by file path.
+func (data AnnotatedFiles) sequenceFrames() map[string][]trackFrame {
+	sequences := make(map[string][]trackFrame)
+	for i := range data {
+		seq, ok := data[i].Attributes[Sequence].(string)
+		if !ok {
+			seq = filepath.Dir(data[i].FilePath)
+		}
+		sequences[seq] = append(sequences[seq], trackFrame{index: i, number: data[i].fileFrame()})
+	}
+
+	for _, frames := range sequences {
+		sort.SliceStable(frames, func(i, j int) bool {
+			fi, fj := frames[i], frames[j]
+			if fi.number != fj.number {
+				return fi.number < fj.number
+			}
+			return data[fi.index].FilePath < data[fj.index].FilePath
+		})
+		for i := range frames {
+			if frames[i].number == 0 {
+				frames[i].number = i + 1
+			}
+		}
+	}
+	return sequences
+}
+
+// InterpolateTracks adds the bounding boxes of object tracks to the frames between two keyframes
+// of the track, i.e. frames with an annotation with the same TrackID, if at most maxGap frames
+// are missing between them. This is useful when exporting video datasets that are annotated at
+// keyframes only, e.g. MOT or CVAT tracks, to per-frame formats.
+//
+// The boxes are interpolated linearly and have the label and attributes of the preceding keyframe,
+// with the Interpolated attribute set. Polygons are not interpolated. Only the frames in data are
+// annotated. Returns the number of interpolated annotations.
+func (data *AnnotatedFiles) InterpolateTracks(maxGap int) int {
+	if maxGap <= 0 {
+		return 0
+	}
+
+	n := 0
+	for _, frames := range data.sequenceFrames() {
+		// Find the keyframes of each track, in frame order.
+		type keyframe struct {
+			frame      int // The index in frames.
+			annotation Annotation
+		}
+		tracks := make(map[string][]keyframe)
+		var trackOrder []string
+		for i, fr := range frames {
+			for _, a := range (*data)[fr.index].Annotations {
+				if key, ok := a.trackKey(); ok {
+					if tracks[key] == nil {
+						trackOrder = append(trackOrder, key)
+					}
+					tracks[key] = append(tracks[key], keyframe{frame: i, annotation: a})
+				}
+			}
+		}
+
+		for _, key := range trackOrder {
+			keyframes := tracks[key]
+			for k := 1; k < len(keyframes); k++ {
+				prev, next := keyframes[k-1], keyframes[k]
+				start, end := frames[prev.frame].number, frames[next.frame].number
+				if end-start <= 1 || end-start-1 > maxGap {
+					continue
+				}
+
+				for i := prev.frame + 1; i < next.frame; i++ {
+					t := float64(frames[i].number-start) / float64(end-start)
+					a := Annotation{Label: prev.annotation.Label}
+					for j := range a.Coords {
+						a.Coords[j] = prev.annotation.Coords[j] +
+								t*(next.annotation.Coords[j]-prev.annotation.Coords[j])
+					}
+					a.Attributes = make(map[string]interface{}, len(prev.annotation.Attributes)+1)
+					for attr, v := range prev.annotation.Attributes {
+						a.Attributes[attr] = v
+					}
+					a.Attributes[Interpolated] = true
+
+					f := &(*data)[frames[i].index]
+					f.Annotations = append(f.Annotations[:len(f.Annotations):len(f.Annotations)], a)
+					n++
+				}
+			}
+		}
+	}
+	return n
+}
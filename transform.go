@@ -0,0 +1,103 @@
+package lblconv
+
+// Whole-dataset transforms and their composition.
+
+// Transform modifies a dataset in memory, e.g. to map labels or to process the images. Unlike a
+// Stage, which processes one file at a time, a Transform has access to the whole dataset, e.g. to
+// sort or subsample it.
+type Transform interface {
+	Apply(data *AnnotatedFiles) error
+}
+
+// TransformFunc adapts a function to the Transform interface, e.g. for custom transforms.
+type TransformFunc func(data *AnnotatedFiles) error
+
+// Apply implements Transform.
+func (fn TransformFunc) Apply(data *AnnotatedFiles) error {
+	return fn(data)
+}
+
+// Pipeline is a Transform that applies its transforms in order, and stops at the first error.
+// Pipelines can be nested.
+type Pipeline []Transform
+
+// Apply implements Transform.
+func (p Pipeline) Apply(data *AnnotatedFiles) error {
+	for _, t := range p {
+		if err := t.Apply(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StageTransform returns a Transform that passes each file through stage, in order, and replaces
+// the files with the results, e.g. to use a custom Stage in a Pipeline.
+func StageTransform(stage Stage) Transform {
+	return TransformFunc(func(data *AnnotatedFiles) error {
+		out := make(AnnotatedFiles, 0, len(*data))
+		for _, f := range *data {
+			files, err := stage(f)
+			if err != nil {
+				return err
+			}
+			out = append(out, files...)
+		}
+		*data = out
+		return nil
+	})
+}
+
+// MapLabelsTransform returns a Transform that applies AnnotatedFiles.MapLabels.
+func MapLabelsTransform(mappings []string) Transform {
+	return TransformFunc(func(data *AnnotatedFiles) error {
+		return data.MapLabels(mappings)
+	})
+}
+
+// TransformBboxesTransform returns a Transform that applies AnnotatedFiles.TransformBboxes.
+func TransformBboxesTransform(scaleX, scaleY, aspectRatio float64) Transform {
+	return TransformFunc(func(data *AnnotatedFiles) error {
+		data.TransformBboxes(scaleX, scaleY, aspectRatio)
+		return nil
+	})
+}
+
+// FilterTransform returns a Transform that applies AnnotatedFiles.FilterWithOptions.
+func FilterTransform(opts FilterOptions) Transform {
+	return TransformFunc(func(data *AnnotatedFiles) error {
+		data.FilterWithOptions(opts)
+		return nil
+	})
+}
+
+// ProcessImagesTransform returns a Transform that applies AnnotatedFiles.ProcessImagesWithOptions.
+func ProcessImagesTransform(opts ImageProcessingOptions) Transform {
+	return TransformFunc(func(data *AnnotatedFiles) error {
+		return data.ProcessImagesWithOptions(opts)
+	})
+}
+
+// SortTransform returns a Transform that applies AnnotatedFiles.Sort.
+func SortTransform() Transform {
+	return TransformFunc(func(data *AnnotatedFiles) error {
+		data.Sort()
+		return nil
+	})
+}
+
+// CapClassesTransform returns a Transform that applies AnnotatedFiles.CapClasses.
+func CapClassesTransform(opts ClassCapOptions) Transform {
+	return TransformFunc(func(data *AnnotatedFiles) error {
+		data.CapClasses(opts)
+		return nil
+	})
+}
+
+// InterpolateTracksTransform returns a Transform that applies AnnotatedFiles.InterpolateTracks.
+func InterpolateTracksTransform(maxGap int) Transform {
+	return TransformFunc(func(data *AnnotatedFiles) error {
+		data.InterpolateTracks(maxGap)
+		return nil
+	})
+}
@@ -2,6 +2,7 @@ package lblconv
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,11 +10,16 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
 // filesByExtInDir retuns all regular files with file extension ext found directly in directory
 // dirPath. All files are returned if extension is empty.
 func filesByExtInDir(dirPath, ext string) (files []string, err error) {
+	if a, dir, ok := archiveOf(dirPath); ok {
+		return a.files(dir, ext, false)
+	}
+
 	// Open the directory.
 	dirInfo, err := os.Stat(dirPath)
 	if err != nil || !dirInfo.IsDir() {
@@ -68,32 +74,51 @@ func splitPath(path string) (dir, baseNoExt, ext string, err error) {
 	return dir, baseNoExt, ext, nil
 }
 
-// mapFileNamesToExtensions maps the base names of the given file paths, with the file type
-// extensions stripped off, to the file extension (without the dot).
-func mapFileNamesToExtensions(filePaths []string) map[string]string {
-	mapping := make(map[string]string, len(filePaths))
-	for _, path := range filePaths {
-		_, baseNoExt, ext, err := splitPath(path)
+// filesInDirRecursive returns all regular files found in directory dirPath and its
+// subdirectories.
+func filesInDirRecursive(dirPath string) (files []string, err error) {
+	if a, dir, ok := archiveOf(dirPath); ok {
+		return a.files(dir, "", true)
+	}
+
+	dirInfo, err := os.Stat(dirPath)
+	if err != nil || !dirInfo.IsDir() {
+		return nil, fmt.Errorf("cannot read directory %q: %v: ", dirPath, err)
+	}
+
+	err = filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			log.Print(err)
-			continue
+			log.Printf("Failed to access %q: %v", path, err)
+			return nil
 		}
-		mapping[baseNoExt] = ext
-	}
+		// Must be a regular file or a symlink.
+		if info.Mode().IsRegular() || info.Mode()&os.ModeSymlink != 0 {
+			files = append(files, path)
+		}
+		return nil
+	})
 
-	return mapping
+	return files, err
 }
 
 // labelParserFn parses a label file given the label and image file paths.
 type labelParserFn func(labelPath, imagePath string) (AnnotatedFile, error)
 
-// parseLabelsWithOneToOneImages matches label files in labelDir, with file extension labelFileExt
-// (e.g. ".json") by file name to images in imageDir (with an arbitrary file extension). It then
-// invokes labelParserFn on these path pairs.
+// oneToOneSource is a Source that matches label files in a directory to the images in another
+// directory by file name and parses the label files concurrently.
+type oneToOneSource struct {
+	pool *orderedPool
+}
+
+// newOneToOneSource matches label files in labelDir, with file extension labelFileExt (e.g.
+// ".json") by file name to images in imageDir (with an arbitrary file extension), as configured by
+// match. The returned Source then invokes labelParserFn on these path pairs.
 //
-// Returns the list of file annotations obtained by applying labelParserFn to all label files.
-func parseLabelsWithOneToOneImages(labelDir, labelFileExt, imageDir string, parse labelParserFn) (
-		[]AnnotatedFile, error) {
+// The label files are parsed concurrently, but the Source retains the order of the label files in
+// labelDir. Next returns a ParseError for label files that fail to parse or have no corresponding
+// image.
+func newOneToOneSource(labelDir, labelFileExt, imageDir string, match ImageMatchOptions,
+		parse labelParserFn) (Source, error) {
 
 	// Get the label file paths.
 	labelFiles, err := filesByExtInDir(labelDir, labelFileExt)
@@ -102,44 +127,199 @@ func parseLabelsWithOneToOneImages(labelDir, labelFileExt, imageDir string, pars
 	}
 	log.Printf("Parsing labels for %d files", len(labelFiles))
 
-	// Find the image files and create a map from base file name without ext to ext.
-	imageFiles, err := filesByExtInDir(imageDir, "")
+	matcher, err := newImageMatcher(imageDir, match)
 	if err != nil {
 		return nil, err
 	}
-	imageNamesToExt := mapFileNamesToExtensions(imageFiles)
 
-	data := make([]AnnotatedFile, 0, len(labelFiles))
+	// Match the label files to the corresponding images.
+	type parseTask struct {
+		labelPath string
+		imagePath string
+		err       error // Set if the label file cannot be matched to an image.
+	}
+	tasks := make([]parseTask, 0, len(labelFiles))
 	for _, labelPath := range labelFiles {
-		// Find the corresponding image.
-		_, baseNoExt, _, err := splitPath(labelPath)
+		imagePath, err := matcher.match(labelPath, labelFileExt)
 		if err != nil {
-			log.Printf("Error while parsing, skipping %q: %v", labelPath, err)
+			tasks = append(tasks, parseTask{labelPath: labelPath, err: err})
 			continue
 		}
-		imageExt, found := imageNamesToExt[baseNoExt]
-		if !found {
-			log.Printf("No corresponding image file, skipping %q", labelPath)
-			continue
+
+		tasks = append(tasks, parseTask{labelPath: labelPath, imagePath: imagePath})
+	}
+	if matcher.missing > 0 {
+		log.Printf("Matched %d label files to missing images in %q", matcher.missing, imageDir)
+	}
+
+	// Parse the label files concurrently. Reading the labels and probing the image headers is
+	// dominated by IO latency, which is significant on network file systems.
+	pool := newOrderedPool(numWorkers())
+	go func() {
+		defer pool.closeInput()
+		for _, t := range tasks {
+			t := t
+			ok := pool.submit(func() fileResult {
+				if t.err != nil {
+					return fileResult{err: newParseError(t.labelPath, t.err)}
+				}
+				fileData, err := parse(t.labelPath, t.imagePath)
+				if err != nil {
+					return fileResult{err: newParseError(t.labelPath, err)}
+				}
+				return fileResult{files: []AnnotatedFile{fileData}}
+			})
+			if !ok {
+				return
+			}
 		}
-		imagePath := filepath.Join(imageDir, baseNoExt+"."+imageExt)
+	}()
 
-		// Parse the label file.
-		fileData, err := parse(labelPath, imagePath)
-		if err != nil {
-			log.Printf("Error while parsing, skipping %q: %v", labelPath, err)
-			continue
+	return &oneToOneSource{pool: pool}, nil
+}
+
+// Next implements Source.
+func (s *oneToOneSource) Next() (AnnotatedFile, error) {
+	r, ok := s.pool.next()
+	if !ok {
+		return AnnotatedFile{}, io.EOF
+	}
+	if r.err != nil {
+		return AnnotatedFile{}, r.err
+	}
+	return r.files[0], nil
+}
+
+// Close implements Source.
+func (s *oneToOneSource) Close() error {
+	s.pool.stop()
+	return nil
+}
+
+// parseLabelsWithOneToOneImages matches label files in labelDir, with file extension labelFileExt
+// (e.g. ".json") by file name to images in imageDir (with an arbitrary file extension), as
+// configured by match. It then invokes labelParserFn on these path pairs.
+//
+// Returns the list of file annotations obtained by applying labelParserFn to all label files. Label
+// files that fail to parse are logged and skipped.
+func parseLabelsWithOneToOneImages(ctx context.Context, labelDir, labelFileExt, imageDir string,
+		match ImageMatchOptions, parse labelParserFn) ([]AnnotatedFile, error) {
+
+	src, err := newOneToOneSource(labelDir, labelFileExt, imageDir, match, parse)
+	if err != nil {
+		return nil, err
+	}
+
+	return ReadAllContext(ctx, src)
+}
+
+// fileResult is the result of processing a single input file.
+type fileResult struct {
+	files  []AnnotatedFile
+	record []byte // The serialised output for files, for writers that encode concurrently.
+	err    error
+}
+
+// orderedTask is a function queued for execution in an orderedPool.
+type orderedTask struct {
+	fn     func() fileResult
+	result chan fileResult
+}
+
+// orderedPool executes tasks concurrently on a bounded number of goroutines and returns their
+// results in the order in which the tasks were submitted.
+//
+// At most 2*numWorkers results are held in memory at any time. Tasks must be submitted from a
+// different goroutine than the one consuming the results.
+type orderedPool struct {
+	work     chan orderedTask
+	results  chan chan fileResult
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// newOrderedPool starts numWorkers goroutines that execute submitted tasks.
+func newOrderedPool(numWorkers int) *orderedPool {
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+
+	p := &orderedPool{
+		work:    make(chan orderedTask),
+		results: make(chan chan fileResult, 2*numWorkers),
+		done:    make(chan struct{}),
+	}
+	for i := 0; i < numWorkers; i++ {
+		go func() {
+			for t := range p.work {
+				t.result <- t.fn()
+			}
+		}()
+	}
+
+	return p
+}
+
+// submit queues fn for execution, blocking while the maximum number of results are pending. Returns
+// false if the pool has been stopped.
+func (p *orderedPool) submit(fn func() fileResult) bool {
+	t := orderedTask{fn: fn, result: make(chan fileResult, 1)}
+
+	// Reserve the slot for the result first to bound the number of pending results.
+	select {
+	case p.results <- t.result:
+	case <-p.done:
+		return false
+	}
+
+	select {
+	case p.work <- t:
+	case <-p.done:
+		return false
+	}
+
+	return true
+}
+
+// closeInput signals that no more tasks will be submitted. It must be called exactly once by the
+// submitting goroutine.
+func (p *orderedPool) closeInput() {
+	close(p.work)
+	close(p.results)
+}
+
+// next returns the result of the next task in submission order. Returns false when all results
+// have been consumed or the pool has been stopped.
+func (p *orderedPool) next() (fileResult, bool) {
+	var result chan fileResult
+	var ok bool
+	select {
+	case result, ok = <-p.results:
+		if !ok {
+			return fileResult{}, false
 		}
+	case <-p.done:
+		return fileResult{}, false
+	}
 
-		data = append(data, fileData)
+	select {
+	case r := <-result:
+		return r, true
+	case <-p.done:
+		return fileResult{}, false
 	}
+}
 
-	return data, nil
+// stop aborts the processing of queued tasks. Tasks that are already executing run to completion.
+func (p *orderedPool) stop() {
+	p.stopOnce.Do(func() {
+		close(p.done)
+	})
 }
 
 // readLines returns a slice of lines read from the file at path.
 func readLines(path string) (lines []string, err error) {
-	file, err := os.Open(path)
+	file, err := openFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("cannot read file %q: %v", path, err)
 	}
@@ -156,9 +336,9 @@ func readLines(path string) (lines []string, err error) {
 	return lines, nil
 }
 
-// readFile uses ioutil.ReadAll to read the file at path.
+// readFile uses ioutil.ReadAll to read the file at path, which may be in an open Archive.
 func readFile(path string) (data []byte, err error) {
-	f, err := os.Open(path)
+	f, err := openFile(path)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,189 @@
+package lblconv
+
+// Vertex AI image object detection import files (JSON Lines).
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"path/filepath"
+	"strings"
+)
+
+// VertexAIImage is a line of a Vertex AI image object detection import file.
+type VertexAIImage struct {
+	ImageGCSURI            string                `json:"imageGcsUri"`
+	BoundingBoxAnnotations []VertexAIBoundingBox `json:"boundingBoxAnnotations,omitempty"`
+	DataItemResourceLabels map[string]string     `json:"dataItemResourceLabels,omitempty"`
+}
+
+// VertexAIBoundingBox is a bounding box annotation with coordinates relative to the image size.
+type VertexAIBoundingBox struct {
+	DisplayName string  `json:"displayName"`
+	XMin        float64 `json:"xMin"`
+	YMin        float64 `json:"yMin"`
+	XMax        float64 `json:"xMax"`
+	YMax        float64 `json:"yMax"`
+}
+
+// vertexAIMLUse is the data item resource label that assigns images to the training, validation
+// or test set.
+const vertexAIMLUse = "aiplatform.googleapis.com/ml_use"
+
+// mlUses maps split names to the ML use (training, validation or test) of the Google Cloud formats.
+var mlUses = map[string]string{
+	"train":      "training",
+	"training":   "training",
+	"val":        "validation",
+	"validation": "validation",
+	"test":       "test",
+}
+
+// mlUseOfSplit returns the ML use for the split with the given name, or "" if split is empty.
+func mlUseOfSplit(split string) (string, error) {
+	if split == "" {
+		return "", nil
+	}
+	mlUse, ok := mlUses[strings.ToLower(split)]
+	if !ok {
+		return "", fmt.Errorf("split %q is not one of train, val or test", split)
+	}
+	return mlUse, nil
+}
+
+// gcsImageURI returns the Cloud Storage URI of the image at path, which is prefix followed by the
+// file name, unless path is a "gs://" URI already.
+func gcsImageURI(path, prefix string) string {
+	if strings.HasPrefix(path, "gs://") || prefix == "" {
+		return path
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix + filepath.Base(path)
+}
+
+// ToVertexAI converts f to a Vertex AI import file line. The image URI is formed with
+// gcsImageURI, and mlUse is the value of the ML use label, if not empty. The image dimensions are
+// only read from the image if the coordinates are absolute and the dimensions are not known.
+// Image-level labels are omitted.
+func ToVertexAI(f AnnotatedFile, gcsPrefix, mlUse string) (VertexAIImage, error) {
+	img := VertexAIImage{ImageGCSURI: gcsImageURI(f.FilePath, gcsPrefix)}
+	if mlUse != "" {
+		img.DataItemResourceLabels = map[string]string{vertexAIMLUse: mlUse}
+	}
+	if len(f.Annotations) == 0 {
+		return img, nil
+	}
+
+	sx, sy, err := f.normalizationScale()
+	if err != nil {
+		return VertexAIImage{}, err
+	}
+
+	// The coordinates must be in the range [0, 1].
+	norm := func(v, scale float64) float64 {
+		return math.Min(math.Max(v*scale, 0), 1)
+	}
+	for _, a := range f.Annotations {
+		if a.boolAttribute(ImageLabel) {
+			continue
+		}
+		img.BoundingBoxAnnotations = append(img.BoundingBoxAnnotations, VertexAIBoundingBox{
+			DisplayName: a.Label,
+			XMin:        norm(a.Coords[0], sx),
+			YMin:        norm(a.Coords[1], sy),
+			XMax:        norm(a.Coords[2], sx),
+			YMax:        norm(a.Coords[3], sy),
+		})
+	}
+	return img, nil
+}
+
+// vertexAISink is a Sink that writes a Vertex AI import file.
+type vertexAISink struct {
+	file      *atomicFile
+	w         *bufio.Writer
+	gcsPrefix string
+	mlUse     string
+}
+
+// NewVertexAISink returns a Sink that writes a Vertex AI image object detection import file to
+// outFile. gcsPrefix is the Cloud Storage location of the images, see ToVertexAI. All images are
+// assigned to the split with the name split (train, val or test), if not empty.
+func NewVertexAISink(outFile, gcsPrefix, split string) (Sink, error) {
+	mlUse, err := mlUseOfSplit(split)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := createAtomicFile(outFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot write file %q: %v", outFile, err)
+	}
+	s := &vertexAISink{file: file, w: bufio.NewWriter(file), gcsPrefix: gcsPrefix, mlUse: mlUse}
+	return s, nil
+}
+
+// Write implements Sink. Files whose image dimensions cannot be determined are logged and skipped.
+func (s *vertexAISink) Write(f AnnotatedFile) error {
+	img, err := ToVertexAI(f, s.gcsPrefix, s.mlUse)
+	if err != nil {
+		log.Print("Skipping file: ", err)
+		return ErrFileSkipped
+	}
+	enc, err := json.Marshal(img)
+	if err != nil {
+		return err
+	}
+	if _, err := s.w.Write(enc); err != nil {
+		return err
+	}
+	return s.w.WriteByte('\n')
+}
+
+// Close implements Sink.
+func (s *vertexAISink) Close() (err error) {
+	defer s.file.commit(&err)
+	return s.w.Flush()
+}
+
+// Abort implements Aborter. It removes the partially written file.
+func (s *vertexAISink) Abort() error {
+	return s.file.Abort()
+}
+
+// vertexAIFormat implements the Writer interface for Vertex AI import files.
+type vertexAIFormat struct{}
+
+// Write implements Writer.
+func (vertexAIFormat) Write(outFile string, data AnnotatedFiles, opts FormatOptions) (err error) {
+	s, err := NewVertexAISink(outFile, opts.GCSPrefix, opts.Split)
+	if err != nil {
+		return err
+	}
+	defer closeWithErrCheck(s, &err)
+
+	return writeFiles(s, data)
+}
+
+// NewSink implements StreamWriter.
+func (vertexAIFormat) NewSink(outFile string, opts FormatOptions) (Sink, error) {
+	return NewVertexAISink(outFile, opts.GCSPrefix, opts.Split)
+}
+
+// AcceptsNormalizedCoords implements NormalizedWriter.
+func (vertexAIFormat) AcceptsNormalizedCoords() bool {
+	return true
+}
+
+func init() {
+	RegisterFormat(Format{
+		Name:        "vertex-ai",
+		Description: "Vertex AI image object detection import file (JSON Lines)",
+		Writer:      vertexAIFormat{},
+		WriterArgs:  "-labels-out <file> [-gcs-prefix <gs://bucket/dir/>]",
+	})
+}
@@ -3,21 +3,65 @@ package lblconv
 // VGG Immage Annotator (VIA) specific functionality.
 
 import (
+	"bufio"
 	"encoding"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"math"
 	"strconv"
+	"strings"
 )
 
-// VIAShape describes the shape of an annotation.
+// VIAShape describes the shape of an annotation. Rectangles ("rect") are defined by X, Y, Width and
+// Height, polygons ("polygon") by AllPointsX and AllPointsY.
 type VIAShape struct {
-	Name   string `json:"name"`
-	X      int32  `json:"x"`
-	Y      int32  `json:"y"`
-	Width  int32  `json:"width"`
-	Height int32  `json:"height"`
+	Name       string  `json:"name"`
+	X          int32   `json:"x"`
+	Y          int32   `json:"y"`
+	Width      int32   `json:"width"`
+	Height     int32   `json:"height"`
+	AllPointsX []int32 `json:"all_points_x"`
+	AllPointsY []int32 `json:"all_points_y"`
+}
+
+// MarshalJSON implements json.Marshaler. Only the attributes of the named shape are encoded.
+func (s VIAShape) MarshalJSON() ([]byte, error) {
+	if s.Name == "polygon" {
+		return json.Marshal(struct {
+			Name       string  `json:"name"`
+			AllPointsX []int32 `json:"all_points_x"`
+			AllPointsY []int32 `json:"all_points_y"`
+		}{s.Name, s.AllPointsX, s.AllPointsY})
+	}
+	return json.Marshal(struct {
+		Name   string `json:"name"`
+		X      int32  `json:"x"`
+		Y      int32  `json:"y"`
+		Width  int32  `json:"width"`
+		Height int32  `json:"height"`
+	}{s.Name, s.X, s.Y, s.Width, s.Height})
+}
+
+// bbox returns the bounding box of the shape as x1, y1, x2, y2.
+func (s VIAShape) bbox() [4]float64 {
+	if polygon := s.polygon(); polygon != nil {
+		return PolygonBounds(polygon)
+	}
+	return CoordsFromXYWH(float64(s.X), float64(s.Y), float64(s.Width), float64(s.Height))
+}
+
+// polygon returns the vertices of the shape if it is a polygon, or nil otherwise.
+func (s VIAShape) polygon() [][2]float64 {
+	if s.Name != "polygon" || len(s.AllPointsX) == 0 || len(s.AllPointsX) != len(s.AllPointsY) {
+		return nil
+	}
+
+	points := make([][2]float64, len(s.AllPointsX))
+	for i := range s.AllPointsX {
+		points[i] = [2]float64{float64(s.AllPointsX[i]), float64(s.AllPointsY[i])}
+	}
+	return points
 }
 
 // VIARegionAnnotation is a single region annotation for a particular image in a VIA file.
@@ -55,36 +99,184 @@ type VIAAttributes struct {
 	File   map[string]interface{} `json:"file"`
 }
 
+// VIASettings defines the VIA project settings. Default values are used for the settings that are
+// not set.
+type VIASettings struct {
+	Project *VIAProjectSettings `json:"project,omitempty"`
+}
+
+// VIAProjectSettings defines the project specific VIA settings.
+type VIAProjectSettings struct {
+	Name string `json:"name"`
+}
+
 // VIAProject defines the VIA project structure.
 type VIAProject struct {
 	Attributes    VIAAttributes               `json:"_via_attributes"`
 	ImageMetadata map[string]VIAAnnotatedFile `json:"_via_img_metadata"`
-	// Must exist for VIA to load the project. Default values will be used.
-	Settings struct{} `json:"_via_settings"`
+	Settings      VIASettings                 `json:"_via_settings"` // Must exist for VIA to load.
+
+	// The provenance of the project, which VIA ignores.
+	Provenance *Provenance `json:"_lblconv_provenance,omitempty"`
 }
 
-const viaLabelAttribute = "Label" // The attribute key used for labels.
+// VIAAttributeSchema defines the type and options of a VIA region attribute.
+type VIAAttributeSchema struct {
+	Type        string   `json:"type"` // "radio", "dropdown" or "text".
+	Description string   `json:"description"`
+	Options     []string `json:"options"` // The pre-populated options for radio and dropdown types.
+	Default     string   `json:"default"` // The default option or text value.
+}
 
-// FromVIA reads and parses VIA annotations from the file at path.
-func FromVIA(path string) ([]AnnotatedFile, error) {
-	enc, err := ioutil.ReadFile(path)
+// VIAOptions configures the VIA project output.
+type VIAOptions struct {
+	ProjectName string // The project name shown by VIA. VIA's default is used if empty.
+	// The shape to write bounding boxes as, "rect" (default) or "polygon". Annotations with a
+	// polygon are always written as polygons.
+	RegionShape string
+
+	// The pre-populated options for the label attribute, e.g. the labels of a label map.
+	LabelOptions []string
+
+	// The display names of the label options, which VIA shows instead of the labels, e.g. from
+	// LoadDisplayNames.
+	LabelDisplayNames map[string]string
+
+	// The provenance to record in the project, if not nil.
+	Provenance *Provenance
+
+	// The rounding of the coordinates to whole pixels, of which only the Mode applies. Bounding
+	// box coordinates are truncated and polygon vertices rounded to the nearest pixel if it is not
+	// set.
+	Rounding CoordRounding
+
+	// The region attribute schema by attribute name, which overrides the default types. The label
+	// attribute is named "Label" and is of type radio by default. Other attributes are only
+	// described in the project if they are in the schema or declared by Attributes.
+	Schema map[string]VIAAttributeSchema
+
+	// The declared attribute types, of which bool attributes are described as radio and the others
+	// as text attributes, unless they are in Schema. DefaultAttributeSchema applies if nil.
+	Attributes AttributeSchema
+}
+
+// LoadVIAAttributeSchema reads a VIA region attribute schema from the JSON file at path, which
+// maps attribute names to VIAAttributeSchema objects.
+func LoadVIAAttributeSchema(path string) (map[string]VIAAttributeSchema, error) {
+	enc, err := readFile(path)
 	if err != nil {
 		return nil, err
 	}
 
-	var viaData VIAProject
-	err = json.Unmarshal(enc, &viaData)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse VIA input from %q: %v", path, err)
+	var schema map[string]VIAAttributeSchema
+	if err := json.Unmarshal(enc, &schema); err != nil {
+		return nil, newJSONParseError(path, enc, err)
 	}
+	for name, attr := range schema {
+		switch attr.Type {
+		case "radio", "dropdown", "text":
+		default:
+			return nil, fmt.Errorf("unsupported type %q of attribute %q", attr.Type, name)
+		}
+	}
+
+	return schema, nil
+}
+
+const (
+	viaLabelAttribute    = "Label"  // The attribute key used for labels.
+	viaChecksumAttribute = "sha256" // The file attribute key used for the image SHA-256.
+)
+
+// VIAJSONSchema is the JSON Schema of the VIA projects read by FromVIA.
+const VIAJSONSchema = `{
+  "type": "object",
+  "required": ["_via_img_metadata"],
+  "properties": {
+    "_via_attributes": {"type": "object"},
+    "_via_settings": {"type": "object"},
+    "_via_img_metadata": {
+      "type": "object",
+      "additionalProperties": {
+        "type": "object",
+        "required": ["filename"],
+        "properties": {
+          "filename": {"type": "string"},
+          "size": {"type": "integer"},
+          "file_attributes": {"type": "object", "additionalProperties": {"type": "string"}},
+          "regions": {
+            "type": ["array", "null"],
+            "items": {
+              "type": "object",
+              "required": ["shape_attributes"],
+              "properties": {
+                "region_attributes": {
+                  "type": "object",
+                  "additionalProperties": {"type": "string"}
+                },
+                "shape_attributes": {
+                  "type": "object",
+                  "required": ["name"],
+                  "properties": {
+                    "name": {"type": "string"},
+                    "x": {"type": "integer"},
+                    "y": {"type": "integer"},
+                    "width": {"type": "integer", "minimum": 0},
+                    "height": {"type": "integer", "minimum": 0},
+                    "all_points_x": {"type": "array", "items": {"type": "integer"}},
+                    "all_points_y": {"type": "array", "items": {"type": "integer"}}
+                  }
+                }
+              }
+            }
+          }
+        }
+      }
+    }
+  }
+}`
+
+// viaSchema is the parsed VIAJSONSchema.
+var viaSchema = mustParseJSONSchema(VIAJSONSchema)
+
+// FromVIA reads and parses VIA annotations from the file at path. The annotations of entries for
+// the same image are merged, see AnnotatedFiles.MergeDuplicates. The attribute values are coerced
+// to the types of DefaultAttributeSchema.
+func FromVIA(path string) ([]AnnotatedFile, error) {
+	return readJSONEntries(path, viaImageMetadata, viaEntryConverter(path, false, nil), false)
+}
+
+// NewVIASource returns a Source that parses the VIA project at path one image at a time, so that
+// the file need not fit into memory. The attribute values are coerced to the types of schema and
+// its defaults. The annotations of entries for the same image are merged into the last of them. If
+// strict is true, such entries are an error instead. If validate is true, the entries are validated
+// against VIAJSONSchema. Otherwise, they are only validated to report the location of the errors if
+// they fail to decode. Invalid entries are returned as ParseErrors.
+func NewVIASource(path string, strict, validate bool, schema AttributeSchema) (Source, error) {
+	return newJSONEntrySource(path, viaImageMetadata, viaEntryConverter(path, validate, schema),
+		strict)
+}
+
+// viaImageMetadata is the member of VIA projects with the entries for the images.
+const viaImageMetadata = "_via_img_metadata"
+
+// viaEntryConverter returns a jsonEntryConverter for the image entries of the VIA project at path,
+// with the attribute values coerced to the types of schema and its defaults. If validate is true,
+// the entries are validated against VIAJSONSchema, see decodeJSONEntry.
+func viaEntryConverter(path string, validate bool, schema AttributeSchema) jsonEntryConverter {
+	schema = schema.withDefaults()
+	entrySchema := viaSchema.Properties[viaImageMetadata].AdditionalProperties
+	return func(raw json.RawMessage, pointer string) (AnnotatedFile, error) {
+		var viaFile VIAAnnotatedFile
+		if err := decodeJSONEntry(path, pointer, raw, entrySchema, validate, &viaFile); err != nil {
+			return AnnotatedFile{}, err
+		}
 
-	// Convert to the intermediate representation.
-	irData := make([]AnnotatedFile, 0, len(viaData.ImageMetadata))
-	for _, viaFile := range viaData.ImageMetadata {
-		// Per file data. Convert all annotations.
+		// Convert all annotations to the intermediate representation.
 		irFile := AnnotatedFile{
 			Annotations: make([]Annotation, 0, len(viaFile.Annotations)),
 			FilePath:    viaFile.FilePath,
+			ImageSHA256: viaFile.Attributes[viaChecksumAttribute],
 		}
 		for _, a := range viaFile.Annotations {
 			irObject := Annotation{}
@@ -95,129 +287,340 @@ func FromVIA(path string) ([]AnnotatedFile, error) {
 				irObject.Attributes = make(map[string]interface{})
 			}
 			for k, v := range a.Attributes {
-				switch k {
-				case viaLabelAttribute:
+				if k == viaLabelAttribute {
 					irObject.Label = v
-				case Confidence: // float64
-					if v, err := strconv.ParseFloat(v, 64); err == nil {
-						irObject.Attributes[k] = v
-					} else {
-						log.Printf("Failed to parse attribute %q as float: %v", k, err)
-					}
-				default:
+				} else {
 					irObject.Attributes[k] = v
 				}
 			}
+			if err := schema.Coerce(irObject.Attributes); err != nil {
+				log.Printf("%s: %s: %v", path, viaFile.FilePath, err)
+			}
 
-			// Set the bounding box.
-			irObject.Coords[0] = float64(a.Shape.X)
-			irObject.Coords[1] = float64(a.Shape.Y)
-			irObject.Coords[2] = float64(a.Shape.X + a.Shape.Width)
-			irObject.Coords[3] = float64(a.Shape.Y + a.Shape.Height)
+			// Set the bounding box and polygon.
+			irObject.Coords = a.Shape.bbox()
+			irObject.Polygon = a.Shape.polygon()
 
 			irFile.Annotations = append(irFile.Annotations, irObject)
 		}
-		irData = append(irData, irFile)
+		return irFile, nil
 	}
+}
 
-	return irData, nil
+// viaConverter converts the intermediate representation to VIA format file by file and
+// accumulates the attribute metadata of the project.
+type viaConverter struct {
+	opts       VIAOptions
+	attributes VIAAttributes
+
+	clamped    int // The number of regions with coordinates clamped to the valid range.
+	swapped    int // The number of bounding boxes with inverted corners, which are swapped.
+	degenerate int // The number of regions omitted because they have no area.
 }
 
-// ToVIA converts the intermediate representation to VIA format.
-func ToVIA(irData []AnnotatedFile) VIAProject {
-	viaData := VIAProject{
-		Attributes: VIAAttributes{
+// newVIAConverter returns a viaConverter with the attribute metadata from opts.
+func newVIAConverter(opts VIAOptions) *viaConverter {
+	c := &viaConverter{
+		opts: opts,
+		attributes: VIAAttributes{
 			Region: make(map[string]interface{}),
 			File:   make(map[string]interface{}),
 		},
-		ImageMetadata: make(map[string]VIAAnnotatedFile, len(irData)),
-	}
-
-	// Adds an option to a VIAOptionsAttribute, creating the attribute if necessary.
-	addAttrOption := func(attrs map[string]interface{}, attrName, attrType, option string) {
-		var attr VIAOptionsAttribute
-		if a, ok := attrs[attrName]; ok {
-			// Copy the existing attribute.
-			if v, ok := a.(VIAOptionsAttribute); ok && v.Type == attrType {
-				attr = v
-			} else {
-				log.Printf("Invalid type %T, expected VIAOptionsAttribute", a)
-				return
+	}
+
+	// Pre-populate the attribute metadata.
+	for name, attr := range opts.Schema {
+		switch attr.Type {
+		case "text":
+			c.attributes.Region[name] = VIATextAttribute{
+				Type:         attr.Type,
+				Description:  attr.Description,
+				DefaultValue: attr.Default,
 			}
-		} else {
-			// Create a new attribute.
-			attr = VIAOptionsAttribute{
-				Type:           attrType,
-				Options:        make(map[string]string),
-				DefaultOptions: make(map[string]bool, 0),
+		default:
+			a := VIAOptionsAttribute{
+				Type:           attr.Type,
+				Description:    attr.Description,
+				Options:        make(map[string]string, len(attr.Options)),
+				DefaultOptions: make(map[string]bool, 1),
 			}
+			for _, option := range attr.Options {
+				a.Options[option] = ""
+			}
+			if attr.Default != "" {
+				a.DefaultOptions[attr.Default] = true
+			}
+			c.attributes.Region[name] = a
 		}
+	}
+	c.opts.Attributes = c.opts.Attributes.withDefaults()
+	for _, label := range opts.LabelOptions {
+		addAttrOption(c.attributes.Region, viaLabelAttribute, c.attrType(viaLabelAttribute), label,
+			opts.LabelDisplayNames[label])
+	}
+
+	return c
+}
+
+// attrType returns the VIA type of the region attribute with the given name, or the empty string
+// if it is neither in the VIA schema nor declared by the attribute schema.
+func (c *viaConverter) attrType(name string) string {
+	if attr, ok := c.opts.Schema[name]; ok {
+		return attr.Type
+	}
+	if name == viaLabelAttribute {
+		return "radio"
+	}
+	switch t, ok := c.opts.Attributes[name]; {
+	case !ok:
+		return ""
+	case t == BoolAttribute:
+		return "radio"
+	}
+	return "text"
+}
 
-		// Add the option value and copy the attribute back into the map.
-		attr.Options[option] = ""
-		attrs[attrName] = attr
+// settings returns the project settings.
+func (c *viaConverter) settings() VIASettings {
+	var settings VIASettings
+	if c.opts.ProjectName != "" {
+		settings.Project = &VIAProjectSettings{Name: c.opts.ProjectName}
 	}
+	return settings
+}
 
-	var haveTextAttr, haveConfidenceAttr bool
-	for _, irFile := range irData {
-		viaFile := VIAAnnotatedFile{
-			Annotations: make([]VIARegionAnnotation, 0, len(irFile.Annotations)),
-			Attributes:  make(map[string]string, 0), // Must not be nil as that becomes JSON null.
-			FilePath:    irFile.FilePath,
-		}
-		for _, a := range irFile.Annotations {
-			viaObject := VIARegionAnnotation{
-				Attributes: map[string]string{viaLabelAttribute: a.Label},
-				Shape: VIAShape{
-					Name:   "rect",
-					X:      int32(a.Coords[0]),
-					Y:      int32(a.Coords[1]),
-					Width:  int32(a.Coords[2] - a.Coords[0]),
-					Height: int32(a.Coords[3] - a.Coords[1]),
-				},
-			}
+// pixel converts the coordinate v to a whole pixel in [0, max], or [0, math.MaxInt32] if max is
+// zero, so that negative or huge coordinates do not wrap around. Vertices are rounded to the
+// nearest pixel and bounding box coordinates truncated, unless c.opts.Rounding is set. Returns
+// whether v was clamped.
+func (c *viaConverter) pixel(v float64, max int, vertex bool) (int32, bool) {
+	if c.opts.Rounding.Mode != RoundNone {
+		v = CoordRounding{Mode: c.opts.Rounding.Mode}.Round(v)
+	} else if vertex {
+		v = math.Round(v)
+	}
 
-			// Add additional attributes with string values or values that can be converted to string.
-			for k, v := range a.Attributes {
-				switch v := v.(type) {
-				case int:
-					viaObject.Attributes[k] = strconv.Itoa(v)
-				case float64:
-					viaObject.Attributes[k] = strconv.FormatFloat(v, 'f', -1, 64)
-				case string:
-					viaObject.Attributes[k] = v
-				case encoding.TextMarshaler:
-					if s, err := v.MarshalText(); err == nil {
-						viaObject.Attributes[k] = string(s)
-					} else {
-						log.Printf("Failed to marshal text for %s: %v", k, v)
-					}
+	limit := float64(math.MaxInt32)
+	if max > 0 {
+		limit = float64(max)
+	}
+	switch {
+	case math.IsNaN(v) || v < 0:
+		return 0, true
+	case v > limit:
+		return int32(limit), true
+	}
+	return int32(v), false
+}
+
+// shape returns the VIA shape for the annotation, i.e. its polygon, if any, or its bounding box.
+// The coordinates are clamped to the bounds of the image of the given size, if known, see pixel,
+// and inverted bounding box corners are swapped. Returns false if the shape has no area, e.g.
+// because it lies outside of the image, unless the annotation is an image-level label.
+func (c *viaConverter) shape(a Annotation, width, height int) (VIAShape, bool) {
+	clamped := false
+	pixel := func(v float64, max int, vertex bool) int32 {
+		p, ok := c.pixel(v, max, vertex)
+		clamped = clamped || ok
+		return p
+	}
+	// Returns whether the points span an area, i.e. a range of both x and y coordinates.
+	hasArea := func(xs, ys []int32) bool {
+		span := func(vs []int32) bool {
+			for _, v := range vs {
+				if v != vs[0] {
+					return true
 				}
 			}
+			return false
+		}
+		return a.boolAttribute(ImageLabel) || span(xs) && span(ys)
+	}
+	defer func() {
+		if clamped {
+			c.clamped++
+		}
+	}()
+
+	if len(a.Polygon) > 0 {
+		s := VIAShape{
+			Name:       "polygon",
+			AllPointsX: make([]int32, len(a.Polygon)),
+			AllPointsY: make([]int32, len(a.Polygon)),
+		}
+		for i, p := range a.Polygon {
+			s.AllPointsX[i] = pixel(p[0], width, true)
+			s.AllPointsY[i] = pixel(p[1], height, true)
+		}
+		return s, hasArea(s.AllPointsX, s.AllPointsY)
+	}
+
+	coords := a.Coords
+	if coords[0] > coords[2] || coords[1] > coords[3] {
+		coords[0], coords[2] = math.Min(coords[0], coords[2]), math.Max(coords[0], coords[2])
+		coords[1], coords[3] = math.Min(coords[1], coords[3]), math.Max(coords[1], coords[3])
+		c.swapped++
+	}
+	x1, y1 := pixel(coords[0], width, false), pixel(coords[1], height, false)
+	x2, y2 := pixel(coords[2], width, false), pixel(coords[3], height, false)
+	ok := hasArea([]int32{x1, x2}, []int32{y1, y2})
+	if c.opts.RegionShape == "polygon" {
+		return VIAShape{
+			Name:       "polygon",
+			AllPointsX: []int32{x1, x2, x2, x1},
+			AllPointsY: []int32{y1, y1, y2, y2},
+		}, ok
+	}
+	return VIAShape{Name: "rect", X: x1, Y: y1, Width: x2 - x1, Height: y2 - y1}, ok
+}
 
-			// Add the label value to the attribute metadata.
-			addAttrOption(viaData.Attributes.Region, viaLabelAttribute, "radio", a.Label)
+// addAttrOption adds an option to a VIAOptionsAttribute, creating the attribute if necessary.
+// VIA shows the description instead of the option, if not empty. The description of an existing
+// option is only replaced by a non-empty one.
+func addAttrOption(attrs map[string]interface{}, attrName, attrType, option, description string) {
+	var attr VIAOptionsAttribute
+	if a, ok := attrs[attrName]; ok {
+		// Copy the existing attribute.
+		if v, ok := a.(VIAOptionsAttribute); ok && v.Type == attrType {
+			attr = v
+		} else {
+			log.Printf("Invalid type %T, expected VIAOptionsAttribute", a)
+			return
+		}
+	} else {
+		// Create a new attribute.
+		attr = VIAOptionsAttribute{
+			Type:           attrType,
+			Options:        make(map[string]string),
+			DefaultOptions: make(map[string]bool, 0),
+		}
+	}
+
+	// Add the option value and copy the attribute back into the map.
+	if _, ok := attr.Options[option]; !ok || description != "" {
+		attr.Options[option] = description
+	}
+	attrs[attrName] = attr
+}
+
+// convert converts the intermediate representation for a single file to VIA format and adds the
+// attribute metadata for its annotations to c.attributes.
+func (c *viaConverter) convert(irFile AnnotatedFile) VIAAnnotatedFile {
+	viaFile := VIAAnnotatedFile{
+		Annotations: make([]VIARegionAnnotation, 0, len(irFile.Annotations)),
+		Attributes:  make(map[string]string, 0), // Must not be nil as that becomes JSON null.
+		FilePath:    irFile.FilePath,
+	}
+	if irFile.ImageSHA256 != "" {
+		viaFile.Attributes[viaChecksumAttribute] = irFile.ImageSHA256
+		if _, ok := c.attributes.File[viaChecksumAttribute]; !ok {
+			c.attributes.File[viaChecksumAttribute] = VIATextAttribute{
+				Type:        "text",
+				Description: "The SHA-256 of the image file",
+			}
+		}
+	}
+	for _, a := range irFile.Annotations {
+		shape, ok := c.shape(a, irFile.ImageWidth, irFile.ImageHeight)
+		if !ok {
+			c.degenerate++
+			continue
+		}
+		viaObject := VIARegionAnnotation{
+			Attributes: map[string]string{viaLabelAttribute: a.Label},
+			Shape:      shape,
+		}
 
-			// Add attribute metadata for DetectedText and Confidence if they are part of the annotation.
-			if !haveTextAttr {
-				_, haveTextAttr = a.Attributes[DetectedText]
-				if haveTextAttr {
-					viaData.Attributes.Region[DetectedText] = VIATextAttribute{Type: "text"}
+		// Add additional attributes with string values or values that can be converted to string.
+		for k, v := range a.Attributes {
+			switch v := v.(type) {
+			case bool:
+				viaObject.Attributes[k] = strconv.FormatBool(v)
+			case int:
+				viaObject.Attributes[k] = strconv.Itoa(v)
+			case float64:
+				viaObject.Attributes[k] = strconv.FormatFloat(v, 'f', -1, 64)
+			case string:
+				viaObject.Attributes[k] = v
+			case []string:
+				viaObject.Attributes[k] = strings.Join(v, ",")
+			case encoding.TextMarshaler:
+				if s, err := v.MarshalText(); err == nil {
+					viaObject.Attributes[k] = string(s)
+				} else {
+					log.Printf("Failed to marshal text for %s: %v", k, v)
 				}
 			}
-			if !haveConfidenceAttr {
-				_, haveConfidenceAttr = a.Attributes[Confidence]
-				if haveConfidenceAttr {
-					viaData.Attributes.Region[Confidence] = VIATextAttribute{Type: "text"}
+		}
+
+		// Add the label value and the values of other attributes with options to the attribute
+		// metadata, and describe the declared text attributes.
+		for k, v := range viaObject.Attributes {
+			switch attrType := c.attrType(k); attrType {
+			case "":
+			case "text":
+				if _, ok := c.attributes.Region[k]; !ok {
+					c.attributes.Region[k] = VIATextAttribute{Type: "text"}
+				}
+			default:
+				var description string
+				if k == viaLabelAttribute {
+					description = c.opts.LabelDisplayNames[v]
 				}
+				addAttrOption(c.attributes.Region, k, attrType, v, description)
 			}
+		}
+
+		viaFile.Annotations = append(viaFile.Annotations, viaObject)
+	}
+
+	return viaFile
+}
+
+// logRepairs logs the number of regions with clamped coordinates or swapped corners, and of the
+// regions omitted, if any.
+func (c *viaConverter) logRepairs() {
+	if c.clamped > 0 {
+		log.Printf("Clamped the out-of-range coordinates of %d VIA regions", c.clamped)
+	}
+	if c.swapped > 0 {
+		log.Printf("Swapped the inverted corners of %d VIA bounding boxes", c.swapped)
+	}
+	if c.degenerate > 0 {
+		log.Printf("Omitted %d VIA regions without area, e.g. outside of their image",
+			c.degenerate)
+	}
+}
+
+// ToVIA converts the intermediate representation to VIA format.
+func ToVIA(irData []AnnotatedFile) VIAProject {
+	return ToVIAWithOptions(irData, VIAOptions{})
+}
 
-			viaFile.Annotations = append(viaFile.Annotations, viaObject)
+// ToVIAWithOptions converts the intermediate representation to a VIA project configured by opts.
+// Coordinates outside of the image bounds, or of the int32 range if the image size is unknown, are
+// clamped, inverted bounding box corners swapped and regions without area omitted, and the number
+// of regions affected is logged.
+func ToVIAWithOptions(irData []AnnotatedFile, opts VIAOptions) VIAProject {
+	c := newVIAConverter(opts)
+	imageMetadata := make(map[string]VIAAnnotatedFile, len(irData))
+	for _, irFile := range irData {
+		viaFile := c.convert(irFile)
+		if prev, ok := imageMetadata[viaFile.FilePath]; ok {
+			// VIA projects hold a single entry per image, so merge the regions of duplicates.
+			prev.Annotations = append(prev.Annotations, viaFile.Annotations...)
+			viaFile = prev
 		}
-		viaData.ImageMetadata[viaFile.FilePath] = viaFile
+		imageMetadata[viaFile.FilePath] = viaFile
 	}
+	c.logRepairs()
 
-	return viaData
+	return VIAProject{
+		Attributes:    c.attributes,
+		ImageMetadata: imageMetadata,
+		Settings:      c.settings(),
+		Provenance:    opts.Provenance,
+	}
 }
 
 // WriteVIA writes the VIA project data to outFile.
@@ -226,8 +629,188 @@ func WriteVIA(outFile string, data VIAProject) error {
 	if err != nil {
 		return err
 	}
-	if err := ioutil.WriteFile(outFile, enc, 0644); err != nil {
+	if err := writeFileAtomic(outFile, enc); err != nil {
 		return fmt.Errorf("cannot write file %q: %v", outFile, err)
 	}
 	return nil
 }
+
+// viaSink is a Sink that writes a VIA project file incrementally.
+//
+// The image metadata is written as it arrives, while the attribute metadata, which depends on all
+// annotations, is written when the sink is closed.
+type viaSink struct {
+	file      *atomicFile
+	w         *bufio.Writer
+	converter *viaConverter
+	n         int             // The number of elements written.
+	keys      map[string]bool // The image metadata keys written.
+}
+
+// NewVIASink returns a Sink that writes a VIA project to outFile.
+func NewVIASink(outFile string) (Sink, error) {
+	return NewVIASinkWithOptions(outFile, VIAOptions{})
+}
+
+// NewVIASinkWithOptions returns a Sink that writes a VIA project configured by opts to outFile.
+func NewVIASinkWithOptions(outFile string, opts VIAOptions) (Sink, error) {
+	file, err := createAtomicFile(outFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot write file %q: %v", outFile, err)
+	}
+	return &viaSink{
+		file:      file,
+		w:         bufio.NewWriter(file),
+		converter: newVIAConverter(opts),
+		keys:      make(map[string]bool),
+	}, nil
+}
+
+// Write implements Sink. As a VIA project holds a single entry per image and the entries are
+// written as they arrive, it returns an error for a duplicate entry for the same image, which must
+// be merged beforehand, see AnnotatedFiles.MergeDuplicates.
+func (s *viaSink) Write(f AnnotatedFile) error {
+	if s.keys[f.FilePath] {
+		return fmt.Errorf("duplicate entries for image %q", f.FilePath)
+	}
+	s.keys[f.FilePath] = true
+	viaFile := s.converter.convert(f)
+	key, err := json.Marshal(viaFile.FilePath)
+	if err != nil {
+		return err
+	}
+	enc, err := json.MarshalIndent(viaFile, "    ", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write the start of the project and image metadata or the separator from the previous element.
+	sep := ",\n    "
+	if s.n == 0 {
+		sep = "{\n  \"_via_img_metadata\": {\n    "
+	}
+	if _, err := s.w.WriteString(sep); err != nil {
+		return err
+	}
+	if _, err := s.w.Write(key); err != nil {
+		return err
+	}
+	if _, err := s.w.WriteString(": "); err != nil {
+		return err
+	}
+	if _, err := s.w.Write(enc); err != nil {
+		return err
+	}
+	s.n++
+
+	return nil
+}
+
+// Close implements Sink.
+func (s *viaSink) Close() (err error) {
+	defer s.file.commit(&err)
+
+	attrs, err := json.MarshalIndent(s.converter.attributes, "  ", "  ")
+	if err != nil {
+		return err
+	}
+	settings, err := json.MarshalIndent(s.converter.settings(), "  ", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Complete the image metadata and write the remainder of the project.
+	start := "\n  },\n"
+	if s.n == 0 {
+		start = "{\n  \"_via_img_metadata\": {},\n"
+	}
+	if _, err := s.w.WriteString(start + "  \"_via_attributes\": "); err != nil {
+		return err
+	}
+	if _, err := s.w.Write(attrs); err != nil {
+		return err
+	}
+	if _, err := s.w.WriteString(",\n  \"_via_settings\": "); err != nil {
+		return err
+	}
+	if _, err := s.w.Write(settings); err != nil {
+		return err
+	}
+	if p := s.converter.opts.Provenance; p != nil {
+		enc, err := json.MarshalIndent(p, "  ", "  ")
+		if err != nil {
+			return err
+		}
+		if _, err := s.w.WriteString(",\n  \"_lblconv_provenance\": "); err != nil {
+			return err
+		}
+		if _, err := s.w.Write(enc); err != nil {
+			return err
+		}
+	}
+	if _, err := s.w.WriteString("\n}"); err != nil {
+		return err
+	}
+	s.converter.logRepairs()
+
+	return s.w.Flush()
+}
+
+// Abort implements Aborter. It removes the partially written file.
+func (s *viaSink) Abort() error {
+	return s.file.Abort()
+}
+
+// viaFormat implements the Reader and Writer interfaces for the VIA format.
+type viaFormat struct{}
+
+// Parse implements Reader.
+func (viaFormat) Parse(path string, opts FormatOptions) ([]AnnotatedFile, error) {
+	convert := viaEntryConverter(path, opts.ValidateInput, opts.Attributes)
+	return readJSONEntries(path, viaImageMetadata, convert, opts.StrictDuplicates)
+}
+
+// NewSource implements StreamReader.
+func (viaFormat) NewSource(path string, opts FormatOptions) (Source, error) {
+	return NewVIASource(path, opts.StrictDuplicates, opts.ValidateInput, opts.Attributes)
+}
+
+// Write implements Writer.
+func (f viaFormat) Write(outFile string, data AnnotatedFiles, opts FormatOptions) error {
+	return WriteVIA(outFile, ToVIAWithOptions(data, f.options(opts)))
+}
+
+// NewSink implements StreamWriter.
+func (f viaFormat) NewSink(outFile string, opts FormatOptions) (Sink, error) {
+	return NewVIASinkWithOptions(outFile, f.options(opts))
+}
+
+// options returns the VIA options of opts, with the provenance, rounding and attribute schema of
+// opts unless they are set already.
+func (viaFormat) options(opts FormatOptions) VIAOptions {
+	viaOpts := opts.VIA
+	if viaOpts.Provenance == nil {
+		viaOpts.Provenance = opts.Provenance
+	}
+	if viaOpts.Rounding.Mode == RoundNone {
+		viaOpts.Rounding = opts.Rounding
+	}
+	if viaOpts.Attributes == nil {
+		viaOpts.Attributes = opts.Attributes
+	}
+	if viaOpts.LabelDisplayNames == nil {
+		viaOpts.LabelDisplayNames = opts.DisplayNames
+	}
+	return viaOpts
+}
+
+func init() {
+	RegisterFormat(Format{
+		Name:        "via",
+		Description: "VGG Image Annotator (VIA)",
+		Reader:      viaFormat{},
+		Writer:      viaFormat{},
+		ReaderArgs:  "-labels <file>",
+		WriterArgs:  "-labels-out <file>",
+	})
+}